@@ -2,50 +2,99 @@ package access
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha512"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"mime"
+	"net"
+	"strings"
 	"time"
 )
 
 type AKey struct {
 	expires         bool
 	ttl             *time.Time
+	notBefore       *time.Time
+	windows         []TimeWindow
 	limited         bool
 	limit           uint64
 	usedTimes       *uint64
+	reservedTimes   uint64
 	BucketId        string
 	KeyId           string
 	UrlKey          string
 	NeedsKey        bool
 	validKeys       *HashSet
+	unlockSalt      []byte
 	ResolveByUrlKey bool
+	CreatedBy       string
+	Kind            KeyKind
+	Prefix          bool
+	MaxSize         int64
+	ContentTypes    []string
+	PerObjectLimit  bool
+	AllowedCidrs    []string
+	DeniedCidrs     []string
+	object          string
+	reservation     string
 }
 
+type KeyKind uint8
+
+const (
+	DownloadKey KeyKind = iota
+	UploadKey
+)
+
 type ExAccessKey struct {
-	Ttl             *time.Time `json:"Ttl,omitempty"`
-	Limit           *uint64    `json:"Limit,omitempty"`
-	ValidKeys       [][]byte   `json:"ValidKeys,omitempty"`
-	ResolveByUrlKey bool       `json:"ResolveByUrlKey,omitempty"`
-	BucketId        string     `json:"BucketId"`
-	KeyId           string     `json:"KeyId"`
-	UrlKey          string     `json:"UrlKey"`
+	Ttl             *time.Time   `json:"Ttl,omitempty"`
+	Limit           *uint64      `json:"Limit,omitempty"`
+	ValidKeys       [][]byte     `json:"ValidKeys,omitempty"`
+	Passwords       []string     `json:"Passwords,omitempty"`
+	ResolveByUrlKey bool         `json:"ResolveByUrlKey,omitempty"`
+	BucketId        string       `json:"BucketId"`
+	KeyId           string       `json:"KeyId"`
+	UrlKey          string       `json:"UrlKey"`
+	Upload          bool         `json:"Upload,omitempty"`
+	Prefix          bool         `json:"Prefix,omitempty"`
+	MaxSize         int64        `json:"MaxSize,omitempty"`
+	ContentTypes    []string     `json:"ContentTypes,omitempty"`
+	PerObjectLimit  bool         `json:"PerObjectLimit,omitempty"`
+	NotBefore       *time.Time   `json:"NotBefore,omitempty"`
+	Windows         []TimeWindow `json:"Windows,omitempty"`
+	AllowedCidrs    []string     `json:"AllowedCidrs,omitempty"`
+	DeniedCidrs     []string     `json:"DeniedCidrs,omitempty"`
 }
 
 func FromExAccessKey(ex ExAccessKey) (*AKey, error) {
-	validKeys := newHashSet()
-	if len(ex.ValidKeys) == 0 {
-		validKeys = nil
-	} else {
-		for _, e := range ex.ValidKeys {
-			if len(e) != sha512.Size {
-				return nil, errors.New("one of the valid keys doesn't has the wrong length")
-			}
-			arr := [sha512.Size]byte{}
-			for i := range arr {
-				arr[i] = e[i]
-			}
-			validKeys.Insert(arr)
+	// Digests of older clients are treated like any other secret, so both kinds
+	// end up salted with the salt of this link.
+	secrets := make([][]byte, 0, len(ex.ValidKeys)+len(ex.Passwords))
+	for _, e := range ex.ValidKeys {
+		if len(e) != sha512.Size {
+			return nil, errors.New("one of the valid keys doesn't has the wrong length")
+		}
+		secrets = append(secrets, e)
+	}
+	for _, password := range ex.Passwords {
+		if len(password) == 0 || len(password) > MaxUnlockSecretLength {
+			return nil, UnlockSecretHasWrongLength
+		}
+		secrets = append(secrets, []byte(password))
+	}
+	var validKeys *HashSet
+	var salt []byte
+	if len(secrets) != 0 {
+		var err error
+		salt, err = newUnlockSalt()
+		if err != nil {
+			return nil, err
+		}
+		validKeys = newHashSet()
+		for _, secret := range secrets {
+			validKeys.Insert(deriveUnlockKey(secret, salt))
 		}
 	}
 	keyOpts, err := NewKeyOptions(ex.Ttl, ex.Limit, validKeys, ex.ResolveByUrlKey)
@@ -53,6 +102,59 @@ func FromExAccessKey(ex ExAccessKey) (*AKey, error) {
 		return nil, err
 	}
 	ret := NewAccessKey(ex.BucketId, ex.KeyId, ex.UrlKey, *keyOpts)
+	ret.unlockSalt = salt
+	if ex.NotBefore != nil && ex.Ttl != nil && !ex.NotBefore.Before(*ex.Ttl) {
+		return nil, errors.New("not before has to be earlier than the ttl")
+	}
+	for _, window := range ex.Windows {
+		err = window.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	ret.notBefore = ex.NotBefore
+	ret.windows = ex.Windows
+	ret.AllowedCidrs, err = normalizeCidrs(ex.AllowedCidrs)
+	if err != nil {
+		return nil, err
+	}
+	ret.DeniedCidrs, err = normalizeCidrs(ex.DeniedCidrs)
+	if err != nil {
+		return nil, err
+	}
+	if !ex.Upload {
+		if ex.MaxSize != 0 || len(ex.ContentTypes) != 0 {
+			return nil, errors.New("max size and content types only apply to upload keys")
+		}
+		if ex.PerObjectLimit && (!ex.Prefix || ex.Limit == nil) {
+			return nil, errors.New("per object limits need a prefix and a limit")
+		}
+		// An empty prefix shares the whole bucket.
+		ret.Prefix = ex.Prefix
+		ret.PerObjectLimit = ex.PerObjectLimit
+		return ret, nil
+	}
+	if ex.PerObjectLimit {
+		return nil, errors.New("upload keys can't have per object limits")
+	}
+	if ex.MaxSize < 0 {
+		return nil, errors.New("max size must not be negative")
+	}
+	for _, contentType := range ex.ContentTypes {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != strings.ToLower(contentType) {
+			return nil, errors.New(fmt.Sprintf("content type %v isn't a plain media type", contentType))
+		}
+	}
+	ret.Kind = UploadKey
+	ret.Prefix = ex.Prefix
+	ret.MaxSize = ex.MaxSize
+	ret.ContentTypes = ex.ContentTypes
+	// A key without prefix grants exactly one object.
+	if !ret.Prefix {
+		ret.limited = true
+		ret.limit = 1
+	}
 	return ret, nil
 
 }
@@ -104,10 +206,253 @@ func NewAccessKey(bucketId, keyId, urlKey string, options KeyOptions) *AKey {
 	return ret
 }
 
+// AccessStore hands out uses of a key in two steps. Reserve atomically claims
+// one use if the limit allows it, the claim is then either turned into a use
+// with Commit or given back with Release. Claims neither committed nor
+// released within the reservation lease, because the server died in between,
+// count as released. The object is the key id the use is for, it may be
+// empty for keys that point at a single object.
 type AccessStore interface {
 	AddKey(key *AKey) error
-	Access(ctx context.Context, urlKey string) (chan<- bool, *AKey, error)
+	Reserve(ctx context.Context, urlKey, object string) (*AKey, error)
+	Commit(ctx context.Context, key *AKey) error
+	Release(ctx context.Context, key *AKey) error
 	DeleteKey(key *AKey) error
+	GetKey(ctx context.Context, urlKey string) (*AKey, error)
+	ListKeys(ctx context.Context, filter KeyFilter) ([]*AKey, error)
+	UpdateKey(ctx context.Context, urlKey string, update KeyUpdate) (*AKey, error)
+}
+
+// KeyFilter selects keys for ListKeys, empty fields match every key.
+type KeyFilter struct {
+	BucketId  string
+	KeyId     string
+	CreatedBy string
+}
+
+func (f KeyFilter) Matches(key *AKey) bool {
+	if f.BucketId != "" && f.BucketId != key.BucketId {
+		return false
+	}
+	if f.KeyId != "" && f.KeyId != key.KeyId {
+		return false
+	}
+	if f.CreatedBy != "" && f.CreatedBy != key.CreatedBy {
+		return false
+	}
+	return true
+}
+
+// KeyUpdate can only loosen a key, the ttl is moved further into the future
+// and the limit is raised.
+type KeyUpdate struct {
+	Ttl   *time.Time `json:"Ttl,omitempty"`
+	Limit *uint64    `json:"Limit,omitempty"`
+}
+
+func (a *AKey) applyUpdate(update KeyUpdate) error {
+	if update.Ttl != nil {
+		if !a.expires || a.ttl == nil || update.Ttl.Before(*a.ttl) {
+			return UpdateNotAnExtension()
+		}
+		ttl := *update.Ttl
+		a.ttl = &ttl
+	}
+	if update.Limit != nil {
+		if !a.limited || *update.Limit < a.limit {
+			return UpdateNotAnExtension()
+		}
+		a.limit = *update.Limit
+	}
+	return nil
+}
+
+type AccessKeyInfo struct {
+	UrlKey          string       `json:"UrlKey"`
+	BucketId        string       `json:"BucketId"`
+	KeyId           string       `json:"KeyId"`
+	CreatedBy       string       `json:"CreatedBy,omitempty"`
+	Ttl             *time.Time   `json:"Ttl,omitempty"`
+	Limit           *uint64      `json:"Limit,omitempty"`
+	UsedTimes       uint64       `json:"UsedTimes"`
+	RemainingUses   *uint64      `json:"RemainingUses,omitempty"`
+	NeedsKey        bool         `json:"NeedsKey"`
+	ResolveByUrlKey bool         `json:"ResolveByUrlKey"`
+	Upload          bool         `json:"Upload,omitempty"`
+	Prefix          bool         `json:"Prefix,omitempty"`
+	MaxSize         int64        `json:"MaxSize,omitempty"`
+	ContentTypes    []string     `json:"ContentTypes,omitempty"`
+	PerObjectLimit  bool         `json:"PerObjectLimit,omitempty"`
+	NotBefore       *time.Time   `json:"NotBefore,omitempty"`
+	Windows         []TimeWindow `json:"Windows,omitempty"`
+	AllowedCidrs    []string     `json:"AllowedCidrs,omitempty"`
+	DeniedCidrs     []string     `json:"DeniedCidrs,omitempty"`
+}
+
+// reserveObject resolves the object a reservation is made for and checks that
+// it's in the scope of the key. Inactive keys can't be reserved at all.
+func (a *AKey) reserveObject(object string) (string, error) {
+	if !a.Active(time.Now()) {
+		return "", KeyInactive
+	}
+	if object == "" && !a.Prefix {
+		return a.KeyId, nil
+	}
+	if object == "" || !a.AllowsObject(object) {
+		return "", ObjectOutOfScope(a.UrlKey, object)
+	}
+	return object, nil
+}
+
+// reservationLease is how long a reservation holds its use.
+var reservationLease = time.Hour
+
+// newReservation names a reservation, so Commit and Release only give back
+// the one they were reserved with, even if it expired meanwhile.
+func newReservation() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Object is the key id a reserved key was reserved for.
+func (a *AKey) Object() string {
+	return a.object
+}
+
+// limitedPerObject reports whether the limit is counted for every object in
+// scope instead of for the key as a whole.
+func (a *AKey) limitedPerObject() bool {
+	return a.limited && a.PerObjectLimit
+}
+
+// AllowsObject reports whether a key grants access to keyId.
+func (a *AKey) AllowsObject(keyId string) bool {
+	if a.Prefix {
+		return strings.HasPrefix(keyId, a.KeyId)
+	}
+	return keyId == a.KeyId
+}
+
+// AllowsUpload checks size and content type of an upload, contentType is
+// compared without its parameters.
+func (a *AKey) AllowsUpload(size int64, contentType string) bool {
+	if a.MaxSize > 0 && size > a.MaxSize {
+		return false
+	}
+	if len(a.ContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range a.ContentTypes {
+		if strings.EqualFold(allowed, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeCidrs validates a list of networks, single addresses are turned
+// into networks of their own.
+func normalizeCidrs(cidrs []string) ([]string, error) {
+	if len(cidrs) == 0 {
+		return nil, nil
+	}
+	ret := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("%v is neither an ip nor a network", cidr))
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, network.String())
+	}
+	return ret, nil
+}
+
+func cidrsContain(cidrs []string, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIp checks the client ip against the networks of the key, denied
+// networks take precedence over allowed ones.
+func (a *AKey) AllowsIp(clientIp string) bool {
+	if len(a.AllowedCidrs) == 0 && len(a.DeniedCidrs) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return false
+	}
+	if cidrsContain(a.DeniedCidrs, ip) {
+		return false
+	}
+	return len(a.AllowedCidrs) == 0 || cidrsContain(a.AllowedCidrs, ip)
+}
+
+func (a *AKey) Info() AccessKeyInfo {
+	ret := AccessKeyInfo{
+		UrlKey:          a.UrlKey,
+		BucketId:        a.BucketId,
+		KeyId:           a.KeyId,
+		CreatedBy:       a.CreatedBy,
+		NeedsKey:        a.NeedsKey,
+		ResolveByUrlKey: a.ResolveByUrlKey,
+		Upload:          a.Kind == UploadKey,
+		Prefix:          a.Prefix,
+		MaxSize:         a.MaxSize,
+		ContentTypes:    a.ContentTypes,
+		PerObjectLimit:  a.PerObjectLimit,
+		Windows:         a.windows,
+		AllowedCidrs:    a.AllowedCidrs,
+		DeniedCidrs:     a.DeniedCidrs,
+	}
+	if a.notBefore != nil {
+		notBefore := *a.notBefore
+		ret.NotBefore = &notBefore
+	}
+	if a.usedTimes != nil {
+		ret.UsedTimes = *a.usedTimes
+	}
+	if a.expires && a.ttl != nil {
+		ttl := *a.ttl
+		ret.Ttl = &ttl
+	}
+	if a.limited {
+		limit := a.limit
+		ret.Limit = &limit
+		if a.PerObjectLimit {
+			return ret
+		}
+		remaining := uint64(0)
+		if ret.UsedTimes < limit {
+			remaining = limit - ret.UsedTimes
+		}
+		ret.RemainingUses = &remaining
+	}
+	return ret
 }
 
 type byteArray [sha512.Size]byte
@@ -150,17 +495,74 @@ func KeyDoesntExist(urlKey string) error {
 	return errors.New(fmt.Sprintf("no key is assigned to the url key %v", urlKey))
 }
 
+// NoUsesLeft and TtlExpired are wrapped by the errors Reserve returns for keys
+// that exist but can't be used anymore, check them with errors.Is.
+var NoUsesLeft = errors.New("no uses left")
+var TtlExpired = errors.New("expired")
+
+func KeyExhausted(urlKey string) error {
+	return fmt.Errorf("the key assigned to the url key %v has %w", urlKey, NoUsesLeft)
+}
+
+func KeyExpired(urlKey string) error {
+	return fmt.Errorf("the key assigned to the url key %v has %w", urlKey, TtlExpired)
+}
+
+func ObjectOutOfScope(urlKey, object string) error {
+	return errors.New(fmt.Sprintf("the key assigned to the url key %v doesn't grant access to %v", urlKey, object))
+}
+
+func UpdateNotAnExtension() error {
+	return errors.New("keys can only be updated to a later ttl or a higher limit")
+}
+
 func TTLAlreadyExpired(ttl *time.Time) error {
 	return errors.New(fmt.Sprintf("TTL %v already expired %v ago", ttl, time.Now().Sub(*ttl)))
 }
 
+func (a *AKey) Expired(now time.Time) bool {
+	return a.expires && a.ttl != nil && !now.Before(*a.ttl)
+}
+
+// ValidKey checks the secret sent to unlock the key. Keys with a salt store
+// Argon2id hashes of their secrets, keys created before salts were introduced
+// store the client side digests as they are.
 func (a *AKey) ValidKey(key []byte) (bool, error) {
-	if len(key) != sha512.Size {
-		return false, errors.New("one of the valid keys doesn't has the wrong length")
+	if a.validKeys == nil {
+		return false, nil
+	}
+	if len(a.unlockSalt) == 0 {
+		if len(key) != sha512.Size {
+			return false, errors.New("one of the valid keys doesn't has the wrong length")
+		}
+		arr := byteArray{}
+		copy(arr[:], key)
+		return a.validKeys.containsConstantTime(arr), nil
+	}
+	if len(key) == 0 || len(key) > MaxUnlockSecretLength {
+		return false, UnlockSecretHasWrongLength
 	}
-	arr := [sha512.Size]byte{}
-	for i := range arr {
-		arr[i] = key[i]
+	return a.validKeys.containsConstantTime(deriveUnlockKey(key, a.unlockSalt)), nil
+}
+
+// waitUntilExpired waits for duration, it returns false if done was closed
+// in the meantime.
+func waitUntilExpired(duration time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(duration)
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		timer.Stop()
+		return false
+	}
+}
+
+// sendUnlessDone hands a key to one of the goroutines removing keys, unless
+// they already stopped.
+func sendUnlessDone(keys chan<- *AKey, key *AKey, done <-chan struct{}) {
+	select {
+	case keys <- key:
+	case <-done:
 	}
-	return a.validKeys.Contains(arr), nil
 }
@@ -21,6 +21,52 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+type ProtoKeyKind int32
+
+const (
+	ProtoKeyKind_DOWNLOAD ProtoKeyKind = 0
+	ProtoKeyKind_UPLOAD   ProtoKeyKind = 1
+)
+
+// Enum value maps for ProtoKeyKind.
+var (
+	ProtoKeyKind_name = map[int32]string{
+		0: "DOWNLOAD",
+		1: "UPLOAD",
+	}
+	ProtoKeyKind_value = map[string]int32{
+		"DOWNLOAD": 0,
+		"UPLOAD":   1,
+	}
+)
+
+func (x ProtoKeyKind) Enum() *ProtoKeyKind {
+	p := new(ProtoKeyKind)
+	*p = x
+	return p
+}
+
+func (x ProtoKeyKind) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ProtoKeyKind) Descriptor() protoreflect.EnumDescriptor {
+	return file_access_proto_enumTypes[0].Descriptor()
+}
+
+func (ProtoKeyKind) Type() protoreflect.EnumType {
+	return &file_access_proto_enumTypes[0]
+}
+
+func (x ProtoKeyKind) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ProtoKeyKind.Descriptor instead.
+func (ProtoKeyKind) EnumDescriptor() ([]byte, []int) {
+	return file_access_proto_rawDescGZIP(), []int{0}
+}
+
 type ProtoAKey struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -37,6 +83,17 @@ type ProtoAKey struct {
 	NeedsKey        bool                   `protobuf:"varint,9,opt,name=needsKey,proto3" json:"needsKey,omitempty"`
 	ValidKeys       [][]byte               `protobuf:"bytes,10,rep,name=validKeys,proto3" json:"validKeys,omitempty"`
 	ResolveByUrlKey bool                   `protobuf:"varint,11,opt,name=resolveByUrlKey,proto3" json:"resolveByUrlKey,omitempty"`
+	CreatedBy       string                 `protobuf:"bytes,12,opt,name=createdBy,proto3" json:"createdBy,omitempty"`
+	Kind            ProtoKeyKind           `protobuf:"varint,13,opt,name=kind,proto3,enum=access.ProtoKeyKind" json:"kind,omitempty"`
+	Prefix          bool                   `protobuf:"varint,14,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	MaxSize         int64                  `protobuf:"varint,15,opt,name=maxSize,proto3" json:"maxSize,omitempty"`
+	ContentTypes    []string               `protobuf:"bytes,16,rep,name=contentTypes,proto3" json:"contentTypes,omitempty"`
+	PerObjectLimit  bool                   `protobuf:"varint,17,opt,name=perObjectLimit,proto3" json:"perObjectLimit,omitempty"`
+	UnlockSalt      []byte                 `protobuf:"bytes,18,opt,name=unlockSalt,proto3" json:"unlockSalt,omitempty"`
+	NotBefore       *timestamppb.Timestamp `protobuf:"bytes,19,opt,name=notBefore,proto3" json:"notBefore,omitempty"`
+	Windows         []*ProtoTimeWindow     `protobuf:"bytes,20,rep,name=windows,proto3" json:"windows,omitempty"`
+	AllowedCidrs    []string               `protobuf:"bytes,21,rep,name=allowedCidrs,proto3" json:"allowedCidrs,omitempty"`
+	DeniedCidrs     []string               `protobuf:"bytes,22,rep,name=deniedCidrs,proto3" json:"deniedCidrs,omitempty"`
 }
 
 func (x *ProtoAKey) Reset() {
@@ -148,13 +205,161 @@ func (x *ProtoAKey) GetResolveByUrlKey() bool {
 	return false
 }
 
+func (x *ProtoAKey) GetCreatedBy() string {
+	if x != nil {
+		return x.CreatedBy
+	}
+	return ""
+}
+
+func (x *ProtoAKey) GetKind() ProtoKeyKind {
+	if x != nil {
+		return x.Kind
+	}
+	return ProtoKeyKind_DOWNLOAD
+}
+
+func (x *ProtoAKey) GetPrefix() bool {
+	if x != nil {
+		return x.Prefix
+	}
+	return false
+}
+
+func (x *ProtoAKey) GetMaxSize() int64 {
+	if x != nil {
+		return x.MaxSize
+	}
+	return 0
+}
+
+func (x *ProtoAKey) GetContentTypes() []string {
+	if x != nil {
+		return x.ContentTypes
+	}
+	return nil
+}
+
+func (x *ProtoAKey) GetPerObjectLimit() bool {
+	if x != nil {
+		return x.PerObjectLimit
+	}
+	return false
+}
+
+func (x *ProtoAKey) GetUnlockSalt() []byte {
+	if x != nil {
+		return x.UnlockSalt
+	}
+	return nil
+}
+
+func (x *ProtoAKey) GetNotBefore() *timestamppb.Timestamp {
+	if x != nil {
+		return x.NotBefore
+	}
+	return nil
+}
+
+func (x *ProtoAKey) GetWindows() []*ProtoTimeWindow {
+	if x != nil {
+		return x.Windows
+	}
+	return nil
+}
+
+func (x *ProtoAKey) GetAllowedCidrs() []string {
+	if x != nil {
+		return x.AllowedCidrs
+	}
+	return nil
+}
+
+func (x *ProtoAKey) GetDeniedCidrs() []string {
+	if x != nil {
+		return x.DeniedCidrs
+	}
+	return nil
+}
+
+type ProtoTimeWindow struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Days     []int32 `protobuf:"varint,1,rep,packed,name=days,proto3" json:"days,omitempty"`
+	Start    string  `protobuf:"bytes,2,opt,name=start,proto3" json:"start,omitempty"`
+	End      string  `protobuf:"bytes,3,opt,name=end,proto3" json:"end,omitempty"`
+	Timezone string  `protobuf:"bytes,4,opt,name=timezone,proto3" json:"timezone,omitempty"`
+}
+
+func (x *ProtoTimeWindow) Reset() {
+	*x = ProtoTimeWindow{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_access_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ProtoTimeWindow) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProtoTimeWindow) ProtoMessage() {}
+
+func (x *ProtoTimeWindow) ProtoReflect() protoreflect.Message {
+	mi := &file_access_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProtoTimeWindow.ProtoReflect.Descriptor instead.
+func (*ProtoTimeWindow) Descriptor() ([]byte, []int) {
+	return file_access_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ProtoTimeWindow) GetDays() []int32 {
+	if x != nil {
+		return x.Days
+	}
+	return nil
+}
+
+func (x *ProtoTimeWindow) GetStart() string {
+	if x != nil {
+		return x.Start
+	}
+	return ""
+}
+
+func (x *ProtoTimeWindow) GetEnd() string {
+	if x != nil {
+		return x.End
+	}
+	return ""
+}
+
+func (x *ProtoTimeWindow) GetTimezone() string {
+	if x != nil {
+		return x.Timezone
+	}
+	return ""
+}
+
 var File_access_proto protoreflect.FileDescriptor
 
 var file_access_proto_rawDesc = []byte{
 	0x0a, 0x0c, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x06,
 	0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x1a, 0x1f, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70,
 	0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
-	0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xcf, 0x02, 0x0a, 0x09, 0x50, 0x72, 0x6f, 0x74,
+	0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xe8, 0x05, 0x0a, 0x09, 0x50, 0x72, 0x6f, 0x74,
 	0x6f, 0x41, 0x4b, 0x65, 0x79, 0x12, 0x18, 0x0a, 0x07, 0x65, 0x78, 0x70, 0x69, 0x72, 0x65, 0x73,
 	0x18, 0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x65, 0x78, 0x70, 0x69, 0x72, 0x65, 0x73, 0x12,
 	0x2c, 0x0a, 0x03, 0x74, 0x74, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67,
@@ -175,8 +380,43 @@ var file_access_proto_rawDesc = []byte{
 	0x20, 0x03, 0x28, 0x0c, 0x52, 0x09, 0x76, 0x61, 0x6c, 0x69, 0x64, 0x4b, 0x65, 0x79, 0x73, 0x12,
 	0x28, 0x0a, 0x0f, 0x72, 0x65, 0x73, 0x6f, 0x6c, 0x76, 0x65, 0x42, 0x79, 0x55, 0x72, 0x6c, 0x4b,
 	0x65, 0x79, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0f, 0x72, 0x65, 0x73, 0x6f, 0x6c, 0x76,
-	0x65, 0x42, 0x79, 0x55, 0x72, 0x6c, 0x4b, 0x65, 0x79, 0x42, 0x0a, 0x5a, 0x08, 0x2e, 0x2f, 0x61,
-	0x63, 0x63, 0x65, 0x73, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x65, 0x42, 0x79, 0x55, 0x72, 0x6c, 0x4b, 0x65, 0x79, 0x12, 0x1c, 0x0a, 0x09, 0x63, 0x72, 0x65,
+	0x61, 0x74, 0x65, 0x64, 0x42, 0x79, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x63, 0x72,
+	0x65, 0x61, 0x74, 0x65, 0x64, 0x42, 0x79, 0x12, 0x28, 0x0a, 0x04, 0x6b, 0x69, 0x6e, 0x64, 0x18,
+	0x0d, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x14, 0x2e, 0x61, 0x63, 0x63, 0x65, 0x73, 0x73, 0x2e, 0x50,
+	0x72, 0x6f, 0x74, 0x6f, 0x4b, 0x65, 0x79, 0x4b, 0x69, 0x6e, 0x64, 0x52, 0x04, 0x6b, 0x69, 0x6e,
+	0x64, 0x12, 0x16, 0x0a, 0x06, 0x70, 0x72, 0x65, 0x66, 0x69, 0x78, 0x18, 0x0e, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x06, 0x70, 0x72, 0x65, 0x66, 0x69, 0x78, 0x12, 0x18, 0x0a, 0x07, 0x6d, 0x61, 0x78,
+	0x53, 0x69, 0x7a, 0x65, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x03, 0x52, 0x07, 0x6d, 0x61, 0x78, 0x53,
+	0x69, 0x7a, 0x65, 0x12, 0x22, 0x0a, 0x0c, 0x63, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x54, 0x79,
+	0x70, 0x65, 0x73, 0x18, 0x10, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0c, 0x63, 0x6f, 0x6e, 0x74, 0x65,
+	0x6e, 0x74, 0x54, 0x79, 0x70, 0x65, 0x73, 0x12, 0x26, 0x0a, 0x0e, 0x70, 0x65, 0x72, 0x4f, 0x62,
+	0x6a, 0x65, 0x63, 0x74, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x18, 0x11, 0x20, 0x01, 0x28, 0x08, 0x52,
+	0x0e, 0x70, 0x65, 0x72, 0x4f, 0x62, 0x6a, 0x65, 0x63, 0x74, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x12,
+	0x1e, 0x0a, 0x0a, 0x75, 0x6e, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x61, 0x6c, 0x74, 0x18, 0x12, 0x20,
+	0x01, 0x28, 0x0c, 0x52, 0x0a, 0x75, 0x6e, 0x6c, 0x6f, 0x63, 0x6b, 0x53, 0x61, 0x6c, 0x74, 0x12,
+	0x38, 0x0a, 0x09, 0x6e, 0x6f, 0x74, 0x42, 0x65, 0x66, 0x6f, 0x72, 0x65, 0x18, 0x13, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x09,
+	0x6e, 0x6f, 0x74, 0x42, 0x65, 0x66, 0x6f, 0x72, 0x65, 0x12, 0x31, 0x0a, 0x07, 0x77, 0x69, 0x6e,
+	0x64, 0x6f, 0x77, 0x73, 0x18, 0x14, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x61, 0x63, 0x63,
+	0x65, 0x73, 0x73, 0x2e, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x54, 0x69, 0x6d, 0x65, 0x57, 0x69, 0x6e,
+	0x64, 0x6f, 0x77, 0x52, 0x07, 0x77, 0x69, 0x6e, 0x64, 0x6f, 0x77, 0x73, 0x12, 0x22, 0x0a, 0x0c,
+	0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x65, 0x64, 0x43, 0x69, 0x64, 0x72, 0x73, 0x18, 0x15, 0x20, 0x03,
+	0x28, 0x09, 0x52, 0x0c, 0x61, 0x6c, 0x6c, 0x6f, 0x77, 0x65, 0x64, 0x43, 0x69, 0x64, 0x72, 0x73,
+	0x12, 0x20, 0x0a, 0x0b, 0x64, 0x65, 0x6e, 0x69, 0x65, 0x64, 0x43, 0x69, 0x64, 0x72, 0x73, 0x18,
+	0x16, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x64, 0x65, 0x6e, 0x69, 0x65, 0x64, 0x43, 0x69, 0x64,
+	0x72, 0x73, 0x22, 0x69, 0x0a, 0x0f, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x54, 0x69, 0x6d, 0x65, 0x57,
+	0x69, 0x6e, 0x64, 0x6f, 0x77, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x79, 0x73, 0x18, 0x01, 0x20,
+	0x03, 0x28, 0x05, 0x52, 0x04, 0x64, 0x61, 0x79, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x74, 0x61,
+	0x72, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x73, 0x74, 0x61, 0x72, 0x74, 0x12,
+	0x10, 0x0a, 0x03, 0x65, 0x6e, 0x64, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x65, 0x6e,
+	0x64, 0x12, 0x1a, 0x0a, 0x08, 0x74, 0x69, 0x6d, 0x65, 0x7a, 0x6f, 0x6e, 0x65, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x08, 0x74, 0x69, 0x6d, 0x65, 0x7a, 0x6f, 0x6e, 0x65, 0x2a, 0x28, 0x0a,
+	0x0c, 0x50, 0x72, 0x6f, 0x74, 0x6f, 0x4b, 0x65, 0x79, 0x4b, 0x69, 0x6e, 0x64, 0x12, 0x0c, 0x0a,
+	0x08, 0x44, 0x4f, 0x57, 0x4e, 0x4c, 0x4f, 0x41, 0x44, 0x10, 0x00, 0x12, 0x0a, 0x0a, 0x06, 0x55,
+	0x50, 0x4c, 0x4f, 0x41, 0x44, 0x10, 0x01, 0x42, 0x0a, 0x5a, 0x08, 0x2e, 0x2f, 0x61, 0x63, 0x63,
+	0x65, 0x73, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -191,18 +431,24 @@ func file_access_proto_rawDescGZIP() []byte {
 	return file_access_proto_rawDescData
 }
 
-var file_access_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_access_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_access_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
 var file_access_proto_goTypes = []interface{}{
-	(*ProtoAKey)(nil),             // 0: access.ProtoAKey
-	(*timestamppb.Timestamp)(nil), // 1: google.protobuf.Timestamp
+	(ProtoKeyKind)(0),             // 0: access.ProtoKeyKind
+	(*ProtoAKey)(nil),             // 1: access.ProtoAKey
+	(*ProtoTimeWindow)(nil),       // 2: access.ProtoTimeWindow
+	(*timestamppb.Timestamp)(nil), // 3: google.protobuf.Timestamp
 }
 var file_access_proto_depIdxs = []int32{
-	1, // 0: access.ProtoAKey.ttl:type_name -> google.protobuf.Timestamp
-	1, // [1:1] is the sub-list for method output_type
-	1, // [1:1] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	3, // 0: access.ProtoAKey.ttl:type_name -> google.protobuf.Timestamp
+	0, // 1: access.ProtoAKey.kind:type_name -> access.ProtoKeyKind
+	3, // 2: access.ProtoAKey.notBefore:type_name -> google.protobuf.Timestamp
+	2, // 3: access.ProtoAKey.windows:type_name -> access.ProtoTimeWindow
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_access_proto_init() }
@@ -223,19 +469,32 @@ func file_access_proto_init() {
 				return nil
 			}
 		}
+		file_access_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ProtoTimeWindow); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_access_proto_rawDesc,
-			NumEnums:      0,
-			NumMessages:   1,
+			NumEnums:      1,
+			NumMessages:   2,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
 		GoTypes:           file_access_proto_goTypes,
 		DependencyIndexes: file_access_proto_depIdxs,
+		EnumInfos:         file_access_proto_enumTypes,
 		MessageInfos:      file_access_proto_msgTypes,
 	}.Build()
 	File_access_proto = out.File
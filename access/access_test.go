@@ -1,9 +1,13 @@
 package access
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha512"
+	"errors"
 	"sync"
 	"testing"
+	"time"
 )
 
 var Buckets = []string{"Bucket1", "Bucket2", "Bucket3", "Bucket4"}
@@ -85,6 +89,7 @@ func AddAndDeleteTest(t *testing.T, db AccessStore) {
 			}
 		}()
 	}
+	wg.Wait()
 }
 
 func AddAndAccessTest(t *testing.T, db AccessStore) {
@@ -114,7 +119,7 @@ func AddAndAccessTest(t *testing.T, db AccessStore) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			channel, bKey, errGo := db.Access(context.TODO(), aKey.UrlKey)
+			bKey, errGo := db.Reserve(context.TODO(), aKey.UrlKey, "")
 			if errGo != nil {
 				t.Errorf("Access key %v -> %v -> %v", aKey.BucketId, aKey.KeyId, aKey.UrlKey)
 				t.Error(errGo)
@@ -122,7 +127,10 @@ func AddAndAccessTest(t *testing.T, db AccessStore) {
 				return
 			}
 			defer func() {
-				channel <- true
+				errGo := db.Commit(context.TODO(), bKey)
+				if errGo != nil {
+					t.Error(errGo)
+				}
 			}()
 			if bKey.UrlKey != aKey.UrlKey {
 				t.Errorf("Returned wrong access key")
@@ -133,3 +141,712 @@ func AddAndAccessTest(t *testing.T, db AccessStore) {
 	}
 	wg.Wait()
 }
+
+const StressLimit = 5
+const StressDownloads = 50
+
+// LimitStressTest fires many parallel downloads at a limited key, exactly
+// StressLimit of them may succeed and the key has to be gone afterwards.
+func LimitStressTest(t *testing.T, db AccessStore) {
+	options := KeyOptions{limited: true, limit: StressLimit}
+	aKey := NewAccessKey("StressBucket", "StressKey", "StressUrlKey", options)
+	err := db.AddKey(aKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	succeeded := 0
+	for i := 0; i < StressDownloads; i++ {
+		release := i%2 == 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bKey, errGo := db.Reserve(context.TODO(), aKey.UrlKey, "")
+			if errGo != nil {
+				return
+			}
+			// Every other download fails and hands its reservation back.
+			if release {
+				errGo = db.Release(context.TODO(), bKey)
+				if errGo != nil {
+					t.Error(errGo)
+				}
+				return
+			}
+			errGo = db.Commit(context.TODO(), bKey)
+			if errGo != nil {
+				t.Error(errGo)
+				return
+			}
+			m.Lock()
+			succeeded++
+			m.Unlock()
+		}()
+	}
+	wg.Wait()
+	for succeeded < StressLimit {
+		bKey, err := db.Reserve(context.TODO(), aKey.UrlKey, "")
+		if err != nil {
+			break
+		}
+		err = db.Commit(context.TODO(), bKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		succeeded++
+	}
+	if succeeded != StressLimit {
+		t.Errorf("Key with limit %v was used %v times", StressLimit, succeeded)
+	}
+	_, err = db.Reserve(context.TODO(), aKey.UrlKey, "")
+	if err == nil {
+		t.Error("Exhausted key can still be reserved")
+	}
+}
+
+func ManageKeysTest(t *testing.T, db AccessStore) {
+	limit := uint64(3)
+	ttl := time.Now().Add(time.Hour)
+	limitedOptions, err := NewKeyOptions(&ttl, &limit, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := NewAccessKey("ManageBucket", "ManageKey1", "manage-one", *limitedOptions)
+	limited.CreatedBy = "creator-a"
+	open := NewAccessKey("ManageBucket", "ManageKey2", "manage-two", Options[0])
+	open.CreatedBy = "creator-b"
+	other := NewAccessKey("OtherBucket", "ManageKey1", "manage-three", Options[0])
+	other.CreatedBy = "creator-a"
+	for _, key := range []*AKey{limited, open, other} {
+		err = db.AddKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byBucket, err := db.ListKeys(context.TODO(), KeyFilter{BucketId: "ManageBucket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byBucket) != 2 {
+		t.Errorf("Listing by bucket returned %v keys", len(byBucket))
+	}
+	byCreator, err := db.ListKeys(context.TODO(), KeyFilter{CreatedBy: "creator-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byCreator) != 2 || byCreator[0].UrlKey != "manage-one" || byCreator[1].UrlKey != "manage-three" {
+		t.Errorf("Listing by creator returned %v", byCreator)
+	}
+	byKey, err := db.ListKeys(context.TODO(), KeyFilter{BucketId: "OtherBucket", KeyId: "ManageKey1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byKey) != 1 || byKey[0].UrlKey != "manage-three" {
+		t.Errorf("Listing by key returned %v", byKey)
+	}
+
+	reserved, err := db.Reserve(context.TODO(), limited.UrlKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit(context.TODO(), reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetKey(context.TODO(), limited.UrlKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := got.Info()
+	if info.CreatedBy != "creator-a" || info.UsedTimes != 1 || info.RemainingUses == nil || *info.RemainingUses != 2 {
+		t.Errorf("Unexpected key info %+v", info)
+	}
+
+	lower := uint64(2)
+	_, err = db.UpdateKey(context.TODO(), limited.UrlKey, KeyUpdate{Limit: &lower})
+	if err == nil {
+		t.Error("Lowering the limit was accepted")
+	}
+	earlier := time.Now().Add(time.Minute)
+	_, err = db.UpdateKey(context.TODO(), limited.UrlKey, KeyUpdate{Ttl: &earlier})
+	if err == nil {
+		t.Error("Shortening the ttl was accepted")
+	}
+	higher := uint64(10)
+	later := time.Now().Add(2 * time.Hour)
+	updated, err := db.UpdateKey(context.TODO(), limited.UrlKey, KeyUpdate{Ttl: &later, Limit: &higher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = updated.Info()
+	if *info.Limit != higher || !info.Ttl.Equal(later) || *info.RemainingUses != 9 {
+		t.Errorf("Unexpected key info after update %+v", info)
+	}
+	_, err = db.UpdateKey(context.TODO(), open.UrlKey, KeyUpdate{Limit: &higher})
+	if err == nil {
+		t.Error("Adding a limit to an unlimited key was accepted")
+	}
+
+	for _, key := range []*AKey{limited, open, other} {
+		err = db.DeleteKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.GetKey(context.TODO(), limited.UrlKey)
+	if err == nil {
+		t.Error("Deleted key can still be resolved")
+	}
+	remaining, err := db.ListKeys(context.TODO(), KeyFilter{CreatedBy: "creator-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("Deleted keys are still listed: %v", remaining)
+	}
+}
+
+func UploadKeyTest(t *testing.T, db AccessStore) {
+	limit := uint64(3)
+	prefixKey, err := FromExAccessKey(ExAccessKey{
+		Limit:        &limit,
+		BucketId:     "UploadBucket",
+		KeyId:        "report-",
+		UrlKey:       "upload-prefix",
+		Upload:       true,
+		Prefix:       true,
+		MaxSize:      1024,
+		ContentTypes: []string{"application/pdf", "text/plain"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	singleKey, err := FromExAccessKey(ExAccessKey{
+		BucketId: "UploadBucket",
+		KeyId:    "contract",
+		UrlKey:   "upload-single",
+		Upload:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []*AKey{prefixKey, singleKey} {
+		err = db.AddKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := db.GetKey(context.TODO(), prefixKey.UrlKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Kind != UploadKey || !got.Prefix || got.MaxSize != 1024 || len(got.ContentTypes) != 2 {
+		t.Errorf("Upload key didn't survive the round trip: %+v", got.Info())
+	}
+	if !got.AllowsObject("report-march") || got.AllowsObject("invoice-march") {
+		t.Error("Prefix isn't enforced")
+	}
+	if !got.AllowsUpload(1024, "text/plain; charset=utf-8") {
+		t.Error("Allowed upload was rejected")
+	}
+	if got.AllowsUpload(1025, "text/plain") || got.AllowsUpload(10, "image/png") {
+		t.Error("Size or content type isn't enforced")
+	}
+
+	reserved, err := db.Reserve(context.TODO(), singleKey.UrlKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved.Kind != UploadKey || !reserved.AllowsObject("contract") || reserved.AllowsObject("contract-two") {
+		t.Errorf("Single object key grants the wrong objects: %+v", reserved.Info())
+	}
+	err = db.Commit(context.TODO(), reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Reserve(context.TODO(), singleKey.UrlKey, "")
+	if err == nil {
+		t.Error("Single object key could be used twice")
+	}
+	err = db.DeleteKey(prefixKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ShareKeyTest(t *testing.T, db AccessStore) {
+	limit := uint64(2)
+	perObject, err := FromExAccessKey(ExAccessKey{
+		Limit:          &limit,
+		BucketId:       "ShareBucket",
+		KeyId:          "report-",
+		UrlKey:         "share-reports",
+		Prefix:         true,
+		PerObjectLimit: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wholeBucket, err := FromExAccessKey(ExAccessKey{
+		Limit:    &limit,
+		BucketId: "ShareBucket",
+		UrlKey:   "share-bucket",
+		Prefix:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []*AKey{perObject, wholeBucket} {
+		err = db.AddKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	use := func(urlKey, object string) error {
+		reserved, err := db.Reserve(context.TODO(), urlKey, object)
+		if err != nil {
+			return err
+		}
+		if reserved.Object() != object {
+			t.Errorf("Reserved %v instead of %v", reserved.Object(), object)
+		}
+		return db.Commit(context.TODO(), reserved)
+	}
+
+	_, err = db.Reserve(context.TODO(), perObject.UrlKey, "invoice")
+	if err == nil {
+		t.Error("Object outside of the prefix could be reserved")
+	}
+	_, err = db.Reserve(context.TODO(), perObject.UrlKey, "")
+	if err == nil {
+		t.Error("Prefix key could be reserved without an object")
+	}
+	for i := uint64(0); i < limit; i++ {
+		err = use(perObject.UrlKey, "report-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = use(perObject.UrlKey, "report-a")
+	if err == nil {
+		t.Error("Object could be downloaded beyond its limit")
+	}
+	err = use(perObject.UrlKey, "report-b")
+	if err != nil {
+		t.Errorf("Limit of one object blocked another one: %v", err)
+	}
+	got, err := db.GetKey(context.TODO(), perObject.UrlKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Info().UsedTimes != limit+1 {
+		t.Errorf("Key counted %v downloads", got.Info().UsedTimes)
+	}
+
+	err = use(wholeBucket.UrlKey, "invoice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = use(wholeBucket.UrlKey, "report-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Reserve(context.TODO(), wholeBucket.UrlKey, "report-b")
+	if err == nil {
+		t.Error("Bucket key could be used beyond its limit")
+	}
+
+	err = db.DeleteKey(perObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func UnlockKeyTest(t *testing.T, db AccessStore) {
+	legacyDigest := bytes.Repeat([]byte{7}, sha512.Size)
+	salted, err := FromExAccessKey(ExAccessKey{
+		ValidKeys: [][]byte{legacyDigest},
+		Passwords: []string{"correct horse"},
+		BucketId:  "UnlockBucket",
+		KeyId:     "unlock-key",
+		UrlKey:    "unlock-salted",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := FromExAccessKey(ExAccessKey{
+		Passwords: []string{"correct horse"},
+		BucketId:  "UnlockBucket",
+		KeyId:     "unlock-key",
+		UrlKey:    "unlock-other",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(salted.unlockSalt, other.unlockSalt) {
+		t.Error("Links share the same salt")
+	}
+	// Keys stored before salts were introduced hold the digests themselves.
+	legacySet := newHashSet()
+	arr := byteArray{}
+	copy(arr[:], legacyDigest)
+	legacySet.Insert(arr)
+	legacyOpts, err := NewKeyOptions(nil, nil, legacySet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := NewAccessKey("UnlockBucket", "unlock-key", "unlock-legacy", *legacyOpts)
+	for _, key := range []*AKey{salted, other, legacy} {
+		err = db.AddKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := db.GetKey(context.TODO(), salted.UrlKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.NeedsKey || got.validKeys.Size() != 2 {
+		t.Fatal("Unlock keys weren't stored")
+	}
+	if got.validKeys.Contains(arr) {
+		t.Error("Digest was stored without deriving it")
+	}
+	for _, secret := range [][]byte{[]byte("correct horse"), legacyDigest} {
+		valid, err := got.ValidKey(secret)
+		if err != nil || !valid {
+			t.Errorf("Secret %q was rejected: %v", secret, err)
+		}
+	}
+	valid, _ := got.ValidKey([]byte("wrong horse"))
+	if valid {
+		t.Error("Wrong secret unlocked the key")
+	}
+	otherGot, err := db.GetKey(context.TODO(), other.UrlKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hash := range otherGot.validKeys.set {
+		if got.validKeys.Contains(hash) {
+			t.Error("Same password derived the same hash on two links")
+		}
+	}
+
+	legacyGot, err := db.GetKey(context.TODO(), legacy.UrlKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err = legacyGot.ValidKey(legacyDigest)
+	if err != nil || !valid {
+		t.Errorf("Legacy digest was rejected: %v", err)
+	}
+	valid, _ = legacyGot.ValidKey([]byte("correct horse"))
+	if valid {
+		t.Error("Legacy key accepted a plain secret")
+	}
+
+	for _, key := range []*AKey{salted, other, legacy} {
+		err = db.DeleteKey(key)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func FailureStoreTest(t *testing.T, db FailureStore) {
+	ctx := context.TODO()
+	now := time.Now()
+	subject := "link:failure-test"
+	for i := uint64(1); i <= 3; i++ {
+		record, err := db.TakeAttempt(ctx, subject, now, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Failures != i || !record.LastFailure.IsZero() {
+			t.Errorf("Took slot %v at %v instead of %v", record.Failures, record.LastFailure, i)
+		}
+	}
+	err := db.ReleaseAttempt(ctx, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := db.FailAttempt(ctx, subject, now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Failures != 2 {
+		t.Errorf("Failing an attempt counted %v failures instead of 2", record.Failures)
+	}
+	record, err = db.GetFailures(ctx, subject, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Failures != 2 || record.LastFailure.Sub(now) > time.Second || now.Sub(record.LastFailure) > time.Second {
+		t.Errorf("Read back %v failures at %v", record.Failures, record.LastFailure)
+	}
+	err = db.ResetFailures(ctx, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err = db.GetFailures(ctx, subject, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Failures != 0 {
+		t.Errorf("%v failures survived the reset", record.Failures)
+	}
+	err = db.ReleaseAttempt(ctx, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	slots := make([]bool, 21)
+	var m sync.Mutex
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record, errGo := db.TakeAttempt(ctx, subject, now, time.Hour)
+			if errGo != nil {
+				t.Error(errGo)
+				return
+			}
+			m.Lock()
+			if record.Failures < uint64(len(slots)) {
+				slots[record.Failures] = true
+			}
+			m.Unlock()
+		}()
+	}
+	wg.Wait()
+	for i := 1; i < len(slots); i++ {
+		if !slots[i] {
+			t.Errorf("No concurrent attempt got slot %v", i)
+		}
+	}
+	_ = db.ResetFailures(ctx, subject)
+
+	_, err = db.TakeAttempt(ctx, "ip:failure-test", now, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.FailAttempt(ctx, "ip:failure-test", now, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err = db.GetFailures(ctx, "ip:failure-test", now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Failures != 0 {
+		t.Error("Failures outlived their window")
+	}
+	record, err = db.TakeAttempt(ctx, "ip:failure-test", now.Add(time.Minute), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Failures != 1 || !record.LastFailure.IsZero() {
+		t.Errorf("Count continued at %v after the window passed", record.Failures)
+	}
+	_ = db.ResetFailures(ctx, "ip:failure-test")
+}
+
+func ActivationTest(t *testing.T, db AccessStore) {
+	now := time.Now().UTC()
+	clock := func(at time.Time) string {
+		return at.Format(windowClockLayout)
+	}
+	notBefore := now.Add(time.Hour).Truncate(time.Second)
+	embargoed, err := FromExAccessKey(ExAccessKey{
+		NotBefore: &notBefore,
+		BucketId:  "WindowBucket",
+		KeyId:     "embargoed",
+		UrlKey:    "window-embargoed",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := FromExAccessKey(ExAccessKey{
+		Windows:  []TimeWindow{{Start: clock(now.Add(-time.Hour)), End: clock(now.Add(time.Hour))}},
+		BucketId: "WindowBucket",
+		KeyId:    "open",
+		UrlKey:   "window-open",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, err := FromExAccessKey(ExAccessKey{
+		Windows:  []TimeWindow{{Days: []time.Weekday{now.Weekday()}, Start: clock(now.Add(time.Hour)), End: clock(now.Add(2 * time.Hour))}},
+		BucketId: "WindowBucket",
+		KeyId:    "closed",
+		UrlKey:   "window-closed",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []*AKey{embargoed, open, closed} {
+		err = db.AddKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, key := range []*AKey{embargoed, closed} {
+		_, err = db.Reserve(context.TODO(), key.UrlKey, "")
+		if err != KeyInactive {
+			t.Errorf("Inactive key %v reserved with %v", key.UrlKey, err)
+		}
+	}
+	reserved, err := db.Reserve(context.TODO(), open.UrlKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Release(context.TODO(), reserved)
+	if err != nil {
+		t.Error(err)
+	}
+
+	got, err := db.GetKey(context.TODO(), embargoed.UrlKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := got.Info()
+	if info.NotBefore == nil || !info.NotBefore.Equal(notBefore) {
+		t.Errorf("Not before read back as %v", info.NotBefore)
+	}
+	if !got.Active(notBefore) {
+		t.Error("Key isn't active once its not before time passed")
+	}
+	got, err = db.GetKey(context.TODO(), closed.UrlKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Info().Windows) != 1 || got.Info().Windows[0].Days[0] != now.Weekday() {
+		t.Errorf("Windows read back as %v", got.Info().Windows)
+	}
+
+	for _, key := range []*AKey{embargoed, open, closed} {
+		err = db.DeleteKey(key)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func IpRestrictionTest(t *testing.T, db AccessStore) {
+	key, err := FromExAccessKey(ExAccessKey{
+		BucketId:     "IpBucket",
+		KeyId:        "restricted",
+		UrlKey:       "ip-restricted",
+		AllowedCidrs: []string{"192.0.2.0/24", "2001:db8::/32"},
+		DeniedCidrs:  []string{"192.0.2.7"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.GetKey(context.TODO(), key.UrlKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.AllowsIp("192.0.2.1") || !got.AllowsIp("2001:db8::1") {
+		t.Error("Stored key rejects allowed ips")
+	}
+	if got.AllowsIp("192.0.2.7") || got.AllowsIp("2001:db9::1") {
+		t.Error("Stored key lost its restrictions")
+	}
+	err = db.DeleteKey(key)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// ExpiryTest lets keys run out, advance moves the clock of the store forward.
+// ReservationLeaseTest gives back the use of a reservation that was neither
+// committed nor released, like after a crash in between.
+func ReservationLeaseTest(t *testing.T, db AccessStore) {
+	lease := reservationLease
+	reservationLease = 50 * time.Millisecond
+	defer func() {
+		reservationLease = lease
+	}()
+	key := NewAccessKey("LeaseBucket", "leased", "lease-key", KeyOptions{limited: true, limit: 1})
+	err := db.AddKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := db.Reserve(context.TODO(), key.UrlKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Reserve(context.TODO(), key.UrlKey, "")
+	if !errors.Is(err, NoUsesLeft) {
+		t.Errorf("Reserved a use held by an open reservation: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	reservationLease = lease
+	reserved, err := db.Reserve(context.TODO(), key.UrlKey, "")
+	if err != nil {
+		t.Fatalf("Expired reservation still holds its use: %v", err)
+	}
+	// The late release mustn't give back the use of the new reservation.
+	err = db.Release(context.TODO(), stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Reserve(context.TODO(), key.UrlKey, "")
+	if !errors.Is(err, NoUsesLeft) {
+		t.Errorf("Released expired reservation freed another use: %v", err)
+	}
+	err = db.Commit(context.TODO(), reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ExpiryTest(t *testing.T, db AccessStore, advance func(time.Duration)) {
+	ttl := time.Now().Add(300 * time.Millisecond)
+	opts, err := NewKeyOptions(&ttl, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewAccessKey("ExpiryBucket", "expiring", "expiry-key", *opts)
+	err = db.AddKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddKey(NewAccessKey("ExpiryBucket", "other", "expiry-key", *opts))
+	if err == nil {
+		t.Error("Existing key was overwritten")
+	}
+	extended := ttl.Add(500 * time.Millisecond)
+	_, err = db.UpdateKey(context.TODO(), key.UrlKey, KeyUpdate{Ttl: &extended})
+	if err != nil {
+		t.Fatal(err)
+	}
+	advance(500 * time.Millisecond)
+	got, err := db.GetKey(context.TODO(), key.UrlKey)
+	if err != nil {
+		t.Fatalf("Key expired before its extended ttl: %v", err)
+	}
+	if got.KeyId != "expiring" {
+		t.Errorf("Key was replaced by %v", got.KeyId)
+	}
+	advance(500 * time.Millisecond)
+	_, err = db.GetKey(context.TODO(), key.UrlKey)
+	if err == nil {
+		t.Error("Key outlived its ttl")
+	}
+	_, err = db.Reserve(context.TODO(), key.UrlKey, "")
+	if err == nil {
+		t.Error("Expired key could be reserved")
+	}
+}
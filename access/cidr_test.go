@@ -0,0 +1,59 @@
+package access
+
+import "testing"
+
+func TestAllowsIp(t *testing.T) {
+	key, err := FromExAccessKey(ExAccessKey{
+		BucketId:     "Bucket",
+		KeyId:        "key",
+		UrlKey:       "office-only",
+		AllowedCidrs: []string{"192.0.2.0/24", "2001:db8::/32", "198.51.100.7"},
+		DeniedCidrs:  []string{"192.0.2.128/25", "2001:db8:dead::/48"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"192.0.2.10":        true,
+		"192.0.2.200":       false,
+		"198.51.100.7":      true,
+		"198.51.100.8":      false,
+		"::ffff:192.0.2.10": true,
+		"2001:db8:1::1":     true,
+		"2001:db8:dead::1":  false,
+		"2001:db9::1":       false,
+		"not an ip":         false,
+		"":                  false,
+	}
+	for ip, allowed := range cases {
+		if key.AllowsIp(ip) != allowed {
+			t.Errorf("Ip %q allowed: %v", ip, !allowed)
+		}
+	}
+
+	denyOnly, err := FromExAccessKey(ExAccessKey{
+		BucketId:    "Bucket",
+		KeyId:       "key",
+		UrlKey:      "no-partner",
+		DeniedCidrs: []string{"203.0.113.0/24", "2001:db8::/32"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !denyOnly.AllowsIp("192.0.2.1") || !denyOnly.AllowsIp("2001:db9::1") {
+		t.Error("Deny list blocked an unlisted ip")
+	}
+	if denyOnly.AllowsIp("203.0.113.9") || denyOnly.AllowsIp("2001:db8::9") {
+		t.Error("Deny list let a listed ip through")
+	}
+
+	_, err = FromExAccessKey(ExAccessKey{
+		BucketId:     "Bucket",
+		KeyId:        "key",
+		UrlKey:       "broken-range",
+		AllowedCidrs: []string{"192.0.2.0/33"},
+	})
+	if err == nil {
+		t.Error("Invalid network was accepted")
+	}
+}
@@ -0,0 +1,252 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// FailureStore counts failed attempts per subject. Every attempt takes a slot
+// in the count before it's verified, so concurrent attempts see each other.
+// Failed attempts keep their slot, the others give it back. A count starts
+// over once window passed without another failure.
+type FailureStore interface {
+	// TakeAttempt counts an attempt that isn't verified yet.
+	TakeAttempt(ctx context.Context, subject string, now time.Time, window time.Duration) (*FailureRecord, error)
+	// FailAttempt keeps the slot of a failed attempt and starts the window.
+	FailAttempt(ctx context.Context, subject string, now time.Time, window time.Duration) (*FailureRecord, error)
+	// ReleaseAttempt gives the slot of an attempt back.
+	ReleaseAttempt(ctx context.Context, subject string) error
+	GetFailures(ctx context.Context, subject string, now time.Time) (*FailureRecord, error)
+	ResetFailures(ctx context.Context, subject string) error
+}
+
+// FailureRecord holds the failures of a subject, Failures includes the
+// attempts that are still verified.
+type FailureRecord struct {
+	Failures    uint64
+	LastFailure time.Time
+}
+
+type LockoutPolicy struct {
+	// MaxFailures locks a link, zero never locks.
+	MaxFailures uint64        `yaml:"maxFailures"`
+	BaseDelay   time.Duration `yaml:"baseDelay"`
+	MaxDelay    time.Duration `yaml:"maxDelay"`
+	Window      time.Duration `yaml:"window"`
+}
+
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		MaxFailures: 10,
+		BaseDelay:   time.Second,
+		MaxDelay:    5 * time.Minute,
+		Window:      time.Hour,
+	}
+}
+
+func (p LockoutPolicy) Validate() error {
+	if p.BaseDelay < 0 || p.MaxDelay < p.BaseDelay {
+		return errors.New("lockout delays must satisfy 0 <= base delay <= max delay")
+	}
+	if p.Window <= 0 {
+		return errors.New("lockout window must be positive")
+	}
+	return nil
+}
+
+// delay is the backoff after the given number of failures, it doubles with
+// every failure.
+func (p LockoutPolicy) delay(failures uint64) time.Duration {
+	if failures == 0 || p.BaseDelay == 0 {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := uint64(1); i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+type LockoutEvent struct {
+	Subject  string
+	Ip       string
+	Failures uint64
+	Until    time.Time
+}
+
+type Lockout struct {
+	store  FailureStore
+	policy LockoutPolicy
+	alert  func(LockoutEvent)
+	now    func() time.Time
+}
+
+// NewLockout guards unlock keys and other secrets with the counters of store,
+// alert is called whenever a subject gets locked. A nil alert logs the event.
+func NewLockout(store FailureStore, policy LockoutPolicy, alert func(LockoutEvent)) (*Lockout, error) {
+	err := policy.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if alert == nil {
+		alert = logLockout
+	}
+	return &Lockout{store: store, policy: policy, alert: alert, now: time.Now}, nil
+}
+
+func logLockout(event LockoutEvent) {
+	logrus.WithFields(logrus.Fields{
+		"Subject":  event.Subject,
+		"Ip":       event.Ip,
+		"Failures": event.Failures,
+		"Until":    event.Until,
+	}).Warnln("Locked after repeated failures.")
+}
+
+// LinkSubject counts the failed unlock keys of a share link.
+func LinkSubject(urlKey string) string {
+	return "link:" + urlKey
+}
+
+// IsLinkSubject tells failures counted against a link from the ones counted
+// against an ip or a user.
+func IsLinkSubject(subject string) bool {
+	return strings.HasPrefix(subject, "link:")
+}
+
+// UserSubject counts the failed passwords or second factors of a user.
+func UserSubject(username string) string {
+	return "user:" + username
+}
+
+func ipSubject(ip string) string {
+	return "ip:" + ip
+}
+
+// Attempt is an attempt at the secret of a subject that holds a slot in the
+// failure counts until it failed or succeeded.
+type Attempt struct {
+	lockout *Lockout
+	subject string
+	ip      string
+	slot    uint64
+}
+
+// Attempt takes a slot for an attempt at subject from ip before the secret is
+// verified. The slot counts like a failure, so concurrent guesses can't all
+// pass before the first failure is counted. Blocked attempts give their slot
+// back and get the reason as error and how long to wait until the next try.
+func (l *Lockout) Attempt(ctx context.Context, subject, ip string) (*Attempt, time.Duration, error) {
+	now := l.now()
+	target, err := l.store.TakeAttempt(ctx, subject, now, l.policy.Window)
+	if err != nil {
+		return nil, 0, err
+	}
+	client, err := l.store.TakeAttempt(ctx, ipSubject(ip), now, l.policy.Window)
+	if err != nil {
+		_ = l.store.ReleaseAttempt(ctx, subject)
+		return nil, 0, err
+	}
+	attempt := &Attempt{lockout: l, subject: subject, ip: ip, slot: target.Failures}
+	wait, err := l.blocked(subject, target, client, now)
+	if err != nil {
+		attempt.release(ctx)
+		return nil, wait, err
+	}
+	return attempt, 0, nil
+}
+
+func (l *Lockout) blocked(subject string, target, client *FailureRecord, now time.Time) (time.Duration, error) {
+	if l.policy.MaxFailures != 0 && target.Failures > l.policy.MaxFailures {
+		wait := target.LastFailure.Add(l.policy.Window).Sub(now)
+		// Attempts in flight fill the slots before there is a failure.
+		if wait < time.Second {
+			wait = time.Second
+		}
+		return wait, Locked(subject)
+	}
+	wait := time.Duration(0)
+	for _, record := range []*FailureRecord{target, client} {
+		// The slot of this attempt is part of the count.
+		remaining := record.LastFailure.Add(l.policy.delay(record.Failures - 1)).Sub(now)
+		if remaining > wait {
+			wait = remaining
+		}
+	}
+	if wait > 0 {
+		return wait, TooManyFailures(wait)
+	}
+	return 0, nil
+}
+
+func (a *Attempt) release(ctx context.Context) {
+	err := a.lockout.store.ReleaseAttempt(ctx, a.subject)
+	if err == nil {
+		err = a.lockout.store.ReleaseAttempt(ctx, ipSubject(a.ip))
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("Subject", a.subject).Errorln("Releasing attempt failed.")
+	}
+}
+
+// Fail counts the attempt as a failure of the subject and the ip.
+func (a *Attempt) Fail(ctx context.Context) error {
+	l := a.lockout
+	now := l.now()
+	_, err := l.store.FailAttempt(ctx, a.subject, now, l.policy.Window)
+	if err != nil {
+		return err
+	}
+	_, err = l.store.FailAttempt(ctx, ipSubject(a.ip), now, l.policy.Window)
+	if err != nil {
+		return err
+	}
+	// Concurrent attempts have distinct slots, only one of them locks.
+	if l.policy.MaxFailures != 0 && a.slot == l.policy.MaxFailures {
+		l.alert(LockoutEvent{
+			Subject:  a.subject,
+			Ip:       a.ip,
+			Failures: a.slot,
+			Until:    now.Add(l.policy.Window),
+		})
+	}
+	return nil
+}
+
+// Succeed gives the slot back and clears the backoff of the ip. The subject
+// keeps its failures, so a successful guess elsewhere doesn't lift a lock.
+func (a *Attempt) Succeed(ctx context.Context) error {
+	err := a.lockout.store.ReleaseAttempt(ctx, a.subject)
+	if err != nil {
+		return err
+	}
+	return a.lockout.store.ResetFailures(ctx, ipSubject(a.ip))
+}
+
+// Unlock lifts the lock and the backoff of a link.
+func (l *Lockout) Unlock(ctx context.Context, urlKey string) error {
+	return l.store.ResetFailures(ctx, LinkSubject(urlKey))
+}
+
+// Locked explains a lock, links are named by their url key.
+func Locked(subject string) error {
+	if IsLinkSubject(subject) {
+		return LinkLocked(strings.TrimPrefix(subject, "link:"))
+	}
+	return errors.New("locked after repeated failures")
+}
+
+func LinkLocked(urlKey string) error {
+	return errors.New(fmt.Sprintf("the key assigned to the url key %v is locked after repeated unlock failures", urlKey))
+}
+
+func TooManyFailures(wait time.Duration) error {
+	return errors.New(fmt.Sprintf("too many unlock failures, retry in %v", wait.Round(time.Second)))
+}
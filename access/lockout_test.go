@@ -0,0 +1,177 @@
+package access
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testLockout(t *testing.T, policy LockoutPolicy) (*Lockout, *time.Time, *[]LockoutEvent) {
+	now := time.Unix(1700000000, 0)
+	events := make([]LockoutEvent, 0)
+	lockout, err := NewLockout(NewMemoryStore(), policy, func(event LockoutEvent) {
+		events = append(events, event)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockout.now = func() time.Time {
+		return now
+	}
+	return lockout, &now, &events
+}
+
+// guess fails an attempt at the link.
+func guess(t *testing.T, lockout *Lockout, urlKey, ip string) {
+	attempt, _, err := lockout.Attempt(context.TODO(), LinkSubject(urlKey), ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = attempt.Fail(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// check makes an attempt at the link without finishing it, the slot is
+// given back.
+func check(lockout *Lockout, urlKey, ip string) (time.Duration, error) {
+	attempt, wait, err := lockout.Attempt(context.TODO(), LinkSubject(urlKey), ip)
+	if err == nil {
+		attempt.release(context.TODO())
+	}
+	return wait, err
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	lockout, now, _ := testLockout(t, LockoutPolicy{
+		MaxFailures: 10,
+		BaseDelay:   time.Second,
+		MaxDelay:    4 * time.Second,
+		Window:      time.Hour,
+	})
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		guess(t, lockout, "share-link", "192.0.2.1")
+		wait, err := check(lockout, "share-link", "192.0.2.1")
+		if err == nil || wait != expected {
+			t.Errorf("Failure %v waits %v instead of %v", i+1, wait, expected)
+		}
+		*now = now.Add(expected)
+		_, err = check(lockout, "share-link", "192.0.2.1")
+		if err != nil {
+			t.Errorf("Failure %v still blocks after the backoff: %v", i+1, err)
+		}
+	}
+}
+
+func TestLockoutPerIp(t *testing.T) {
+	lockout, _, _ := testLockout(t, LockoutPolicy{
+		MaxFailures: 10,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		Window:      time.Hour,
+	})
+	guess(t, lockout, "share-link", "192.0.2.1")
+	_, err := check(lockout, "other-link", "192.0.2.1")
+	if err == nil {
+		t.Error("Ip could guess another link without backoff")
+	}
+	attempt, _, err := lockout.Attempt(context.TODO(), LinkSubject("other-link"), "192.0.2.2")
+	if err != nil {
+		t.Fatalf("Unrelated client was blocked: %v", err)
+	}
+	err = attempt.Succeed(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A success only clears the backoff of its own ip.
+	_, err = check(lockout, "other-link", "192.0.2.1")
+	if err == nil {
+		t.Error("Success of another ip cleared the backoff")
+	}
+	err = lockout.store.ResetFailures(context.TODO(), ipSubject("192.0.2.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = check(lockout, "other-link", "192.0.2.1")
+	if err != nil {
+		t.Errorf("Backoff of the ip survived a success: %v", err)
+	}
+}
+
+func TestLockoutLocksLink(t *testing.T) {
+	lockout, now, events := testLockout(t, LockoutPolicy{
+		MaxFailures: 3,
+		Window:      time.Hour,
+	})
+	ctx := context.TODO()
+	for i := 0; i < 3; i++ {
+		guess(t, lockout, "share-link", "192.0.2.1")
+	}
+	if len(*events) != 1 || (*events)[0].Subject != LinkSubject("share-link") || (*events)[0].Failures != 3 {
+		t.Errorf("Lock raised events %v", *events)
+	}
+	wait, err := check(lockout, "share-link", "192.0.2.9")
+	if err == nil || wait != time.Hour {
+		t.Errorf("Locked link checked with %v after %v", err, wait)
+	}
+	*now = now.Add(time.Hour)
+	_, err = check(lockout, "share-link", "192.0.2.9")
+	if err != nil {
+		t.Errorf("Lock outlived its window: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		guess(t, lockout, "share-link", "192.0.2.1")
+	}
+	err = lockout.Unlock(ctx, "share-link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = check(lockout, "share-link", "192.0.2.9")
+	if err != nil {
+		t.Errorf("Unlocked link is still locked: %v", err)
+	}
+}
+
+func TestLockoutBoundsConcurrentGuesses(t *testing.T) {
+	lockout, _, events := testLockout(t, LockoutPolicy{
+		MaxFailures: 5,
+		Window:      time.Hour,
+	})
+	ctx := context.TODO()
+	var m sync.Mutex
+	attempts := make([]*Attempt, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// All guesses are in flight before the first one fails.
+			attempt, _, err := lockout.Attempt(ctx, LinkSubject("share-link"), "192.0.2.1")
+			if err == nil {
+				m.Lock()
+				attempts = append(attempts, attempt)
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(attempts) != 5 {
+		t.Errorf("%v concurrent guesses passed the lockout", len(attempts))
+	}
+	for _, attempt := range attempts {
+		err := attempt.Fail(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(*events) != 1 {
+		t.Errorf("Lock raised events %v", *events)
+	}
+	_, err := check(lockout, "share-link", "192.0.2.9")
+	if err == nil {
+		t.Error("Link wasn't locked after the guesses failed")
+	}
+}
@@ -2,49 +2,91 @@ package access
 
 import (
 	"context"
+	"sort"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
 type MemoryStore struct {
 	m          sync.Map
+	counter    sync.Mutex
+	objects    map[string]map[string]*objectUse
+	leases     map[string]map[string]*memoryLease
+	failureM   sync.Mutex
+	failures   map[string]*failureEntry
+	swept      time.Time
 	killer     chan<- *AKey
 	timeKiller chan<- *AKey
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+type objectUse struct {
+	used     uint64
+	reserved uint64
+}
+
+// memoryLease is an open reservation of a key.
+type memoryLease struct {
+	object  string
+	expires time.Time
 }
 
 func NewMemoryStore() *MemoryStore {
-	ret := &MemoryStore{}
+	done := make(chan struct{})
+	ret := &MemoryStore{objects: make(map[string]map[string]*objectUse), leases: make(map[string]map[string]*memoryLease), failures: make(map[string]*failureEntry), done: done}
 	killerChan := make(chan *AKey)
 	ret.killer = killerChan
 	go func() {
 		for {
-			k := <-killerChan
-			if k == nil {
+			select {
+			case k := <-killerChan:
+				_ = ret.DeleteKey(k)
+			case <-done:
 				return
 			}
-			_ = ret.DeleteKey(k)
 		}
 	}()
 	timeKiller := make(chan *AKey)
 	ret.timeKiller = timeKiller
 	go func() {
 		for {
-			k := <-timeKiller
-			if k == nil {
+			var k *AKey
+			select {
+			case k = <-timeKiller:
+			case <-done:
 				return
 			}
+			ret.counter.Lock()
 			duration := time.Until(*k.ttl)
+			ret.counter.Unlock()
 			go func() {
-				timer := time.NewTimer(duration)
-				_ = <-timer.C
-				killerChan <- k
+				if !waitUntilExpired(duration, done) {
+					return
+				}
+				// The ttl might have been extended in the meantime.
+				ret.counter.Lock()
+				expired := k.Expired(time.Now())
+				ret.counter.Unlock()
+				if !expired {
+					sendUnlessDone(timeKiller, k, done)
+					return
+				}
+				sendUnlessDone(killerChan, k, done)
 			}()
 		}
 	}()
 	return ret
 }
 
+// Close stops removing used up and expired keys.
+func (m *MemoryStore) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+	return nil
+}
+
 func (m *MemoryStore) AddKey(key *AKey) error {
 	_, ok := m.m.Load(key.UrlKey)
 	if ok {
@@ -52,35 +94,142 @@ func (m *MemoryStore) AddKey(key *AKey) error {
 	}
 	m.m.Store(key.UrlKey, key)
 	if key.expires {
-		m.timeKiller <- key
+		sendUnlessDone(m.timeKiller, key, m.done)
 	}
 	return nil
 }
 
-func (m *MemoryStore) Access(ctx context.Context, urlKey string) (chan<- bool, *AKey, error) {
+// objectUse has to be called with the counter lock held.
+func (m *MemoryStore) objectUse(urlKey, object string) *objectUse {
+	uses, ok := m.objects[urlKey]
+	if !ok {
+		uses = make(map[string]*objectUse)
+		m.objects[urlKey] = uses
+	}
+	use, ok := uses[object]
+	if !ok {
+		use = &objectUse{}
+		uses[object] = use
+	}
+	return use
+}
+
+// unreserve gives back the use a reservation held, it has to be called with
+// the counter lock held.
+func (m *MemoryStore) unreserve(key *AKey, object string) {
+	if key.limitedPerObject() {
+		use := m.objectUse(key.UrlKey, object)
+		if use.reserved > 0 {
+			use.reserved -= 1
+		}
+	} else if key.reservedTimes > 0 {
+		key.reservedTimes -= 1
+	}
+}
+
+// endLease reports whether the reservation was still open, it has to be
+// called with the counter lock held.
+func (m *MemoryStore) endLease(urlKey, reservation string) bool {
+	_, ok := m.leases[urlKey][reservation]
+	delete(m.leases[urlKey], reservation)
+	return ok
+}
+
+// expireLeases releases the reservations of key whose lease passed, it has
+// to be called with the counter lock held.
+func (m *MemoryStore) expireLeases(key *AKey, now time.Time) {
+	for reservation, lease := range m.leases[key.UrlKey] {
+		if !now.Before(lease.expires) {
+			delete(m.leases[key.UrlKey], reservation)
+			m.unreserve(key, lease.object)
+		}
+	}
+}
+
+func (m *MemoryStore) Reserve(ctx context.Context, urlKey, object string) (*AKey, error) {
 	keyTmp, ok := m.m.Load(urlKey)
 	if !ok {
-		return nil, nil, KeyDoesntExist(urlKey)
+		return nil, KeyDoesntExist(urlKey)
 	}
 	key := keyTmp.(*AKey)
-	backChan := make(chan bool)
-	go func() {
-		select {
-		case <-ctx.Done():
-			return
-		case resp := <-backChan:
-			if resp {
-				counterPointer := key.usedTimes
-				atomic.AddUint64(counterPointer, 1)
-			}
-			counter := atomic.LoadUint64(key.usedTimes)
-			if counter >= key.limit && key.limited {
-				m.killer <- key
-			}
-			return
+	reservation, err := newReservation()
+	if err != nil {
+		return nil, err
+	}
+	m.counter.Lock()
+	defer m.counter.Unlock()
+	now := time.Now()
+	if key.Expired(now) {
+		return nil, KeyExpired(urlKey)
+	}
+	object, err = key.reserveObject(object)
+	if err != nil {
+		return nil, err
+	}
+	m.expireLeases(key, now)
+	if key.limitedPerObject() {
+		use := m.objectUse(urlKey, object)
+		if use.used+use.reserved >= key.limit {
+			return nil, KeyExhausted(urlKey)
 		}
-	}()
-	return backChan, key, nil
+		use.reserved += 1
+	} else {
+		if key.limited && *key.usedTimes+key.reservedTimes >= key.limit {
+			return nil, KeyExhausted(urlKey)
+		}
+		key.reservedTimes += 1
+	}
+	leases, ok := m.leases[urlKey]
+	if !ok {
+		leases = make(map[string]*memoryLease)
+		m.leases[urlKey] = leases
+	}
+	leases[reservation] = &memoryLease{object: object, expires: now.Add(reservationLease)}
+	ret := *key
+	ret.object = object
+	ret.reservation = reservation
+	return &ret, nil
+}
+
+// Commit counts the use even if the lease passed, the reservation was only
+// given back then.
+func (m *MemoryStore) Commit(ctx context.Context, key *AKey) error {
+	keyTmp, ok := m.m.Load(key.UrlKey)
+	if !ok {
+		return KeyDoesntExist(key.UrlKey)
+	}
+	stored := keyTmp.(*AKey)
+	m.counter.Lock()
+	if m.endLease(key.UrlKey, key.reservation) {
+		m.unreserve(stored, key.object)
+	}
+	exhausted := false
+	if stored.limitedPerObject() {
+		m.objectUse(key.UrlKey, key.object).used += 1
+	}
+	*stored.usedTimes += 1
+	if !stored.limitedPerObject() {
+		exhausted = stored.limited && *stored.usedTimes >= stored.limit
+	}
+	m.counter.Unlock()
+	if exhausted {
+		return m.DeleteKey(stored)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Release(ctx context.Context, key *AKey) error {
+	keyTmp, ok := m.m.Load(key.UrlKey)
+	if !ok {
+		return nil
+	}
+	stored := keyTmp.(*AKey)
+	m.counter.Lock()
+	defer m.counter.Unlock()
+	if m.endLease(key.UrlKey, key.reservation) {
+		m.unreserve(stored, key.object)
+	}
+	return nil
 }
 
 func (m *MemoryStore) DeleteKey(key *AKey) error {
@@ -90,5 +239,146 @@ func (m *MemoryStore) DeleteKey(key *AKey) error {
 		return KeyDoesntExist(urlKey)
 	}
 	m.m.Delete(urlKey)
+	m.counter.Lock()
+	delete(m.objects, urlKey)
+	delete(m.leases, urlKey)
+	m.counter.Unlock()
+	return nil
+}
+
+// snapshot copies a key under the counter lock, so callers can read it while
+// downloads keep counting.
+func (m *MemoryStore) snapshot(key *AKey) *AKey {
+	m.counter.Lock()
+	defer m.counter.Unlock()
+	ret := *key
+	usedTimes := *key.usedTimes
+	ret.usedTimes = &usedTimes
+	return &ret
+}
+
+func (m *MemoryStore) GetKey(ctx context.Context, urlKey string) (*AKey, error) {
+	keyTmp, ok := m.m.Load(urlKey)
+	if !ok {
+		return nil, KeyDoesntExist(urlKey)
+	}
+	key := m.snapshot(keyTmp.(*AKey))
+	if key.Expired(time.Now()) {
+		return nil, KeyDoesntExist(urlKey)
+	}
+	return key, nil
+}
+
+func (m *MemoryStore) ListKeys(ctx context.Context, filter KeyFilter) ([]*AKey, error) {
+	ret := make([]*AKey, 0)
+	now := time.Now()
+	m.m.Range(func(_, value interface{}) bool {
+		key := m.snapshot(value.(*AKey))
+		if filter.Matches(key) && !key.Expired(now) {
+			ret = append(ret, key)
+		}
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].UrlKey < ret[j].UrlKey
+	})
+	return ret, nil
+}
+
+func (m *MemoryStore) UpdateKey(ctx context.Context, urlKey string, update KeyUpdate) (*AKey, error) {
+	keyTmp, ok := m.m.Load(urlKey)
+	if !ok {
+		return nil, KeyDoesntExist(urlKey)
+	}
+	key := keyTmp.(*AKey)
+	m.counter.Lock()
+	if key.Expired(time.Now()) {
+		m.counter.Unlock()
+		return nil, KeyDoesntExist(urlKey)
+	}
+	err := key.applyUpdate(update)
+	m.counter.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return m.snapshot(key), nil
+}
+
+// FailureSweepInterval is how often expired failure counts are dropped, so
+// guesses from many addresses don't pile up in memory.
+const FailureSweepInterval = time.Minute
+
+type failureEntry struct {
+	record  FailureRecord
+	expires time.Time
+}
+
+// sweepFailures drops expired counts, failureM must be held.
+func (m *MemoryStore) sweepFailures(now time.Time) {
+	if now.Sub(m.swept) < FailureSweepInterval {
+		return
+	}
+	m.swept = now
+	for subject, entry := range m.failures {
+		if !now.Before(entry.expires) {
+			delete(m.failures, subject)
+		}
+	}
+}
+
+func (m *MemoryStore) TakeAttempt(ctx context.Context, subject string, now time.Time, window time.Duration) (*FailureRecord, error) {
+	m.failureM.Lock()
+	defer m.failureM.Unlock()
+	m.sweepFailures(now)
+	entry, ok := m.failures[subject]
+	if !ok || !now.Before(entry.expires) {
+		entry = &failureEntry{expires: now.Add(window)}
+		m.failures[subject] = entry
+	}
+	entry.record.Failures++
+	ret := entry.record
+	return &ret, nil
+}
+
+func (m *MemoryStore) FailAttempt(ctx context.Context, subject string, now time.Time, window time.Duration) (*FailureRecord, error) {
+	m.failureM.Lock()
+	defer m.failureM.Unlock()
+	entry, ok := m.failures[subject]
+	if !ok || !now.Before(entry.expires) {
+		// The slot expired with the count, the failure starts a new one.
+		entry = &failureEntry{record: FailureRecord{Failures: 1}}
+		m.failures[subject] = entry
+	}
+	entry.record.LastFailure = now
+	entry.expires = now.Add(window)
+	ret := entry.record
+	return &ret, nil
+}
+
+func (m *MemoryStore) ReleaseAttempt(ctx context.Context, subject string) error {
+	m.failureM.Lock()
+	defer m.failureM.Unlock()
+	entry, ok := m.failures[subject]
+	if ok && entry.record.Failures > 0 {
+		entry.record.Failures--
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetFailures(ctx context.Context, subject string, now time.Time) (*FailureRecord, error) {
+	m.failureM.Lock()
+	defer m.failureM.Unlock()
+	entry, ok := m.failures[subject]
+	if !ok || !now.Before(entry.expires) {
+		return &FailureRecord{}, nil
+	}
+	ret := entry.record
+	return &ret, nil
+}
+
+func (m *MemoryStore) ResetFailures(ctx context.Context, subject string) error {
+	m.failureM.Lock()
+	defer m.failureM.Unlock()
+	delete(m.failures, subject)
 	return nil
 }
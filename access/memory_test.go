@@ -1,6 +1,11 @@
 package access
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
 
 func TestAddAndDeleteMemory(t *testing.T) {
 	db := NewMemoryStore()
@@ -11,3 +16,73 @@ func TestAddAndAccessMemory(t *testing.T) {
 	db := NewMemoryStore()
 	AddAndAccessTest(t, db)
 }
+
+func TestLimitStressMemory(t *testing.T) {
+	db := NewMemoryStore()
+	LimitStressTest(t, db)
+}
+
+func TestManageKeysMemory(t *testing.T) {
+	db := NewMemoryStore()
+	ManageKeysTest(t, db)
+}
+
+func TestUploadKeyMemory(t *testing.T) {
+	db := NewMemoryStore()
+	UploadKeyTest(t, db)
+}
+
+func TestShareKeyMemory(t *testing.T) {
+	db := NewMemoryStore()
+	ShareKeyTest(t, db)
+}
+
+func TestUnlockKeyMemory(t *testing.T) {
+	db := NewMemoryStore()
+	UnlockKeyTest(t, db)
+}
+
+func TestFailureStoreMemory(t *testing.T) {
+	db := NewMemoryStore()
+	FailureStoreTest(t, db)
+}
+
+func TestFailureSweepMemory(t *testing.T) {
+	db := NewMemoryStore()
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		_, err := db.TakeAttempt(context.TODO(), fmt.Sprintf("ip:192.0.2.%v", i), now, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.TakeAttempt(context.TODO(), "ip:198.51.100.1", now.Add(FailureSweepInterval+time.Minute), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.failureM.Lock()
+	defer db.failureM.Unlock()
+	if len(db.failures) != 1 {
+		t.Errorf("Sweep kept %v failure counts", len(db.failures))
+	}
+}
+
+func TestActivationMemory(t *testing.T) {
+	db := NewMemoryStore()
+	ActivationTest(t, db)
+}
+
+func TestIpRestrictionMemory(t *testing.T) {
+	db := NewMemoryStore()
+	IpRestrictionTest(t, db)
+}
+
+func TestExpiryMemory(t *testing.T) {
+	db := NewMemoryStore()
+	ExpiryTest(t, db, time.Sleep)
+}
+
+func TestReservationLeaseMemory(t *testing.T) {
+	db := NewMemoryStore()
+	ReservationLeaseTest(t, db)
+}
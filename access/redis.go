@@ -7,6 +7,9 @@ import (
 	"github.com/sirupsen/logrus"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -33,12 +36,32 @@ func ProtoKeyFromAKey(key *AKey) *ProtoAKey {
 	keys := make([][]byte, 0)
 	if ret.NeedsKey {
 		for array := range key.validKeys.set {
-			keys = append(keys, array[:])
+			validKey := array
+			keys = append(keys, validKey[:])
 		}
 	}
 
 	ret.ValidKeys = keys
+	ret.UnlockSalt = key.unlockSalt
+	if key.notBefore != nil {
+		ret.NotBefore = timestamppb.New(*key.notBefore)
+	}
+	for _, window := range key.windows {
+		protoWindow := &ProtoTimeWindow{Start: window.Start, End: window.End, Timezone: window.Timezone}
+		for _, day := range window.Days {
+			protoWindow.Days = append(protoWindow.Days, int32(day))
+		}
+		ret.Windows = append(ret.Windows, protoWindow)
+	}
 	ret.ResolveByUrlKey = key.ResolveByUrlKey
+	ret.CreatedBy = key.CreatedBy
+	ret.Kind = ProtoKeyKind(key.Kind)
+	ret.Prefix = key.Prefix
+	ret.MaxSize = key.MaxSize
+	ret.ContentTypes = key.ContentTypes
+	ret.PerObjectLimit = key.PerObjectLimit
+	ret.AllowedCidrs = key.AllowedCidrs
+	ret.DeniedCidrs = key.DeniedCidrs
 	return ret
 }
 
@@ -69,7 +92,28 @@ func AKeyFromProtoKey(proto *ProtoAKey) *AKey {
 		keys.Insert(validKey)
 	}
 	ret.validKeys = keys
+	ret.unlockSalt = proto.UnlockSalt
+	// Keys stored before activation times existed have neither field set.
+	if proto.NotBefore != nil {
+		notBefore := proto.NotBefore.AsTime()
+		ret.notBefore = &notBefore
+	}
+	for _, protoWindow := range proto.Windows {
+		window := TimeWindow{Start: protoWindow.Start, End: protoWindow.End, Timezone: protoWindow.Timezone}
+		for _, day := range protoWindow.Days {
+			window.Days = append(window.Days, time.Weekday(day))
+		}
+		ret.windows = append(ret.windows, window)
+	}
 	ret.ResolveByUrlKey = proto.ResolveByUrlKey
+	ret.CreatedBy = proto.CreatedBy
+	ret.Kind = KeyKind(proto.Kind)
+	ret.Prefix = proto.Prefix
+	ret.MaxSize = proto.MaxSize
+	ret.ContentTypes = proto.ContentTypes
+	ret.PerObjectLimit = proto.PerObjectLimit
+	ret.AllowedCidrs = proto.AllowedCidrs
+	ret.DeniedCidrs = proto.DeniedCidrs
 	return ret
 }
 
@@ -77,6 +121,8 @@ type RedisStore struct {
 	client     *redis.Client
 	ctx        context.Context
 	killerChan chan<- *AKey
+	done       chan struct{}
+	closeOnce  sync.Once
 }
 
 func NewRedisStore(ctx context.Context, client *redis.Client) (*RedisStore, error) {
@@ -90,92 +136,519 @@ func NewRedisStore(ctx context.Context, client *redis.Client) (*RedisStore, erro
 	ret.ctx = ctx
 	killerChan := make(chan *AKey)
 	ret.killerChan = killerChan
+	done := make(chan struct{})
+	ret.done = done
 	go func() {
 		for {
-			k := <-killerChan
-			if k == nil {
+			select {
+			case k := <-killerChan:
+				_ = ret.DeleteKey(k)
+			case <-done:
 				return
 			}
-			_ = ret.DeleteKey(k)
 		}
 	}()
 	return ret, nil
 }
 
+// Close stops deleting keys in the background and closes the client.
+func (r *RedisStore) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.done)
+		err = r.client.Close()
+	})
+	return err
+}
+
+// AddKey only writes keys that don't exist yet, expiring keys get the time
+// left until their ttl as expiration.
 func (r *RedisStore) AddKey(key *AKey) error {
 	protoKey := ProtoKeyFromAKey(key)
 	data, err := proto.Marshal(protoKey)
 	if err != nil {
 		return err
 	}
-	statusCmd := &redis.StatusCmd{}
-	if key.expires {
-		statusCmd = r.client.Set(r.ctx, key.UrlKey, data, time.Now().Sub(*key.ttl))
-	} else {
-		statusCmd = r.client.Set(r.ctx, key.UrlKey, data, time.Second*0)
+	expiration := time.Duration(0)
+	if key.expires && key.ttl != nil {
+		expiration = time.Until(*key.ttl)
+		if expiration <= 0 {
+			return TTLAlreadyExpired(key.ttl)
+		}
 	}
-	if statusCmd.Err() != nil {
-		return statusCmd.Err()
+	added, err := r.client.SetNX(r.ctx, key.UrlKey, data, expiration).Result()
+	if err != nil {
+		return err
+	}
+	if !added {
+		return KeyAlreadyExists(key.UrlKey)
+	}
+	pipe := r.client.TxPipeline()
+	for _, index := range indexKeys(key) {
+		pipe.SAdd(r.ctx, index, key.UrlKey)
+	}
+	_, err = pipe.Exec(r.ctx)
+	return err
+}
+
+func usedKey(urlKey string) string {
+	return urlKey + ":used"
+}
+
+func reservedKey(urlKey string) string {
+	return urlKey + ":reserved"
+}
+
+// Url keys never contain a colon, so the index sets can't collide with them.
+const allKeysIndex = "keys:all"
+
+func bucketIndex(bucketId string) string {
+	return "keys:bucket:" + bucketId
+}
+
+func creatorIndex(createdBy string) string {
+	return "keys:creator:" + createdBy
+}
+
+func indexKeys(key *AKey) []string {
+	ret := []string{allKeysIndex, bucketIndex(key.BucketId)}
+	if key.CreatedBy != "" {
+		ret = append(ret, creatorIndex(key.CreatedBy))
+	}
+	return ret
+}
+
+func counterKeys(urlKey string) []string {
+	return []string{urlKey, usedKey(urlKey), reservedKey(urlKey)}
+}
+
+// objectCounterKeys are laid out like counterKeys, so the same scripts work on
+// them. The total use counter of the key comes last.
+func objectCounterKeys(urlKey, object string) []string {
+	return []string{urlKey, usedKey(urlKey) + ":" + object, reservedKey(urlKey) + ":" + object, usedKey(urlKey)}
+}
+
+func reservationKeys(key *AKey) []string {
+	if key.limitedPerObject() {
+		return objectCounterKeys(key.UrlKey, key.object)
+	}
+	return counterKeys(key.UrlKey)
+}
+
+func limitArgs(key *AKey) []interface{} {
+	limited := 0
+	if key.limited {
+		limited = 1
 	}
-	return nil
+	return []interface{}{limited, key.limit}
 }
 
-func (r *RedisStore) Access(ctx context.Context, urlKey string) (chan<- bool, *AKey, error) {
-	backChan := make(chan bool)
+// The counters live next to the serialized key so the scripts can check and
+// update them atomically, they inherit the expiration of the key. Open
+// reservations are a sorted set scored by the end of their lease, expired
+// ones are dropped before counting. Counters of reservations from before the
+// leases are dropped as well.
+const leasesLua = `
+if redis.call('TYPE', KEYS[3])['ok'] == 'string' then
+	redis.call('DEL', KEYS[3])
+end
+`
+
+var reserveScript = redis.NewScript(leasesLua + `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', ARGV[3])
+local used = tonumber(redis.call('GET', KEYS[2]) or '0')
+local reserved = redis.call('ZCARD', KEYS[3])
+if ARGV[1] == '1' and used + reserved >= tonumber(ARGV[2]) then
+	return -2
+end
+redis.call('ZADD', KEYS[3], ARGV[4], ARGV[5])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[3], ttl)
+end
+return used
+`)
+
+var commitScript = redis.NewScript(leasesLua + `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+redis.call('ZREM', KEYS[3], ARGV[3])
+local used = redis.call('INCR', KEYS[2])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+if ARGV[1] == '1' and used >= tonumber(ARGV[2]) then
+	redis.call('DEL', KEYS[1], KEYS[2], KEYS[3])
+end
+return used
+`)
+
+var commitObjectScript = redis.NewScript(leasesLua + `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+redis.call('ZREM', KEYS[3], ARGV[3])
+local used = redis.call('INCR', KEYS[2])
+redis.call('INCR', KEYS[4])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+	redis.call('PEXPIRE', KEYS[4], ttl)
+end
+return used
+`)
+
+var releaseScript = redis.NewScript(leasesLua + `
+return redis.call('ZREM', KEYS[3], ARGV[1])
+`)
+
+func (r *RedisStore) Reserve(ctx context.Context, urlKey, object string) (*AKey, error) {
 	statusCmd := r.client.Get(ctx, urlKey)
 	data, err := statusCmd.Bytes()
+	if err == redis.Nil {
+		return nil, KeyDoesntExist(urlKey)
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	protoKey := &ProtoAKey{}
 	err = proto.Unmarshal(data, protoKey)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	aKey := AKeyFromProtoKey(protoKey)
-	go func() {
-		select {
-		case <-ctx.Done():
-			return
-		case resp := <-backChan:
-			statusCmd = r.client.Get(ctx, urlKey)
-			if statusCmd.Err() != nil {
-				logrus.WithError(err).WithField("Url Key", urlKey).Errorf("error retrieving data from redis")
-				return
-			}
-			protoData, err := statusCmd.Bytes()
+	aKey.object, err = aKey.reserveObject(object)
+	if err != nil {
+		return nil, err
+	}
+	aKey.reservation, err = newReservation()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	args := append(limitArgs(aKey), unixMillis(now), unixMillis(now.Add(reservationLease)), aKey.reservation)
+	used, err := reserveScript.Run(ctx, r.client, reservationKeys(aKey), args...).Int64()
+	if err != nil {
+		return nil, err
+	}
+	switch used {
+	case -1:
+		return nil, KeyDoesntExist(urlKey)
+	case -2:
+		return nil, KeyExhausted(urlKey)
+	}
+	if !aKey.limitedPerObject() {
+		usedTimes := uint64(used)
+		aKey.usedTimes = &usedTimes
+	}
+	return aKey, nil
+}
+
+func (r *RedisStore) Commit(ctx context.Context, key *AKey) error {
+	script := commitScript
+	if key.limitedPerObject() {
+		script = commitObjectScript
+	}
+	args := append(limitArgs(key), key.reservation)
+	err := script.Run(ctx, r.client, reservationKeys(key), args...).Err()
+	if err != nil {
+		logrus.WithError(err).WithField("Url Key", key.UrlKey).Errorf("error committing key usage to redis")
+	}
+	return err
+}
+
+func (r *RedisStore) Release(ctx context.Context, key *AKey) error {
+	return releaseScript.Run(ctx, r.client, reservationKeys(key), key.reservation).Err()
+}
+
+func (r *RedisStore) DeleteKey(key *AKey) error {
+	statusCmd := r.client.Del(r.ctx, counterKeys(key.UrlKey)...)
+	if statusCmd.Err() != nil {
+		return statusCmd.Err()
+	}
+	objectCounters, err := objectCounters(r.ctx, r.client, key.UrlKey)
+	if err != nil {
+		return err
+	}
+	if len(objectCounters) != 0 {
+		err = r.client.Del(r.ctx, objectCounters...).Err()
+		if err != nil {
+			return err
+		}
+	}
+	pipe := r.client.TxPipeline()
+	for _, index := range indexKeys(key) {
+		pipe.SRem(r.ctx, index, key.UrlKey)
+	}
+	_, err = pipe.Exec(r.ctx)
+	return err
+}
+
+// objectCounters finds the per object counters of a key. The patterns are
+// narrow enough to never match the index sets, even for a url key like "keys".
+func objectCounters(ctx context.Context, client redis.Cmdable, urlKey string) ([]string, error) {
+	ret := make([]string, 0)
+	for _, pattern := range []string{usedKey(urlKey) + ":*", reservedKey(urlKey) + ":*"} {
+		iter := client.Scan(ctx, 0, pattern, 0).Iterator()
+		for iter.Next(ctx) {
+			ret = append(ret, iter.Val())
+		}
+		if iter.Err() != nil {
+			return nil, iter.Err()
+		}
+	}
+	return ret, nil
+}
+
+func (r *RedisStore) loadKeys(ctx context.Context, urlKeys []string) ([]*AKey, []string, error) {
+	if len(urlKeys) == 0 {
+		return []*AKey{}, []string{}, nil
+	}
+	names := make([]string, 0, len(urlKeys)*2)
+	for _, urlKey := range urlKeys {
+		names = append(names, urlKey, usedKey(urlKey))
+	}
+	values, err := r.client.MGet(ctx, names...).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	ret := make([]*AKey, 0, len(urlKeys))
+	missing := make([]string, 0)
+	for i, urlKey := range urlKeys {
+		data, ok := values[2*i].(string)
+		if !ok {
+			missing = append(missing, urlKey)
+			continue
+		}
+		protoKey := &ProtoAKey{}
+		err = proto.Unmarshal([]byte(data), protoKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		key := AKeyFromProtoKey(protoKey)
+		usedTimes := uint64(0)
+		if used, ok := values[2*i+1].(string); ok {
+			usedTimes, err = strconv.ParseUint(used, 10, 64)
 			if err != nil {
-				logrus.WithError(err).Errorf("error while retrieving bytes from Redis back")
-				return
+				return nil, nil, err
 			}
-			protoAKey := &ProtoAKey{}
-			err = proto.Unmarshal(protoData, protoAKey)
+		}
+		key.usedTimes = &usedTimes
+		ret = append(ret, key)
+	}
+	return ret, missing, nil
+}
+
+func (r *RedisStore) GetKey(ctx context.Context, urlKey string) (*AKey, error) {
+	keys, _, err := r.loadKeys(ctx, []string{urlKey})
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, KeyDoesntExist(urlKey)
+	}
+	return keys[0], nil
+}
+
+// ListKeys reads the most selective index set. Keys that expired or were used
+// up in the meantime are pruned from it on the way.
+func (r *RedisStore) ListKeys(ctx context.Context, filter KeyFilter) ([]*AKey, error) {
+	index := allKeysIndex
+	if filter.CreatedBy != "" {
+		index = creatorIndex(filter.CreatedBy)
+	} else if filter.BucketId != "" {
+		index = bucketIndex(filter.BucketId)
+	}
+	urlKeys, err := r.client.SMembers(ctx, index).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(urlKeys)
+	keys, missing, err := r.loadKeys(ctx, urlKeys)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		members := make([]interface{}, 0, len(missing))
+		for _, urlKey := range missing {
+			members = append(members, urlKey)
+		}
+		err = r.client.SRem(ctx, index, members...).Err()
+		if err != nil {
+			logrus.WithError(err).Errorf("error pruning key index in redis")
+		}
+	}
+	ret := make([]*AKey, 0, len(keys))
+	for _, key := range keys {
+		if filter.Matches(key) {
+			ret = append(ret, key)
+		}
+	}
+	return ret, nil
+}
+
+func (r *RedisStore) UpdateKey(ctx context.Context, urlKey string, update KeyUpdate) (*AKey, error) {
+	var ret *AKey
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, urlKey).Bytes()
+		if err == redis.Nil {
+			return KeyDoesntExist(urlKey)
+		}
+		if err != nil {
+			return err
+		}
+		protoKey := &ProtoAKey{}
+		err = proto.Unmarshal(data, protoKey)
+		if err != nil {
+			return err
+		}
+		key := AKeyFromProtoKey(protoKey)
+		err = key.applyUpdate(update)
+		if err != nil {
+			return err
+		}
+		data, err = proto.Marshal(ProtoKeyFromAKey(key))
+		if err != nil {
+			return err
+		}
+		counters := counterKeys(urlKey)
+		if update.Ttl != nil {
+			objectCounters, err := objectCounters(ctx, tx, urlKey)
 			if err != nil {
-				logrus.WithError(err).Errorf("unmarshiling in coroutine failed")
-				return
+				return err
 			}
-			if resp {
-				protoAKey.UsedTimes += 1
-				protoData, err = proto.Marshal(protoAKey)
-				if err != nil {
-					logrus.WithError(err).WithField("Url Key", urlKey).Errorf("Error while marshalling")
-					return
+			counters = append(counters, objectCounters...)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			// The ttl of the key only moves with an update of it.
+			pipe.Set(ctx, urlKey, data, redis.KeepTTL)
+			if update.Ttl != nil {
+				for _, name := range counters {
+					pipe.PExpireAt(ctx, name, *key.ttl)
 				}
-				r.client.Set(ctx, urlKey, protoData, time.Now().Sub(protoAKey.Ttl.AsTime()))
 			}
-			if protoAKey.UsedTimes >= protoAKey.Limit && protoAKey.Limited {
-				r.killerChan <- AKeyFromProtoKey(protoAKey)
-			}
-			return
-		}
-	}()
-	return backChan, aKey, nil
+			return nil
+		})
+		ret = key
+		return err
+	}, urlKey)
+	if err != nil {
+		return nil, err
+	}
+	used, err := r.client.Get(ctx, usedKey(urlKey)).Uint64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	ret.usedTimes = &used
+	return ret, nil
 }
 
-func (r *RedisStore) DeleteKey(key *AKey) error {
-	statusCmd := r.client.Del(r.ctx, key.UrlKey)
-	if statusCmd.Err() != nil {
-		return statusCmd.Err()
+// Failure counters can't collide with keys of url keys, those never start with
+// an underscore.
+func failureKey(subject string) string {
+	return "_failures:" + subject
+}
+
+// The window is tracked next to the count as well, so the count follows the
+// clock of the callers like in the other stores. The redis expiration only
+// cleans up.
+var takeAttemptScript = redis.NewScript(`
+local expires = tonumber(redis.call('HGET', KEYS[1], 'expires') or '0')
+if expires <= tonumber(ARGV[1]) then
+	redis.call('DEL', KEYS[1])
+	redis.call('HSET', KEYS[1], 'expires', tonumber(ARGV[1]) + tonumber(ARGV[2]))
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+local failures = redis.call('HINCRBY', KEYS[1], 'failures', 1)
+return {failures, tonumber(redis.call('HGET', KEYS[1], 'last') or '0')}
+`)
+
+// A slot that expired with its count starts a new count with the failure.
+var failAttemptScript = redis.NewScript(`
+local expires = tonumber(redis.call('HGET', KEYS[1], 'expires') or '0')
+if expires <= tonumber(ARGV[1]) then
+	redis.call('DEL', KEYS[1])
+	redis.call('HSET', KEYS[1], 'failures', 1)
+end
+redis.call('HSET', KEYS[1], 'last', ARGV[1], 'expires', tonumber(ARGV[1]) + tonumber(ARGV[2]))
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return tonumber(redis.call('HGET', KEYS[1], 'failures'))
+`)
+
+var releaseAttemptScript = redis.NewScript(`
+local failures = tonumber(redis.call('HGET', KEYS[1], 'failures') or '0')
+if failures > 0 then
+	redis.call('HINCRBY', KEYS[1], 'failures', -1)
+end
+return 0
+`)
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMillis(millis int64) time.Time {
+	if millis == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+func (r *RedisStore) TakeAttempt(ctx context.Context, subject string, now time.Time, window time.Duration) (*FailureRecord, error) {
+	values, err := takeAttemptScript.Run(ctx, r.client, []string{failureKey(subject)}, unixMillis(now), window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	return &FailureRecord{Failures: uint64(values[0]), LastFailure: fromUnixMillis(values[1])}, nil
+}
+
+func (r *RedisStore) FailAttempt(ctx context.Context, subject string, now time.Time, window time.Duration) (*FailureRecord, error) {
+	failures, err := failAttemptScript.Run(ctx, r.client, []string{failureKey(subject)}, unixMillis(now), window.Milliseconds()).Int64()
+	if err != nil {
+		return nil, err
+	}
+	return &FailureRecord{Failures: uint64(failures), LastFailure: now}, nil
+}
+
+func (r *RedisStore) ReleaseAttempt(ctx context.Context, subject string) error {
+	return releaseAttemptScript.Run(ctx, r.client, []string{failureKey(subject)}).Err()
+}
+
+func (r *RedisStore) GetFailures(ctx context.Context, subject string, now time.Time) (*FailureRecord, error) {
+	values, err := r.client.HMGet(ctx, failureKey(subject), "failures", "last", "expires").Result()
+	if err != nil {
+		return nil, err
+	}
+	ret := &FailureRecord{}
+	fields := make([]int64, len(values))
+	for i, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			return ret, nil
+		}
+		fields[i], err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fields[2] <= unixMillis(now) {
+		return ret, nil
 	}
-	return nil
+	ret.Failures = uint64(fields[0])
+	ret.LastFailure = fromUnixMillis(fields[1])
+	return ret, nil
+}
+
+func (r *RedisStore) ResetFailures(ctx context.Context, subject string) error {
+	return r.client.Del(ctx, failureKey(subject)).Err()
+}
+
+// CheckHealth pings the redis server.
+func (r *RedisStore) CheckHealth(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
 }
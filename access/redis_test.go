@@ -3,50 +3,108 @@ package access
 import (
 	ctx "context"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis/v8"
 	"os"
 	"testing"
+	"time"
 )
 
 const RedisTestEnvHost = "REDIS_TEST_HOST"
 const RedisTestEnvPort = "REDIS_TEST_PORT"
-const RedisTestEnvSkip = "REDIS_TEST_SKIP"
 
 var redisHost = os.Getenv(RedisTestEnvHost)
 var redisPort = os.Getenv(RedisTestEnvPort)
 
-func TestAddAndDeleteRedis(t *testing.T) {
-	_, ok := os.LookupEnv(RedisTestEnvSkip)
-	if !ok {
-		t.SkipNow()
+// newTestRedisStore runs against the redis in REDIS_TEST_HOST if it's set and
+// against an in-process fake otherwise. Live databases are flushed first. The
+// returned function moves the clock of the redis forward.
+func newTestRedisStore(t *testing.T, db int) (*RedisStore, func(time.Duration)) {
+	var redisClient *redis.Client
+	advance := time.Sleep
+	if redisHost == "" {
+		server := miniredis.RunT(t)
+		redisClient = redis.NewClient(&redis.Options{
+			Addr: server.Addr(),
+		})
+		advance = server.FastForward
+	} else {
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:     fmt.Sprintf("%v:%v", redisHost, redisPort),
+			Password: "",
+			DB:       db,
+		})
+		err := redisClient.FlushDB(ctx.TODO()).Err()
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
-
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%v:%v", redisHost, redisPort),
-		Password: "",
-		DB:       1,
+	t.Cleanup(func() {
+		_ = redisClient.Close()
 	})
-	db, err := NewRedisStore(ctx.TODO(), redisClient)
+	store, err := NewRedisStore(ctx.TODO(), redisClient)
 	if err != nil {
 		t.Fatal(err)
 	}
+	return store, advance
+}
+
+func TestAddAndDeleteRedis(t *testing.T) {
+	db, _ := newTestRedisStore(t, 1)
 	AddAndDeleteTest(t, db)
 }
 
 func TestAddAndAccessRedis(t *testing.T) {
-	_, ok := os.LookupEnv(RedisTestEnvSkip)
-	if !ok {
-		t.SkipNow()
-	}
-
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%v:%v", redisHost, redisPort),
-		Password: "",
-		DB:       2,
-	})
-	db, err := NewRedisStore(ctx.TODO(), redisClient)
-	if err != nil {
-		t.Fatal(err)
-	}
+	db, _ := newTestRedisStore(t, 2)
 	AddAndAccessTest(t, db)
 }
+
+func TestLimitStressRedis(t *testing.T) {
+	db, _ := newTestRedisStore(t, 3)
+	LimitStressTest(t, db)
+}
+
+func TestManageKeysRedis(t *testing.T) {
+	db, _ := newTestRedisStore(t, 4)
+	ManageKeysTest(t, db)
+}
+
+func TestUploadKeyRedis(t *testing.T) {
+	db, _ := newTestRedisStore(t, 5)
+	UploadKeyTest(t, db)
+}
+
+func TestShareKeyRedis(t *testing.T) {
+	db, _ := newTestRedisStore(t, 6)
+	ShareKeyTest(t, db)
+}
+
+func TestUnlockKeyRedis(t *testing.T) {
+	db, _ := newTestRedisStore(t, 7)
+	UnlockKeyTest(t, db)
+}
+
+func TestFailureStoreRedis(t *testing.T) {
+	db, _ := newTestRedisStore(t, 8)
+	FailureStoreTest(t, db)
+}
+
+func TestActivationRedis(t *testing.T) {
+	db, _ := newTestRedisStore(t, 9)
+	ActivationTest(t, db)
+}
+
+func TestIpRestrictionRedis(t *testing.T) {
+	db, _ := newTestRedisStore(t, 10)
+	IpRestrictionTest(t, db)
+}
+
+func TestExpiryRedis(t *testing.T) {
+	db, advance := newTestRedisStore(t, 11)
+	ExpiryTest(t, db, advance)
+}
+
+func TestReservationLeaseRedis(t *testing.T) {
+	db, _ := newTestRedisStore(t, 12)
+	ReservationLeaseTest(t, db)
+}
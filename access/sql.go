@@ -3,9 +3,13 @@ package access
 import (
 	"context"
 	"crypto/sha512"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"log"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,6 +19,9 @@ type SQLStore struct {
 	db         *gorm.DB
 	killer     chan<- *AKey
 	timeKiller chan<- *AKey
+	done       chan struct{}
+	closeOnce  sync.Once
+	swept      time.Time
 }
 
 type DBAKey struct {
@@ -24,18 +31,53 @@ type DBAKey struct {
 	Limited         bool
 	Limit           uint64
 	UsedTimes       uint64
+	ReservedTimes   uint64
 	BucketId        string
 	KeyId           string
 	UrlKey          string
 	NeedsKey        bool
-	ValidKeysID     uint
-	ValidKeys       ValidKeys
+	ValidKeys       []byte
+	UnlockSalt      []byte
+	NotBefore       *time.Time
+	Windows         string
 	ResolveByUrlKey bool
+	CreatedBy       string `gorm:"index"`
+	Kind            KeyKind
+	Prefix          bool
+	MaxSize         int64
+	ContentTypes    string
+	PerObjectLimit  bool
+	AllowedCidrs    string
+	DeniedCidrs     string
 }
 
-type ValidKeys struct {
-	gorm.Model
-	keys [][sha512.Size]byte
+// DBObjectUse counts the uses of a single object for keys with per object
+// limits.
+type DBObjectUse struct {
+	ID            uint
+	UrlKey        string `gorm:"uniqueIndex:idx_object_use"`
+	KeyId         string `gorm:"uniqueIndex:idx_object_use"`
+	UsedTimes     uint64
+	ReservedTimes uint64
+}
+
+// DBReservation is an open reservation counted in ReservedTimes, it gives its
+// use back once it expires.
+type DBReservation struct {
+	ID          uint
+	Reservation string `gorm:"uniqueIndex"`
+	UrlKey      string `gorm:"index"`
+	KeyId       string
+	Expires     time.Time
+}
+
+// DBFailure counts failed unlock attempts of a link or a client ip.
+type DBFailure struct {
+	ID          uint
+	Subject     string `gorm:"uniqueIndex"`
+	Failures    uint64
+	LastFailure time.Time
+	Expires     time.Time
 }
 
 func DBAKeyFromAKey(key *AKey) *DBAKey {
@@ -50,16 +92,29 @@ func DBAKeyFromAKey(key *AKey) *DBAKey {
 	ret.UrlKey = key.UrlKey
 	ret.NeedsKey = key.NeedsKey
 
-	keys := make([][sha512.Size]byte, 0)
+	// The valid keys are stored back to back in a single column.
+	keys := make([]byte, 0)
 	if ret.NeedsKey {
 		for array := range key.validKeys.set {
-			keys = append(keys, array)
+			keys = append(keys, array[:]...)
 		}
 	}
-
-	ret.ValidKeys = ValidKeys{keys: keys}
-	ret.ValidKeysID = ret.ValidKeys.ID
+	ret.ValidKeys = keys
+	ret.UnlockSalt = key.unlockSalt
+	ret.NotBefore = key.notBefore
+	if len(key.windows) != 0 {
+		windows, _ := json.Marshal(key.windows)
+		ret.Windows = string(windows)
+	}
 	ret.ResolveByUrlKey = key.ResolveByUrlKey
+	ret.CreatedBy = key.CreatedBy
+	ret.Kind = key.Kind
+	ret.Prefix = key.Prefix
+	ret.MaxSize = key.MaxSize
+	ret.ContentTypes = strings.Join(key.ContentTypes, ",")
+	ret.PerObjectLimit = key.PerObjectLimit
+	ret.AllowedCidrs = strings.Join(key.AllowedCidrs, ",")
+	ret.DeniedCidrs = strings.Join(key.DeniedCidrs, ",")
 	return ret
 }
 
@@ -70,17 +125,46 @@ func AKeyFromDBAKey(dbaKey *DBAKey) *AKey {
 	ret.limited = dbaKey.Limited
 	ret.limit = dbaKey.Limit
 	ret.usedTimes = &dbaKey.UsedTimes
+	ret.reservedTimes = dbaKey.ReservedTimes
 	ret.BucketId = dbaKey.BucketId
 	ret.KeyId = dbaKey.KeyId
 	ret.UrlKey = dbaKey.UrlKey
 	ret.NeedsKey = dbaKey.NeedsKey
 
-	keys := new(HashSet)
-	for _, key := range dbaKey.ValidKeys.keys {
+	keys := newHashSet()
+	for i := 0; i+sha512.Size <= len(dbaKey.ValidKeys); i += sha512.Size {
+		key := byteArray{}
+		copy(key[:], dbaKey.ValidKeys[i:i+sha512.Size])
 		keys.Insert(key)
 	}
 	ret.validKeys = keys
+	ret.unlockSalt = dbaKey.UnlockSalt
+	ret.notBefore = dbaKey.NotBefore
+	// Rows written before windows existed keep an empty column.
+	if dbaKey.Windows != "" {
+		err := json.Unmarshal([]byte(dbaKey.Windows), &ret.windows)
+		if err != nil {
+			// An empty window contains nothing, so the key stays unusable
+			// instead of losing its restriction.
+			log.Println(err)
+			ret.windows = []TimeWindow{{}}
+		}
+	}
 	ret.ResolveByUrlKey = dbaKey.ResolveByUrlKey
+	ret.CreatedBy = dbaKey.CreatedBy
+	ret.Kind = dbaKey.Kind
+	ret.Prefix = dbaKey.Prefix
+	ret.MaxSize = dbaKey.MaxSize
+	if dbaKey.ContentTypes != "" {
+		ret.ContentTypes = strings.Split(dbaKey.ContentTypes, ",")
+	}
+	ret.PerObjectLimit = dbaKey.PerObjectLimit
+	if dbaKey.AllowedCidrs != "" {
+		ret.AllowedCidrs = strings.Split(dbaKey.AllowedCidrs, ",")
+	}
+	if dbaKey.DeniedCidrs != "" {
+		ret.DeniedCidrs = strings.Split(dbaKey.DeniedCidrs, ",")
+	}
 	return ret
 }
 
@@ -89,23 +173,26 @@ func NewSQLStore(genericDb gorm.Dialector) (*SQLStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = db.AutoMigrate(&DBAKey{})
+	err = db.AutoMigrate(&DBAKey{}, &DBObjectUse{}, &DBReservation{}, &DBFailure{})
 	if err != nil {
 		return nil, err
 	}
 
 	killerChan := make(chan *AKey)
+	done := make(chan struct{})
 	ret := new(SQLStore)
 	ret.db = db
 	ret.killer = killerChan
+	ret.done = done
 
 	go func() {
 		for {
-			k := <-killerChan
-			if k == nil {
+			select {
+			case k := <-killerChan:
+				_ = ret.deleteExpired(k)
+			case <-done:
 				return
 			}
-			_ = ret.DeleteKey(k)
 		}
 	}()
 
@@ -114,15 +201,17 @@ func NewSQLStore(genericDb gorm.Dialector) (*SQLStore, error) {
 
 	go func() {
 		for {
-			k := <-timeKiller
-			if k == nil {
+			var k *AKey
+			select {
+			case k = <-timeKiller:
+			case <-done:
 				return
 			}
 			duration := time.Until(*k.ttl)
 			go func() {
-				timer := time.NewTimer(duration)
-				_ = <-timer.C
-				killerChan <- k
+				if waitUntilExpired(duration, done) {
+					sendUnlessDone(killerChan, k, done)
+				}
 			}()
 		}
 	}()
@@ -130,6 +219,20 @@ func NewSQLStore(genericDb gorm.Dialector) (*SQLStore, error) {
 	return ret, nil
 }
 
+// Close stops removing expired keys and closes the database.
+func (s *SQLStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		var db *sql.DB
+		db, err = s.db.DB()
+		if err == nil {
+			err = db.Close()
+		}
+	})
+	return err
+}
+
 func (s *SQLStore) AddKey(key *AKey) error {
 	s.m.Lock()
 	defer func() {
@@ -149,44 +252,178 @@ func (s *SQLStore) AddKey(key *AKey) error {
 		return result.Error
 	}
 	if key.expires {
-		s.timeKiller <- key
+		sendUnlessDone(s.timeKiller, key, s.done)
 	}
 	return nil
 }
 
-func (s *SQLStore) Access(ctx context.Context, urlKey string) (chan<- bool, *AKey, error) {
+// unreserve gives back the use held by a reservation of object.
+func unreserve(db *gorm.DB, key *AKey, object string) error {
+	if key.limitedPerObject() {
+		return db.Model(&DBObjectUse{}).
+			Where("url_key = ? AND key_id = ? AND reserved_times > 0", key.UrlKey, object).
+			UpdateColumn("reserved_times", gorm.Expr("reserved_times - ?", 1)).Error
+	}
+	return db.Model(&DBAKey{}).
+		Where("url_key = ? AND reserved_times > 0", key.UrlKey).
+		UpdateColumn("reserved_times", gorm.Expr("reserved_times - ?", 1)).Error
+}
+
+// endReservation reports whether the reservation was still open. Only the
+// store that deletes the row gives its use back, even if several race.
+func endReservation(db *gorm.DB, reservation string) (bool, error) {
+	result := db.Where("reservation = ?", reservation).Delete(&DBReservation{})
+	return result.RowsAffected != 0, result.Error
+}
+
+// expireReservations releases the reservations of key whose lease passed.
+func expireReservations(db *gorm.DB, key *AKey, now time.Time) error {
+	expired := make([]DBReservation, 0)
+	err := db.Where("url_key = ? AND expires <= ?", key.UrlKey, now).Find(&expired).Error
+	if err != nil {
+		return err
+	}
+	for _, reservation := range expired {
+		ended, err := endReservation(db, reservation.Reservation)
+		if err != nil {
+			return err
+		}
+		if ended {
+			err = unreserve(db, key, reservation.KeyId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reserve only touches the row if a use is still available, the check and the
+// increment happen in the same UPDATE statement.
+func (s *SQLStore) Reserve(ctx context.Context, urlKey, object string) (*AKey, error) {
 	s.m.Lock()
 	defer func() {
 		s.m.Unlock()
 	}()
+	db := s.db.WithContext(ctx)
 	var dbaKey DBAKey
-	result := s.db.First(&dbaKey, "url_key = ?", urlKey)
+	found := s.liveKeys(ctx).Limit(1).Find(&dbaKey, "url_key = ?", urlKey)
+	if found.Error != nil {
+		return nil, found.Error
+	}
+	if found.RowsAffected == 0 {
+		return nil, KeyDoesntExist(urlKey)
+	}
+	key := AKeyFromDBAKey(&dbaKey)
+	object, err := key.reserveObject(object)
+	if err != nil {
+		return nil, err
+	}
+	reservation, err := newReservation()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err = expireReservations(db, key, now)
+	if err != nil {
+		return nil, err
+	}
+	var result *gorm.DB
+	if key.limitedPerObject() {
+		use := DBObjectUse{UrlKey: urlKey, KeyId: object}
+		err = db.Where(&use).FirstOrCreate(&use).Error
+		if err != nil {
+			return nil, err
+		}
+		result = db.Model(&DBObjectUse{}).
+			Where("id = ? AND used_times + reserved_times < ?", use.ID, key.limit).
+			UpdateColumn("reserved_times", gorm.Expr("reserved_times + ?", 1))
+	} else {
+		result = db.Model(&DBAKey{}).
+			Where("id = ?", dbaKey.ID).
+			Where("limited = ? OR used_times + reserved_times < ?", false, clause.Column{Name: "limit"}).
+			UpdateColumn("reserved_times", gorm.Expr("reserved_times + ?", 1))
+	}
+	if result.Error != nil {
+		return nil, result.Error
+	}
 	if result.RowsAffected == 0 {
-		return nil, nil, KeyDoesntExist(urlKey)
+		return nil, KeyExhausted(urlKey)
 	}
-	id := dbaKey.ID
-	backChan := make(chan bool)
-	go func() {
-		select {
-		case <-ctx.Done():
-			return
-		case resp := <-backChan:
-			s.m.Lock()
-			defer func() {
-				s.m.Unlock()
-			}()
-			var dbKey DBAKey
-			s.db.First(&dbKey, id)
-			if resp {
-				s.db.Model(&DBAKey{}).Where("url_key = ?", urlKey).Update("used_times", dbKey.UsedTimes+1)
-			}
-			if dbKey.UsedTimes >= dbKey.Limit && dbKey.Limited {
-				s.killer <- AKeyFromDBAKey(&dbKey)
-			}
-			return
+	err = db.Create(&DBReservation{
+		Reservation: reservation,
+		UrlKey:      urlKey,
+		KeyId:       object,
+		Expires:     now.Add(reservationLease),
+	}).Error
+	if err != nil {
+		_ = unreserve(db, key, object)
+		return nil, err
+	}
+	key.object = object
+	key.reservation = reservation
+	return key, nil
+}
+
+// Commit counts the use even if the lease passed, the reservation was only
+// given back then.
+func (s *SQLStore) Commit(ctx context.Context, key *AKey) error {
+	s.m.Lock()
+	defer func() {
+		s.m.Unlock()
+	}()
+	db := s.db.WithContext(ctx)
+	ended, err := endReservation(db, key.reservation)
+	if err != nil {
+		return err
+	}
+	if ended {
+		err = unreserve(db, key, key.object)
+		if err != nil {
+			return err
 		}
+	}
+	if key.limitedPerObject() {
+		result := db.Model(&DBObjectUse{}).
+			Where("url_key = ? AND key_id = ?", key.UrlKey, key.object).
+			UpdateColumn("used_times", gorm.Expr("used_times + ?", 1))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return KeyDoesntExist(key.UrlKey)
+		}
+		return db.Model(&DBAKey{}).Where("url_key = ?", key.UrlKey).
+			UpdateColumn("used_times", gorm.Expr("used_times + ?", 1)).Error
+	}
+	result := db.Model(&DBAKey{}).
+		Where("url_key = ?", key.UrlKey).
+		UpdateColumn("used_times", gorm.Expr("used_times + ?", 1))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return KeyDoesntExist(key.UrlKey)
+	}
+	result = db.Where("url_key = ? AND limited = ? AND used_times >= ?", key.UrlKey, true, clause.Column{Name: "limit"}).
+		Delete(&DBAKey{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	return db.Where("url_key = ?", key.UrlKey).Delete(&DBReservation{}).Error
+}
+
+func (s *SQLStore) Release(ctx context.Context, key *AKey) error {
+	s.m.Lock()
+	defer func() {
+		s.m.Unlock()
 	}()
-	return backChan, AKeyFromDBAKey(&dbaKey), nil
+	db := s.db.WithContext(ctx)
+	ended, err := endReservation(db, key.reservation)
+	if err != nil || !ended {
+		return err
+	}
+	return unreserve(db, key, key.object)
 }
 
 func (s *SQLStore) DeleteKey(key *AKey) error {
@@ -199,5 +436,196 @@ func (s *SQLStore) DeleteKey(key *AKey) error {
 	if result.Error != nil {
 		return result.Error
 	}
-	return nil
+	err := s.db.Where("url_key = ?", key.UrlKey).Delete(&DBReservation{}).Error
+	if err != nil {
+		return err
+	}
+	return s.db.Where("url_key = ?", key.UrlKey).Delete(&DBObjectUse{}).Error
+}
+
+// deleteExpired leaves keys alone whose ttl was extended after the timer for
+// the old ttl was started.
+func (s *SQLStore) deleteExpired(key *AKey) error {
+	s.m.Lock()
+	defer func() {
+		s.m.Unlock()
+	}()
+	result := s.db.Where("url_key = ? AND expires = ? AND ttl <= ?", key.UrlKey, true, time.Now()).
+		Delete(&DBAKey{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	err := s.db.Where("url_key = ?", key.UrlKey).Delete(&DBReservation{}).Error
+	if err != nil {
+		return err
+	}
+	return s.db.Where("url_key = ?", key.UrlKey).Delete(&DBObjectUse{}).Error
+}
+
+func (s *SQLStore) liveKeys(ctx context.Context) *gorm.DB {
+	return s.db.WithContext(ctx).Where("expires = ? OR ttl > ?", false, time.Now())
+}
+
+func (s *SQLStore) GetKey(ctx context.Context, urlKey string) (*AKey, error) {
+	s.m.Lock()
+	defer func() {
+		s.m.Unlock()
+	}()
+	var dbaKey DBAKey
+	result := s.liveKeys(ctx).Limit(1).Find(&dbaKey, "url_key = ?", urlKey)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, KeyDoesntExist(urlKey)
+	}
+	return AKeyFromDBAKey(&dbaKey), nil
+}
+
+func (s *SQLStore) ListKeys(ctx context.Context, filter KeyFilter) ([]*AKey, error) {
+	s.m.Lock()
+	defer func() {
+		s.m.Unlock()
+	}()
+	query := s.liveKeys(ctx)
+	if filter.BucketId != "" {
+		query = query.Where("bucket_id = ?", filter.BucketId)
+	}
+	if filter.KeyId != "" {
+		query = query.Where("key_id = ?", filter.KeyId)
+	}
+	if filter.CreatedBy != "" {
+		query = query.Where("created_by = ?", filter.CreatedBy)
+	}
+	var dbaKeys []DBAKey
+	result := query.Order("url_key").Find(&dbaKeys)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	ret := make([]*AKey, 0, len(dbaKeys))
+	for i := range dbaKeys {
+		ret = append(ret, AKeyFromDBAKey(&dbaKeys[i]))
+	}
+	return ret, nil
+}
+
+func (s *SQLStore) UpdateKey(ctx context.Context, urlKey string, update KeyUpdate) (*AKey, error) {
+	s.m.Lock()
+	defer func() {
+		s.m.Unlock()
+	}()
+	var dbaKey DBAKey
+	result := s.liveKeys(ctx).Limit(1).Find(&dbaKey, "url_key = ?", urlKey)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, KeyDoesntExist(urlKey)
+	}
+	key := AKeyFromDBAKey(&dbaKey)
+	err := key.applyUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+	result = s.db.WithContext(ctx).Model(&DBAKey{}).Where("id = ?", dbaKey.ID).
+		UpdateColumns(map[string]interface{}{
+			"ttl":   key.ttl,
+			"limit": key.limit,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if update.Ttl != nil {
+		sendUnlessDone(s.timeKiller, key, s.done)
+	}
+	return key, nil
+}
+
+// updateFailure applies columns to the failure row of subject, creating it
+// first, and returns the row.
+func (s *SQLStore) updateFailure(ctx context.Context, subject string, columns map[string]interface{}) (*FailureRecord, error) {
+	s.m.Lock()
+	defer func() {
+		s.m.Unlock()
+	}()
+	db := s.db.WithContext(ctx)
+	failure := DBFailure{Subject: subject}
+	err := db.Where(&failure).FirstOrCreate(&failure).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Model(&DBFailure{}).Where("id = ?", failure.ID).UpdateColumns(columns).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.First(&failure, failure.ID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &FailureRecord{Failures: failure.Failures, LastFailure: failure.LastFailure}, nil
+}
+
+// sweepFailures deletes expired failure rows every FailureSweepInterval, so
+// guesses from many addresses don't pile up in the table.
+func (s *SQLStore) sweepFailures(ctx context.Context, now time.Time) {
+	s.m.Lock()
+	if now.Sub(s.swept) < FailureSweepInterval {
+		s.m.Unlock()
+		return
+	}
+	s.swept = now
+	s.m.Unlock()
+	err := s.db.WithContext(ctx).Where("expires <= ?", now).Delete(&DBFailure{}).Error
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// TakeAttempt starts the count over inside the same UPDATE if the previous
+// window already passed.
+func (s *SQLStore) TakeAttempt(ctx context.Context, subject string, now time.Time, window time.Duration) (*FailureRecord, error) {
+	s.sweepFailures(ctx, now)
+	return s.updateFailure(ctx, subject, map[string]interface{}{
+		"failures":     gorm.Expr("CASE WHEN expires <= ? THEN 1 ELSE failures + 1 END", now),
+		"last_failure": gorm.Expr("CASE WHEN expires <= ? THEN ? ELSE last_failure END", now, time.Time{}),
+		"expires":      gorm.Expr("CASE WHEN expires <= ? THEN ? ELSE expires END", now, now.Add(window)),
+	})
+}
+
+func (s *SQLStore) FailAttempt(ctx context.Context, subject string, now time.Time, window time.Duration) (*FailureRecord, error) {
+	return s.updateFailure(ctx, subject, map[string]interface{}{
+		"failures":     gorm.Expr("CASE WHEN expires <= ? THEN 1 ELSE failures END", now),
+		"last_failure": now,
+		"expires":      now.Add(window),
+	})
+}
+
+func (s *SQLStore) ReleaseAttempt(ctx context.Context, subject string) error {
+	return s.db.WithContext(ctx).Model(&DBFailure{}).Where("subject = ? AND failures > 0", subject).
+		UpdateColumn("failures", gorm.Expr("failures - 1")).Error
+}
+
+func (s *SQLStore) GetFailures(ctx context.Context, subject string, now time.Time) (*FailureRecord, error) {
+	var failure DBFailure
+	result := s.db.WithContext(ctx).Limit(1).Find(&failure, "subject = ? AND expires > ?", subject, now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return &FailureRecord{}, nil
+	}
+	return &FailureRecord{Failures: failure.Failures, LastFailure: failure.LastFailure}, nil
+}
+
+func (s *SQLStore) ResetFailures(ctx context.Context, subject string) error {
+	return s.db.WithContext(ctx).Where("subject = ?", subject).Delete(&DBFailure{}).Error
+}
+
+// CheckHealth pings the database.
+func (s *SQLStore) CheckHealth(ctx context.Context) error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
 }
@@ -1,8 +1,11 @@
 package access
 
 import (
+	"context"
+	"fmt"
 	"gorm.io/driver/sqlite"
 	"testing"
+	"time"
 )
 
 func TestAddAndDeleteSQL(t *testing.T) {
@@ -24,3 +27,131 @@ func TestAddAndAccessSQL(t *testing.T) {
 	}
 	AddAndAccessTest(t, db)
 }
+
+func TestLimitStressSQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	LimitStressTest(t, db)
+}
+
+func TestManageKeysSQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ManageKeysTest(t, db)
+}
+
+func TestUploadKeySQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UploadKeyTest(t, db)
+}
+
+func TestShareKeySQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ShareKeyTest(t, db)
+}
+
+func TestUnlockKeySQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UnlockKeyTest(t, db)
+}
+
+func TestFailureStoreSQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	FailureStoreTest(t, db)
+}
+
+func TestFailureSweepSQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		_, err := db.TakeAttempt(context.TODO(), fmt.Sprintf("ip:192.0.2.%v", i), now, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.TakeAttempt(context.TODO(), "ip:198.51.100.1", now.Add(FailureSweepInterval+time.Minute), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows int64
+	err = db.db.Model(&DBFailure{}).Where("subject LIKE ?", "ip:192.0.2.%").Count(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Errorf("Sweep kept %v failure rows", rows)
+	}
+}
+
+func TestActivationSQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ActivationTest(t, db)
+}
+
+func TestIpRestrictionSQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	IpRestrictionTest(t, db)
+}
+
+func TestExpirySQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpiryTest(t, db, time.Sleep)
+}
+
+func TestReservationLeaseSQL(t *testing.T) {
+
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ReservationLeaseTest(t, db)
+}
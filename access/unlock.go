@@ -0,0 +1,45 @@
+package access
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"golang.org/x/crypto/argon2"
+)
+
+const UnlockSaltLength = 32
+const MaxUnlockSecretLength = 1024
+
+const unlockArgonTime = 1
+const unlockArgonMemory = 64 * 1024
+const unlockArgonThreads = 4
+
+var UnlockSecretHasWrongLength = errors.New("unlock secret is empty or too long")
+
+func newUnlockSalt() ([]byte, error) {
+	salt := make([]byte, UnlockSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// deriveUnlockKey hashes a share link secret with the salt of its link, only
+// the result is ever stored.
+func deriveUnlockKey(secret, salt []byte) byteArray {
+	ret := byteArray{}
+	copy(ret[:], argon2.IDKey(secret, salt, unlockArgonTime, unlockArgonMemory, unlockArgonThreads, sha512.Size))
+	return ret
+}
+
+// containsConstantTime compares against every entry of the set, so the time
+// taken doesn't tell which or how many entries matched.
+func (m *HashSet) containsConstantTime(obj byteArray) bool {
+	found := 0
+	for entry := range m.set {
+		found |= subtle.ConstantTimeCompare(entry[:], obj[:])
+	}
+	return found == 1
+}
@@ -0,0 +1,108 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const windowClockLayout = "15:04"
+
+// TimeWindow is a recurring span of the day during which a key can be used.
+// An End before Start spans midnight, the part after midnight belongs to the
+// day the window started on. Without days the window applies every day.
+type TimeWindow struct {
+	Days     []time.Weekday `json:"Days,omitempty"`
+	Start    string         `json:"Start"`
+	End      string         `json:"End"`
+	Timezone string         `json:"Timezone,omitempty"`
+}
+
+// KeyInactive is returned for keys used before their not-before time or
+// outside their windows. It deliberately doesn't tell when the key is usable.
+var KeyInactive = errors.New("the key can't be used at this time")
+
+func parseClock(clock string) (int, error) {
+	parsed, err := time.Parse(windowClockLayout, clock)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("%v isn't a time of day like 09:30", clock))
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func (w TimeWindow) Validate() error {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return errors.New("time windows must not start and end at the same time")
+	}
+	for _, day := range w.Days {
+		if day < time.Sunday || day > time.Saturday {
+			return errors.New(fmt.Sprintf("%v isn't a weekday", int(day)))
+		}
+	}
+	_, err = time.LoadLocation(w.Timezone)
+	return err
+}
+
+func (w TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, allowed := range w.Days {
+		if allowed == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains reports whether now falls into the window, windows that don't
+// validate contain nothing.
+func (w TimeWindow) Contains(now time.Time) bool {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return false
+	}
+	location, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return false
+	}
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	if start < end {
+		return w.onDay(day) && minute >= start && minute < end
+	}
+	if minute >= start {
+		return w.onDay(day)
+	}
+	return minute < end && w.onDay((day+6)%7)
+}
+
+// Active reports whether the key may be used at now, independent of its ttl
+// and limit.
+func (a *AKey) Active(now time.Time) bool {
+	if a.notBefore != nil && now.Before(*a.notBefore) {
+		return false
+	}
+	if len(a.windows) == 0 {
+		return true
+	}
+	for _, window := range a.windows {
+		if window.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package access
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	businessHours := TimeWindow{
+		Days:     []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Start:    "09:00",
+		End:      "17:00",
+		Timezone: "Europe/Berlin",
+	}
+	nightShift := TimeWindow{
+		Days:  []time.Weekday{time.Friday},
+		Start: "22:00",
+		End:   "02:00",
+	}
+	cases := []struct {
+		window   TimeWindow
+		at       time.Time
+		contains bool
+	}{
+		{businessHours, time.Date(2023, 11, 13, 9, 0, 0, 0, berlin), true},
+		{businessHours, time.Date(2023, 11, 13, 16, 59, 0, 0, berlin), true},
+		{businessHours, time.Date(2023, 11, 13, 17, 0, 0, 0, berlin), false},
+		{businessHours, time.Date(2023, 11, 13, 8, 30, 0, 0, time.UTC), true},
+		{businessHours, time.Date(2023, 11, 18, 12, 0, 0, 0, berlin), false},
+		{nightShift, time.Date(2023, 11, 17, 23, 0, 0, 0, time.UTC), true},
+		{nightShift, time.Date(2023, 11, 18, 1, 59, 0, 0, time.UTC), true},
+		{nightShift, time.Date(2023, 11, 18, 2, 0, 0, 0, time.UTC), false},
+		{nightShift, time.Date(2023, 11, 17, 1, 0, 0, 0, time.UTC), false},
+	}
+	for _, c := range cases {
+		if c.window.Contains(c.at) != c.contains {
+			t.Errorf("Window %v-%v contains %v: %v", c.window.Start, c.window.End, c.at, !c.contains)
+		}
+	}
+}
+
+func TestTimeWindowValidate(t *testing.T) {
+	invalid := []TimeWindow{
+		{Start: "9", End: "17:00"},
+		{Start: "09:00", End: "09:00"},
+		{Start: "09:00", End: "17:00", Timezone: "Mars/Olympus"},
+		{Start: "09:00", End: "17:00", Days: []time.Weekday{7}},
+	}
+	for _, window := range invalid {
+		if window.Validate() == nil {
+			t.Errorf("Window %v validated", window)
+		}
+	}
+}
+
+func TestActivationDecodesOldKeys(t *testing.T) {
+	key := AKeyFromProtoKey(&ProtoAKey{BucketId: "Bucket", KeyId: "key", UrlKey: "old-key"})
+	if !key.Active(time.Now()) {
+		t.Error("Key without activation fields is inactive")
+	}
+	key = AKeyFromDBAKey(&DBAKey{BucketId: "Bucket", KeyId: "key", UrlKey: "old-key"})
+	if !key.Active(time.Now()) {
+		t.Error("Row without activation fields is inactive")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// ErrorCode is the machine readable part of an error response. Codes are part
+// of the API, they don't change once released.
+type ErrorCode string
+
+const (
+	CodeInvalidRequest   ErrorCode = "invalid_request"
+	CodeInvalidBucketId  ErrorCode = "invalid_bucket_id"
+	CodeInvalidKeyId     ErrorCode = "invalid_key_id"
+	CodeInvalidUrlKey    ErrorCode = "invalid_url_key"
+	CodeUnauthenticated  ErrorCode = "unauthenticated"
+	CodeForbidden        ErrorCode = "forbidden"
+	CodeBucketNotFound   ErrorCode = "bucket_not_found"
+	CodeObjectNotFound   ErrorCode = "object_not_found"
+	CodeKeyNotFound      ErrorCode = "key_not_found"
+	CodeUserNotFound     ErrorCode = "user_not_found"
+	CodeBucketExists     ErrorCode = "bucket_exists"
+	CodeKeyExists        ErrorCode = "key_exists"
+	CodeObjectExists     ErrorCode = "object_exists"
+	CodeLengthRequired   ErrorCode = "length_required"
+	CodeInternal         ErrorCode = "internal"
+	CodeInvalidUpdate    ErrorCode = "invalid_update"
+	CodeInvalidAccessKey ErrorCode = "invalid_access_key"
+)
+
+// ApiError is returned by the service layer, it carries everything a
+// transport needs to answer with.
+type ApiError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+	err     error
+}
+
+func (e *ApiError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%v: %v", e.Message, e.err)
+	}
+	return e.Message
+}
+
+func (e *ApiError) Unwrap() error {
+	return e.err
+}
+
+func newApiError(status int, code ErrorCode, message string) *ApiError {
+	return &ApiError{Status: status, Code: code, Message: message}
+}
+
+// wrapApiError keeps err for logs, only message is shown to clients.
+func wrapApiError(status int, code ErrorCode, message string, err error) *ApiError {
+	return &ApiError{Status: status, Code: code, Message: message, err: err}
+}
+
+func forbiddenError() *ApiError {
+	return newApiError(http.StatusForbidden, CodeForbidden, AccessForbiddenError().Error())
+}
+
+func internalError(err error) *ApiError {
+	return wrapApiError(http.StatusInternalServerError, CodeInternal, "internal error", err)
+}
+
+// asApiError turns any error into an ApiError, unknown errors are internal.
+func asApiError(err error) *ApiError {
+	apiErr := &ApiError{}
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return internalError(err)
+}
+
+// isApiError reports whether err carries the given code.
+func isApiError(err error, code ErrorCode) bool {
+	apiErr := &ApiError{}
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+type ErrorBody struct {
+	Code    ErrorCode `json:"Code"`
+	Message string    `json:"Message"`
+}
+
+type ErrorEnvelope struct {
+	Error ErrorBody `json:"Error"`
+}
+
+// abortWithApiError answers with the error envelope and records the full error
+// on the context for the logs.
+func abortWithApiError(c *gin.Context, err error) {
+	apiErr := asApiError(err)
+	_ = c.Error(err)
+	if apiErr.Status >= http.StatusInternalServerError {
+		logrus.WithError(err).WithField("Path", c.FullPath()).Errorf("Request failed.")
+	}
+	c.AbortWithStatusJSON(apiErr.Status, ErrorEnvelope{
+		Error: ErrorBody{Code: apiErr.Code, Message: apiErr.Message},
+	})
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"secure-store/access"
+	"secure-store/users"
+	"strings"
+	"time"
+)
+
+const AuthorizationHeader = "Authorization"
+const BearerPrefix = "Bearer "
+const TokenType = "Bearer"
+
+const UserContextKey = "secure-store/user"
+const SessionContextKey = "secure-store/session"
+const PermissionsContextKey = "secure-store/permissions"
+
+var InvalidCredentials = errors.New("invalid credentials")
+var UnknownClientCertificate = errors.New("client certificate isn't mapped to a user")
+
+type Authenticator struct {
+	users    users.UserStorage
+	sessions users.SessionStore
+	tokens   *users.TokenSigner
+	totp     *users.TotpManager
+	// lockout limits the guesses at second factors, nil doesn't limit them.
+	lockout *access.Lockout
+	// clientUsers maps client certificate identities to usernames.
+	clientUsers map[string]string
+}
+
+func NewAuthenticator(u users.UserStorage, sessions users.SessionStore, tokens *users.TokenSigner, totp *users.TotpManager, lockout *access.Lockout) *Authenticator {
+	ret := new(Authenticator)
+	ret.users = u
+	ret.sessions = sessions
+	ret.tokens = tokens
+	ret.totp = totp
+	ret.lockout = lockout
+	return ret
+}
+
+func (a *Authenticator) AuthenticateApiKey(apiKey []byte) (*users.User, error) {
+	user, err := a.users.ResolveByApiKey(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	if !user.VerifyApiKey(apiKey) {
+		return nil, InvalidCredentials
+	}
+	return user, nil
+}
+
+// MapClientCertificates lets callers with a verified client certificate in
+// as the user its subject or a subject alternative name maps to.
+func (a *Authenticator) MapClientCertificates(identities map[string]string) {
+	a.clientUsers = identities
+}
+
+// AuthenticateCertificate resolves the user of the verified client
+// certificate of the connection.
+func (a *Authenticator) AuthenticateCertificate(state *tls.ConnectionState) (*users.User, error) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(a.clientUsers) == 0 {
+		return nil, InvalidCredentials
+	}
+	for _, identity := range certificateIdentities(state.VerifiedChains[0][0]) {
+		username, ok := a.clientUsers[identity]
+		if ok {
+			return a.users.ResolveByUsername(username)
+		}
+	}
+	return nil, UnknownClientCertificate
+}
+
+func (a *Authenticator) AuthenticateToken(token string) (*users.User, *users.Session, error) {
+	claims, err := a.tokens.Verify(token, users.AccessTokenKind)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := a.sessions.ResolveSession(claims.SessionId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !session.Valid() {
+		return nil, nil, users.SessionIsRevoked
+	}
+	user, err := a.users.ResolveByUuid(session.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, session, nil
+}
+
+func (a *Authenticator) authenticateRequest(c *gin.Context) (*users.User, *users.Session, error) {
+	header := c.GetHeader(AuthorizationHeader)
+	if strings.HasPrefix(header, BearerPrefix) {
+		return a.AuthenticateToken(strings.TrimPrefix(header, BearerPrefix))
+	}
+	apiKey := c.Query(ApiKeyQuery)
+	if apiKey == "" {
+		user, err := a.AuthenticateCertificate(c.Request.TLS)
+		return user, nil, err
+	}
+	apiKeyBytes, err := base64.RawURLEncoding.DecodeString(apiKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := a.AuthenticateApiKey(apiKeyBytes)
+	return user, nil, err
+}
+
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	return a.middleware(func(c *gin.Context, status int, err error) {
+		_ = c.AbortWithError(status, err)
+	})
+}
+
+// ApiMiddleware authenticates like Middleware but answers failures with the
+// error envelope of the versioned api.
+func (a *Authenticator) ApiMiddleware() gin.HandlerFunc {
+	return a.middleware(func(c *gin.Context, status int, err error) {
+		if status == http.StatusForbidden {
+			abortWithApiError(c, newApiError(http.StatusUnauthorized, CodeUnauthenticated, InvalidCredentials.Error()))
+			return
+		}
+		abortWithApiError(c, internalError(err))
+	})
+}
+
+func (a *Authenticator) middleware(abort func(c *gin.Context, status int, err error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, session, err := a.authenticateRequest(c)
+		if err != nil {
+			abort(c, http.StatusForbidden, AccessForbiddenError())
+			logrus.WithError(err).WithField("Path", c.FullPath()).Infoln("Rejected unauthenticated request.")
+			return
+		}
+		permissions, err := users.ResolvePermissions(a.users, user)
+		if err != nil {
+			abort(c, http.StatusInternalServerError, err)
+			return
+		}
+		c.Set(UserContextKey, user)
+		c.Set(PermissionsContextKey, permissions)
+		if session != nil {
+			c.Set(SessionContextKey, session)
+		}
+		c.Next()
+	}
+}
+
+func CurrentUser(c *gin.Context) *users.User {
+	return c.MustGet(UserContextKey).(*users.User)
+}
+
+func CurrentPermissions(c *gin.Context) *users.Permissions {
+	return c.MustGet(PermissionsContextKey).(*users.Permissions)
+}
+
+// CurrentPrincipal is the authenticated caller as seen by the service layer.
+func CurrentPrincipal(c *gin.Context) *Principal {
+	return &Principal{User: CurrentUser(c), Permissions: CurrentPermissions(c)}
+}
+
+func CurrentSession(c *gin.Context) *users.Session {
+	session, ok := c.Get(SessionContextKey)
+	if !ok {
+		return nil
+	}
+	return session.(*users.Session)
+}
+
+func (a *Authenticator) issueTokens(session *users.Session) (*users.TokenJson, error) {
+	accessToken, expires, err := a.tokens.NewAccessToken(session)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := a.tokens.NewRefreshToken(session)
+	if err != nil {
+		return nil, err
+	}
+	return &users.TokenJson{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    TokenType,
+		ExpiresAt:    expires,
+	}, nil
+}
+
+// Login exchanges the credentials for tokens. Wrong totp or recovery codes
+// count against the user and ip, blocked logins get how long to wait.
+func (a *Authenticator) Login(ctx context.Context, ip, username, password, code string) (*users.TokenJson, time.Duration, error) {
+	passwordKey := users.DerivePasswordKey(password)
+	user, err := a.users.ResolveByUsername(username)
+	if err != nil {
+		return nil, 0, InvalidCredentials
+	}
+	if !user.VerifyPassword(passwordKey) {
+		return nil, 0, InvalidCredentials
+	}
+	if user.Totp.Enabled {
+		if code == "" {
+			return nil, 0, users.TotpCodeRequired
+		}
+		wait, err := a.verifySecondFactor(ctx, ip, user, code)
+		if err != nil {
+			return nil, wait, err
+		}
+	}
+	session := users.NewSession(user.Id)
+	err = a.sessions.CreateSession(session)
+	if err != nil {
+		return nil, 0, err
+	}
+	tokens, err := a.issueTokens(session)
+	return tokens, 0, err
+}
+
+func (a *Authenticator) verifySecondFactor(ctx context.Context, ip string, user *users.User, code string) (time.Duration, error) {
+	if a.lockout == nil {
+		if a.totp.Verify(user, code) != nil {
+			return 0, InvalidCredentials
+		}
+		return 0, nil
+	}
+	attempt, wait, err := a.lockout.Attempt(ctx, access.UserSubject(user.Username), ip)
+	if err != nil {
+		return wait, err
+	}
+	if a.totp.Verify(user, code) != nil {
+		err = attempt.Fail(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("Counting totp failure failed.")
+		}
+		return 0, InvalidCredentials
+	}
+	err = attempt.Succeed(ctx)
+	if err != nil {
+		logrus.WithError(err).Errorf("Resetting totp failures failed.")
+	}
+	return 0, nil
+}
+
+func (a *Authenticator) Refresh(refreshToken string) (*users.TokenJson, error) {
+	claims, err := a.tokens.Verify(refreshToken, users.RefreshTokenKind)
+	if err != nil {
+		return nil, err
+	}
+	session, err := a.sessions.RotateRefresh(claims.SessionId, claims.RefreshId)
+	if err != nil {
+		return nil, err
+	}
+	_, err = a.users.ResolveByUuid(session.UserId)
+	if err != nil {
+		_ = a.sessions.RevokeSession(session.Id)
+		return nil, err
+	}
+	return a.issueTokens(session)
+}
+
+func (a *Authenticator) Logout(session *users.Session) error {
+	return a.sessions.RevokeSession(session.Id)
+}
+
+func (a *Authenticator) RevokeSessions(userId uuid.UUID) error {
+	return a.sessions.RevokeUserSessions(userId)
+}
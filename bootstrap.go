@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"os"
+	"secure-store/users"
+)
+
+const RootSecretsFileEnv = "ROOT_SECRETS_FILE"
+const RootPasswordLength = 24
+
+const ResetRootCommand = "reset-root"
+
+type RootCredentials struct {
+	ApiKey   string `json:"ApiKey"`
+	Password string `json:"Password"`
+}
+
+func NewRootCredentials() (*RootCredentials, error) {
+	apiKey := make([]byte, users.APIKeyLength)
+	_, err := rand.Read(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	password := make([]byte, RootPasswordLength)
+	_, err = rand.Read(password)
+	if err != nil {
+		return nil, err
+	}
+	return &RootCredentials{
+		ApiKey:   base64.RawURLEncoding.EncodeToString(apiKey),
+		Password: base64.RawURLEncoding.EncodeToString(password),
+	}, nil
+}
+
+func LoadRootCredentials(path string) (*RootCredentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ret := &RootCredentials{}
+	err = json.Unmarshal(data, ret)
+	if err != nil {
+		return nil, err
+	}
+	apiKey, err := base64.RawURLEncoding.DecodeString(ret.ApiKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(apiKey) != users.APIKeyLength {
+		return nil, errors.New("root api key in secrets file has the wrong length")
+	}
+	if ret.Password == "" {
+		return nil, users.PasswordIsEmpty
+	}
+	return ret, nil
+}
+
+// WriteRootCredentials refuses to replace an existing file unless overwrite is
+// set, the credentials are only ever handed out once.
+func WriteRootCredentials(path string, credentials *RootCredentials, overwrite bool) error {
+	data, err := json.MarshalIndent(credentials, "", "  ")
+	if err != nil {
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return err
+	}
+	err = file.Chmod(0600)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func RootUserFromCredentials(credentials *RootCredentials) (*users.User, error) {
+	apiKey, err := base64.RawURLEncoding.DecodeString(credentials.ApiKey)
+	if err != nil {
+		return nil, err
+	}
+	user := &users.User{
+		Id:       uuid.MustParse(RootUserId),
+		Name:     RootName,
+		Role:     RootRule,
+		Username: RootUsername,
+		ApiKey:   apiKey,
+	}
+	err = user.SetPassword(users.DerivePasswordKey(credentials.Password))
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// BootstrapRoot makes sure a root user exists. Credentials from the secrets
+// file take precedence, otherwise random ones are generated on the first start
+// with an empty user store.
+func BootstrapRoot(u users.UserStorage, secretsFile string) error {
+	_, err := u.ResolveByUuid(uuid.MustParse(RootUserId))
+	if err == nil {
+		logrus.Infoln("Root user already exists")
+		return nil
+	}
+	var credentials *RootCredentials
+	if secretsFile != "" {
+		credentials, err = LoadRootCredentials(secretsFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if credentials == nil {
+		_, total, err := u.List(0, 1)
+		if err != nil {
+			return err
+		}
+		if total > 0 {
+			logrus.Infoln("User store isn't empty, not creating a root user")
+			return nil
+		}
+		credentials, err = NewRootCredentials()
+		if err != nil {
+			return err
+		}
+		if secretsFile != "" {
+			err = WriteRootCredentials(secretsFile, credentials, false)
+			if err != nil {
+				return err
+			}
+			logrus.WithField("Secrets File", secretsFile).Infoln("Wrote generated root credentials")
+		} else {
+			fmt.Printf("Generated root credentials, they won't be shown again:\n  Username: %v\n  Password: %v\n  Api Key:  %v\n", RootUsername, credentials.Password, credentials.ApiKey)
+		}
+	}
+	rootUser, err := RootUserFromCredentials(credentials)
+	if err != nil {
+		return err
+	}
+	err = u.Create(rootUser)
+	if err != nil {
+		return err
+	}
+	logrus.Infoln("Added root user")
+	return nil
+}
+
+// ResetRoot replaces the credentials in the secrets file while the server is
+// offline, the next start creates the root user from them.
+func ResetRoot(secretsFile string) error {
+	if secretsFile == "" {
+		return errors.New(fmt.Sprintf("%v has to point at the root secrets file", RootSecretsFileEnv))
+	}
+	credentials, err := NewRootCredentials()
+	if err != nil {
+		return err
+	}
+	err = WriteRootCredentials(secretsFile, credentials, true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reset root credentials in %v:\n  Username: %v\n  Password: %v\n  Api Key:  %v\n", secretsFile, RootUsername, credentials.Password, credentials.ApiKey)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"secure-store/users"
+	"testing"
+)
+
+func TestBootstrapRootWritesCredentialsOnce(t *testing.T) {
+	secretsFile := filepath.Join(t.TempDir(), "root.json")
+	first := users.NewMemoryStore()
+	err := BootstrapRoot(first, secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("Secrets file has mode %v", stat.Mode().Perm())
+	}
+	credentials, err := LoadRootCredentials(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := users.NewMemoryStore()
+	err = BootstrapRoot(second, secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadRootCredentials(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reloaded != *credentials {
+		t.Error("Root credentials were recreated on the second start")
+	}
+	root, err := second.ResolveByUuid(uuid.MustParse(RootUserId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey, _ := base64.RawURLEncoding.DecodeString(credentials.ApiKey)
+	if !root.VerifyApiKey(apiKey) {
+		t.Error("Root api key doesn't match the secrets file")
+	}
+	if !root.VerifyPassword(users.DerivePasswordKey(credentials.Password)) {
+		t.Error("Root password doesn't match the secrets file")
+	}
+}
+
+func TestBootstrapRootSkipsNonEmptyStore(t *testing.T) {
+	store := users.NewMemoryStore()
+	err := store.Create(&users.User{Id: uuid.New(), Username: "someone", ApiKey: []byte("key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = BootstrapRoot(store, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.ResolveByUuid(uuid.MustParse(RootUserId))
+	if err == nil {
+		t.Error("Root user was created in a non empty store")
+	}
+}
+
+func TestResetRoot(t *testing.T) {
+	secretsFile := filepath.Join(t.TempDir(), "root.json")
+	err := ResetRoot(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := LoadRootCredentials(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ResetRoot(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadRootCredentials(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *first == *second {
+		t.Error("Reset didn't replace the root credentials")
+	}
+}
@@ -1 +1,2 @@
-protoc -I=. --go_out=. ./access.proto
\ No newline at end of file
+protoc -I=. --go_out=. ./access.proto
+protoc -I=. --go_out=. --go-grpc_out=. ./store.proto
\ No newline at end of file
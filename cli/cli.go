@@ -18,11 +18,24 @@ import (
 	"time"
 )
 
-var RootApiKey = []byte("root-api-key")
+const ApiKeyEnv = "SECURE_STORE_API_KEY"
+
+// RootApiKey reads the api key of the user managing the server.
+func RootApiKey() ([]byte, error) {
+	encoded := os.Getenv(ApiKeyEnv)
+	if encoded == "" {
+		return nil, fmt.Errorf("%v is not set", ApiKeyEnv)
+	}
+	apiKey, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%v is not base64 url encoded: %w", ApiKeyEnv, err)
+	}
+	return apiKey, nil
+}
 
 func main() {
 	c := client.NewClient("http://localhost:8080")
-	items := []string{"Create Bucket", "Read", "Write", "Delete", "DeleteBucket", "Add Key", "Download From Key", "Add User", "Exit"}
+	items := []string{"Create Bucket", "Read", "Write", "Delete", "DeleteBucket", "Add Key", "Download From Key", "Add User", "List Users", "Get User", "Update Role", "Delete User", "Change Password", "Reset Password", "List Keys", "Revoke Key", "Exit"}
 	for {
 		prompt := promptui.Select{
 			Label:             "Select operation",
@@ -42,9 +55,18 @@ func main() {
 			break
 		}
 		bucket := ""
-		if op != 6 && op != 7 {
+		if op < 6 {
 			bucket = AskForBucketId()
 		}
+		// Managing users and keys needs the api key.
+		var rootApiKey []byte
+		if op >= 7 {
+			rootApiKey, err = RootApiKey()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+		}
 		switch op {
 		case 0:
 			err = c.CreateBucket(bucket)
@@ -144,17 +166,16 @@ func main() {
 			key := AskForKeyId()
 			var ttl *time.Time = nil
 			var limit *uint64 = nil
-			validKeys := make([][]byte, 0)
+			passwords := make([]string, 0)
 			urlKey := AskForUrlKey()
 			if AskIfPassword() {
-				password, err := GetPassword()
-				if err == nil {
-					validKeys = append(validKeys, password)
-				}
+				passwords = append(passwords, AskForPlainPassword("Enter passkey"))
 			}
 			apiKey := []byte("api-key-key")
 			apiKeyHash := sha512.Sum512(apiKey)
-			err = c.AddKey(ttl, limit, validKeys, true, bucket, key, urlKey, apiKeyHash[:])
+			// Share passwords travel in the unlockKey header, not in urls
+			// that end up in logs.
+			err = c.AddKeyWithPasswords(ttl, limit, passwords, false, bucket, key, urlKey, apiKeyHash[:])
 			if err != nil {
 				log.Println(err)
 				continue
@@ -164,12 +185,9 @@ func main() {
 			urlKey := AskForUrlKey()
 			validKey := make([]byte, 0)
 			if AskIfPassword() {
-				password, err := GetPassword()
-				if err == nil {
-					validKey = password
-				}
+				validKey = []byte(AskForPlainPassword("Enter passkey"))
 			}
-			data, length, err := c.DownloadFromKey(urlKey, validKey, true)
+			data, length, err := c.DownloadFromKey(urlKey, validKey, false)
 			if err != nil {
 				log.Println(err)
 				continue
@@ -203,7 +221,75 @@ func main() {
 				PasswordHash: password,
 				ApiKey:       apiKeyHash[:],
 			}
-			err = c.AddUser(&userJson, RootApiKey)
+			err = c.AddUser(&userJson, rootApiKey)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+		case 8:
+			list, err := c.ListUsers(0, 0, rootApiKey)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			for _, user := range list.Users {
+				fmt.Printf("%v\t%v\t%v\n", user.Id, user.Username, user.Name)
+			}
+			fmt.Printf("%v users in total\n", list.Total)
+		case 9:
+			user, err := c.GetUser(AskForUsername(), rootApiKey)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fmt.Printf("%+v\n", *user)
+		case 10:
+			username := AskForUsername()
+			role := users.Role{
+				RootUser:       AskForPermission("Root user"),
+				CanCreateUsers: AskForPermission("Can create users"),
+				CanAddKeys:     AskForPermission("Can add keys"),
+				CanUploadData:  AskForPermission("Can upload data"),
+				CanDeleteKeys:  AskForPermission("Can delete keys"),
+			}
+			_, err = c.UpdateRole(username, role, rootApiKey)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+		case 11:
+			err = c.DeleteUser(AskForUsername(), rootApiKey)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+		case 12:
+			oldPassword := AskForPlainPassword("Old password")
+			newPassword := AskForPlainPassword("New password")
+			err = c.ChangePassword(oldPassword, newPassword, rootApiKey)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+		case 13:
+			username := AskForUsername()
+			password := AskForPlainPassword("New password")
+			err = c.ResetPassword(username, password, rootApiKey)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+		case 14:
+			keys, err := c.ListKeys(AskForBucketId(), "", "", rootApiKey)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			for _, key := range keys {
+				fmt.Printf("%v\t%v/%v\tused %v times\n", key.UrlKey, key.BucketId, key.KeyId, key.UsedTimes)
+			}
+		case 15:
+			err = c.RevokeKey(AskForUrlKey(), rootApiKey)
 			if err != nil {
 				log.Println(err)
 				continue
@@ -279,6 +365,24 @@ func AskForUsername() string {
 	return res
 }
 
+func AskForPermission(label string) bool {
+	prompt := promptui.Select{Label: label, Items: []string{"No", "Yes"}}
+	_, out, err := prompt.Run()
+	if err != nil {
+		panic(err)
+	}
+	return out == "Yes"
+}
+
+func AskForPlainPassword(label string) string {
+	prompt := promptui.Prompt{Label: label, Mask: '*'}
+	res, err := prompt.Run()
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
 func DownloadInteraction(data io.Reader, length int64) bool {
 	prompt := promptui.Select{
 		Label: "Select target",
@@ -9,7 +9,9 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"secure-store/access"
+	"secure-store/presign"
 	"secure-store/users"
 	"strings"
 	"time"
@@ -149,6 +151,23 @@ func (s *SecureClient) AddKey(ttl *time.Time, limit *uint64, validKeys [][]byte,
 	return nil
 }
 
+// AddKeyWithPasswords creates a key unlocked by plain passwords, the server
+// derives and stores their salted hashes.
+func (s *SecureClient) AddKeyWithPasswords(ttl *time.Time, limit *uint64, passwords []string, resolveByUrlKey bool, bucketId, keyId, urlKey string, apiKey []byte) error {
+	exKey := access.ExAccessKey{
+		Ttl:             ttl,
+		Limit:           limit,
+		Passwords:       passwords,
+		ResolveByUrlKey: resolveByUrlKey,
+		BucketId:        bucketId,
+		KeyId:           keyId,
+		UrlKey:          urlKey,
+	}
+	return s.doJson(http.MethodPost, "/api/add", apiKey, exKey, nil)
+}
+
+// DownloadFromKey takes either the plain password of the key or, for keys
+// created with AddKey, the digest of it.
 func (s *SecureClient) DownloadFromKey(urlKey string, unlockKey []byte, inUrlKey bool) (io.Reader, int64, error) {
 	complete := ""
 	base64UnlockKey := base64.RawURLEncoding.EncodeToString(unlockKey)
@@ -192,3 +211,173 @@ func (s *SecureClient) AddUser(userJson *users.UserJson, apiKey []byte) error {
 	}
 	return nil
 }
+
+func (s *SecureClient) doJson(method, path string, apiKey []byte, body interface{}, out interface{}) error {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	complete := fmt.Sprintf("%v%v%v%v=%v", s.addr, path, separator, ApiKeyQuery, base64.RawURLEncoding.EncodeToString(apiKey))
+	var requestBody io.Reader
+	if body != nil {
+		jsonBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(jsonBytes)
+	}
+	req, err := http.NewRequest(method, complete, requestBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected server response")
+	}
+	if out == nil {
+		return nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// SecureJSON prefixes arrays with a guard against JSON hijacking.
+	data = bytes.TrimPrefix(data, []byte("while(1);"))
+	return json.Unmarshal(data, out)
+}
+
+func (s *SecureClient) ListUsers(offset, limit int, apiKey []byte) (*users.UserListJson, error) {
+	ret := &users.UserListJson{}
+	path := fmt.Sprintf("/api/users?offset=%v&limit=%v", offset, limit)
+	err := s.doJson(http.MethodGet, path, apiKey, nil, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *SecureClient) GetUser(idOrUsername string, apiKey []byte) (*users.UserSafeJson, error) {
+	ret := &users.UserSafeJson{}
+	err := s.doJson(http.MethodGet, "/api/users/"+url.PathEscape(idOrUsername), apiKey, nil, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *SecureClient) UpdateRole(idOrUsername string, role users.Role, apiKey []byte) (*users.UserSafeJson, error) {
+	ret := &users.UserSafeJson{}
+	err := s.doJson(http.MethodPut, "/api/users/"+url.PathEscape(idOrUsername)+"/role", apiKey, role, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *SecureClient) DeleteUser(idOrUsername string, apiKey []byte) error {
+	return s.doJson(http.MethodDelete, "/api/users/"+url.PathEscape(idOrUsername), apiKey, nil, nil)
+}
+
+func (s *SecureClient) ResetPassword(idOrUsername, password string, apiKey []byte) error {
+	body := users.PasswordResetJson{Password: password}
+	return s.doJson(http.MethodPost, "/api/users/"+url.PathEscape(idOrUsername)+"/password", apiKey, body, nil)
+}
+
+func (s *SecureClient) ChangePassword(oldPassword, newPassword string, apiKey []byte) error {
+	body := users.PasswordChangeJson{OldPassword: oldPassword, NewPassword: newPassword}
+	return s.doJson(http.MethodPost, "/api/user/password", apiKey, body, nil)
+}
+
+func (s *SecureClient) ListKeys(bucketId, keyId, createdBy string, apiKey []byte) ([]access.AccessKeyInfo, error) {
+	query := url.Values{}
+	if bucketId != "" {
+		query.Set("bucketId", bucketId)
+	}
+	if keyId != "" {
+		query.Set("keyId", keyId)
+	}
+	if createdBy != "" {
+		query.Set("createdBy", createdBy)
+	}
+	ret := &struct {
+		Keys []access.AccessKeyInfo `json:"Keys"`
+	}{}
+	err := s.doJson(http.MethodGet, "/api/keys?"+query.Encode(), apiKey, nil, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret.Keys, nil
+}
+
+func (s *SecureClient) GetKey(urlKey string, apiKey []byte) (*access.AccessKeyInfo, error) {
+	ret := &access.AccessKeyInfo{}
+	err := s.doJson(http.MethodGet, "/api/keys/"+url.PathEscape(urlKey), apiKey, nil, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *SecureClient) UpdateKey(urlKey string, ttl *time.Time, limit *uint64, apiKey []byte) (*access.AccessKeyInfo, error) {
+	ret := &access.AccessKeyInfo{}
+	body := access.KeyUpdate{Ttl: ttl, Limit: limit}
+	err := s.doJson(http.MethodPatch, "/api/keys/"+url.PathEscape(urlKey), apiKey, body, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *SecureClient) RevokeKey(urlKey string, apiKey []byte) error {
+	return s.doJson(http.MethodDelete, "/api/keys/"+url.PathEscape(urlKey), apiKey, nil, nil)
+}
+
+// UnlockKey lifts the lock a key got after repeated unlock failures.
+func (s *SecureClient) UnlockKey(urlKey string, apiKey []byte) error {
+	return s.doJson(http.MethodDelete, "/api/keys/"+url.PathEscape(urlKey)+"/lockout", apiKey, nil, nil)
+}
+
+// PresignDownload builds a presigned download url offline, secret and version
+// have to match one of the keys in the server's presign keyring.
+func (s *SecureClient) PresignDownload(secret []byte, version uint32, bucketId, keyId string, expires time.Time, ip string) string {
+	query := presign.Query(secret, version, bucketId, keyId, expires, ip)
+	return fmt.Sprintf("%v/api/download?%v", s.addr, query.Encode())
+}
+
+func (s *SecureClient) AddUploadKey(exKey access.ExAccessKey, apiKey []byte) error {
+	exKey.Upload = true
+	return s.doJson(http.MethodPost, "/api/add", apiKey, exKey, nil)
+}
+
+// UploadWithKey writes an object through an upload key, keyId may be empty for
+// keys that grant a single object.
+func (s *SecureClient) UploadWithKey(urlKey, keyId string, data io.Reader, length int64, contentType, filename string) error {
+	query := url.Values{}
+	query.Set("urlKey", urlKey)
+	if keyId != "" {
+		query.Set("keyId", keyId)
+	}
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%v/api/upload?%v", s.addr, query.Encode()), data)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = length
+	req.Header.Add("Content-Type", contentType)
+	req.Header.Add("filename", filename)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected server response")
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"secure-store/rpc"
+	"secure-store/users"
+	"time"
+)
+
+const GrpcApiKeyMetadata = "x-api-key"
+const GrpcChunkSize = 64 * 1024
+
+var DownloadWithoutInfo = errors.New("download didn't start with the object info")
+
+// GrpcClient talks to the gRPC API, calls authenticate with the api key they
+// are given like the methods of SecureClient.
+type GrpcClient struct {
+	conn *grpc.ClientConn
+	rpc  rpc.SecureStoreClient
+}
+
+func NewGrpcClient(addr string, opts ...grpc.DialOption) (*GrpcClient, error) {
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &GrpcClient{conn: conn, rpc: rpc.NewSecureStoreClient(conn)}, nil
+}
+
+func (g *GrpcClient) Close() error {
+	return g.conn.Close()
+}
+
+func withApiKey(apiKey []byte) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), GrpcApiKeyMetadata, base64.RawURLEncoding.EncodeToString(apiKey))
+}
+
+func (g *GrpcClient) CreateBucket(bucketId string, apiKey []byte) error {
+	_, err := g.rpc.CreateBucket(withApiKey(apiKey), &rpc.BucketRequest{BucketId: bucketId})
+	return err
+}
+
+func (g *GrpcClient) DeleteBucket(bucketId string, apiKey []byte) error {
+	_, err := g.rpc.DeleteBucket(withApiKey(apiKey), &rpc.BucketRequest{BucketId: bucketId})
+	return err
+}
+
+func (g *GrpcClient) ListBuckets(apiKey []byte) ([]string, error) {
+	list, err := g.rpc.ListBuckets(withApiKey(apiKey), &emptypb.Empty{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Buckets, nil
+}
+
+// Upload streams data in chunks, length has to be the exact size of data.
+func (g *GrpcClient) Upload(bucketId, keyId string, data io.Reader, length int64, filename string, apiKey []byte) (*rpc.ObjectInfo, error) {
+	stream, err := g.rpc.Upload(withApiKey(apiKey))
+	if err != nil {
+		return nil, err
+	}
+	err = stream.Send(&rpc.UploadRequest{Data: &rpc.UploadRequest_Header{Header: &rpc.UploadHeader{
+		BucketId: bucketId,
+		KeyId:    keyId,
+		Filename: filename,
+		Length:   length,
+	}}})
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, GrpcChunkSize)
+	for {
+		n, err := data.Read(buf)
+		if n > 0 {
+			sendErr := stream.Send(&rpc.UploadRequest{Data: &rpc.UploadRequest_Chunk{Chunk: buf[:n]}})
+			// The server's error is returned by CloseAndRecv.
+			if sendErr == io.EOF {
+				break
+			}
+			if sendErr != nil {
+				return nil, sendErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+type downloadReader struct {
+	stream rpc.SecureStore_DownloadClient
+	chunk  []byte
+}
+
+func (d *downloadReader) Read(b []byte) (int, error) {
+	for len(d.chunk) == 0 {
+		resp, err := d.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		d.chunk = resp.GetChunk()
+	}
+	n := copy(b, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+// Download returns the content of the object and its length.
+func (g *GrpcClient) Download(bucketId, keyId string, apiKey []byte) (io.Reader, int64, error) {
+	stream, err := g.rpc.Download(withApiKey(apiKey), &rpc.ObjectRequest{BucketId: bucketId, KeyId: keyId})
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, 0, err
+	}
+	info := resp.GetInfo()
+	if info == nil {
+		return nil, 0, DownloadWithoutInfo
+	}
+	return &downloadReader{stream: stream}, info.Length, nil
+}
+
+func (g *GrpcClient) Delete(bucketId, keyId string, apiKey []byte) error {
+	_, err := g.rpc.DeleteObject(withApiKey(apiKey), &rpc.ObjectRequest{BucketId: bucketId, KeyId: keyId})
+	return err
+}
+
+func (g *GrpcClient) ListObjects(bucketId, prefix string, apiKey []byte) ([]*rpc.ObjectInfo, error) {
+	list, err := g.rpc.ListObjects(withApiKey(apiKey), &rpc.ListObjectsRequest{BucketId: bucketId, Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	return list.Objects, nil
+}
+
+func (g *GrpcClient) AddKey(request *rpc.AddKeyRequest, apiKey []byte) (*rpc.KeyInfo, error) {
+	return g.rpc.AddKey(withApiKey(apiKey), request)
+}
+
+func (g *GrpcClient) ListKeys(bucketId, keyId, createdBy string, apiKey []byte) ([]*rpc.KeyInfo, error) {
+	list, err := g.rpc.ListKeys(withApiKey(apiKey), &rpc.ListKeysRequest{BucketId: bucketId, KeyId: keyId, CreatedBy: createdBy})
+	if err != nil {
+		return nil, err
+	}
+	return list.Keys, nil
+}
+
+func (g *GrpcClient) GetKey(urlKey string, apiKey []byte) (*rpc.KeyInfo, error) {
+	return g.rpc.GetKey(withApiKey(apiKey), &rpc.KeyRequest{UrlKey: urlKey})
+}
+
+func (g *GrpcClient) UpdateKey(urlKey string, ttl *time.Time, limit *uint64, apiKey []byte) (*rpc.KeyInfo, error) {
+	request := &rpc.UpdateKeyRequest{UrlKey: urlKey, Limit: limit}
+	if ttl != nil {
+		request.Ttl = timestamppb.New(*ttl)
+	}
+	return g.rpc.UpdateKey(withApiKey(apiKey), request)
+}
+
+func (g *GrpcClient) RevokeKey(urlKey string, apiKey []byte) error {
+	_, err := g.rpc.RevokeKey(withApiKey(apiKey), &rpc.KeyRequest{UrlKey: urlKey})
+	return err
+}
+
+func roleToProto(role users.Role) *rpc.Role {
+	return &rpc.Role{
+		RootUser:       role.RootUser,
+		CanCreateUsers: role.CanCreateUsers,
+		CanAddKeys:     role.CanAddKeys,
+		CanUploadData:  role.CanUploadData,
+		CanDeleteKeys:  role.CanDeleteKeys,
+	}
+}
+
+func (g *GrpcClient) AddUser(userJson *users.UserJson, apiKey []byte) (*rpc.User, error) {
+	return g.rpc.CreateUser(withApiKey(apiKey), &rpc.CreateUserRequest{
+		Id:           userJson.Id,
+		Name:         userJson.Name,
+		Role:         roleToProto(userJson.Role),
+		Username:     userJson.Username,
+		PasswordHash: userJson.PasswordHash,
+		ApiKey:       userJson.ApiKey,
+	})
+}
+
+func (g *GrpcClient) ListUsers(offset, limit int, apiKey []byte) (*rpc.UserList, error) {
+	return g.rpc.ListUsers(withApiKey(apiKey), &rpc.ListUsersRequest{Offset: int32(offset), Limit: int32(limit)})
+}
+
+func (g *GrpcClient) GetUser(idOrUsername string, apiKey []byte) (*rpc.User, error) {
+	return g.rpc.GetUser(withApiKey(apiKey), &rpc.UserRequest{User: idOrUsername})
+}
+
+func (g *GrpcClient) UpdateRole(idOrUsername string, role users.Role, apiKey []byte) (*rpc.User, error) {
+	return g.rpc.SetUserRole(withApiKey(apiKey), &rpc.SetUserRoleRequest{User: idOrUsername, Role: roleToProto(role)})
+}
+
+func (g *GrpcClient) DeleteUser(idOrUsername string, apiKey []byte) error {
+	_, err := g.rpc.DeleteUser(withApiKey(apiKey), &rpc.UserRequest{User: idOrUsername})
+	return err
+}
+
+func (g *GrpcClient) ResetPassword(idOrUsername, password string, apiKey []byte) error {
+	_, err := g.rpc.ResetPassword(withApiKey(apiKey), &rpc.ResetPasswordRequest{User: idOrUsername, Password: password})
+	return err
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"net"
+	"os"
+	"secure-store/access"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ConfigFileEnv = "CONFIG_FILE"
+const ConfigCommand = "config"
+const ConfigValidateCommand = "validate"
+
+const DomainsEnv = "DOMAINS"
+const LogLevelEnv = "LOG_LEVEL"
+const RateLimitEnv = "RATE_LIMIT"
+const RateLimitBurstEnv = "RATE_LIMIT_BURST"
+const CorsOriginsEnv = "CORS_ORIGINS"
+
+const DefaultPort = "8080"
+const DefaultRedisHost = "0.0.0.0"
+const DefaultRedisPort = "6379"
+
+type StorageConfig struct {
+	Kind string `yaml:"kind"`
+	// DataDir defaults to a new directory in the temp directory.
+	DataDir string `yaml:"dataDir"`
+}
+
+type RedisConfig struct {
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Password string `yaml:"password"`
+	Db       int    `yaml:"db"`
+}
+
+type AccessConfig struct {
+	Kind  string      `yaml:"kind"`
+	Redis RedisConfig `yaml:"redis"`
+}
+
+// TlsConfig serves https from certificate files instead of Let's Encrypt.
+// With a client ca file, callers may authenticate with a client certificate
+// whose subject or subject alternative name is mapped to a username.
+type TlsConfig struct {
+	CertFile     string            `yaml:"certFile"`
+	KeyFile      string            `yaml:"keyFile"`
+	MinVersion   string            `yaml:"minVersion"`
+	ClientCaFile string            `yaml:"clientCaFile"`
+	ClientUsers  map[string]string `yaml:"clientUsers"`
+}
+
+// RateLimitConfig limits requests per client ip, zero requests per second
+// turns the limit off.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	Burst             int     `yaml:"burst"`
+}
+
+// Config holds the settings of the server. It's read from the yaml file in
+// CONFIG_FILE, the environment variables override the file. Secrets like the
+// session secret are only taken from the environment.
+type Config struct {
+	Port            string               `yaml:"port"`
+	Domains         []string             `yaml:"domains"`
+	TrustedProxies  []string             `yaml:"trustedProxies"`
+	S3Port          string               `yaml:"s3Port"`
+	GrpcPort        string               `yaml:"grpcPort"`
+	WebDavPort      string               `yaml:"webdavPort"`
+	MetricsPort     string               `yaml:"metricsPort"`
+	ShutdownTimeout time.Duration        `yaml:"shutdownTimeout"`
+	Tls             TlsConfig            `yaml:"tls"`
+	Storage         StorageConfig        `yaml:"storage"`
+	Access          AccessConfig         `yaml:"access"`
+	Lockout         access.LockoutPolicy `yaml:"lockout"`
+
+	// The settings below are applied again on SIGHUP.
+	LogLevel    string          `yaml:"logLevel"`
+	RateLimit   RateLimitConfig `yaml:"rateLimit"`
+	CorsOrigins []string        `yaml:"corsOrigins"`
+}
+
+// ConfigErrors collects every problem of a config, so they can be fixed in
+// one go.
+type ConfigErrors []error
+
+func (c ConfigErrors) Error() string {
+	messages := make([]string, len(c))
+	for i, err := range c {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (c *ConfigErrors) add(format string, args ...interface{}) {
+	*c = append(*c, errors.New(fmt.Sprintf(format, args...)))
+}
+
+func (c ConfigErrors) orNil() error {
+	if len(c) == 0 {
+		return nil
+	}
+	return c
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Port:            DefaultPort,
+		ShutdownTimeout: DefaultShutdownTimeout,
+		Tls:             TlsConfig{MinVersion: DefaultTlsMinVersion},
+		Access: AccessConfig{
+			Redis: RedisConfig{Host: DefaultRedisHost, Port: DefaultRedisPort},
+		},
+		Lockout:  access.DefaultLockoutPolicy(),
+		LogLevel: logrus.InfoLevel.String(),
+	}
+}
+
+// LoadConfig reads the file at path, if there is one, applies the environment
+// and validates the result.
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.UnmarshalStrict(data, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	problems := config.applyEnv()
+	problems = append(problems, config.validate()...)
+	return config, problems.orNil()
+}
+
+func splitList(value string) []string {
+	ret := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+// applyEnv overrides the config with the environment variables that are set.
+func (c *Config) applyEnv() ConfigErrors {
+	problems := ConfigErrors{}
+	texts := map[string]*string{
+		PortEnv:            &c.Port,
+		S3PortEnv:          &c.S3Port,
+		GrpcPortEnv:        &c.GrpcPort,
+		WebDavPortEnv:      &c.WebDavPort,
+		MetricsPortEnv:     &c.MetricsPort,
+		StorageEnv:         &c.Storage.Kind,
+		DataDirEnv:         &c.Storage.DataDir,
+		AccessEnv:          &c.Access.Kind,
+		RedisEnvHost:       &c.Access.Redis.Host,
+		RedisEnvPort:       &c.Access.Redis.Port,
+		RedisEnvPassword:   &c.Access.Redis.Password,
+		LogLevelEnv:        &c.LogLevel,
+		TlsCertFileEnv:     &c.Tls.CertFile,
+		TlsKeyFileEnv:      &c.Tls.KeyFile,
+		TlsMinVersionEnv:   &c.Tls.MinVersion,
+		TlsClientCaFileEnv: &c.Tls.ClientCaFile,
+	}
+	for env, target := range texts {
+		value := os.Getenv(env)
+		if value != "" {
+			*target = value
+		}
+	}
+	lists := map[string]*[]string{
+		DomainsEnv:        &c.Domains,
+		TrustedProxiesEnv: &c.TrustedProxies,
+		CorsOriginsEnv:    &c.CorsOrigins,
+	}
+	for env, target := range lists {
+		value := os.Getenv(env)
+		if value != "" {
+			*target = splitList(value)
+		}
+	}
+	durations := map[string]*time.Duration{
+		ShutdownTimeoutEnv:  &c.ShutdownTimeout,
+		LockoutBaseDelayEnv: &c.Lockout.BaseDelay,
+		LockoutMaxDelayEnv:  &c.Lockout.MaxDelay,
+		LockoutWindowEnv:    &c.Lockout.Window,
+	}
+	for env, target := range durations {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			problems.add("%v isn't a duration like 30s: %v", env, value)
+			continue
+		}
+		*target = parsed
+	}
+	if value := os.Getenv(RedisEnvDb); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			problems.add("%v isn't a number: %v", RedisEnvDb, value)
+		} else {
+			c.Access.Redis.Db = int(parsed)
+		}
+	}
+	if value := os.Getenv(LockoutMaxFailuresEnv); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			problems.add("%v isn't a number: %v", LockoutMaxFailuresEnv, value)
+		} else {
+			c.Lockout.MaxFailures = parsed
+		}
+	}
+	if value := os.Getenv(TlsClientUsersEnv); value != "" {
+		c.Tls.ClientUsers = map[string]string{}
+		for _, item := range splitList(value) {
+			// Subjects contain = themselves, usernames don't.
+			split := strings.LastIndex(item, "=")
+			if split <= 0 || split == len(item)-1 {
+				problems.add("%v has to list identity=username pairs, not %q", TlsClientUsersEnv, item)
+				continue
+			}
+			c.Tls.ClientUsers[item[:split]] = item[split+1:]
+		}
+	}
+	if value := os.Getenv(RateLimitEnv); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			problems.add("%v isn't a number: %v", RateLimitEnv, value)
+		} else {
+			c.RateLimit.RequestsPerSecond = parsed
+		}
+	}
+	if value := os.Getenv(RateLimitBurstEnv); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			problems.add("%v isn't a number: %v", RateLimitBurstEnv, value)
+		} else {
+			c.RateLimit.Burst = parsed
+		}
+	}
+	return problems
+}
+
+func validPort(port string) bool {
+	parsed, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && parsed > 0
+}
+
+func (c *Config) validate() ConfigErrors {
+	problems := ConfigErrors{}
+	ports := map[string]string{}
+	for name, port := range map[string]string{"port": c.Port, "s3Port": c.S3Port, "grpcPort": c.GrpcPort, "webdavPort": c.WebDavPort, "metricsPort": c.MetricsPort} {
+		if port == "" && name != "port" {
+			continue
+		}
+		if !validPort(port) {
+			problems.add("%v isn't a valid port: %q", name, port)
+			continue
+		}
+		if other, ok := ports[port]; ok {
+			problems.add("%v and %v both use port %v", name, other, port)
+		}
+		ports[port] = name
+	}
+	switch c.Storage.Kind {
+	case StorageEnvFs, StorageEnvMem:
+	default:
+		problems.add("storage kind must be %v or %v, not %q", StorageEnvFs, StorageEnvMem, c.Storage.Kind)
+	}
+	switch c.Access.Kind {
+	case AccessEnvMem:
+	case AccessEnvRedis:
+		if c.Access.Redis.Host == "" {
+			problems.add("redis host is empty")
+		}
+		if !validPort(c.Access.Redis.Port) {
+			problems.add("redis port isn't a valid port: %q", c.Access.Redis.Port)
+		}
+		if c.Access.Redis.Db < 0 {
+			problems.add("redis db can't be negative")
+		}
+	default:
+		problems.add("access kind must be %v or %v, not %q", AccessEnvMem, AccessEnvRedis, c.Access.Kind)
+	}
+	for _, proxy := range c.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			_, _, err := net.ParseCIDR(proxy)
+			if err != nil {
+				problems.add("trusted proxy %q is neither an ip nor a network", proxy)
+			}
+		}
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems.add("shutdown timeout has to be positive")
+	}
+	err := c.Lockout.Validate()
+	if err != nil {
+		problems.add("lockout: %v", err)
+	}
+	problems = append(problems, c.validateTls()...)
+	problems = append(problems, c.validateReloadable()...)
+	return problems
+}
+
+func (c *Config) validateTls() ConfigErrors {
+	problems := ConfigErrors{}
+	tlsConfig := c.Tls
+	if _, ok := TlsVersions[tlsConfig.MinVersion]; !ok {
+		problems.add("tls min version must be 1.0, 1.1, 1.2 or 1.3, not %q", tlsConfig.MinVersion)
+	}
+	for identity := range tlsConfig.ClientUsers {
+		if !hasIdentityKind(identity) {
+			problems.add("tls client user %q has to start with %v", identity, strings.Join(identityKinds, ", "))
+		}
+	}
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		problems.add("tls needs both a cert file and a key file")
+		return problems
+	}
+	if tlsConfig.CertFile == "" {
+		if tlsConfig.ClientCaFile != "" {
+			problems.add("tls client ca file needs a cert file and a key file")
+		}
+		if len(tlsConfig.ClientUsers) > 0 {
+			problems.add("tls client users need a client ca file")
+		}
+		return problems
+	}
+	if len(c.Domains) > 0 {
+		problems.add("domains and a tls cert file can't be used together")
+	}
+	if len(tlsConfig.ClientUsers) > 0 && tlsConfig.ClientCaFile == "" {
+		problems.add("tls client users need a client ca file")
+	}
+	_, err := NewCertificateFiles(tlsConfig.CertFile, tlsConfig.KeyFile, tlsConfig.ClientCaFile)
+	if err != nil {
+		problems.add("tls certificate: %v", err)
+	}
+	return problems
+}
+
+// validateReloadable checks the settings that can change on SIGHUP.
+func (c *Config) validateReloadable() ConfigErrors {
+	problems := ConfigErrors{}
+	_, err := logrus.ParseLevel(c.LogLevel)
+	if err != nil {
+		problems.add("log level %q isn't one of panic, fatal, error, warn, info, debug or trace", c.LogLevel)
+	}
+	if c.RateLimit.RequestsPerSecond < 0 {
+		problems.add("rate limit can't be negative")
+	}
+	if c.RateLimit.RequestsPerSecond > 0 && c.RateLimit.Burst < 1 {
+		problems.add("rate limit burst has to be at least 1")
+	}
+	for _, origin := range c.CorsOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			problems.add("cors origin %q has to be * or start with http:// or https://", origin)
+		}
+	}
+	return problems
+}
+
+// ValidateConfig implements the config validate command, it prints every
+// problem of the config and tells whether there were any.
+func ValidateConfig(path string) bool {
+	_, err := LoadConfig(path)
+	if err == nil {
+		fmt.Println("Config is valid.")
+		return true
+	}
+	problems, ok := err.(ConfigErrors)
+	if !ok {
+		problems = ConfigErrors{err}
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	return false
+}
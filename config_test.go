@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+port: "9000"
+storage:
+  kind: FS_STORAGE
+  dataDir: /var/lib/secure-store
+access:
+  kind: REDIS_ACCESS
+  redis:
+    host: redis
+lockout:
+  maxFailures: 3
+  window: 10m
+rateLimit:
+  requestsPerSecond: 5
+  burst: 10
+corsOrigins: ["https://example.com"]
+`)
+	t.Setenv(PortEnv, "9001")
+	t.Setenv(LockoutBaseDelayEnv, "2s")
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Port != "9001" || config.Storage.DataDir != "/var/lib/secure-store" || config.Access.Redis.Host != "redis" || config.Access.Redis.Port != DefaultRedisPort {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if config.Lockout.MaxFailures != 3 || config.Lockout.Window != 10*time.Minute || config.Lockout.BaseDelay != 2*time.Second {
+		t.Errorf("Unexpected lockout %+v", config.Lockout)
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	path := writeConfig(t, `
+port: "80000"
+s3Port: "9000"
+grpcPort: "9000"
+storage:
+  kind: DISK
+access:
+  kind: MEM_ACCESS
+logLevel: loud
+corsOrigins: [example.com]
+`)
+	t.Setenv(RedisEnvDb, "first")
+	_, err := LoadConfig(path)
+	problems, ok := err.(ConfigErrors)
+	if !ok || len(problems) != 6 {
+		t.Errorf("Expected 6 problems, got %v", err)
+	}
+
+	_, err = LoadConfig(writeConfig(t, "storage:\n  knd: FS_STORAGE\n"))
+	if err == nil {
+		t.Error("Unknown setting was accepted")
+	}
+}
+
+func TestLiveSettings(t *testing.T) {
+	config := DefaultConfig()
+	config.Storage.Kind = StorageEnvMem
+	config.Access.Kind = AccessEnvMem
+	config.RateLimit = RateLimitConfig{RequestsPerSecond: 0.01, Burst: 2}
+	config.CorsOrigins = []string{"https://example.com"}
+	live := NewLiveSettings(config)
+	router := gin.New()
+	router.Use(live.Middleware())
+	router.GET("/ping", func(c *gin.Context) {
+		c.String(http.StatusOK, "Pong")
+	})
+	do := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/ping", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodOptions, "https://example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://example.com" {
+		t.Errorf("Preflight answered %v with %v", w.Code, w.Header())
+	}
+	w = do(http.MethodGet, "https://other.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Other origin answered %v with %v", w.Code, w.Header())
+	}
+	w = do(http.MethodGet, "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Request over the limit answered %v", w.Code)
+	}
+
+	path := writeConfig(t, `
+storage:
+  kind: MEM_STORAGE
+access:
+  kind: MEM_ACCESS
+logLevel: warn
+corsOrigins: ["*"]
+`)
+	err := live.Reload(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = do(http.MethodGet, "https://other.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://other.com" {
+		t.Errorf("Reloaded settings answered %v with %v", w.Code, w.Header())
+	}
+	err = live.Reload(writeConfig(t, "logLevel: loud\n"))
+	if err == nil {
+		t.Error("Invalid config was applied")
+	}
+	w = do(http.MethodGet, "https://other.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Errorf("Rejected reload changed the settings, answered %v", w.Code)
+	}
+}
+
+func TestLoadConfigChecksTls(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	newTestServerCertificate(t, newTestCa(t, "Test CA")).write(t, certFile, keyFile, time.Now())
+	t.Setenv(TlsCertFileEnv, certFile)
+	t.Setenv(TlsKeyFileEnv, keyFile)
+	t.Setenv(TlsClientCaFileEnv, certFile)
+	t.Setenv(TlsClientUsersEnv, "cn:nightly-backup=root,uri:spiffe://example.com/exporter=root")
+	config, err := LoadConfig(writeConfig(t, "storage:\n  kind: MEM_STORAGE\naccess:\n  kind: MEM_ACCESS\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Tls.MinVersion != DefaultTlsMinVersion || config.Tls.ClientUsers["uri:spiffe://example.com/exporter"] != RootUsername ||
+		config.Tls.ClientUsers["cn:nightly-backup"] != RootUsername {
+		t.Errorf("Unexpected tls config %+v", config.Tls)
+	}
+}
+
+func TestLoadConfigReportsTlsProblems(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, `
+storage:
+  kind: MEM_STORAGE
+access:
+  kind: MEM_ACCESS
+tls:
+  certFile: /nonexistent/cert.pem
+  keyFile: /nonexistent/key.pem
+  minVersion: "1.4"
+  clientUsers:
+    nightly-backup: root
+`))
+	problems, ok := err.(ConfigErrors)
+	if !ok || len(problems) != 4 {
+		t.Errorf("Expected 4 problems, got %v", err)
+	}
+}
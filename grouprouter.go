@@ -0,0 +1,206 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"secure-store/users"
+)
+
+func resolveGroup(u users.UserStorage, idOrName string) (*users.Group, error) {
+	id, err := uuid.Parse(idOrName)
+	if err == nil {
+		return u.ResolveGroup(id)
+	}
+	return u.ResolveGroupByName(idOrName)
+}
+
+func groupLog(actor *users.User, group *users.Group) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"Acting User":    actor.Username,
+		"Acting User Id": actor.Id,
+		"Group":          group.Name,
+		"Group Id":       group.Id,
+	})
+}
+
+func bindGroupJson(c *gin.Context) (*users.GroupJson, bool) {
+	groupJson := &users.GroupJson{}
+	err := c.ShouldBindJSON(groupJson)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return nil, false
+	}
+	err = groupJson.IsValid()
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return nil, false
+	}
+	if groupJson.Role.RootUser && !CurrentPermissions(c).Role.RootUser {
+		_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+		return nil, false
+	}
+	return groupJson, true
+}
+
+func registerGroupRoutes(router *gin.Engine, u users.UserStorage, auth *Authenticator) {
+	router.POST("/api/groups", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		groupJson, ok := bindGroupJson(c)
+		if !ok {
+			return
+		}
+		groupJson.Id = ""
+		group, err := users.GroupFromGroupJson(groupJson)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		err = u.CreateGroup(group)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusConflict, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, users.GroupJsonFromGroup(group))
+		groupLog(CurrentUser(c), group).Infoln("Created group.")
+	})
+
+	router.GET("/api/groups", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		groups, err := u.ListGroups()
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		ret := make([]users.GroupJson, 0, len(groups))
+		for _, group := range groups {
+			ret = append(ret, users.GroupJsonFromGroup(group))
+		}
+		c.SecureJSON(http.StatusOK, gin.H{"Groups": ret})
+	})
+
+	router.GET("/api/groups/:group", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		group, err := resolveGroup(u, c.Param("group"))
+		if err != nil {
+			_ = c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, users.GroupJsonFromGroup(group))
+	})
+
+	router.PUT("/api/groups/:group", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		existing, err := resolveGroup(u, c.Param("group"))
+		if err != nil {
+			_ = c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		if existing.Role.RootUser && !CurrentPermissions(c).Role.RootUser {
+			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+			return
+		}
+		groupJson, ok := bindGroupJson(c)
+		if !ok {
+			return
+		}
+		groupJson.Id = existing.Id.String()
+		group, err := users.GroupFromGroupJson(groupJson)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		err = u.UpdateGroup(group)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusConflict, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, users.GroupJsonFromGroup(group))
+		groupLog(CurrentUser(c), group).WithFields(logrus.Fields{
+			"Old Role": existing.Role,
+			"New Role": group.Role,
+		}).Infoln("Updated group.")
+	})
+
+	router.DELETE("/api/groups/:group", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		group, err := resolveGroup(u, c.Param("group"))
+		if err != nil {
+			_ = c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		if group.Role.RootUser && !CurrentPermissions(c).Role.RootUser {
+			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+			return
+		}
+		err = u.DeleteGroup(group.Id)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.String(http.StatusOK, "Deleted group with id: %v", group.Id)
+		groupLog(CurrentUser(c), group).Infoln("Deleted group.")
+	})
+
+	router.PUT("/api/groups/:group/members/:user", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		group, err := resolveGroup(u, c.Param("group"))
+		if err != nil {
+			_ = c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		target, err := resolveUser(u, c.Param("user"))
+		if err != nil {
+			_ = c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		if group.Role.RootUser && !CurrentPermissions(c).Role.RootUser {
+			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+			return
+		}
+		err = CurrentPrincipal(c).canManage(u, target)
+		if err != nil {
+			_ = c.AbortWithError(asApiError(err).Status, err)
+			return
+		}
+		if !target.InGroup(group.Id) {
+			updated := *target
+			updated.Groups = append(append(make([]uuid.UUID, 0, len(target.Groups)+1), target.Groups...), group.Id)
+			err = u.Update(&updated)
+			if err != nil {
+				_ = c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			target = &updated
+		}
+		c.SecureJSON(http.StatusOK, users.UserSafeJsonFromUser(target))
+		groupLog(CurrentUser(c), group).WithField("User", target.Username).Infoln("Added user to group.")
+	})
+
+	router.DELETE("/api/groups/:group/members/:user", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		group, err := resolveGroup(u, c.Param("group"))
+		if err != nil {
+			_ = c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		target, err := resolveUser(u, c.Param("user"))
+		if err != nil {
+			_ = c.AbortWithError(http.StatusNotFound, err)
+			return
+		}
+		err = CurrentPrincipal(c).canManage(u, target)
+		if err != nil {
+			_ = c.AbortWithError(asApiError(err).Status, err)
+			return
+		}
+		updated := *target
+		updated.Groups = make([]uuid.UUID, 0, len(target.Groups))
+		for _, id := range target.Groups {
+			if id != group.Id {
+				updated.Groups = append(updated.Groups, id)
+			}
+		}
+		err = u.Update(&updated)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, users.UserSafeJsonFromUser(&updated))
+		groupLog(CurrentUser(c), group).WithField("User", target.Username).Infoln("Removed user from group.")
+	})
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io"
+	"net/http"
+	"secure-store/access"
+	"secure-store/rpc"
+	"secure-store/users"
+	"strings"
+	"time"
+)
+
+const GrpcPortEnv = "GRPC_PORT"
+
+// GrpcApiKeyMetadata carries the encoded api key, like the apiKey query of
+// the HTTP routes.
+const GrpcApiKeyMetadata = "x-api-key"
+const GrpcAuthorizationMetadata = "authorization"
+
+const grpcChunkSize = 64 * 1024
+
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.AlreadyExists,
+	http.StatusLengthRequired:      codes.InvalidArgument,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+// grpcError answers an ApiError with the matching status code, the error
+// code of the HTTP API prefixes the message.
+func grpcError(err error) error {
+	apiErr := asApiError(err)
+	code, ok := grpcCodes[apiErr.Status]
+	if !ok {
+		code = codes.Unknown
+	}
+	if code == codes.Internal {
+		logrus.WithError(err).Errorf("gRPC call failed.")
+	}
+	return status.Errorf(code, "%v: %v", apiErr.Code, apiErr.Message)
+}
+
+type grpcPrincipalKey struct{}
+
+func grpcPrincipal(ctx context.Context) *Principal {
+	return ctx.Value(grpcPrincipalKey{}).(*Principal)
+}
+
+type grpcServer struct {
+	rpc.UnimplementedSecureStoreServer
+	svc  *Service
+	auth *Authenticator
+}
+
+// NewGrpcServer serves the service over gRPC, every call is authenticated
+// like the HTTP routes. Options like the transport credentials are passed on.
+func NewGrpcServer(svc *Service, auth *Authenticator, options ...grpc.ServerOption) *grpc.Server {
+	g := &grpcServer{svc: svc, auth: auth}
+	options = append(options,
+		grpc.UnaryInterceptor(g.authenticateUnary),
+		grpc.StreamInterceptor(g.authenticateStream),
+	)
+	server := grpc.NewServer(options...)
+	rpc.RegisterSecureStoreServer(server, g)
+	return server
+}
+
+func grpcTlsState(ctx context.Context) *tls.ConnectionState {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return &info.State
+}
+
+func (g *grpcServer) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var user *users.User
+	var err error
+	if values := md.Get(GrpcAuthorizationMetadata); len(values) > 0 && strings.HasPrefix(values[0], BearerPrefix) {
+		user, _, err = g.auth.AuthenticateToken(strings.TrimPrefix(values[0], BearerPrefix))
+	} else if values := md.Get(GrpcApiKeyMetadata); len(values) > 0 {
+		var apiKey []byte
+		apiKey, err = base64.RawURLEncoding.DecodeString(values[0])
+		if err == nil {
+			user, err = g.auth.AuthenticateApiKey(apiKey)
+		}
+	} else if state := grpcTlsState(ctx); state != nil {
+		user, err = g.auth.AuthenticateCertificate(state)
+	} else {
+		err = InvalidCredentials
+	}
+	if err != nil {
+		logrus.WithError(err).Infoln("Rejected unauthenticated gRPC call.")
+		return nil, status.Error(codes.Unauthenticated, InvalidCredentials.Error())
+	}
+	permissions, err := users.ResolvePermissions(g.auth.users, user)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return context.WithValue(ctx, grpcPrincipalKey{}, &Principal{User: user, Permissions: permissions}), nil
+}
+
+func (g *grpcServer) authenticateUnary(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := g.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (g *grpcServer) authenticateStream(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := g.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+func (g *grpcServer) CreateBucket(ctx context.Context, req *rpc.BucketRequest) (*emptypb.Empty, error) {
+	err := g.svc.CreateBucket(grpcPrincipal(ctx), req.BucketId)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (g *grpcServer) DeleteBucket(ctx context.Context, req *rpc.BucketRequest) (*emptypb.Empty, error) {
+	err := g.svc.DeleteBucket(grpcPrincipal(ctx), req.BucketId)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (g *grpcServer) ListBuckets(ctx context.Context, _ *emptypb.Empty) (*rpc.BucketList, error) {
+	buckets, err := g.svc.ListBuckets(grpcPrincipal(ctx))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &rpc.BucketList{Buckets: buckets}, nil
+}
+
+// uploadReader reads the chunks following the header of an upload.
+type uploadReader struct {
+	stream rpc.SecureStore_UploadServer
+	chunk  []byte
+	read   int64
+}
+
+func (r *uploadReader) Read(b []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.chunk = req.GetChunk()
+	}
+	n := copy(b, r.chunk)
+	r.chunk = r.chunk[n:]
+	r.read += int64(n)
+	return n, nil
+}
+
+func (g *grpcServer) Upload(stream rpc.SecureStore_UploadServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := req.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "upload has to start with a header")
+	}
+	if header.Length < 0 {
+		return grpcError(newApiError(http.StatusLengthRequired, CodeLengthRequired, "length is required"))
+	}
+	filename := header.Filename
+	if filename == "" {
+		filename = header.KeyId
+	}
+	reader := &uploadReader{stream: stream}
+	meta, err := g.svc.PutObject(grpcPrincipal(stream.Context()), header.BucketId, header.KeyId, filename, header.Length, reader)
+	if err != nil {
+		// Internal errors happen while writing, after the metadata was stored.
+		if asApiError(err).Code == CodeInternal {
+			_ = g.svc.store.Delete(header.BucketId, header.KeyId)
+		}
+		return grpcError(err)
+	}
+	if reader.read != header.Length {
+		_ = g.svc.store.Delete(header.BucketId, header.KeyId)
+		return status.Error(codes.InvalidArgument, "content doesn't match the length of the header")
+	}
+	return stream.SendAndClose(&rpc.ObjectInfo{
+		BucketId: header.BucketId,
+		KeyId:    header.KeyId,
+		Filename: meta.Filename,
+		Length:   meta.Length,
+		Owner:    meta.Owner,
+	})
+}
+
+func (g *grpcServer) Download(req *rpc.ObjectRequest, stream rpc.SecureStore_DownloadServer) error {
+	meta, reader, err := g.svc.GetObject(grpcPrincipal(stream.Context()), req.BucketId, req.KeyId)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer reader.Close()
+	err = stream.Send(&rpc.DownloadResponse{Data: &rpc.DownloadResponse_Info{Info: &rpc.ObjectInfo{
+		BucketId: req.BucketId,
+		KeyId:    req.KeyId,
+		Filename: meta.Filename,
+		Length:   meta.Length,
+		Owner:    meta.Owner,
+	}}})
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, grpcChunkSize)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			sendErr := stream.Send(&rpc.DownloadResponse{Data: &rpc.DownloadResponse_Chunk{Chunk: buf[:n]}})
+			if sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return grpcError(internalError(err))
+		}
+	}
+}
+
+func (g *grpcServer) DeleteObject(ctx context.Context, req *rpc.ObjectRequest) (*emptypb.Empty, error) {
+	err := g.svc.DeleteObject(grpcPrincipal(ctx), req.BucketId, req.KeyId)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (g *grpcServer) ListObjects(ctx context.Context, req *rpc.ListObjectsRequest) (*rpc.ObjectList, error) {
+	objects, err := g.svc.ListObjects(grpcPrincipal(ctx), req.BucketId, req.Prefix)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	ret := &rpc.ObjectList{Objects: make([]*rpc.ObjectInfo, 0, len(objects))}
+	for _, object := range objects {
+		ret.Objects = append(ret.Objects, &rpc.ObjectInfo{
+			BucketId: object.BucketId,
+			KeyId:    object.KeyId,
+			Filename: object.Filename,
+			Length:   object.Length,
+			Owner:    object.Owner,
+		})
+	}
+	return ret, nil
+}
+
+func timeFromProto(t *timestamppb.Timestamp) *time.Time {
+	if t == nil {
+		return nil
+	}
+	ret := t.AsTime()
+	return &ret
+}
+
+func timeToProto(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func windowsFromProto(windows []*rpc.TimeWindow) []access.TimeWindow {
+	ret := make([]access.TimeWindow, 0, len(windows))
+	for _, window := range windows {
+		days := make([]time.Weekday, 0, len(window.Days))
+		for _, day := range window.Days {
+			days = append(days, time.Weekday(day))
+		}
+		ret = append(ret, access.TimeWindow{Days: days, Start: window.Start, End: window.End, Timezone: window.Timezone})
+	}
+	return ret
+}
+
+func windowsToProto(windows []access.TimeWindow) []*rpc.TimeWindow {
+	ret := make([]*rpc.TimeWindow, 0, len(windows))
+	for _, window := range windows {
+		days := make([]int32, 0, len(window.Days))
+		for _, day := range window.Days {
+			days = append(days, int32(day))
+		}
+		ret = append(ret, &rpc.TimeWindow{Days: days, Start: window.Start, End: window.End, Timezone: window.Timezone})
+	}
+	return ret
+}
+
+func keyInfoToProto(info access.AccessKeyInfo) *rpc.KeyInfo {
+	return &rpc.KeyInfo{
+		UrlKey:          info.UrlKey,
+		BucketId:        info.BucketId,
+		KeyId:           info.KeyId,
+		CreatedBy:       info.CreatedBy,
+		Ttl:             timeToProto(info.Ttl),
+		Limit:           info.Limit,
+		UsedTimes:       info.UsedTimes,
+		RemainingUses:   info.RemainingUses,
+		NeedsKey:        info.NeedsKey,
+		ResolveByUrlKey: info.ResolveByUrlKey,
+		Upload:          info.Upload,
+		Prefix:          info.Prefix,
+		MaxSize:         info.MaxSize,
+		ContentTypes:    info.ContentTypes,
+		PerObjectLimit:  info.PerObjectLimit,
+		NotBefore:       timeToProto(info.NotBefore),
+		Windows:         windowsToProto(info.Windows),
+		AllowedCidrs:    info.AllowedCidrs,
+		DeniedCidrs:     info.DeniedCidrs,
+	}
+}
+
+func (g *grpcServer) AddKey(ctx context.Context, req *rpc.AddKeyRequest) (*rpc.KeyInfo, error) {
+	key, err := g.svc.AddKey(grpcPrincipal(ctx), access.ExAccessKey{
+		Ttl:             timeFromProto(req.Ttl),
+		Limit:           req.Limit,
+		ValidKeys:       req.ValidKeys,
+		Passwords:       req.Passwords,
+		ResolveByUrlKey: req.ResolveByUrlKey,
+		BucketId:        req.BucketId,
+		KeyId:           req.KeyId,
+		UrlKey:          req.UrlKey,
+		Upload:          req.Upload,
+		Prefix:          req.Prefix,
+		MaxSize:         req.MaxSize,
+		ContentTypes:    req.ContentTypes,
+		PerObjectLimit:  req.PerObjectLimit,
+		NotBefore:       timeFromProto(req.NotBefore),
+		Windows:         windowsFromProto(req.Windows),
+		AllowedCidrs:    req.AllowedCidrs,
+		DeniedCidrs:     req.DeniedCidrs,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return keyInfoToProto(key.Info()), nil
+}
+
+func (g *grpcServer) ListKeys(ctx context.Context, req *rpc.ListKeysRequest) (*rpc.KeyList, error) {
+	keys, err := g.svc.ListKeys(ctx, grpcPrincipal(ctx), req.BucketId, req.KeyId, req.CreatedBy)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	ret := &rpc.KeyList{Keys: make([]*rpc.KeyInfo, 0, len(keys))}
+	for _, key := range keys {
+		ret.Keys = append(ret.Keys, keyInfoToProto(key))
+	}
+	return ret, nil
+}
+
+func (g *grpcServer) GetKey(ctx context.Context, req *rpc.KeyRequest) (*rpc.KeyInfo, error) {
+	key, err := g.svc.GetKey(ctx, grpcPrincipal(ctx), req.UrlKey)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return keyInfoToProto(key.Info()), nil
+}
+
+func (g *grpcServer) UpdateKey(ctx context.Context, req *rpc.UpdateKeyRequest) (*rpc.KeyInfo, error) {
+	key, err := g.svc.UpdateKey(ctx, grpcPrincipal(ctx), req.UrlKey, access.KeyUpdate{
+		Ttl:   timeFromProto(req.Ttl),
+		Limit: req.Limit,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return keyInfoToProto(key.Info()), nil
+}
+
+func (g *grpcServer) RevokeKey(ctx context.Context, req *rpc.KeyRequest) (*emptypb.Empty, error) {
+	_, err := g.svc.RevokeKey(ctx, grpcPrincipal(ctx), req.UrlKey)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func roleFromProto(role *rpc.Role) users.Role {
+	if role == nil {
+		return users.Role{}
+	}
+	return users.Role{
+		RootUser:       role.RootUser,
+		CanCreateUsers: role.CanCreateUsers,
+		CanAddKeys:     role.CanAddKeys,
+		CanUploadData:  role.CanUploadData,
+		CanDeleteKeys:  role.CanDeleteKeys,
+	}
+}
+
+func roleToProto(role users.Role) *rpc.Role {
+	return &rpc.Role{
+		RootUser:       role.RootUser,
+		CanCreateUsers: role.CanCreateUsers,
+		CanAddKeys:     role.CanAddKeys,
+		CanUploadData:  role.CanUploadData,
+		CanDeleteKeys:  role.CanDeleteKeys,
+	}
+}
+
+func userJsonToProto(user users.UserSafeJson) *rpc.User {
+	return &rpc.User{
+		Id:       user.Id,
+		Name:     user.Name,
+		Role:     roleToProto(user.Role),
+		Username: user.Username,
+		Groups:   user.Groups,
+	}
+}
+
+func userToProto(user *users.User) *rpc.User {
+	return userJsonToProto(users.UserSafeJsonFromUser(user))
+}
+
+func (g *grpcServer) CreateUser(ctx context.Context, req *rpc.CreateUserRequest) (*rpc.User, error) {
+	id := req.Id
+	if id == "" {
+		id = uuid.NewString()
+	}
+	user, err := g.svc.CreateUser(grpcPrincipal(ctx), &users.UserJson{
+		Id:           id,
+		Name:         req.Name,
+		Role:         roleFromProto(req.Role),
+		Username:     req.Username,
+		PasswordHash: req.PasswordHash,
+		ApiKey:       req.ApiKey,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return userToProto(user), nil
+}
+
+func (g *grpcServer) ListUsers(ctx context.Context, req *rpc.ListUsersRequest) (*rpc.UserList, error) {
+	list, err := g.svc.ListUsers(grpcPrincipal(ctx), int(req.Offset), int(req.Limit))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	ret := &rpc.UserList{
+		Users:  make([]*rpc.User, 0, len(list.Users)),
+		Total:  int32(list.Total),
+		Offset: int32(list.Offset),
+		Limit:  int32(list.Limit),
+	}
+	for _, user := range list.Users {
+		ret.Users = append(ret.Users, userJsonToProto(user))
+	}
+	return ret, nil
+}
+
+func (g *grpcServer) GetUser(ctx context.Context, req *rpc.UserRequest) (*rpc.User, error) {
+	user, err := g.svc.GetUser(grpcPrincipal(ctx), req.User)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return userToProto(user), nil
+}
+
+func (g *grpcServer) SetUserRole(ctx context.Context, req *rpc.SetUserRoleRequest) (*rpc.User, error) {
+	user, err := g.svc.SetUserRole(grpcPrincipal(ctx), req.User, roleFromProto(req.Role))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return userToProto(user), nil
+}
+
+func (g *grpcServer) DeleteUser(ctx context.Context, req *rpc.UserRequest) (*emptypb.Empty, error) {
+	_, err := g.svc.DeleteUser(grpcPrincipal(ctx), req.User)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (g *grpcServer) ResetPassword(ctx context.Context, req *rpc.ResetPasswordRequest) (*emptypb.Empty, error) {
+	_, err := g.svc.ResetPassword(grpcPrincipal(ctx), req.User, req.Password)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &emptypb.Empty{}, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"net"
+	"secure-store/client"
+	"secure-store/rpc"
+	"secure-store/users"
+	"strings"
+	"testing"
+)
+
+func newGrpcTestClient(t *testing.T) (*testServer, *client.GrpcClient, []byte) {
+	server := newTestServer(t)
+	apiKey, err := base64.RawURLEncoding.DecodeString(server.rootApiKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := NewGrpcServer(NewService(server.store, server.access, server.users, server.auth, server.presign, nil), server.auth)
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+	grpcClient, err := client.NewGrpcClient("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = grpcClient.Close()
+	})
+	return server, grpcClient, apiKey
+}
+
+func expectGrpcCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Errorf("Expected %v, got %v", code, err)
+	}
+}
+
+func TestGrpcObjects(t *testing.T) {
+	_, grpcClient, apiKey := newGrpcTestClient(t)
+
+	err := grpcClient.CreateBucket("reports", apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = grpcClient.CreateBucket("reports", apiKey)
+	expectGrpcCode(t, err, codes.AlreadyExists)
+
+	// Larger than a chunk, so the content arrives in several messages.
+	content := bytes.Repeat([]byte("report of monday "), client.GrpcChunkSize/8)
+	info, err := grpcClient.Upload("reports", "monday", bytes.NewReader(content), int64(len(content)), "monday.txt", apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Length != int64(len(content)) || info.Owner != RootUserId {
+		t.Errorf("Unexpected object info %v", info)
+	}
+	_, err = grpcClient.Upload("reports", "tuesday", strings.NewReader("short"), 10, "", apiKey)
+	expectGrpcCode(t, err, codes.InvalidArgument)
+
+	objects, err := grpcClient.ListObjects("reports", "", apiKey)
+	if err != nil || len(objects) != 1 || objects[0].Filename != "monday.txt" {
+		t.Errorf("Unexpected listing %v: %v", objects, err)
+	}
+
+	reader, length, err := grpcClient.Download("reports", "monday", apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := io.ReadAll(reader)
+	if err != nil || length != int64(len(content)) || !bytes.Equal(downloaded, content) {
+		t.Errorf("Downloaded %v of %v bytes: %v", len(downloaded), length, err)
+	}
+
+	err = grpcClient.Delete("reports", "monday", apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = grpcClient.Download("reports", "monday", apiKey)
+	expectGrpcCode(t, err, codes.NotFound)
+	err = grpcClient.DeleteBucket("reports", apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrpcKeysAndUsers(t *testing.T) {
+	server, grpcClient, apiKey := newGrpcTestClient(t)
+	server.putObject(t, "reports", "monday", "content")
+
+	limit := uint64(3)
+	key, err := grpcClient.AddKey(&rpc.AddKeyRequest{BucketId: "reports", KeyId: "monday", UrlKey: "monday-link", Limit: &limit}, apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.GetLimit() != 3 || key.CreatedBy != RootUserId {
+		t.Errorf("Unexpected key %v", key)
+	}
+	raised := uint64(5)
+	key, err = grpcClient.UpdateKey("monday-link", nil, &raised, apiKey)
+	if err != nil || key.GetLimit() != 5 {
+		t.Errorf("Updating returned %v: %v", key, err)
+	}
+	keys, err := grpcClient.ListKeys("reports", "", "", apiKey)
+	if err != nil || len(keys) != 1 {
+		t.Errorf("Unexpected keys %v: %v", keys, err)
+	}
+	err = grpcClient.RevokeKey("monday-link", apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = grpcClient.GetKey("monday-link", apiKey)
+	expectGrpcCode(t, err, codes.NotFound)
+
+	readerKey := bytes.Repeat([]byte{2}, users.APIKeyLength)
+	created, err := grpcClient.AddUser(&users.UserJson{
+		Id:           uuid.NewString(),
+		Name:         "Reader",
+		Username:     "reader",
+		PasswordHash: users.DerivePasswordKey("reader-password"),
+		ApiKey:       readerKey,
+	}, apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := grpcClient.ListUsers(0, 0, apiKey)
+	if err != nil || list.Total != 2 {
+		t.Errorf("Unexpected user list %v: %v", list, err)
+	}
+	_, err = grpcClient.ListUsers(0, 0, readerKey)
+	expectGrpcCode(t, err, codes.PermissionDenied)
+	err = grpcClient.CreateBucket("notes", readerKey)
+	expectGrpcCode(t, err, codes.PermissionDenied)
+
+	updated, err := grpcClient.UpdateRole("reader", users.Role{CanUploadData: true}, apiKey)
+	if err != nil || !updated.Role.CanUploadData {
+		t.Errorf("Updating role returned %v: %v", updated, err)
+	}
+	err = grpcClient.DeleteUser(created.Id, apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = grpcClient.GetUser("reader", apiKey)
+	expectGrpcCode(t, err, codes.NotFound)
+}
+
+func TestGrpcAuthentication(t *testing.T) {
+	_, grpcClient, _ := newGrpcTestClient(t)
+
+	_, err := grpcClient.ListBuckets(bytes.Repeat([]byte{9}, users.APIKeyLength))
+	expectGrpcCode(t, err, codes.Unauthenticated)
+	_, _, err = grpcClient.Download("reports", "monday", nil)
+	expectGrpcCode(t, err, codes.Unauthenticated)
+	_, err = grpcClient.Upload("reports", "monday", strings.NewReader("content"), 7, "", nil)
+	expectGrpcCode(t, err, codes.Unauthenticated)
+}
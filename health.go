@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const ReadinessTimeout = 2 * time.Second
+
+const HealthOk = "ok"
+const HealthDown = "down"
+const HealthUnchecked = "unchecked"
+
+// HealthChecker is implemented by stores that depend on something which can
+// fail on its own, like a database or a directory. Stores without it are
+// reported as unchecked.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// wrappedStore is implemented by decorators, health checks look through them
+// at the store they wrap.
+type wrappedStore interface {
+	unwrap() interface{}
+}
+
+type ComponentHealthJson struct {
+	Status         string  `json:"Status"`
+	Implementation string  `json:"Implementation"`
+	LatencyMs      float64 `json:"LatencyMs"`
+	Error          string  `json:"Error,omitempty"`
+}
+
+type HealthJson struct {
+	Status     string                         `json:"Status"`
+	Components map[string]ComponentHealthJson `json:"Components,omitempty"`
+}
+
+func unwrapStore(store interface{}) interface{} {
+	for {
+		wrapped, ok := store.(wrappedStore)
+		if !ok {
+			return store
+		}
+		store = wrapped.unwrap()
+	}
+}
+
+func checkComponent(ctx context.Context, store interface{}) (ComponentHealthJson, error) {
+	store = unwrapStore(store)
+	component := ComponentHealthJson{Status: HealthUnchecked, Implementation: implementationName(store)}
+	checker, ok := store.(HealthChecker)
+	if !ok {
+		return component, nil
+	}
+	start := time.Now()
+	err := checker.CheckHealth(ctx)
+	component.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		component.Status = HealthDown
+		return component, err
+	}
+	component.Status = HealthOk
+	return component, nil
+}
+
+// checkReadiness probes all components at once, the service is ready if none
+// of them is down.
+func checkReadiness(ctx context.Context, components map[string]interface{}, isInDebugMode bool) (*HealthJson, bool) {
+	ctx, cancel := context.WithTimeout(ctx, ReadinessTimeout)
+	defer cancel()
+	health := &HealthJson{Status: HealthOk, Components: make(map[string]ComponentHealthJson, len(components))}
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	for name, store := range components {
+		wg.Add(1)
+		go func(name string, store interface{}) {
+			defer wg.Done()
+			component, err := checkComponent(ctx, store)
+			if err != nil {
+				logrus.WithError(err).WithField("Component", name).Errorf("Health check failed.")
+				if isInDebugMode {
+					component.Error = err.Error()
+				}
+			}
+			m.Lock()
+			defer m.Unlock()
+			health.Components[name] = component
+			if component.Status == HealthDown {
+				health.Status = HealthDown
+			}
+		}(name, store)
+	}
+	wg.Wait()
+	return health, health.Status != HealthDown
+}
+
+// registerHealthRoutes adds /healthz, which only tells the process is alive,
+// and /readyz, which probes the backends in components.
+func registerHealthRoutes(router *gin.Engine, components map[string]interface{}, isInDebugMode bool) {
+	router.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, HealthJson{Status: HealthOk})
+	})
+
+	router.GET("/readyz", func(c *gin.Context) {
+		health, ready := checkReadiness(c.Request.Context(), components, isInDebugMode)
+		if !ready {
+			c.JSON(http.StatusServiceUnavailable, health)
+			return
+		}
+		c.JSON(http.StatusOK, health)
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"secure-store/storage"
+	"testing"
+)
+
+func TestHealthRoutes(t *testing.T) {
+	server := newTestServer(t)
+
+	w := server.do(httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Liveness answered %v", w.Code)
+	}
+	w = server.do(httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	health := HealthJson{}
+	err := json.Unmarshal(w.Body.Bytes(), &health)
+	if err != nil || w.Code != http.StatusOK || health.Status != HealthOk {
+		t.Fatalf("Readiness answered %v: %v", w.Code, w.Body.String())
+	}
+	for _, name := range []string{"access", "metadata", "security", "storage", "users"} {
+		component, ok := health.Components[name]
+		if !ok || component.Status != HealthUnchecked {
+			t.Errorf("Unexpected health of %v: %+v", name, component)
+		}
+	}
+}
+
+func TestReadinessProbesBackends(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := storage.NewFsStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	components := map[string]interface{}{"storage": NewMetrics().Storage(fs)}
+
+	health, ready := checkReadiness(context.Background(), components, true)
+	if !ready || health.Components["storage"].Status != HealthOk || health.Components["storage"].Implementation != "storage.FsStorage" {
+		t.Errorf("Unexpected health %+v", health)
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health, ready = checkReadiness(context.Background(), components, true)
+	if ready || health.Status != HealthDown || health.Components["storage"].Error == "" {
+		t.Errorf("Removed data directory reported as %+v", health)
+	}
+}
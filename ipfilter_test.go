@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"secure-store/access"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadIpRestrictions(t *testing.T) {
+	server := newTestServer(t)
+	server.putObject(t, "office", "report", "quarterly numbers")
+	key, err := access.FromExAccessKey(access.ExAccessKey{
+		BucketId:     "office",
+		KeyId:        "report",
+		UrlKey:       "office-report",
+		AllowedCidrs: []string{"192.0.2.0/24", "2001:db8::/32"},
+		DeniedCidrs:  []string{"192.0.2.66", "2001:db8:bad::/48"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.access.AddKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"192.0.2.10:40000", http.StatusOK},
+		{"192.0.2.66:40000", http.StatusForbidden},
+		{"203.0.113.5:40000", http.StatusForbidden},
+		{"[2001:db8::10]:40000", http.StatusOK},
+		{"[2001:db8:bad::1]:40000", http.StatusForbidden},
+		{"[2001:db9::1]:40000", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/api/download?urlKey=office-report", nil)
+		req.RemoteAddr = c.remoteAddr
+		w := server.do(req)
+		if w.Code != c.status {
+			t.Errorf("Download from %v answered %v instead of %v", c.remoteAddr, w.Code, c.status)
+		}
+	}
+}
+
+func TestDownloadIpRestrictionsBehindProxy(t *testing.T) {
+	server := newTestServer(t)
+	server.putObject(t, "office", "report", "quarterly numbers")
+	key, err := access.FromExAccessKey(access.ExAccessKey{
+		BucketId:     "office",
+		KeyId:        "report",
+		UrlKey:       "office-report",
+		AllowedCidrs: []string{"192.0.2.0/24", "2001:db8::/32"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.access.AddKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	download := func(remoteAddr, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/download?urlKey=office-report", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		return server.do(req).Code
+	}
+
+	// Without trusted proxies the header is ignored.
+	if code := download("10.0.0.2:40000", "192.0.2.10"); code != http.StatusForbidden {
+		t.Errorf("Untrusted forwarded header was honored with %v", code)
+	}
+	err = server.setProxy([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remoteAddr   string
+		forwardedFor string
+		status       int
+	}{
+		{"10.0.0.2:40000", "192.0.2.10", http.StatusOK},
+		{"10.0.0.2:40000", "203.0.113.5", http.StatusForbidden},
+		{"[fd00::2]:40000", "2001:db8::10", http.StatusOK},
+		{"[fd00::2]:40000", "2001:db9::10", http.StatusForbidden},
+		// Entries left of an untrusted hop can be forged by the client.
+		{"10.0.0.2:40000", "192.0.2.10, 203.0.113.5", http.StatusForbidden},
+		{"10.0.0.2:40000", "203.0.113.5, 192.0.2.10, 10.0.0.3", http.StatusOK},
+		// A client that isn't a trusted proxy can't forward for others.
+		{"203.0.113.5:40000", "192.0.2.10", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if code := download(c.remoteAddr, c.forwardedFor); code != c.status {
+			t.Errorf("Download from %v for %v answered %v instead of %v", c.remoteAddr, c.forwardedFor, code, c.status)
+		}
+	}
+}
+
+func TestInactiveKeysHiddenFromFailedChecks(t *testing.T) {
+	server := newTestServer(t)
+	server.putObject(t, "office", "report", "quarterly numbers")
+	notBefore := time.Now().Add(time.Hour)
+	key, err := access.FromExAccessKey(access.ExAccessKey{
+		BucketId:        "office",
+		KeyId:           "report",
+		UrlKey:          "office-report",
+		Passwords:       []string{"open-sesame"},
+		ResolveByUrlKey: true,
+		NotBefore:       &notBefore,
+		AllowedCidrs:    []string{"192.0.2.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.access.AddKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		remoteAddr string
+		password   string
+		inactive   bool
+	}{
+		{"203.0.113.5:40000", "open-sesame", false},
+		{"192.0.2.10:40000", "wrong", false},
+		{"192.0.2.10:40000", "open-sesame", true},
+	}
+	for _, c := range cases {
+		unlockKey := base64.RawURLEncoding.EncodeToString([]byte(c.password))
+		req := httptest.NewRequest(http.MethodGet, "/api/download?urlKey=office-report&"+UnlockKeyQuery+"="+unlockKey, nil)
+		req.RemoteAddr = c.remoteAddr
+		w := server.do(req)
+		if w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "Inactive") != c.inactive {
+			t.Errorf("Download from %v with %v answered %v: %v", c.remoteAddr, c.password, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"secure-store/access"
+	"secure-store/users"
+)
+
+type KeyListJson struct {
+	Keys []access.AccessKeyInfo `json:"Keys"`
+}
+
+func keyLog(actor *users.User, key *access.AKey) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"Acting User":    actor.Username,
+		"Acting User Id": actor.Id,
+		"Url Key":        key.UrlKey,
+		"Bucket Id":      key.BucketId,
+		"Key Id":         key.KeyId,
+	})
+}
+
+func registerKeyRoutes(router *gin.Engine, svc *Service, auth *Authenticator) {
+	router.GET("/api/keys", auth.Middleware(), func(c *gin.Context) {
+		keys, err := svc.ListKeys(context.TODO(), CurrentPrincipal(c), c.Query("bucketId"), c.Query("keyId"), c.Query("createdBy"))
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, KeyListJson{Keys: keys})
+	})
+
+	router.GET("/api/keys/:urlKey", auth.Middleware(), func(c *gin.Context) {
+		key, err := svc.GetKey(context.TODO(), CurrentPrincipal(c), c.Param("urlKey"))
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, key.Info())
+	})
+
+	router.PATCH("/api/keys/:urlKey", auth.Middleware(), func(c *gin.Context) {
+		update := access.KeyUpdate{}
+		err := c.ShouldBindJSON(&update)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		updated, err := svc.UpdateKey(context.TODO(), CurrentPrincipal(c), c.Param("urlKey"), update)
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, updated.Info())
+	})
+
+	router.DELETE("/api/keys/:urlKey", auth.Middleware(), func(c *gin.Context) {
+		key, err := svc.RevokeKey(context.TODO(), CurrentPrincipal(c), c.Param("urlKey"))
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.String(http.StatusOK, "Revoked access key: %v", key.UrlKey)
+	})
+
+	router.DELETE("/api/keys/:urlKey/lockout", auth.Middleware(), func(c *gin.Context) {
+		key, err := svc.UnlockKey(context.TODO(), CurrentPrincipal(c), c.Param("urlKey"))
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.String(http.StatusOK, "Unlocked access key: %v", key.UrlKey)
+	})
+}
@@ -2,20 +2,23 @@ package main
 
 import (
 	"context"
-	"crypto/sha512"
+	"encoding/base64"
 	"fmt"
-	"github.com/gin-gonic/autotls"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"log"
+	"net"
 	"os"
 	"secure-store/access"
 	"secure-store/metadata"
+	"secure-store/presign"
 	"secure-store/security"
 	"secure-store/storage"
 	"secure-store/users"
-	"strconv"
 	"strings"
 )
 
@@ -35,14 +38,21 @@ const RedisEnvPort = "REDIS_PORT"
 const RedisEnvPassword = "REDIS_PASSWORD"
 const RedisEnvDb = "REDIS_DB"
 
+const SessionSecretEnv = "SESSION_SECRET"
+const TotpKeyEnv = "TOTP_ENCRYPTION_KEY"
+const PresignKeysEnv = "PRESIGN_KEYS"
+
+const TrustedProxiesEnv = "TRUSTED_PROXIES"
+
+const LockoutMaxFailuresEnv = "LOCKOUT_MAX_FAILURES"
+const LockoutBaseDelayEnv = "LOCKOUT_BASE_DELAY"
+const LockoutMaxDelayEnv = "LOCKOUT_MAX_DELAY"
+const LockoutWindowEnv = "LOCKOUT_WINDOW"
+
 const RootUserId = "83672c3d-bb08-4d65-9d71-1191dc11cb80"
 const RootName = "Root"
 const RootUsername = "root"
 
-var RootPassword = []byte("password")
-
-var HashedRootPassword = sha512.New().Sum(RootPassword)
-
 var RootRule = users.Role{
 	RootUser:       true,
 	CanCreateUsers: true,
@@ -51,40 +61,44 @@ var RootRule = users.Role{
 	CanDeleteKeys:  true,
 }
 
-var RootApiKey = []byte("root-api-key")
-
-var RootUserJson = users.UserJson{
-	Id:           RootUserId,
-	Name:         RootName,
-	Role:         RootRule,
-	Username:     RootUsername,
-	PasswordHash: HashedRootPassword,
-	ApiKey:       RootApiKey,
-}
-
-var RootUser, _ = users.UserFromUserJson(&RootUserJson)
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == ResetRootCommand {
+		err := ResetRoot(os.Getenv(RootSecretsFileEnv))
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't reset root credentials")
+		}
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == ConfigCommand && os.Args[2] == ConfigValidateCommand {
+		path := os.Getenv(ConfigFileEnv)
+		if len(os.Args) > 3 {
+			path = os.Args[3]
+		}
+		if !ValidateConfig(path) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	fmt.Println("Welcome to Secure-Store v0.0.1 👋")
 	fmt.Println("I will keep your files secure and accessible 🔒")
 	fmt.Println(" ❌  Don't use this software in production!! ❌  ")
 	fmt.Println("@umgefahren")
 
-	port := os.Getenv(PortEnv)
-	if port == "" {
-		port = "8080"
+	configFile := os.Getenv(ConfigFileEnv)
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid config, run config validate to list the problems")
 	}
+	live := NewLiveSettings(config)
+	live.ReloadOnHangup(configFile)
 
-	logrus.WithField("port", port).Info("Starting server")
+	logrus.WithField("port", config.Port).Info("Starting server")
 
 	var s storage.Storage
-	storageEnv := os.Getenv(StorageEnv)
-	logrus.WithFields(logrus.Fields{
-		"Storage Env": storageEnv,
-	}).Infoln("Storage Env variable")
-	switch storageEnv {
+	switch config.Storage.Kind {
 	case StorageEnvFs:
-		dataDir := os.Getenv(DataDirEnv)
+		dataDir := config.Storage.DataDir
 		if dataDir == "" {
 			dataDir = os.TempDir() + "data/" + uuid.NewString()
 		}
@@ -100,96 +114,209 @@ func main() {
 		store := storage.NewMemoryStorage()
 		logrus.Infoln("Using Memory Storage")
 		s = store
-	default:
-		err := os.Setenv(StorageEnv, StorageEnvMem)
-		if err != nil {
-			logrus.WithError(err).Errorf("While setting environment variable")
-		}
-		logrus.WithField("Storage Env", storageEnv).Fatal("storage env variable is invalid, setting storage to memory")
 	}
 
-	m := metadata.NewMemoryStore()
+	metrics := NewMetrics()
+	m := metrics.MetadataStore(metadata.NewMemoryStore())
 	sec := security.NewMemorySecurityStore()
 	compound := CompoundStore{
 		metadata: m,
 		security: sec,
-		storage:  s,
+		storage:  metrics.Storage(s),
 	}
 
 	var a access.AccessStore
-	accessEnv := os.Getenv(AccessEnv)
-	switch accessEnv {
+	switch config.Access.Kind {
 	case AccessEnvMem:
 		a = access.NewMemoryStore()
 		logrus.Infoln("Using in memory access storage")
 	case AccessEnvRedis:
-		redisHost := os.Getenv(RedisEnvHost)
-		if redisHost == "" {
-			redisHost = "0.0.0.0"
-			logrus.WithField("Redis Host", redisHost).Infoln("Falling back on default redis host")
-		}
-		redisPort := os.Getenv(RedisEnvPort)
-		if redisPort == "" {
-			redisPort = "6379"
-			logrus.WithField("Redis Port", redisPort).Infoln("Falling back on default redis port")
-		}
-		redisPassword := os.Getenv(RedisEnvPassword)
-		if redisPassword == "" {
-			redisPassword = ""
-			logrus.WithField("Redis Password", redisPassword).Infoln("Falling back on default redis password")
-		}
-		redisDb := os.Getenv(RedisEnvDb)
-		if redisDb == "" {
-			redisDb = "0"
-			logrus.WithField("Redis Db", redisDb).Infoln("Falling back on default redis db")
-		}
-		redisDbInt, err := strconv.ParseInt(redisDb, 10, 32)
-		if err != nil {
-			logrus.WithError(err).Fatal("Couldn't parse redis db environment variable")
-		}
+		redisConfig := config.Access.Redis
 		logrus.WithFields(logrus.Fields{
-			"Redis Host": redisHost,
-			"Redis Port": redisPort,
-			"Redis Db":   redisDb,
+			"Redis Host": redisConfig.Host,
+			"Redis Port": redisConfig.Port,
+			"Redis Db":   redisConfig.Db,
 		}).Infoln("Starting redis client.")
 		redisClient := redis.NewClient(&redis.Options{
-			Addr:     fmt.Sprintf("%v:%v", redisHost, redisPort),
-			Password: redisPassword,
-			DB:       int(redisDbInt),
+			Addr:     fmt.Sprintf("%v:%v", redisConfig.Host, redisConfig.Port),
+			Password: redisConfig.Password,
+			DB:       redisConfig.Db,
 		})
 		accessStore, err := access.NewRedisStore(context.TODO(), redisClient)
 		if err != nil {
 			log.Fatal(err)
 		}
 		a = accessStore
-	default:
-		err := os.Setenv(AccessEnv, AccessEnvMem)
-		if err != nil {
-			logrus.WithError(err).Errorf("While setting environment variable")
-		}
-		logrus.WithField("Access Env", accessEnv).Fatal("access env variable is invalid, setting storage to memory")
 	}
+	a = metrics.AccessStore(a)
 
 	u := users.NewMemoryStore()
-	err := u.Create(RootUser)
+	err = BootstrapRoot(u, os.Getenv(RootSecretsFileEnv))
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed during adding root user")
+	}
+	var sessionSecret []byte
+	sessionSecretString := os.Getenv(SessionSecretEnv)
+	if sessionSecretString == "" {
+		sessionSecret, err = users.NewTokenSecret()
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't generate session secret")
+		}
+		logrus.Infoln("Generated random session secret, sessions won't survive a restart")
+	} else {
+		sessionSecret, err = base64.StdEncoding.DecodeString(sessionSecretString)
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't decode session secret environment variable")
+		}
+	}
+	tokens, err := users.NewTokenSigner(sessionSecret)
+	if err != nil {
+		logrus.WithError(err).Fatal("Couldn't create token signer")
+	}
+	var totpKey []byte
+	totpKeyString := os.Getenv(TotpKeyEnv)
+	if totpKeyString == "" {
+		totpKey = security.NewEncryptionKey().Key
+		logrus.Infoln("Generated random totp encryption key, totp secrets won't survive a restart")
+	} else {
+		totpKey, err = base64.StdEncoding.DecodeString(totpKeyString)
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't decode totp encryption key environment variable")
+		}
+	}
+	totpBox, err := users.NewSecretBox(totpKey)
 	if err != nil {
-		logrus.WithError(err).Infoln("Failed during adding root user")
+		logrus.WithError(err).Fatal("Couldn't create totp secret box")
+	}
+	var presigner *presign.Keyring
+	presignKeysString := os.Getenv(PresignKeysEnv)
+	if presignKeysString == "" {
+		presignSecret, err := presign.NewSecret()
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't generate presign secret")
+		}
+		presigner = presign.NewKeyring()
+		err = presigner.Add(1, presignSecret)
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't add presign secret")
+		}
+		logrus.Infoln("Generated random presign secret, presigned urls won't survive a restart")
 	} else {
-		logrus.Infoln("Added root user")
+		presigner, err = presign.ParseKeyring(presignKeysString)
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't parse presign keys environment variable")
+		}
+	}
+	failures, ok := a.(access.FailureStore)
+	if !ok {
+		logrus.Fatal("Access store can't count unlock failures")
+	}
+	lockout, err := access.NewLockout(failures, config.Lockout, nil)
+	if err != nil {
+		logrus.WithError(err).Fatal("Couldn't create lockout")
+	}
+	auth := NewAuthenticator(u, users.NewMemorySessionStore(), tokens, users.NewTotpManager(u, totpBox), lockout)
+	r := NewRouter(&compound, a, u, auth, presigner, lockout, metrics, live)
+	if len(config.TrustedProxies) > 0 {
+		err = r.SetTrustedProxies(config.TrustedProxies)
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't set trusted proxies")
+		}
+		logrus.WithField("Trusted Proxies", strings.Join(config.TrustedProxies, ",")).Infoln("Taking client ips from forwarded headers of trusted proxies")
+	}
+
+	var certificates *CertificateFiles
+	minTlsVersion := TlsVersions[config.Tls.MinVersion]
+	if config.Tls.CertFile != "" {
+		certificates, err = NewCertificateFiles(config.Tls.CertFile, config.Tls.KeyFile, config.Tls.ClientCaFile)
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't load tls certificate")
+		}
+		logrus.WithFields(logrus.Fields{
+			"Certificate File": config.Tls.CertFile,
+			"Min Version":      config.Tls.MinVersion,
+		}).Infoln("Serving tls with the certificate files, changed files are reloaded")
+		if config.Tls.ClientCaFile != "" {
+			auth.MapClientCertificates(config.Tls.ClientUsers)
+			logrus.WithField("Client Users", len(config.Tls.ClientUsers)).Infoln("Accepting client certificates")
+		}
 	}
-	r := NewRouter(&compound, a, u)
 
-	domainsString := os.Getenv("DOMAINS")
-	if domainsString == "" {
-		logrus.Fatal(r.Run(fmt.Sprintf("0.0.0.0:%v", port)))
+	shutdown := NewShutdown(config.ShutdownTimeout)
+
+	s3Port := config.S3Port
+	var s3 *s3Gateway
+	if s3Port != "" {
+		s3 = newS3Gateway(NewService(&compound, a, u, auth, presigner, lockout), u)
+		server := shutdown.Server(fmt.Sprintf("0.0.0.0:%v", s3Port), s3.router())
+		logrus.WithField("port", s3Port).Info("Starting S3 gateway")
+		shutdown.Serve("S3 gateway", listenAndServe(server, certificates, minTlsVersion))
+	}
+
+	grpcPort := config.GrpcPort
+	if grpcPort != "" {
+		var options []grpc.ServerOption
+		if certificates != nil {
+			options = append(options, grpc.Creds(credentials.NewTLS(certificates.ServerConfig(minTlsVersion, "h2"))))
+		}
+		grpcServer := NewGrpcServer(NewService(&compound, a, u, auth, presigner, lockout), auth, options...)
+		listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%v", grpcPort))
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't listen on gRPC port")
+		}
+		shutdown.AddGrpcServer(grpcServer)
+		logrus.WithField("port", grpcPort).Info("Starting gRPC server")
+		shutdown.Serve("gRPC server", func() error {
+			return grpcServer.Serve(listener)
+		})
+	}
+
+	webdavPort := config.WebDavPort
+	if webdavPort != "" {
+		webdav, err := NewWebDavHandler(NewService(&compound, a, u, auth, presigner, lockout), u)
+		if err != nil {
+			logrus.WithError(err).Fatal("Couldn't create WebDAV handler")
+		}
+		server := shutdown.Server(fmt.Sprintf("0.0.0.0:%v", webdavPort), webdav)
+		logrus.WithField("port", webdavPort).Info("Starting WebDAV server")
+		shutdown.Serve("WebDAV server", listenAndServe(server, certificates, minTlsVersion))
+	}
+
+	// Metrics stay off the public ports, scrapers reach them on a port of
+	// their own.
+	metricsPort := config.MetricsPort
+	if metricsPort != "" {
+		server := shutdown.Server(fmt.Sprintf("0.0.0.0:%v", metricsPort), metrics.Handler())
+		logrus.WithField("port", metricsPort).Info("Starting metrics server")
+		shutdown.Serve("Metrics server", listenAndServe(server, certificates, minTlsVersion))
+	}
+
+	if len(config.Domains) == 0 {
+		server := shutdown.Server(fmt.Sprintf("0.0.0.0:%v", config.Port), r)
+		shutdown.Serve("Server", listenAndServe(server, certificates, minTlsVersion))
 	} else {
-		domains := strings.Split(domainsString, ",")
-		domainsFiltered := make([]string, 0)
-		for _, d := range domains {
-			if d != "" {
-				domainsFiltered = append(domainsFiltered, d)
-			}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.Domains...),
+			Cache:      autocert.DirCache(autocertCacheDir()),
 		}
-		logrus.Fatal(autotls.Run(r, domainsFiltered...))
+		// The http port answers the acme challenges and redirects everything
+		// else to https.
+		redirect := shutdown.Server(":http", manager.HTTPHandler(nil))
+		shutdown.Serve("Redirect server", redirect.ListenAndServe)
+		server := shutdown.Server(":https", r)
+		server.TLSConfig = manager.TLSConfig()
+		server.TLSConfig.MinVersion = minTlsVersion
+		shutdown.Serve("Server", func() error {
+			return server.ListenAndServeTLS("", "")
+		})
+	}
+
+	// The gateway deletes the parts of unfinished uploads, so it goes before
+	// the stores.
+	if s3 != nil {
+		shutdown.AddCloser(s3)
 	}
+	shutdown.AddCloser(a, compound.metadata, compound.security, compound.storage, u)
+	shutdown.Wait()
 }
@@ -2,7 +2,9 @@ package metadata
 
 import (
 	"errors"
+	"sort"
 	"secure-store/storage"
+	"strings"
 	"sync"
 )
 
@@ -83,3 +85,20 @@ func (m *MemoryStore) ListBuckets() ([]string, error) {
 	}
 	return ret, nil
 }
+
+func (m *MemoryStore) ListKeys(bucketId, prefix string) ([]string, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	bucket, ok := m.i[bucketId]
+	if !ok {
+		return nil, storage.BucketDoesNotExist(bucketId)
+	}
+	ret := make([]string, 0)
+	for key := range bucket {
+		if strings.HasPrefix(key, prefix) {
+			ret = append(ret, key)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
@@ -16,3 +16,8 @@ func TestDeleteMemory(t *testing.T) {
 	db := NewMemoryStore()
 	DeleteTest(t, db)
 }
+
+func TestListKeysMemory(t *testing.T) {
+	db := NewMemoryStore()
+	ListKeysTest(t, db)
+}
@@ -7,11 +7,13 @@ type MetadataStore interface {
 	Delete(bucket, key string) error
 	DeleteBucket(bucket string) error
 	ListBuckets() ([]string, error)
+	ListKeys(bucketId, prefix string) ([]string, error)
 }
 
 type Metadata struct {
 	Length   int64
 	Filename string
+	Owner    string
 }
 
 func NewMetadata(length int64, filename string) *Metadata {
@@ -153,3 +153,31 @@ func DeleteTest(t *testing.T, db MetadataStore) {
 	}
 	wg2.Wait()
 }
+
+func ListKeysTest(t *testing.T, db MetadataStore) {
+	bucket := "ListBucket"
+	err := db.NewBucket(bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, key := range []string{"report-b", "invoice", "report-a"} {
+		err = db.Write(bucket, key, &Metas[idx])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	all, err := db.ListKeys(bucket, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || all[0] != "invoice" || all[1] != "report-a" || all[2] != "report-b" {
+		t.Errorf("Listing the bucket returned %v", all)
+	}
+	reports, err := db.ListKeys(bucket, "report-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 || reports[0] != "report-a" {
+		t.Errorf("Listing the prefix returned %v", reports)
+	}
+}
@@ -1,8 +1,10 @@
 package metadata
 
 import (
+	"context"
 	"errors"
 	"gorm.io/gorm"
+	"strings"
 	"sync"
 )
 
@@ -16,6 +18,7 @@ type SQLMetadata struct {
 	gorm.Model
 	Length   int64
 	Filename string
+	Owner    string
 	BucketId string
 	KeyId    string
 }
@@ -24,6 +27,7 @@ func MetadataFromSQLMetadata(sqlMeta *SQLMetadata) *Metadata {
 	return &Metadata{
 		Length:   sqlMeta.Length,
 		Filename: sqlMeta.Filename,
+		Owner:    sqlMeta.Owner,
 	}
 }
 
@@ -31,6 +35,7 @@ func SQLMetadataFromMetadata(bucketId, keyId string, meta *Metadata) *SQLMetadat
 	return &SQLMetadata{
 		Length:   meta.Length,
 		Filename: meta.Filename,
+		Owner:    meta.Owner,
 		BucketId: bucketId,
 		KeyId:    keyId,
 	}
@@ -106,3 +111,39 @@ func (s *SQLStore) ListBuckets() ([]string, error) {
 	defer s.m.Unlock()
 	return s.buckets, nil
 }
+
+// ListKeys filters the prefix in go, a LIKE pattern would need escaping that
+// differs between the sql dialects.
+func (s *SQLStore) ListKeys(bucketId, prefix string) ([]string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var keyIds []string
+	result := s.db.Model(&SQLMetadata{}).Where("bucket_id = ?", bucketId).Order("key_id").Pluck("key_id", &keyIds)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	ret := make([]string, 0, len(keyIds))
+	for _, keyId := range keyIds {
+		if strings.HasPrefix(keyId, prefix) {
+			ret = append(ret, keyId)
+		}
+	}
+	return ret, nil
+}
+
+// CheckHealth pings the database.
+func (s *SQLStore) CheckHealth(ctx context.Context) error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.PingContext(ctx)
+}
+
+func (s *SQLStore) Close() error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
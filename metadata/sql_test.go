@@ -31,3 +31,12 @@ func TestDelete(t *testing.T) {
 	}
 	DeleteTest(t, db)
 }
+
+func TestListKeys(t *testing.T) {
+	dbSqlite := sqlite.Open("file::memory:?cache=shared")
+	db, err := NewSQLStore(dbSqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ListKeysTest(t, db)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"secure-store/access"
+	"secure-store/metadata"
+	"secure-store/storage"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MetricsNamespace = "secure_store"
+const MetricsPortEnv = "METRICS_PORT"
+
+const OutcomeGranted = "granted"
+const OutcomeExpired = "expired"
+const OutcomeExhausted = "exhausted"
+const OutcomeInactive = "inactive"
+const OutcomeMissing = "missing"
+const OutcomeBadUnlockKey = "bad_unlock_key"
+
+// Metrics collects what the metrics port exports on a registry of its own. The
+// stores are measured by wrapping them with Storage, MetadataStore and
+// AccessStore.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	bytes           *prometheus.CounterVec
+	activeStreams   prometheus.Gauge
+	keyOutcomes     *prometheus.CounterVec
+	backendDuration *prometheus.HistogramVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by route, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "object_bytes_total",
+			Help:      "Bytes of object content written to and read from the storage.",
+		}, []string{"direction"}),
+		activeStreams: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "active_streams",
+			Help:      "Uploads and downloads currently streaming from or to the storage.",
+		}),
+		keyOutcomes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "access_key_uses_total",
+			Help:      "Attempts to use access keys by outcome. Backends that drop expired keys report them as missing.",
+		}, []string{"outcome"}),
+		backendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "backend_operation_duration_seconds",
+			Help:      "Latency of store operations by store, implementation and operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"store", "implementation", "operation"}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.bytes,
+		m.activeStreams,
+		m.keyOutcomes,
+		m.backendDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	for _, outcome := range []string{OutcomeGranted, OutcomeExpired, OutcomeExhausted, OutcomeInactive, OutcomeMissing, OutcomeBadUnlockKey} {
+		m.keyOutcomes.WithLabelValues(outcome)
+	}
+	for _, direction := range []string{"upload", "download"} {
+		m.bytes.WithLabelValues(direction)
+	}
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format. It isn't part of
+// the public router, main serves it on the metrics port.
+func (m *Metrics) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// Middleware counts requests under their route pattern, so path parameters
+// don't blow up the number of series.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		m.requests.WithLabelValues(route, c.Request.Method, status).Inc()
+		m.requestDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *Metrics) observe(store, implementation, operation string, start time.Time) {
+	m.backendDuration.WithLabelValues(store, implementation, operation).Observe(time.Since(start).Seconds())
+}
+
+func implementationName(store interface{}) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", store), "*")
+}
+
+type meteredStorage struct {
+	inner          storage.Storage
+	m              *Metrics
+	implementation string
+}
+
+// Storage measures s and counts the bytes streamed through it.
+func (m *Metrics) Storage(s storage.Storage) storage.Storage {
+	return &meteredStorage{inner: s, m: m, implementation: implementationName(s)}
+}
+
+func (s *meteredStorage) unwrap() interface{} {
+	return s.inner
+}
+
+func (s *meteredStorage) NewBucket(bucket string) error {
+	defer s.m.observe("storage", s.implementation, "new_bucket", time.Now())
+	return s.inner.NewBucket(bucket)
+}
+
+func (s *meteredStorage) Write(bucket, key string, data io.Reader) error {
+	defer s.m.observe("storage", s.implementation, "write", time.Now())
+	s.m.activeStreams.Inc()
+	defer s.m.activeStreams.Dec()
+	return s.inner.Write(bucket, key, &countingReader{reader: data, counter: s.m.bytes.WithLabelValues("upload")})
+}
+
+func (s *meteredStorage) Read(bucket, key string) (io.ReadCloser, error) {
+	defer s.m.observe("storage", s.implementation, "read", time.Now())
+	reader, err := s.inner.Read(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamReader(reader, s.m), nil
+}
+
+func (s *meteredStorage) Delete(bucket, key string) error {
+	defer s.m.observe("storage", s.implementation, "delete", time.Now())
+	return s.inner.Delete(bucket, key)
+}
+
+func (s *meteredStorage) DeleteBucket(bucket string) error {
+	defer s.m.observe("storage", s.implementation, "delete_bucket", time.Now())
+	return s.inner.DeleteBucket(bucket)
+}
+
+func (s *meteredStorage) ListBuckets() ([]string, error) {
+	defer s.m.observe("storage", s.implementation, "list_buckets", time.Now())
+	return s.inner.ListBuckets()
+}
+
+type countingReader struct {
+	reader  io.Reader
+	counter prometheus.Counter
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+// streamReader counts a download as active until the request closes it.
+type streamReader struct {
+	countingReader
+	closer io.Closer
+	m      *Metrics
+	once   sync.Once
+}
+
+func newStreamReader(reader io.ReadCloser, m *Metrics) *streamReader {
+	m.activeStreams.Inc()
+	return &streamReader{countingReader: countingReader{reader: reader, counter: m.bytes.WithLabelValues("download")}, closer: reader, m: m}
+}
+
+func (s *streamReader) Close() error {
+	s.once.Do(s.m.activeStreams.Dec)
+	return s.closer.Close()
+}
+
+// meteredMetadataStore keeps the bucket and object gauges up to date as the
+// store changes. The gauges are approximate, they count every write as a new
+// object and every delete as a removed one, which holds for the service since
+// it never overwrites metadata or deletes what doesn't exist.
+type meteredMetadataStore struct {
+	inner          metadata.MetadataStore
+	m              *Metrics
+	implementation string
+	buckets        prometheus.Gauge
+	objects        prometheus.Gauge
+}
+
+// MetadataStore measures store and exports its buckets and objects as gauges.
+// They are counted once here, scrapes don't walk the store.
+func (m *Metrics) MetadataStore(store metadata.MetadataStore) metadata.MetadataStore {
+	s := &meteredMetadataStore{
+		inner:          store,
+		m:              m,
+		implementation: implementationName(store),
+		buckets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "buckets",
+			Help:      "Buckets in the metadata store.",
+		}),
+		objects: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "objects",
+			Help:      "Objects in the metadata store.",
+		}),
+	}
+	m.registry.MustRegister(s.buckets, s.objects)
+	buckets, err := store.ListBuckets()
+	if err != nil {
+		logrus.WithError(err).Errorf("Counting buckets for metrics failed.")
+		return s
+	}
+	s.buckets.Set(float64(len(buckets)))
+	objects, err := countObjects(store)
+	if err != nil {
+		logrus.WithError(err).Errorf("Counting objects for metrics failed.")
+		return s
+	}
+	s.objects.Set(float64(objects))
+	return s
+}
+
+func countObjects(store metadata.MetadataStore) (int, error) {
+	buckets, err := store.ListBuckets()
+	if err != nil {
+		return 0, err
+	}
+	objects := 0
+	for _, bucket := range buckets {
+		keys, err := store.ListKeys(bucket, "")
+		if err != nil {
+			return 0, err
+		}
+		objects += len(keys)
+	}
+	return objects, nil
+}
+
+func (s *meteredMetadataStore) unwrap() interface{} {
+	return s.inner
+}
+
+func (s *meteredMetadataStore) NewBucket(bucket string) error {
+	defer s.m.observe("metadata", s.implementation, "new_bucket", time.Now())
+	err := s.inner.NewBucket(bucket)
+	if err == nil {
+		s.buckets.Inc()
+	}
+	return err
+}
+
+func (s *meteredMetadataStore) Write(bucketId, keyId string, metadata *metadata.Metadata) error {
+	defer s.m.observe("metadata", s.implementation, "write", time.Now())
+	err := s.inner.Write(bucketId, keyId, metadata)
+	if err == nil {
+		s.objects.Inc()
+	}
+	return err
+}
+
+func (s *meteredMetadataStore) Read(bucketId, keyId string) (*metadata.Metadata, error) {
+	defer s.m.observe("metadata", s.implementation, "read", time.Now())
+	return s.inner.Read(bucketId, keyId)
+}
+
+func (s *meteredMetadataStore) Delete(bucket, key string) error {
+	defer s.m.observe("metadata", s.implementation, "delete", time.Now())
+	err := s.inner.Delete(bucket, key)
+	if err == nil {
+		s.objects.Dec()
+	}
+	return err
+}
+
+func (s *meteredMetadataStore) DeleteBucket(bucket string) error {
+	defer s.m.observe("metadata", s.implementation, "delete_bucket", time.Now())
+	keys, _ := s.inner.ListKeys(bucket, "")
+	err := s.inner.DeleteBucket(bucket)
+	if err == nil {
+		s.buckets.Dec()
+		s.objects.Sub(float64(len(keys)))
+	}
+	return err
+}
+
+func (s *meteredMetadataStore) ListBuckets() ([]string, error) {
+	defer s.m.observe("metadata", s.implementation, "list_buckets", time.Now())
+	return s.inner.ListBuckets()
+}
+
+func (s *meteredMetadataStore) ListKeys(bucketId, prefix string) ([]string, error) {
+	defer s.m.observe("metadata", s.implementation, "list_keys", time.Now())
+	return s.inner.ListKeys(bucketId, prefix)
+}
+
+type meteredAccessStore struct {
+	inner          access.AccessStore
+	m              *Metrics
+	implementation string
+}
+
+// meteredFailureStore keeps the FailureStore of an access store visible to the
+// lockout, its link failures are the wrong unlock keys.
+type meteredFailureStore struct {
+	*meteredAccessStore
+	failures access.FailureStore
+}
+
+// AccessStore measures store and counts the outcomes of using keys.
+func (m *Metrics) AccessStore(store access.AccessStore) access.AccessStore {
+	metered := &meteredAccessStore{inner: store, m: m, implementation: implementationName(store)}
+	failures, ok := store.(access.FailureStore)
+	if !ok {
+		return metered
+	}
+	return &meteredFailureStore{meteredAccessStore: metered, failures: failures}
+}
+
+func (s *meteredAccessStore) unwrap() interface{} {
+	return s.inner
+}
+
+func (s *meteredAccessStore) AddKey(key *access.AKey) error {
+	defer s.m.observe("access", s.implementation, "add_key", time.Now())
+	return s.inner.AddKey(key)
+}
+
+func (s *meteredAccessStore) Reserve(ctx context.Context, urlKey, object string) (*access.AKey, error) {
+	defer s.m.observe("access", s.implementation, "reserve", time.Now())
+	key, err := s.inner.Reserve(ctx, urlKey, object)
+	if err != nil {
+		s.m.keyOutcomes.WithLabelValues(reserveOutcome(err)).Inc()
+	}
+	return key, err
+}
+
+// reserveOutcome names why a reservation was refused. Granted uses are only
+// counted once they are committed, reservations can still be released.
+func reserveOutcome(err error) string {
+	switch {
+	case err == access.KeyInactive:
+		return OutcomeInactive
+	case errors.Is(err, access.TtlExpired):
+		return OutcomeExpired
+	case errors.Is(err, access.NoUsesLeft):
+		return OutcomeExhausted
+	default:
+		return OutcomeMissing
+	}
+}
+
+func (s *meteredAccessStore) Commit(ctx context.Context, key *access.AKey) error {
+	defer s.m.observe("access", s.implementation, "commit", time.Now())
+	err := s.inner.Commit(ctx, key)
+	if err == nil {
+		s.m.keyOutcomes.WithLabelValues(OutcomeGranted).Inc()
+	}
+	return err
+}
+
+func (s *meteredAccessStore) Release(ctx context.Context, key *access.AKey) error {
+	defer s.m.observe("access", s.implementation, "release", time.Now())
+	return s.inner.Release(ctx, key)
+}
+
+func (s *meteredAccessStore) DeleteKey(key *access.AKey) error {
+	defer s.m.observe("access", s.implementation, "delete_key", time.Now())
+	return s.inner.DeleteKey(key)
+}
+
+func (s *meteredAccessStore) GetKey(ctx context.Context, urlKey string) (*access.AKey, error) {
+	defer s.m.observe("access", s.implementation, "get_key", time.Now())
+	return s.inner.GetKey(ctx, urlKey)
+}
+
+func (s *meteredAccessStore) ListKeys(ctx context.Context, filter access.KeyFilter) ([]*access.AKey, error) {
+	defer s.m.observe("access", s.implementation, "list_keys", time.Now())
+	return s.inner.ListKeys(ctx, filter)
+}
+
+func (s *meteredAccessStore) UpdateKey(ctx context.Context, urlKey string, update access.KeyUpdate) (*access.AKey, error) {
+	defer s.m.observe("access", s.implementation, "update_key", time.Now())
+	return s.inner.UpdateKey(ctx, urlKey, update)
+}
+
+func (s *meteredFailureStore) TakeAttempt(ctx context.Context, subject string, now time.Time, window time.Duration) (*access.FailureRecord, error) {
+	defer s.m.observe("access", s.implementation, "take_attempt", time.Now())
+	return s.failures.TakeAttempt(ctx, subject, now, window)
+}
+
+func (s *meteredFailureStore) FailAttempt(ctx context.Context, subject string, now time.Time, window time.Duration) (*access.FailureRecord, error) {
+	defer s.m.observe("access", s.implementation, "fail_attempt", time.Now())
+	if access.IsLinkSubject(subject) {
+		s.m.keyOutcomes.WithLabelValues(OutcomeBadUnlockKey).Inc()
+	}
+	return s.failures.FailAttempt(ctx, subject, now, window)
+}
+
+func (s *meteredFailureStore) ReleaseAttempt(ctx context.Context, subject string) error {
+	defer s.m.observe("access", s.implementation, "release_attempt", time.Now())
+	return s.failures.ReleaseAttempt(ctx, subject)
+}
+
+func (s *meteredFailureStore) GetFailures(ctx context.Context, subject string, now time.Time) (*access.FailureRecord, error) {
+	defer s.m.observe("access", s.implementation, "get_failures", time.Now())
+	return s.failures.GetFailures(ctx, subject, now)
+}
+
+func (s *meteredFailureStore) ResetFailures(ctx context.Context, subject string) error {
+	defer s.m.observe("access", s.implementation, "reset_failures", time.Now())
+	return s.failures.ResetFailures(ctx, subject)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"secure-store/access"
+	"secure-store/metadata"
+	"secure-store/storage"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	server := newMeteredTestServer(t, metrics)
+	server.putObject(t, "reports", "monday", "content")
+	limit := uint64(2)
+	key, err := access.FromExAccessKey(access.ExAccessKey{BucketId: "reports", KeyId: "monday", UrlKey: "twice", Limit: &limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.access.AddKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := server.do(httptest.NewRequest(http.MethodGet, "/api/download?urlKey=twice", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Download answered %v", w.Code)
+	}
+	server.do(httptest.NewRequest(http.MethodGet, "/api/download?urlKey=unknown", nil))
+	// The last use is still reserved, so the key counts as exhausted.
+	reserved, err := server.access.Reserve(context.Background(), "twice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.access.Reserve(context.Background(), "twice", "")
+	if err == nil {
+		t.Fatal("Reserved more uses than the limit")
+	}
+	// Reservations are only granted uses once they are committed.
+	if value := testutil.ToFloat64(metrics.keyOutcomes.WithLabelValues(OutcomeGranted)); value != 1 {
+		t.Errorf("Counted %v granted key uses before the commit", value)
+	}
+	err = server.access.Commit(context.Background(), reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for outcome, expected := range map[string]float64{
+		OutcomeGranted:   2,
+		OutcomeExhausted: 1,
+		OutcomeMissing:   1,
+	} {
+		value := testutil.ToFloat64(metrics.keyOutcomes.WithLabelValues(outcome))
+		if value != expected {
+			t.Errorf("Counted %v %v key uses instead of %v", value, outcome, expected)
+		}
+	}
+	if value := testutil.ToFloat64(metrics.bytes.WithLabelValues("upload")); value != float64(len("content")) {
+		t.Errorf("Counted %v uploaded bytes", value)
+	}
+	if value := testutil.ToFloat64(metrics.bytes.WithLabelValues("download")); value != float64(len("content")) {
+		t.Errorf("Counted %v downloaded bytes", value)
+	}
+	if value := testutil.ToFloat64(metrics.activeStreams); value != 0 {
+		t.Errorf("%v streams are still active", value)
+	}
+
+	w = server.do(httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("The public router answered /metrics with %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Metrics answered %v", w.Code)
+	}
+	for _, line := range []string{
+		`secure_store_http_requests_total{method="GET",route="/api/download",status="200"} 1`,
+		`secure_store_buckets 1`,
+		`secure_store_objects 1`,
+		`secure_store_backend_operation_duration_seconds_count{implementation="storage.MemoryStorage",operation="write",store="storage"} 1`,
+		`secure_store_backend_operation_duration_seconds_count{implementation="access.MemoryStore",operation="reserve",store="access"} 4`,
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("Metrics are missing %v", line)
+		}
+	}
+}
+
+func TestMetricsCountBadUnlockKeys(t *testing.T) {
+	metrics := NewMetrics()
+	failures := metrics.AccessStore(access.NewMemoryStore()).(access.FailureStore)
+	lockout, err := access.NewLockout(failures, access.DefaultLockoutPolicy(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempt, _, err := lockout.Attempt(context.Background(), access.LinkSubject("monday-link"), "192.0.2.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = attempt.Fail(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := testutil.ToFloat64(metrics.keyOutcomes.WithLabelValues(OutcomeBadUnlockKey)); value != 1 {
+		t.Errorf("Counted %v bad unlock keys", value)
+	}
+}
+
+func TestMetricsEndStreamsOnClose(t *testing.T) {
+	metrics := NewMetrics()
+	s := metrics.Storage(storage.NewMemoryStorage())
+	err := s.NewBucket("reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Write("reports", "monday", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := s.Read("reports", "monday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An aborted download stops reading halfway.
+	_, err = reader.Read(make([]byte, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := testutil.ToFloat64(metrics.activeStreams); value != 1 {
+		t.Errorf("%v streams are active during the download", value)
+	}
+	_ = reader.Close()
+	_ = reader.Close()
+	if value := testutil.ToFloat64(metrics.activeStreams); value != 0 {
+		t.Errorf("%v streams are still active after closing", value)
+	}
+}
+
+func TestMetricsTrackStoreGauges(t *testing.T) {
+	metrics := NewMetrics()
+	store := metadata.NewMemoryStore()
+	err := store.NewBucket("reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Write("reports", "monday", &metadata.Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metered := metrics.MetadataStore(store).(*meteredMetadataStore)
+	check := func(buckets, objects float64) {
+		t.Helper()
+		if value := testutil.ToFloat64(metered.buckets); value != buckets {
+			t.Errorf("Counted %v buckets instead of %v", value, buckets)
+		}
+		if value := testutil.ToFloat64(metered.objects); value != objects {
+			t.Errorf("Counted %v objects instead of %v", value, objects)
+		}
+	}
+	check(1, 1)
+
+	err = metered.NewBucket("invoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tuesday", "wednesday", "thursday"} {
+		err = metered.Write("invoices", key, &metadata.Metadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(2, 4)
+	err = metered.Delete("reports", "monday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(2, 3)
+	err = metered.DeleteBucket("invoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(1, 0)
+}
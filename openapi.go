@@ -0,0 +1,19 @@
+package main
+
+import (
+	_ "embed"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// openApiSpec documents every route of NewRouter, TestOpenApiCoversRoutes
+// keeps both in sync.
+//
+//go:embed static/openapi.json
+var openApiSpec []byte
+
+func registerOpenApiRoute(router *gin.Engine) {
+	router.GET("/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", openApiSpec)
+	})
+}
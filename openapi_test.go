@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type openApiParameter struct {
+	Name string `json:"name"`
+	In   string `json:"in"`
+}
+
+type openApiOperation struct {
+	Parameters []openApiParameter         `json:"parameters"`
+	Responses  map[string]json.RawMessage `json:"responses"`
+}
+
+type openApiDocument struct {
+	OpenApi string                                 `json:"openapi"`
+	Paths   map[string]map[string]openApiOperation `json:"paths"`
+}
+
+var ginParam = regexp.MustCompile(`[:*]([A-Za-z0-9_]+)`)
+var openApiParam = regexp.MustCompile(`{([A-Za-z0-9_]+)}`)
+
+func loadOpenApi(t *testing.T) *openApiDocument {
+	doc := &openApiDocument{}
+	err := json.Unmarshal(openApiSpec, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(doc.OpenApi, "3.") {
+		t.Fatalf("Expected an OpenAPI 3 document, got version %v", doc.OpenApi)
+	}
+	return doc
+}
+
+func TestOpenApiCoversRoutes(t *testing.T) {
+	doc := loadOpenApi(t)
+	server := newMeteredTestServer(t, NewMetrics())
+
+	routes := map[string]bool{}
+	for _, route := range server.router.(*gin.Engine).Routes() {
+		path := ginParam.ReplaceAllString(route.Path, "{$1}")
+		routes[route.Method+" "+path] = true
+	}
+	documented := map[string]bool{}
+	for path, operations := range doc.Paths {
+		for method, operation := range operations {
+			documented[strings.ToUpper(method)+" "+path] = true
+			if len(operation.Responses) == 0 {
+				t.Errorf("%v %v documents no responses", strings.ToUpper(method), path)
+			}
+			params := map[string]bool{}
+			for _, param := range operation.Parameters {
+				if param.In == "path" {
+					params[param.Name] = true
+				}
+			}
+			for _, match := range openApiParam.FindAllStringSubmatch(path, -1) {
+				if !params[match[1]] {
+					t.Errorf("%v %v doesn't document path parameter %v", strings.ToUpper(method), path, match[1])
+				}
+			}
+		}
+	}
+
+	missing := make([]string, 0)
+	for route := range routes {
+		if !documented[route] {
+			missing = append(missing, route)
+		}
+	}
+	stale := make([]string, 0)
+	for route := range documented {
+		if !routes[route] {
+			stale = append(stale, route)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(stale)
+	for _, route := range missing {
+		t.Errorf("Route %v is undocumented", route)
+	}
+	for _, route := range stale {
+		t.Errorf("Documented route %v doesn't exist", route)
+	}
+}
+
+func TestOpenApiDocumentsHeaders(t *testing.T) {
+	doc := loadOpenApi(t)
+	expected := map[string]string{
+		"POST /upload":                           "filename",
+		"PUT /api/upload":                        "unlockKey",
+		"GET /api/download":                      "unlockKey",
+		"GET /api/share":                         "unlockKey",
+		"PUT /v1/buckets/{bucket}/objects/{key}": "filename",
+	}
+	for route, header := range expected {
+		parts := strings.SplitN(route, " ", 2)
+		operation := doc.Paths[parts[1]][strings.ToLower(parts[0])]
+		found := false
+		for _, param := range operation.Parameters {
+			found = found || (param.In == "header" && param.Name == header)
+		}
+		if !found {
+			t.Errorf("%v doesn't document the %v header", route, header)
+		}
+	}
+}
+
+func TestOpenApiIsServed(t *testing.T) {
+	server := newTestServer(t)
+	w := server.do(httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK || !json.Valid(w.Body.Bytes()) {
+		t.Errorf("Serving the spec answered %v", w.Code)
+	}
+}
@@ -0,0 +1,228 @@
+package presign
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const BucketQuery = "bucketId"
+const KeyQuery = "keyId"
+const ExpiresQuery = "expires"
+const IpQuery = "ip"
+const VersionQuery = "version"
+const SignatureQuery = "signature"
+
+const MinSecretLength = 32
+const MaxExpiry = 7 * 24 * time.Hour
+
+var SecretTooShort = errors.New(fmt.Sprintf("presign secrets need at least %v bytes", MinSecretLength))
+var UnknownVersion = errors.New("presign key version is unknown")
+var InvalidSignature = errors.New("presigned url signature is invalid")
+var UrlExpired = errors.New("presigned url expired")
+var ExpiryTooFar = errors.New(fmt.Sprintf("presigned url expires later than %v from now", MaxExpiry))
+var IpMismatch = errors.New("presigned url was issued for another client")
+var MissingParameter = errors.New("presigned url misses a parameter")
+
+// Sign computes the signature of a presigned url. It only depends on the
+// shared secret, so clients holding it can presign urls offline.
+func Sign(secret []byte, version uint32, bucketId, keyId string, expires time.Time, ip string) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = fmt.Fprintf(mac, "secure-store-presign\n%v\n%v\n%v\n%v\n%v", version, bucketId, keyId, expires.Unix(), ip)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Query builds the query parameters of a presigned download url.
+func Query(secret []byte, version uint32, bucketId, keyId string, expires time.Time, ip string) url.Values {
+	ret := url.Values{}
+	ret.Set(BucketQuery, bucketId)
+	ret.Set(KeyQuery, keyId)
+	ret.Set(ExpiresQuery, strconv.FormatInt(expires.Unix(), 10))
+	if ip != "" {
+		ret.Set(IpQuery, ip)
+	}
+	ret.Set(VersionQuery, strconv.FormatUint(uint64(version), 10))
+	ret.Set(SignatureQuery, Sign(secret, version, bucketId, keyId, expires, ip))
+	return ret
+}
+
+func IsPresigned(query url.Values) bool {
+	return query.Get(SignatureQuery) != ""
+}
+
+// Keyring holds the versioned signing secrets. New urls are signed with the
+// current version, every version still in the ring verifies, so rotating the
+// current version doesn't break outstanding links.
+type Keyring struct {
+	m       sync.RWMutex
+	current uint32
+	secrets map[uint32][]byte
+	now     func() time.Time
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		secrets: make(map[uint32][]byte),
+		now:     time.Now,
+	}
+}
+
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, MinSecretLength)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// ParseKeyring reads comma separated version:secret pairs, the secrets are
+// standard base64. The highest version becomes the current one.
+func ParseKeyring(spec string) (*Keyring, error) {
+	ret := NewKeyring()
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("presign keys have to be given as version:secret")
+		}
+		version, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		err = ret.Add(uint32(version), secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(ret.secrets) == 0 {
+		return nil, errors.New("no presign keys given")
+	}
+	return ret, nil
+}
+
+// Add registers a secret, a version higher than the current one becomes the
+// new current version.
+func (k *Keyring) Add(version uint32, secret []byte) error {
+	if len(secret) < MinSecretLength {
+		return SecretTooShort
+	}
+	k.m.Lock()
+	defer k.m.Unlock()
+	k.secrets[version] = append([]byte{}, secret...)
+	if len(k.secrets) == 1 || version > k.current {
+		k.current = version
+	}
+	return nil
+}
+
+// Remove retires a version, urls signed with it stop working.
+func (k *Keyring) Remove(version uint32) {
+	k.m.Lock()
+	defer k.m.Unlock()
+	delete(k.secrets, version)
+	if version != k.current {
+		return
+	}
+	versions := make([]uint32, 0, len(k.secrets))
+	for v := range k.secrets {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] > versions[j]
+	})
+	k.current = 0
+	if len(versions) > 0 {
+		k.current = versions[0]
+	}
+}
+
+func (k *Keyring) Current() uint32 {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	return k.current
+}
+
+func (k *Keyring) Presign(bucketId, keyId string, expiresIn time.Duration, ip string) (url.Values, time.Time, error) {
+	if expiresIn <= 0 || expiresIn > MaxExpiry {
+		return nil, time.Time{}, errors.New(fmt.Sprintf("presigned urls have to expire within %v", MaxExpiry))
+	}
+	k.m.RLock()
+	defer k.m.RUnlock()
+	secret, ok := k.secrets[k.current]
+	if !ok {
+		return nil, time.Time{}, UnknownVersion
+	}
+	expires := k.now().Add(expiresIn)
+	return Query(secret, k.current, bucketId, keyId, expires, ip), expires, nil
+}
+
+// Verify checks a presigned url and returns the object it grants access to.
+// clientIp is only compared if the url was bound to an ip.
+func (k *Keyring) Verify(query url.Values, clientIp string) (string, string, error) {
+	bucketId, keyId := query.Get(BucketQuery), query.Get(KeyQuery)
+	expiresString, versionString := query.Get(ExpiresQuery), query.Get(VersionQuery)
+	signature := query.Get(SignatureQuery)
+	if bucketId == "" || keyId == "" || expiresString == "" || versionString == "" || signature == "" {
+		return "", "", MissingParameter
+	}
+	expiresUnix, err := strconv.ParseInt(expiresString, 10, 64)
+	if err != nil {
+		return "", "", MissingParameter
+	}
+	version, err := strconv.ParseUint(versionString, 10, 32)
+	if err != nil {
+		return "", "", UnknownVersion
+	}
+	k.m.RLock()
+	secret, ok := k.secrets[uint32(version)]
+	now := k.now()
+	k.m.RUnlock()
+	if !ok {
+		return "", "", UnknownVersion
+	}
+	ip := query.Get(IpQuery)
+	expected := Sign(secret, uint32(version), bucketId, keyId, time.Unix(expiresUnix, 0), ip)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", "", InvalidSignature
+	}
+	if !now.Before(time.Unix(expiresUnix, 0)) {
+		return "", "", UrlExpired
+	}
+	// Urls signed offline with a leaked or shared secret can't outlive the
+	// limit Presign enforces.
+	if time.Unix(expiresUnix, 0).After(now.Add(MaxExpiry)) {
+		return "", "", ExpiryTooFar
+	}
+	if ip != "" && !sameIp(ip, clientIp) {
+		return "", "", IpMismatch
+	}
+	return bucketId, keyId, nil
+}
+
+// sameIp compares addresses independent of their notation, like an ipv4
+// address and its ipv6 mapped form.
+func sameIp(signed, client string) bool {
+	signedIp, clientIp := net.ParseIP(signed), net.ParseIP(client)
+	if signedIp == nil || clientIp == nil {
+		return signed == client
+	}
+	return signedIp.Equal(clientIp)
+}
@@ -0,0 +1,158 @@
+package presign
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (f *fakeClock) now() time.Time {
+	return f.t
+}
+
+func testKeyring(t *testing.T, clock *fakeClock, versions ...uint32) *Keyring {
+	ring := NewKeyring()
+	ring.now = clock.now
+	for _, version := range versions {
+		err := ring.Add(version, bytes.Repeat([]byte{byte(version)}, MinSecretLength))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ring
+}
+
+func TestPresignAndVerify(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	ring := testKeyring(t, clock, 1)
+	query, _, err := ring.Presign("bucket", "key", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucketId, keyId, err := ring.Verify(query, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucketId != "bucket" || keyId != "key" {
+		t.Errorf("Verified wrong object %v/%v", bucketId, keyId)
+	}
+
+	tampered := query
+	tampered.Set(KeyQuery, "other")
+	_, _, err = ring.Verify(tampered, "")
+	if err != InvalidSignature {
+		t.Errorf("Tampered url verified with %v", err)
+	}
+}
+
+func TestPresignExpires(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	ring := testKeyring(t, clock, 1)
+	query, _, err := ring.Presign("bucket", "key", time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.t = clock.t.Add(time.Minute)
+	_, _, err = ring.Verify(query, "")
+	if err != UrlExpired {
+		t.Errorf("Expired url verified with %v", err)
+	}
+	_, _, err = ring.Presign("bucket", "key", MaxExpiry+time.Second, "")
+	if err == nil {
+		t.Error("Presigned url beyond the maximum expiry")
+	}
+	secret := bytes.Repeat([]byte{1}, MinSecretLength)
+	query = Query(secret, 1, "bucket", "key", clock.t.Add(MaxExpiry+time.Minute), "")
+	_, _, err = ring.Verify(query, "")
+	if err != ExpiryTooFar {
+		t.Errorf("Url beyond the maximum expiry verified with %v", err)
+	}
+}
+
+func TestPresignIpBinding(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	ring := testKeyring(t, clock, 1)
+	query, _, err := ring.Presign("bucket", "key", time.Hour, "192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ring.Verify(query, "192.0.2.8")
+	if err != IpMismatch {
+		t.Errorf("Url bound to another ip verified with %v", err)
+	}
+	_, _, err = ring.Verify(query, "192.0.2.7")
+	if err != nil {
+		t.Error(err)
+	}
+	_, _, err = ring.Verify(query, "::ffff:192.0.2.7")
+	if err != nil {
+		t.Errorf("Ipv4 mapped address was rejected with %v", err)
+	}
+
+	query, _, err = ring.Presign("bucket", "key", time.Hour, "2001:db8::7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ring.Verify(query, "2001:0db8:0000::0007")
+	if err != nil {
+		t.Errorf("Differently written ipv6 address was rejected with %v", err)
+	}
+}
+
+func TestPresignRotation(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	ring := testKeyring(t, clock, 1)
+	old, _, err := ring.Presign("bucket", "key", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ring.Add(2, bytes.Repeat([]byte{2}, MinSecretLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Current() != 2 {
+		t.Errorf("Current version is %v after rotation", ring.Current())
+	}
+	fresh, _, err := ring.Presign("bucket", "key", time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.Get(VersionQuery) != "2" {
+		t.Errorf("New url signed with version %v", fresh.Get(VersionQuery))
+	}
+	_, _, err = ring.Verify(old, "")
+	if err != nil {
+		t.Errorf("Outstanding url broke on rotation: %v", err)
+	}
+	ring.Remove(1)
+	_, _, err = ring.Verify(old, "")
+	if err != UnknownVersion {
+		t.Errorf("Url of a retired version verified with %v", err)
+	}
+	_, _, err = ring.Verify(fresh, "")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOfflineQueryMatchesKeyring(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	secret := bytes.Repeat([]byte{7}, MinSecretLength)
+	spec := fmt.Sprintf("7:%v", base64.StdEncoding.EncodeToString(secret))
+	ring, err := ParseKeyring(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring.now = clock.now
+	query := Query(secret, 7, "bucket", "key", clock.t.Add(time.Hour), "")
+	_, _, err = ring.Verify(query, "")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LiveSettings holds the settings that are applied again when the config is
+// reloaded: the log level, the rate limit and the CORS origins.
+type LiveSettings struct {
+	m          sync.Mutex
+	config     Config
+	origins    map[string]bool
+	anyOrigin  bool
+	limit      RateLimitConfig
+	buckets    map[string]*tokenBucket
+	lastPruned time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewLiveSettings(config *Config) *LiveSettings {
+	l := &LiveSettings{}
+	l.Apply(config)
+	return l
+}
+
+// Apply takes over the reloadable settings of config, the other ones only
+// change with a restart.
+func (l *LiveSettings) Apply(config *Config) {
+	level, err := logrus.ParseLevel(config.LogLevel)
+	if err == nil {
+		logrus.SetLevel(level)
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.config = *config
+	l.origins = make(map[string]bool, len(config.CorsOrigins))
+	l.anyOrigin = false
+	for _, origin := range config.CorsOrigins {
+		if origin == "*" {
+			l.anyOrigin = true
+		}
+		l.origins[origin] = true
+	}
+	if l.limit != config.RateLimit {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	l.limit = config.RateLimit
+}
+
+// restartRequired lists the settings of config that differ from the running
+// ones but can't be applied without a restart.
+func (l *LiveSettings) restartRequired(config *Config) []string {
+	l.m.Lock()
+	running := l.config
+	l.m.Unlock()
+	running.LogLevel, running.RateLimit, running.CorsOrigins = config.LogLevel, config.RateLimit, config.CorsOrigins
+	changed := make([]string, 0)
+	runningValue, newValue := reflect.ValueOf(running), reflect.ValueOf(*config)
+	for i := 0; i < runningValue.NumField(); i++ {
+		if !reflect.DeepEqual(runningValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			changed = append(changed, runningValue.Type().Field(i).Name)
+		}
+	}
+	return changed
+}
+
+// allow takes a token of the client, buckets of clients that were idle long
+// enough to be full again are dropped now and then.
+func (l *LiveSettings) allow(client string, now time.Time) (bool, time.Duration) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.limit.RequestsPerSecond <= 0 {
+		return true, 0
+	}
+	refill := time.Duration(float64(l.limit.Burst) / l.limit.RequestsPerSecond * float64(time.Second))
+	if now.Sub(l.lastPruned) > refill {
+		for key, bucket := range l.buckets {
+			if now.Sub(bucket.updated) > refill {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastPruned = now
+	}
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.limit.Burst), updated: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * l.limit.RequestsPerSecond
+	if bucket.tokens > float64(l.limit.Burst) {
+		bucket.tokens = float64(l.limit.Burst)
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.limit.RequestsPerSecond * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens -= 1
+	return true, 0
+}
+
+func (l *LiveSettings) allowsOrigin(origin string) bool {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.anyOrigin || l.origins[origin]
+}
+
+// Middleware answers CORS preflights of the allowed origins and rejects
+// clients over the rate limit.
+func (l *LiveSettings) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		cors := origin != "" && l.allowsOrigin(origin)
+		// Browsers only show the rejection to allowed origins.
+		if cors {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Vary", "Origin")
+		}
+		allowed, wait := l.allow(c.ClientIP(), time.Now())
+		if !allowed {
+			c.Header("Retry-After", strconv.FormatInt(int64(wait/time.Second)+1, 10))
+			c.AbortWithStatus(http.StatusTooManyRequests)
+			return
+		}
+		if cors && c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+			c.Header("Access-Control-Allow-Headers", c.GetHeader("Access-Control-Request-Headers"))
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Reload loads the config at path again and applies it, an invalid config is
+// rejected as a whole.
+func (l *LiveSettings) Reload(path string) error {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	changed := l.restartRequired(config)
+	if len(changed) > 0 {
+		logrus.WithField("Settings", strings.Join(changed, ", ")).Warnln("Changed settings only take effect after a restart.")
+	}
+	l.Apply(config)
+	logrus.WithFields(logrus.Fields{
+		"Log Level":    config.LogLevel,
+		"Rate Limit":   config.RateLimit.RequestsPerSecond,
+		"Cors Origins": strings.Join(config.CorsOrigins, ", "),
+	}).Infoln("Reloaded config.")
+	return nil
+}
+
+// ReloadOnHangup reloads the config whenever the process gets SIGHUP.
+func (l *LiveSettings) ReloadOnHangup(path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			err := l.Reload(path)
+			if err != nil {
+				logrus.WithError(err).Errorf("Keeping the running config, the new one is invalid.")
+			}
+		}
+	}()
+}
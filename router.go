@@ -9,35 +9,58 @@ import (
 	"github.com/gin-gonic/gin"
 	rainbow "github.com/guineveresaenger/golang-rainbow"
 	"github.com/sirupsen/logrus"
+	"io"
+	"math"
 	"net/http"
 	"os"
 	"secure-store/access"
 	"secure-store/metadata"
-	"secure-store/security"
+	"secure-store/presign"
 	"secure-store/users"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// UnlockKeyQuery carries the base64url encoded secret of a key, the password
+// itself or the digest older clients derive from it.
 const UnlockKeyQuery = "unlockKey"
 const ApiKeyQuery = "apiKey"
 
+type PresignJson struct {
+	BucketId  string `json:"BucketId"`
+	KeyId     string `json:"KeyId"`
+	ExpiresIn int64  `json:"ExpiresIn"`
+	Ip        string `json:"Ip,omitempty"`
+}
+
+type PresignedUrlJson struct {
+	Url     string    `json:"Url"`
+	Expires time.Time `json:"Expires"`
+}
+
 func AccessForbiddenError() error {
 	return errors.New("access forbidden")
 }
 
-func Download(ctx *gin.Context, s *CompoundStore, bucketId, keyId string) {
+func Download(ctx *gin.Context, s *CompoundStore, bucketId, keyId string) error {
 	meta, bufReader, err := s.Read(bucketId, keyId)
 	if err != nil {
 		_ = ctx.AbortWithError(http.StatusInternalServerError, err)
-		return
+		return err
 	}
+	defer bufReader.Close()
+	renderObject(ctx, bucketId, keyId, meta, bufReader)
+	return nil
+}
+
+func renderObject(ctx *gin.Context, bucketId, keyId string, meta *metadata.Metadata, reader io.Reader) {
 	contentLength := meta.Length
 	contentType := "application/octet-stream"
 	extraHeaders := map[string]string{
 		"Content-Disposition": fmt.Sprintf(`attachment; filename="%v"`, meta.Filename),
 	}
-	ctx.DataFromReader(http.StatusOK, contentLength, contentType, bufReader, extraHeaders)
+	ctx.DataFromReader(http.StatusOK, contentLength, contentType, reader, extraHeaders)
 	logrus.WithFields(logrus.Fields{
 		"Bucket Id":      bucketId,
 		"Key Id":         keyId,
@@ -46,12 +69,198 @@ func Download(ctx *gin.Context, s *CompoundStore, bucketId, keyId string) {
 	}).Infoln("Successfully downloaded.")
 }
 
-func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage) *gin.Engine {
+// abortLegacy answers the routes older than /v1 the way they always did, with
+// a status but no body.
+func abortLegacy(c *gin.Context, err error) {
+	apiErr := asApiError(err)
+	_ = c.AbortWithError(apiErr.Status, err)
+	if apiErr.Status >= http.StatusInternalServerError {
+		logrus.WithError(err).WithField("Path", c.FullPath()).Errorf("Request failed.")
+	}
+}
+
+// reservation holds one reserved use of an access key, finish hands it back
+// unless it was committed.
+type reservation struct {
+	ctx       context.Context
+	a         access.AccessStore
+	key       *access.AKey
+	committed bool
+}
+
+// reserveKey reserves a use of the key of kind assigned to urlKey after
+// checking the ip and the unlock key. Only callers who pass them learn that a
+// key exists but isn't active right now.
+func reserveKey(ctx context.Context, c *gin.Context, a access.AccessStore, lockout *access.Lockout, kind access.KeyKind, urlKey, object string, isInDebugMode bool) (*reservation, bool) {
+	key, err := a.Reserve(ctx, urlKey, object)
+	if err == access.KeyInactive {
+		key, err = a.GetKey(ctx, urlKey)
+		if err == nil && key.Kind == kind && checkClientIp(c, key, isInDebugMode) && checkUnlockKey(c, key, lockout, isInDebugMode) {
+			abortInactive(c)
+			return nil, false
+		}
+		if c.IsAborted() {
+			return nil, false
+		}
+	}
+	if err == nil && key.Kind != kind {
+		_ = a.Release(ctx, key)
+		err = access.KeyDoesntExist(urlKey)
+	}
+	if err != nil {
+		if isInDebugMode {
+			_ = c.AbortWithError(http.StatusInternalServerError, access.KeyDoesntExist(urlKey))
+			logrus.WithError(err).Errorf("Key doesn't of key exists.")
+		} else {
+			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+		}
+		return nil, false
+	}
+	res := &reservation{ctx: ctx, a: a, key: key}
+	if !checkClientIp(c, key, isInDebugMode) || !checkUnlockKey(c, key, lockout, isInDebugMode) {
+		res.finish()
+		return nil, false
+	}
+	return res, true
+}
+
+// checkClientIp enforces the networks of a key against the client ip, which
+// is only taken from X-Forwarded-For if the request came through a trusted
+// proxy.
+func checkClientIp(c *gin.Context, key *access.AKey, isInDebugMode bool) bool {
+	if key.AllowsIp(c.ClientIP()) {
+		return true
+	}
+	if isInDebugMode {
+		_ = c.AbortWithError(http.StatusForbidden, errors.New(fmt.Sprintf("client ip %v isn't allowed to use the key", c.ClientIP())))
+	} else {
+		_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+	}
+	return false
+}
+
+// abortInactive tells holders of a valid link that it can't be used right now,
+// without revealing when it can.
+func abortInactive(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"Inactive": true})
+}
+
+func (r *reservation) commit() {
+	r.committed = true
+	err := r.a.Commit(r.ctx, r.key)
+	if err != nil {
+		logrus.WithError(err).WithField("Url Key", r.key.UrlKey).Errorf("Committing key usage failed.")
+	}
+}
+
+func (r *reservation) finish() {
+	if r.committed {
+		return
+	}
+	err := r.a.Release(r.ctx, r.key)
+	if err != nil {
+		logrus.WithError(err).WithField("Url Key", r.key.UrlKey).Errorf("Releasing reservation failed.")
+	}
+}
+
+// checkUnlockKey verifies the unlock key of keys that need one, it aborts the
+// request if the check fails. Failed guesses count against the link and the
+// client ip when a lockout is configured.
+func checkUnlockKey(c *gin.Context, key *access.AKey, lockout *access.Lockout, isInDebugMode bool) bool {
+	if !key.NeedsKey {
+		return true
+	}
+	// The attempt holds a slot in the failure counts while the key is
+	// verified, so concurrent guesses can't pass the lockout together.
+	var attempt *access.Attempt
+	if lockout != nil {
+		var wait time.Duration
+		var err error
+		attempt, wait, err = lockout.Attempt(c, access.LinkSubject(key.UrlKey), c.ClientIP())
+		if err != nil {
+			if wait > 0 {
+				c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+				_ = c.AbortWithError(http.StatusTooManyRequests, err)
+			} else {
+				_ = c.AbortWithError(http.StatusInternalServerError, err)
+				logrus.WithError(err).Errorf("Checking unlock failures failed.")
+			}
+			return false
+		}
+	}
+	var err error
+	unlockKey := make([]byte, 0)
+	if key.ResolveByUrlKey {
+		unlockKey, err = base64.RawURLEncoding.DecodeString(c.Query(UnlockKeyQuery))
+	} else {
+		unlockKey, err = base64.RawURLEncoding.DecodeString(c.GetHeader(UnlockKeyQuery))
+	}
+	if err != nil {
+		failAttempt(c, attempt)
+		if isInDebugMode {
+			_ = c.AbortWithError(http.StatusBadRequest, errors.New("unlock key could not be base64 decoded"))
+			logrus.WithError(err).Errorf("Decoding of key failed.")
+		} else {
+			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+		}
+		return false
+	}
+	keyValid, err := key.ValidKey(unlockKey)
+	if !keyValid {
+		failAttempt(c, attempt)
+		if isInDebugMode {
+			_ = c.AbortWithError(http.StatusForbidden, errors.New("key is invalid"))
+			logrus.WithError(err).Errorf("Key is invalid.")
+		} else {
+			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+		}
+		return false
+	}
+	if attempt != nil {
+		err = attempt.Succeed(c)
+		if err != nil {
+			logrus.WithError(err).Errorf("Resetting unlock failures failed.")
+		}
+	}
+	return true
+}
+
+func failAttempt(c *gin.Context, attempt *access.Attempt) {
+	if attempt == nil {
+		return
+	}
+	err := attempt.Fail(c)
+	if err != nil {
+		logrus.WithError(err).Errorf("Counting unlock failure failed.")
+	}
+}
+
+func logPresign(user *users.User, request *PresignJson, presigned *PresignedUrlJson) {
+	logrus.WithFields(logrus.Fields{
+		"Acting User": user.Username,
+		"Bucket Id":   request.BucketId,
+		"Key Id":      request.KeyId,
+		"Expires":     presigned.Expires,
+	}).Infoln("Presigned download url.")
+}
+
+func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage, auth *Authenticator, presigner *presign.Keyring, lockout *access.Lockout, metrics *Metrics, live *LiveSettings) *gin.Engine {
 	matcher := NewMatcher()
+	svc := NewService(s, a, u, auth, presigner, lockout)
 
 	router := gin.New()
+	// Forwarded headers are ignored until trusted proxies are configured with
+	// SetTrustedProxies, gin trusts every proxy by default.
+	_ = router.SetTrustedProxies(nil)
 	// router.Use(ginlogrus.Logger(logrus.New()), gin.Recovery())
 	router.Use(gin.Recovery(), gin.Logger())
+	// The stores are measured by the caller wrapping them, see Metrics.
+	if metrics != nil {
+		router.Use(metrics.Middleware())
+	}
+	if live != nil {
+		router.Use(live.Middleware())
+	}
 	isInDebugMode := os.Getenv(gin.EnvGinMode) == "" || strings.ToLower(os.Getenv(gin.EnvGinMode)) == gin.DebugMode
 
 	if isInDebugMode {
@@ -60,17 +269,13 @@ func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage) *gin
 
 	router.LoadHTMLGlob("templates/*")
 
+	// The routes below predate /v1 and are kept as shims over the service. The
+	// ones without auth.Middleware never checked permissions.
 	router.GET("/new-bucket", func(c *gin.Context) {
 		bucketId := c.Query("bucketId")
-		matchRes := matcher.MatchString(bucketId)
-		if !matchRes {
-			_ = c.AbortWithError(http.StatusBadRequest, BucketIdMatchingError())
-			return
-		}
-		err := s.NewBucket(bucketId)
+		err := svc.CreateBucket(legacyPrincipal, bucketId)
 		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
-			logrus.WithError(err).Errorf("Error while creating a new bucket.")
+			abortLegacy(c, err)
 			return
 		}
 		c.String(http.StatusOK, "Created bucket with id: %v", bucketId)
@@ -79,49 +284,14 @@ func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage) *gin
 		}).Infoln("Successfully created a new bucket.")
 	})
 
-	router.POST("/upload", func(c *gin.Context) {
-		apiKey := c.Query(ApiKeyQuery)
-		apiKeyBytes, err := base64.RawURLEncoding.DecodeString(apiKey)
-		if err != nil {
-			_ = c.AbortWithError(http.StatusBadRequest, err)
-			return
-		}
-		user, err := u.ResolveByApiKey(apiKeyBytes)
-		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
-			return
-		}
-		verifiedKey := user.VerifyApiKey(apiKeyBytes)
-		if !verifiedKey {
-			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
-			return
-		}
-		if !user.Role.CanUploadData {
-			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
-			return
-		}
+	router.POST("/upload", auth.Middleware(), func(c *gin.Context) {
 		bucketId := c.Query("bucketId")
-		matchRes := matcher.MatchString(bucketId)
-		if !matchRes {
-			_ = c.AbortWithError(http.StatusBadRequest, BucketIdMatchingError())
-			return
-		}
 		keyId := c.Query("keyId")
-		matchRes = matcher.MatchString(keyId)
-		if !matchRes {
-			_ = c.AbortWithError(http.StatusBadRequest, KeyIdMatchingError())
-			return
-		}
-		r := c.Request.Body
 		filename := c.Request.Header.Get("filename")
 		contentLength := c.Request.ContentLength
-		bufferedReader := bufio.NewReader(r)
-		meta := metadata.NewMetadata(contentLength, filename)
-		key := security.NewEncryptionKey()
-		err = s.Write(bucketId, keyId, meta, key, bufferedReader)
+		_, err := svc.PutObject(CurrentPrincipal(c), bucketId, keyId, filename, contentLength, bufio.NewReader(c.Request.Body))
 		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
-			logrus.WithError(err).Errorf("Error while writing data into storage.")
+			abortLegacy(c, err)
 			return
 		}
 		c.String(http.StatusOK, "Successfully uploaded to bucket-id: %v with key-id: %v", bucketId, keyId)
@@ -135,40 +305,22 @@ func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage) *gin
 
 	router.GET("/download", func(c *gin.Context) {
 		bucketId := c.Query("bucketId")
-		matchRes := matcher.MatchString(bucketId)
-		if !matchRes {
-			_ = c.AbortWithError(http.StatusBadRequest, BucketIdMatchingError())
-			return
-		}
 		keyId := c.Query("keyId")
-		matchRes = matcher.MatchString(keyId)
-		if !matchRes {
-			_ = c.AbortWithError(http.StatusBadRequest, KeyIdMatchingError())
+		meta, reader, err := svc.GetObject(legacyPrincipal, bucketId, keyId)
+		if err != nil {
+			abortLegacy(c, err)
 			return
 		}
-		Download(c, s, bucketId, keyId)
+		defer reader.Close()
+		renderObject(c, bucketId, keyId, meta, reader)
 	})
 
 	router.DELETE("/delete", func(c *gin.Context) {
 		bucketId := c.Query("bucketId")
-		matchRes := matcher.MatchString(bucketId)
-		if !matchRes {
-			_ = c.AbortWithError(http.StatusBadRequest, BucketIdMatchingError())
-			return
-		}
 		keyId := c.Query("keyId")
-		matchRes = matcher.MatchString(keyId)
-		if !matchRes {
-			_ = c.AbortWithError(http.StatusBadRequest, KeyIdMatchingError())
-			return
-		}
-		err := s.Delete(bucketId, keyId)
+		err := svc.DeleteObject(legacyPrincipal, bucketId, keyId)
 		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
-			logrus.WithError(err).WithFields(logrus.Fields{
-				"Bucket Id": bucketId,
-				"Key Id":    keyId,
-			}).Errorf("Error encountered during delete")
+			abortLegacy(c, err)
 			return
 		}
 		c.String(http.StatusOK, "Deleted with buket-id: %v and key-id: %v", bucketId, keyId)
@@ -180,15 +332,9 @@ func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage) *gin
 
 	router.DELETE("/delete-bucket", func(c *gin.Context) {
 		bucketId := c.Query("bucketId")
-		matchRes := matcher.MatchString(bucketId)
-		if !matchRes {
-			_ = c.AbortWithError(http.StatusBadRequest, BucketIdMatchingError())
-			return
-		}
-		err := s.DeleteBucket(bucketId)
+		err := svc.DeleteBucket(legacyPrincipal, bucketId)
 		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
-			logrus.WithError(err).Errorf("During deletion of bucket.")
+			abortLegacy(c, err)
 			return
 		}
 		c.String(http.StatusOK, "Deleted bucket-id: %v", bucketId)
@@ -197,27 +343,7 @@ func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage) *gin
 		}).Debugf("Successfully deleted bucket.")
 	})
 
-	router.POST("/api/add", func(c *gin.Context) {
-		apiKey := c.Query(ApiKeyQuery)
-		apiKeyBytes, err := base64.RawURLEncoding.DecodeString(apiKey)
-		if err != nil {
-			_ = c.AbortWithError(http.StatusBadRequest, err)
-			return
-		}
-		user, err := u.ResolveByApiKey(apiKeyBytes)
-		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
-			return
-		}
-		verifiedKey := user.VerifyApiKey(apiKeyBytes)
-		if !verifiedKey {
-			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
-			return
-		}
-		if !user.Role.CanAddKeys {
-			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
-			return
-		}
+	router.POST("/api/add", auth.Middleware(), func(c *gin.Context) {
 		exKey := &access.ExAccessKey{}
 		contentType := c.Request.Header.Get("Content-Type")
 		if contentType != "application/json" {
@@ -225,22 +351,15 @@ func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage) *gin
 			logrus.WithError(errors.New("wrong content type given")).Errorf("During request the wrong content type was given.")
 			return
 		}
-		err = c.ShouldBindJSON(exKey)
+		err := c.ShouldBindJSON(exKey)
 		if err != nil {
 			_ = c.AbortWithError(http.StatusBadRequest, err)
 			logrus.WithError(err).Errorf("Unsuccessfully binded into JSON.")
 			return
 		}
-		key, err := access.FromExAccessKey(*exKey)
+		_, err = svc.AddKey(CurrentPrincipal(c), *exKey)
 		if err != nil {
-			_ = c.AbortWithError(http.StatusBadRequest, err)
-			logrus.WithError(err).Errorf("Unsuccessfully accessed.")
-			return
-		}
-		err = a.AddKey(key)
-		if err != nil {
-			_ = c.AbortWithError(http.StatusBadRequest, err)
-			logrus.WithError(err).Errorf("Unsuccessfully accessed key.")
+			abortLegacy(c, err)
 			return
 		}
 		c.String(http.StatusOK, "access key was set")
@@ -249,6 +368,20 @@ func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage) *gin
 	router.GET("/api/download", func(c *gin.Context) {
 		ctx, cancel := context.WithDeadline(context.TODO(), time.Now().Add(100*time.Second))
 		defer cancel()
+		if presign.IsPresigned(c.Request.URL.Query()) {
+			bucketId, keyId, err := presigner.Verify(c.Request.URL.Query(), c.ClientIP())
+			if err != nil {
+				if isInDebugMode {
+					_ = c.AbortWithError(http.StatusForbidden, err)
+					logrus.WithError(err).Errorf("Presigned url is invalid.")
+				} else {
+					_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+				}
+				return
+			}
+			_ = Download(c, s, bucketId, keyId)
+			return
+		}
 		urlKey := c.Query("urlKey")
 		matchRes := matcher.MatchString(urlKey)
 		if !matchRes {
@@ -259,115 +392,186 @@ func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage) *gin
 			}
 			return
 		}
-		back, key, err := a.Access(ctx, urlKey)
-		backMessage := false
-		defer func() {
-			go func() {
-				back <- backMessage
-			}()
-		}()
+		// Share links don't reach the objects listings leave out.
+		if hiddenObject(c.Query("keyId")) {
+			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+			return
+		}
+		res, ok := reserveKey(ctx, c, a, lockout, access.DownloadKey, urlKey, c.Query("keyId"), isInDebugMode)
+		if !ok {
+			return
+		}
+		defer res.finish()
+		key := res.key
+		if Download(c, s, key.BucketId, key.Object()) == nil {
+			res.commit()
+		}
+	})
+
+	router.POST("/api/presign", auth.Middleware(), func(c *gin.Context) {
+		presignJson := &PresignJson{}
+		err := c.ShouldBindJSON(presignJson)
 		if err != nil {
-			if isInDebugMode {
-				_ = c.AbortWithError(http.StatusInternalServerError, access.KeyDoesntExist(urlKey))
-				logrus.WithError(err).Errorf("Key doesn't of key exists.")
-			} else {
-				_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
-			}
+			_ = c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
-		if !key.NeedsKey {
-			Download(c, s, key.BucketId, key.KeyId)
-			backMessage = true
+		presigned, err := svc.Presign(CurrentPrincipal(c), *presignJson)
+		if err != nil {
+			abortLegacy(c, err)
 			return
 		}
-		unlockKey := make([]byte, 0)
-		if key.ResolveByUrlKey {
-			queryKey := c.Query(UnlockKeyQuery)
-			unlockKey, err = base64.RawURLEncoding.DecodeString(queryKey)
-			if err != nil {
-				if isInDebugMode {
-					_ = c.AbortWithError(http.StatusBadRequest, errors.New("key in query could not be base64 decoded"))
-					logrus.WithError(err).Errorf("Decoding of key failed.")
-				} else {
-					_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
-				}
-				return
-			}
-		} else {
-			queryKey := c.GetHeader(UnlockKeyQuery)
-			unlockKey, err = base64.RawURLEncoding.DecodeString(queryKey)
+		c.SecureJSON(http.StatusOK, presigned)
+		logPresign(CurrentUser(c), presignJson, presigned)
+	})
 
-			if err != nil {
-				if isInDebugMode {
-					_ = c.AbortWithError(http.StatusBadRequest, errors.New("key in header could not be base64 decoded"))
-					logrus.WithError(err).Errorf("Decoding of key failed.")
-				} else {
-					_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
-				}
-				return
-			}
+	router.POST("/api/login", func(c *gin.Context) {
+		loginJson := &users.LoginJson{}
+		err := c.ShouldBindJSON(loginJson)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
 		}
-		keyValid, err := key.ValidKey(unlockKey)
-		if !keyValid {
-			if isInDebugMode {
-				_ = c.AbortWithError(http.StatusForbidden, errors.New("key is invalid"))
-				logrus.WithError(err).Errorf("Key is invalid.")
-			} else {
-				_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
-			}
+		tokens, wait, err := auth.Login(c, c.ClientIP(), loginJson.Username, loginJson.Password, loginJson.Code)
+		if wait > 0 {
+			c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+			_ = c.AbortWithError(http.StatusTooManyRequests, err)
+			logrus.WithError(err).WithField("Username", loginJson.Username).Infoln("Blocked login attempt.")
+			return
+		}
+		if errors.Is(err, users.TotpCodeRequired) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"TotpRequired": true})
+			return
+		}
+		if err != nil {
+			_ = c.AbortWithError(http.StatusUnauthorized, InvalidCredentials)
+			logrus.WithError(err).WithField("Username", loginJson.Username).Infoln("Failed login attempt.")
 			return
 		}
-		bucketId, keyId := key.BucketId, key.KeyId
-		Download(c, s, bucketId, keyId)
-		backMessage = true
+		c.SecureJSON(http.StatusOK, tokens)
+		logrus.WithField("Username", loginJson.Username).Infoln("Successfully logged in.")
 	})
 
-	router.POST("/api/user/create", func(c *gin.Context) {
-		apiKey := c.Query(ApiKeyQuery)
-		apiKeyBytes, err := base64.RawURLEncoding.DecodeString(apiKey)
+	router.POST("/api/refresh", func(c *gin.Context) {
+		refreshJson := &users.RefreshJson{}
+		err := c.ShouldBindJSON(refreshJson)
 		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		tokens, err := auth.Refresh(refreshJson.RefreshToken)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusUnauthorized, InvalidCredentials)
+			logrus.WithError(err).Infoln("Failed to refresh session.")
+			return
+		}
+		c.SecureJSON(http.StatusOK, tokens)
+	})
+
+	router.POST("/api/logout", auth.Middleware(), func(c *gin.Context) {
+		session := CurrentSession(c)
+		if session == nil {
+			_ = c.AbortWithError(http.StatusBadRequest, errors.New("request is not authenticated with a session"))
 			return
 		}
-		rootUser, err := u.ResolveByApiKey(apiKeyBytes)
+		err := auth.Logout(session)
 		if err != nil {
 			_ = c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
-		if !rootUser.Role.CanCreateUsers || !rootUser.Role.RootUser {
-			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+		c.String(http.StatusOK, "Logged out")
+		logrus.WithField("User Id", session.UserId).Infoln("Successfully logged out.")
+	})
+
+	router.POST("/api/user/totp/enroll", auth.Middleware(), func(c *gin.Context) {
+		user := CurrentUser(c)
+		enrollment, err := auth.totp.Enroll(user)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
 		}
-		userJson := &users.UserJson{}
-		contentType := c.Request.Header.Get("Content-Type")
-		if contentType != "application/json" {
-			_ = c.AbortWithError(http.StatusBadRequest, errors.New("wrong content type given"))
-			logrus.WithError(errors.New("wrong content type given")).Errorf("During request the wrong content type was given.")
+		c.SecureJSON(http.StatusOK, enrollment)
+		logrus.WithField("Username", user.Username).Infoln("Started totp enrollment.")
+	})
+
+	router.POST("/api/user/totp/confirm", auth.Middleware(), func(c *gin.Context) {
+		user := CurrentUser(c)
+		codeJson := &users.TotpCodeJson{}
+		err := c.ShouldBindJSON(codeJson)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
-		err = c.ShouldBindJSON(userJson)
+		recoveryCodes, err := auth.totp.Confirm(user, codeJson.Code)
 		if err != nil {
 			_ = c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
-		err = userJson.IsValid()
+		c.SecureJSON(http.StatusOK, recoveryCodes)
+		logrus.WithField("Username", user.Username).Infoln("Enabled totp.")
+	})
+
+	router.POST("/api/user/totp/recovery-codes", auth.Middleware(), func(c *gin.Context) {
+		user := CurrentUser(c)
+		codeJson := &users.TotpCodeJson{}
+		err := c.ShouldBindJSON(codeJson)
 		if err != nil {
 			_ = c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
-		user, err := users.UserFromUserJson(userJson)
+		recoveryCodes, err := auth.totp.RegenerateRecoveryCodes(user, codeJson.Code)
 		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			_ = c.AbortWithError(http.StatusForbidden, err)
 			return
 		}
-		err = u.Create(user)
+		c.SecureJSON(http.StatusOK, recoveryCodes)
+		logrus.WithField("Username", user.Username).Infoln("Regenerated totp recovery codes.")
+	})
+
+	router.POST("/api/user/totp/disable", auth.Middleware(), func(c *gin.Context) {
+		user := CurrentUser(c)
+		codeJson := &users.TotpCodeJson{}
+		err := c.ShouldBindJSON(codeJson)
 		if err != nil {
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			_ = c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
-		exUser := users.UserSafeJsonFromUser(user)
-		c.SecureJSON(http.StatusOK, exUser)
+		err = auth.totp.Disable(user, codeJson.Code)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusForbidden, err)
+			return
+		}
+		c.String(http.StatusOK, "Disabled totp")
+		logrus.WithField("Username", user.Username).Infoln("Disabled totp.")
 	})
 
+	router.POST("/api/user/create", auth.Middleware(), func(c *gin.Context) {
+		userJson := &users.UserJson{}
+		contentType := c.Request.Header.Get("Content-Type")
+		if contentType != "application/json" {
+			_ = c.AbortWithError(http.StatusBadRequest, errors.New("wrong content type given"))
+			logrus.WithError(errors.New("wrong content type given")).Errorf("During request the wrong content type was given.")
+			return
+		}
+		err := c.ShouldBindJSON(userJson)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		user, err := svc.CreateUser(CurrentPrincipal(c), userJson)
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, users.UserSafeJsonFromUser(user))
+	})
+
+	registerUserRoutes(router, svc, auth)
+	registerGroupRoutes(router, u, auth)
+	registerKeyRoutes(router, svc, auth)
+	registerV1Routes(router, svc, auth)
+	registerUploadKeyRoutes(router, s, a, lockout, matcher, isInDebugMode)
+	registerShareRoutes(router, s, a, lockout, matcher, isInDebugMode)
+
 	router.GET("/teapot", func(c *gin.Context) {
 		ip, _ := c.RemoteIP()
 		t := time.Now()
@@ -392,9 +596,19 @@ func NewRouter(s *CompoundStore, a access.AccessStore, u users.UserStorage) *gin
 
 	router.StaticFile("/favicon.ico", "./static/favicon.ico")
 
+	registerOpenApiRoute(router)
+
 	router.GET("/ping", func(c *gin.Context) {
 		c.String(http.StatusOK, "Pong")
 	})
 
+	registerHealthRoutes(router, map[string]interface{}{
+		"access":   a,
+		"metadata": s.metadata,
+		"security": s.security,
+		"storage":  s.storage,
+		"users":    u,
+	}, isInDebugMode)
+
 	return router
 }
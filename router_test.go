@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"errors"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"secure-store/access"
+	"secure-store/metadata"
+	"secure-store/presign"
+	"secure-store/security"
+	"secure-store/storage"
+	"secure-store/users"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	router   http.Handler
+	store    *CompoundStore
+	access   access.AccessStore
+	users    users.UserStorage
+	auth     *Authenticator
+	presign  *presign.Keyring
+	setProxy func(proxies []string) error
+}
+
+func newTestServer(t *testing.T) *testServer {
+	return newMeteredTestServer(t, nil)
+}
+
+// newMeteredTestServer wraps the stores with metrics unless they are nil.
+func newMeteredTestServer(t *testing.T, metrics *Metrics) *testServer {
+	compound := &CompoundStore{
+		metadata: metadata.NewMemoryStore(),
+		security: security.NewMemorySecurityStore(),
+		storage:  storage.NewMemoryStorage(),
+	}
+	var a access.AccessStore = access.NewMemoryStore()
+	if metrics != nil {
+		compound.metadata = metrics.MetadataStore(compound.metadata)
+		compound.storage = metrics.Storage(compound.storage)
+		a = metrics.AccessStore(a)
+	}
+	u := users.NewMemoryStore()
+	secret, err := users.NewTokenSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := users.NewTokenSigner(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, err := users.NewSecretBox(security.NewEncryptionKey().Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewAuthenticator(u, users.NewMemorySessionStore(), tokens, users.NewTotpManager(u, box), nil)
+	ring := presign.NewKeyring()
+	presignSecret, err := presign.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ring.Add(1, presignSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter(compound, a, u, auth, ring, nil, metrics, nil)
+	return &testServer{
+		router:   r,
+		store:    compound,
+		access:   a,
+		users:    u,
+		auth:     auth,
+		presign:  ring,
+		setProxy: r.SetTrustedProxies,
+	}
+}
+
+func (s *testServer) do(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func (s *testServer) putObject(t *testing.T, bucketId, keyId, content string) {
+	err := s.store.NewBucket(bucketId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := metadata.NewMetadata(int64(len(content)), keyId+".txt")
+	err = s.store.Write(bucketId, keyId, meta, security.NewEncryptionKey(), bytes.NewReader([]byte(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rootCredentials bootstraps the root user and returns its credentials.
+func (s *testServer) rootCredentials(t *testing.T) *RootCredentials {
+	secretsFile := filepath.Join(t.TempDir(), "root.json")
+	err := BootstrapRoot(s.users, secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := LoadRootCredentials(secretsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return credentials
+}
+
+// rootApiKey bootstraps the root user and returns its encoded api key.
+func (s *testServer) rootApiKey(t *testing.T) string {
+	return s.rootCredentials(t).ApiKey
+}
+
+func TestAdminsCantManageGroupRootUsers(t *testing.T) {
+	server := newTestServer(t)
+	svc := NewService(server.store, server.access, server.users, nil, server.presign, nil)
+	group := &users.Group{Id: uuid.New(), Name: "operators", Role: users.Role{RootUser: true}}
+	err := server.users.CreateGroup(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newUser := func(username string, role users.Role, groups ...uuid.UUID) *users.User {
+		user, err := users.UserFromUserJson(&users.UserJson{
+			Id:           uuid.NewString(),
+			Username:     username,
+			Name:         username,
+			PasswordHash: users.DerivePasswordKey(username + "-password"),
+			ApiKey:       bytes.Repeat([]byte(username[:1]), users.APIKeyLength),
+			Role:         role,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Groups = groups
+		err = server.users.Create(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	admin := newUser("admin", users.Role{CanCreateUsers: true})
+	newUser("operator", users.Role{}, group.Id)
+	permissions, err := users.ResolvePermissions(server.users, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal := &Principal{User: admin, Permissions: permissions}
+
+	_, err = svc.ResetPassword(principal, "operator", "taken-over")
+	if asApiError(err).Status != http.StatusForbidden {
+		t.Errorf("Resetting the password of a group root user returned %v", err)
+	}
+	_, err = svc.DeleteUser(principal, "operator")
+	if asApiError(err).Status != http.StatusForbidden {
+		t.Errorf("Deleting a group root user returned %v", err)
+	}
+	_, err = svc.SetUserRole(principal, "operator", users.Role{})
+	if asApiError(err).Status != http.StatusForbidden {
+		t.Errorf("Changing the role of a group root user returned %v", err)
+	}
+}
+
+func TestUploadKeyDoesntOverwriteObjects(t *testing.T) {
+	server := newTestServer(t)
+	server.putObject(t, "reports", "monday", "content")
+	key, err := access.FromExAccessKey(access.ExAccessKey{BucketId: "reports", KeyId: "monday", UrlKey: "monday-upload", Upload: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.access.AddKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/api/upload?urlKey=monday-upload", bytes.NewReader([]byte("replaced content")))
+	req.Header.Set("filename", "replaced.txt")
+	w := server.do(req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Uploading over an object answered %v", w.Code)
+	}
+	meta, err := server.store.ReadMetadata("reports", "monday")
+	if err != nil || meta.Filename != "monday.txt" || meta.Length != int64(len("content")) {
+		t.Errorf("Existing object changed to %+v: %v", meta, err)
+	}
+}
+
+func TestLoginLimitsTotpGuesses(t *testing.T) {
+	server := newTestServer(t)
+	lockout, err := access.NewLockout(access.NewMemoryStore(), access.LockoutPolicy{MaxFailures: 3, Window: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &Authenticator{users: server.users, sessions: server.auth.sessions, tokens: server.auth.tokens, totp: server.auth.totp, lockout: lockout}
+	user := &users.User{Id: uuid.New(), Username: "admin"}
+	err = user.SetPassword(users.DerivePasswordKey("admin-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.users.Create(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollment, err := auth.totp.Enroll(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = auth.totp.Confirm(user, users.TotpCode(secret, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.TODO()
+	for i := 0; i < 3; i++ {
+		_, wait, err := auth.Login(ctx, "192.0.2.1", "admin", "admin-password", "000000")
+		if !errors.Is(err, InvalidCredentials) || wait != 0 {
+			t.Errorf("Wrong code %v answered %v after %v", i+1, err, wait)
+		}
+	}
+	// Another ip doesn't get fresh guesses at the same user.
+	_, wait, err := auth.Login(ctx, "192.0.2.2", "admin", "admin-password", users.TotpCode(secret, time.Now()))
+	if err == nil || wait == 0 {
+		t.Errorf("Locked user logged in with %v after %v", err, wait)
+	}
+}
+
+func TestChangePasswordReloadsUserAndLocksOut(t *testing.T) {
+	server := newTestServer(t)
+	lockout, err := access.NewLockout(access.NewMemoryStore(), access.LockoutPolicy{MaxFailures: 3, Window: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(server.store, server.access, server.users, nil, server.presign, lockout)
+	user := &users.User{Id: uuid.New(), Username: "operator", Role: users.Role{RootUser: true}}
+	err = user.SetPassword(users.DerivePasswordKey("old-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.users.Create(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The caller authenticated before an admin took the root role away.
+	principal := &Principal{User: &users.User{}}
+	*principal.User = *user
+	demoted := *user
+	demoted.Role = users.Role{}
+	err = server.users.Update(&demoted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.TODO()
+	for i := 0; i < 3; i++ {
+		wait, err := svc.ChangePassword(ctx, principal, "192.0.2.1", "guess", "new-password")
+		if asApiError(err).Status != http.StatusForbidden || wait != 0 {
+			t.Errorf("Wrong password %v answered %v after %v", i+1, err, wait)
+		}
+	}
+	wait, err := svc.ChangePassword(ctx, principal, "192.0.2.2", "old-password", "new-password")
+	if asApiError(err).Status != http.StatusTooManyRequests || wait == 0 {
+		t.Errorf("Locked user changed the password with %v after %v", err, wait)
+	}
+
+	svc = NewService(server.store, server.access, server.users, nil, server.presign, nil)
+	_, err = svc.ChangePassword(ctx, principal, "192.0.2.1", "old-password", "new-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := server.users.ResolveByUuid(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Role.RootUser || !stored.VerifyPassword(users.DerivePasswordKey("new-password")) {
+		t.Errorf("Password change stored %+v", stored.Role)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"secure-store/users"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const s3Algorithm = "AWS4-HMAC-SHA256"
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+const s3StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+const s3DateFormat = "20060102T150405Z"
+const s3MaxClockSkew = 15 * time.Minute
+const s3MaxPresignExpiry = 7 * 24 * time.Hour
+
+const s3ContentShaHeader = "X-Amz-Content-Sha256"
+
+var s3PayloadMismatch = errors.New("payload doesn't match x-amz-content-sha256")
+
+// sigV4 holds the parts of an AWS signature version 4, from the Authorization
+// header or from the query of a presigned url.
+type sigV4 struct {
+	accessKey     string
+	scope         string
+	scopeDate     string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	date          time.Time
+	payloadHash   string
+	presigned     bool
+}
+
+// S3Credentials returns the access key and secret the S3 gateway expects from
+// user, the secret is the encoded api key.
+func S3Credentials(user *users.User) (string, string) {
+	return user.Username, base64.RawURLEncoding.EncodeToString(user.ApiKey)
+}
+
+func parseSigV4(r *http.Request, now time.Time) (*sigV4, error) {
+	query := r.URL.Query()
+	ret := &sigV4{}
+	var credential, signedHeaders, date string
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != s3Algorithm {
+			return nil, s3AuthorizationQueryMalformed
+		}
+		ret.presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		ret.signature = query.Get("X-Amz-Signature")
+		date = query.Get("X-Amz-Date")
+		ret.payloadHash = s3UnsignedPayload
+	} else {
+		header := r.Header.Get(AuthorizationHeader)
+		if header == "" {
+			return nil, s3AccessDenied
+		}
+		if !strings.HasPrefix(header, s3Algorithm+" ") {
+			return nil, s3AuthorizationHeaderMalformed
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(header, s3Algorithm+" "), ",") {
+			pair := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(pair) != 2 {
+				return nil, s3AuthorizationHeaderMalformed
+			}
+			switch pair[0] {
+			case "Credential":
+				credential = pair[1]
+			case "SignedHeaders":
+				signedHeaders = pair[1]
+			case "Signature":
+				ret.signature = pair[1]
+			}
+		}
+		date = r.Header.Get("X-Amz-Date")
+		ret.payloadHash = r.Header.Get(s3ContentShaHeader)
+		if ret.payloadHash == "" {
+			return nil, s3InvalidRequest("x-amz-content-sha256 header is missing")
+		}
+	}
+	if credential == "" || signedHeaders == "" || ret.signature == "" || date == "" {
+		return nil, s3AuthorizationHeaderMalformed
+	}
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || parts[3] != "s3" {
+		return nil, s3AuthorizationHeaderMalformed
+	}
+	ret.accessKey, ret.scopeDate, ret.region, ret.service = parts[0], parts[1], parts[2], parts[3]
+	ret.scope = strings.Join(parts[1:], "/")
+	ret.signedHeaders = strings.Split(signedHeaders, ";")
+	parsed, err := time.Parse(s3DateFormat, date)
+	if err != nil || parsed.Format("20060102") != ret.scopeDate {
+		return nil, s3AuthorizationHeaderMalformed
+	}
+	ret.date = parsed
+	if ret.presigned {
+		expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+		if err != nil || expires < 0 || time.Duration(expires)*time.Second > s3MaxPresignExpiry {
+			return nil, s3AuthorizationQueryMalformed
+		}
+		if now.After(parsed.Add(time.Duration(expires)*time.Second)) || parsed.After(now.Add(s3MaxClockSkew)) {
+			return nil, s3AccessDeniedWith("request has expired")
+		}
+	} else if parsed.Before(now.Add(-s3MaxClockSkew)) || parsed.After(now.Add(s3MaxClockSkew)) {
+		return nil, s3RequestTimeTooSkewed
+	}
+	if ret.payloadHash == s3StreamingPayload {
+		return nil, s3NotImplemented("chunked payload signing isn't supported, send UNSIGNED-PAYLOAD or the payload hash")
+	}
+	return ret, nil
+}
+
+// s3Escape encodes like AWS does, everything but unreserved characters.
+func s3Escape(s string, encodeSlash bool) string {
+	buf := strings.Builder{}
+	for _, b := range []byte(s) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			buf.WriteByte(b)
+			continue
+		}
+		buf.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{b})))
+	}
+	return buf.String()
+}
+
+func canonicalQuery(query url.Values, presigned bool) string {
+	pairs := make([]string, 0, len(query))
+	for key, values := range query {
+		if presigned && key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaderValue(r *http.Request, name string) string {
+	if name == "host" {
+		return r.Host
+	}
+	values := r.Header.Values(name)
+	if len(values) == 0 && name == "content-length" && r.ContentLength >= 0 {
+		return strconv.FormatInt(r.ContentLength, 10)
+	}
+	trimmed := make([]string, 0, len(values))
+	for _, value := range values {
+		trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+	}
+	return strings.Join(trimmed, ",")
+}
+
+func (s *sigV4) canonicalRequest(r *http.Request) string {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	headers := strings.Builder{}
+	for _, name := range s.signedHeaders {
+		headers.WriteString(name + ":" + canonicalHeaderValue(r, name) + "\n")
+	}
+	return strings.Join([]string{
+		r.Method,
+		s3Escape(path, false),
+		canonicalQuery(r.URL.Query(), s.presigned),
+		headers.String(),
+		strings.Join(s.signedHeaders, ";"),
+		s.payloadHash,
+	}, "\n")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign returns the hex signature of the request with the given secret.
+func (s *sigV4) sign(r *http.Request, secret string) string {
+	canonical := sha256.Sum256([]byte(s.canonicalRequest(r)))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		s.date.Format(s3DateFormat),
+		s.scope,
+		hex.EncodeToString(canonical[:]),
+	}, "\n")
+	key := hmacSha256([]byte("AWS4"+secret), s.scopeDate)
+	key = hmacSha256(key, s.region)
+	key = hmacSha256(key, s.service)
+	key = hmacSha256(key, "aws4_request")
+	return hex.EncodeToString(hmacSha256(key, stringToSign))
+}
+
+func (s *sigV4) verify(r *http.Request, secret string) bool {
+	return hmac.Equal([]byte(s.sign(r, secret)), []byte(s.signature))
+}
+
+// authenticateS3 resolves the user that signed the request. Signed payloads
+// are checked while the body is read, a mismatch surfaces as
+// s3PayloadMismatch from the body.
+func authenticateS3(r *http.Request, u users.UserStorage, now time.Time) (*users.User, error) {
+	sig, err := parseSigV4(r, now)
+	if err != nil {
+		return nil, err
+	}
+	user, err := u.ResolveByUsername(sig.accessKey)
+	if err != nil || len(user.ApiKey) == 0 {
+		return nil, s3InvalidAccessKeyId
+	}
+	_, secret := S3Credentials(user)
+	if !sig.verify(r, secret) {
+		return nil, s3SignatureDoesNotMatch
+	}
+	if sig.payloadHash != s3UnsignedPayload {
+		expected, err := hex.DecodeString(sig.payloadHash)
+		if err != nil || len(expected) != sha256.Size {
+			return nil, s3InvalidRequest("x-amz-content-sha256 isn't a sha256 hash")
+		}
+		r.Body = &payloadVerifier{body: r.Body, hash: sha256.New(), expected: expected}
+	}
+	return user, nil
+}
+
+type payloadVerifier struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+}
+
+func (p *payloadVerifier) Read(b []byte) (int, error) {
+	n, err := p.body.Read(b)
+	p.hash.Write(b[:n])
+	if err == io.EOF && !bytes.Equal(p.hash.Sum(nil), p.expected) {
+		return n, s3PayloadMismatch
+	}
+	return n, err
+}
+
+func (p *payloadVerifier) Close() error {
+	return p.body.Close()
+}
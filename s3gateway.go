@@ -0,0 +1,560 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"secure-store/users"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const S3PortEnv = "S3_PORT"
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+const s3DefaultMaxKeys = 1000
+
+// S3Error is answered as the XML error document S3 clients expect.
+type S3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Code, e.Message)
+}
+
+var (
+	s3AccessDenied                 = &S3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	s3AuthorizationHeaderMalformed = &S3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	s3AuthorizationQueryMalformed  = &S3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "The authorization query parameters are malformed."}
+	s3RequestTimeTooSkewed         = &S3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	s3InvalidAccessKeyId           = &S3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key id doesn't exist."}
+	s3SignatureDoesNotMatch        = &S3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature doesn't match."}
+	s3ContentShaMismatch           = &S3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The payload doesn't match x-amz-content-sha256."}
+	s3MissingContentLength         = &S3Error{http.StatusLengthRequired, "MissingContentLength", "Content-Length is required."}
+	s3BucketNotEmpty               = &S3Error{http.StatusConflict, "BucketNotEmpty", "The bucket isn't empty."}
+	s3InvalidRange                 = &S3Error{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range isn't satisfiable."}
+	s3NoSuchUpload                 = &S3Error{http.StatusNotFound, "NoSuchUpload", "The multipart upload doesn't exist."}
+	s3InvalidPart                  = &S3Error{http.StatusBadRequest, "InvalidPart", "A part wasn't uploaded or its ETag doesn't match."}
+	s3InvalidPartOrder             = &S3Error{http.StatusBadRequest, "InvalidPartOrder", "Parts must be listed in ascending order."}
+	s3MalformedXML                 = &S3Error{http.StatusBadRequest, "MalformedXML", "The XML isn't well formed."}
+)
+
+func s3AccessDeniedWith(message string) *S3Error {
+	return &S3Error{http.StatusForbidden, "AccessDenied", message}
+}
+
+func s3InvalidRequest(message string) *S3Error {
+	return &S3Error{http.StatusBadRequest, "InvalidRequest", message}
+}
+
+func s3NotImplemented(message string) *S3Error {
+	return &S3Error{http.StatusNotImplemented, "NotImplemented", message}
+}
+
+var s3Codes = map[ErrorCode]*S3Error{
+	CodeInvalidBucketId: {http.StatusBadRequest, "InvalidBucketName", BucketIdMatchingError().Error()},
+	CodeInvalidKeyId:    {http.StatusBadRequest, "InvalidArgument", KeyIdMatchingError().Error()},
+	CodeForbidden:       s3AccessDenied,
+	CodeBucketNotFound:  {http.StatusNotFound, "NoSuchBucket", "The bucket doesn't exist."},
+	CodeObjectNotFound:  {http.StatusNotFound, "NoSuchKey", "The key doesn't exist."},
+	CodeBucketExists:    {http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists."},
+	CodeObjectExists:    {http.StatusConflict, "OperationAborted", "The object was created by a concurrent upload."},
+}
+
+// asS3Error translates service errors into their S3 counterparts.
+func asS3Error(err error) *S3Error {
+	s3Err := &S3Error{}
+	if errors.As(err, &s3Err) {
+		return s3Err
+	}
+	if errors.Is(err, s3PayloadMismatch) {
+		return s3ContentShaMismatch
+	}
+	apiErr := asApiError(err)
+	mapped, ok := s3Codes[apiErr.Code]
+	if ok {
+		return mapped
+	}
+	if apiErr.Status >= http.StatusInternalServerError {
+		return &S3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error."}
+	}
+	return s3InvalidRequest(apiErr.Message)
+}
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestId string   `xml:"RequestId"`
+}
+
+func abortWithS3Error(c *gin.Context, err error) {
+	s3Err := asS3Error(err)
+	_ = c.Error(err)
+	if s3Err.Status >= http.StatusInternalServerError && s3Err.Status != http.StatusNotImplemented {
+		logrus.WithError(err).WithField("Path", c.Request.URL.Path).Errorf("S3 request failed.")
+	}
+	if c.Request.Method == http.MethodHead {
+		c.AbortWithStatus(s3Err.Status)
+		return
+	}
+	c.Abort()
+	c.XML(s3Err.Status, s3ErrorResponse{
+		Code:      s3Err.Code,
+		Message:   s3Err.Message,
+		Resource:  c.Request.URL.Path,
+		RequestId: c.Writer.Header().Get("X-Amz-Request-Id"),
+	})
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string    `xml:"Name"`
+	CreationDate time.Time `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+	StorageClass string    `xml:"StorageClass"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name   `xml:"ListBucketResult"`
+	Xmlns                 string     `xml:"xmlns,attr"`
+	Name                  string     `xml:"Name"`
+	Prefix                string     `xml:"Prefix"`
+	StartAfter            string     `xml:"StartAfter,omitempty"`
+	ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int        `xml:"KeyCount"`
+	MaxKeys               int        `xml:"MaxKeys"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	Contents              []s3Object `xml:"Contents"`
+}
+
+// s3Gateway serves buckets and objects of the service to S3 clients.
+type s3Gateway struct {
+	svc     *Service
+	users   users.UserStorage
+	uploads *s3Uploads
+	now     func() time.Time
+}
+
+// NewS3Router answers path style S3 requests, signed with the credentials
+// returned by S3Credentials. Keys have to satisfy the same rules as on the
+// other routes, so keys with slashes are rejected.
+func NewS3Router(svc *Service, u users.UserStorage) *gin.Engine {
+	return newS3Gateway(svc, u).router()
+}
+
+func newS3Gateway(svc *Service, u users.UserStorage) *s3Gateway {
+	return &s3Gateway{svc: svc, users: u, uploads: newS3Uploads(), now: time.Now}
+}
+
+func (g *s3Gateway) router() *gin.Engine {
+	router := gin.New()
+	router.RedirectTrailingSlash = false
+	router.Use(gin.Recovery(), gin.Logger(), g.authenticate)
+
+	router.GET("/", g.listBuckets)
+	router.PUT("/:bucket", g.createBucket)
+	router.HEAD("/:bucket", g.headBucket)
+	router.DELETE("/:bucket", g.deleteBucket)
+	router.GET("/:bucket", g.listObjects)
+	router.PUT("/:bucket/*key", g.bucketOr(g.createBucket, g.putObject))
+	router.HEAD("/:bucket/*key", g.bucketOr(g.headBucket, g.headObject))
+	router.DELETE("/:bucket/*key", g.bucketOr(g.deleteBucket, g.deleteObject))
+	router.GET("/:bucket/*key", g.bucketOr(g.listObjects, g.getObject))
+	router.POST("/:bucket/*key", g.bucketOr(g.notImplemented, g.postObject))
+	return router
+}
+
+func (g *s3Gateway) authenticate(c *gin.Context) {
+	c.Header("X-Amz-Request-Id", uuid.NewString())
+	user, err := authenticateS3(c.Request, g.users, g.now())
+	if err != nil {
+		abortWithS3Error(c, err)
+		logrus.WithError(err).WithField("Path", c.Request.URL.Path).Infoln("Rejected unauthenticated S3 request.")
+		return
+	}
+	permissions, err := users.ResolvePermissions(g.users, user)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	c.Set(UserContextKey, user)
+	c.Set(PermissionsContextKey, permissions)
+	c.Next()
+}
+
+func objectKey(c *gin.Context) string {
+	return strings.TrimPrefix(c.Param("key"), "/")
+}
+
+// bucketOr sends requests with a trailing slash but no key to the bucket
+// handler.
+func (g *s3Gateway) bucketOr(bucket, object gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if objectKey(c) == "" {
+			bucket(c)
+			return
+		}
+		object(c)
+	}
+}
+
+func (g *s3Gateway) notImplemented(c *gin.Context) {
+	abortWithS3Error(c, s3NotImplemented("the operation isn't supported"))
+}
+
+func (g *s3Gateway) listBuckets(c *gin.Context) {
+	buckets, err := g.svc.ListBuckets(CurrentPrincipal(c))
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	user := CurrentUser(c)
+	ret := s3ListAllMyBucketsResult{
+		Xmlns:   s3Namespace,
+		Owner:   s3Owner{ID: user.Id.String(), DisplayName: user.Username},
+		Buckets: make([]s3Bucket, 0, len(buckets)),
+	}
+	for _, bucket := range buckets {
+		ret.Buckets = append(ret.Buckets, s3Bucket{Name: bucket})
+	}
+	c.XML(http.StatusOK, ret)
+}
+
+func (g *s3Gateway) createBucket(c *gin.Context) {
+	bucketId := c.Param("bucket")
+	err := g.svc.CreateBucket(CurrentPrincipal(c), bucketId)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	c.Header("Location", "/"+bucketId)
+	c.Status(http.StatusOK)
+}
+
+func (g *s3Gateway) headBucket(c *gin.Context) {
+	_, err := g.svc.ListObjects(CurrentPrincipal(c), c.Param("bucket"), "")
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// deleteBucket only removes empty buckets, like S3 does.
+func (g *s3Gateway) deleteBucket(c *gin.Context) {
+	principal := CurrentPrincipal(c)
+	bucketId := c.Param("bucket")
+	err := g.svc.checkBucketId(bucketId)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	if !principal.can((*users.Permissions).CanDelete, bucketId) {
+		abortWithS3Error(c, s3AccessDenied)
+		return
+	}
+	err = g.svc.requireBucket(bucketId)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	keyIds, err := g.svc.store.ListKeys(bucketId, "")
+	if err != nil {
+		abortWithS3Error(c, internalError(err))
+		return
+	}
+	// Unfinished uploads don't keep a bucket from being deleted, they aren't
+	// objects yet.
+	for _, keyId := range keyIds {
+		if !hiddenObject(keyId) {
+			abortWithS3Error(c, s3BucketNotEmpty)
+			return
+		}
+	}
+	err = g.svc.DeleteBucket(principal, bucketId)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// listObjects implements ListObjectsV2. Keys can't contain slashes, so a
+// delimiter never yields common prefixes.
+func (g *s3Gateway) listObjects(c *gin.Context) {
+	query := c.Request.URL.Query()
+	if _, ok := query["location"]; ok {
+		c.XML(http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: s3Namespace})
+		return
+	}
+	if query.Get("list-type") != "2" {
+		abortWithS3Error(c, s3NotImplemented("only ListObjectsV2 is supported"))
+		return
+	}
+	maxKeys := s3DefaultMaxKeys
+	if query.Get("max-keys") != "" {
+		parsed, err := strconv.Atoi(query.Get("max-keys"))
+		if err != nil || parsed < 0 {
+			abortWithS3Error(c, s3InvalidRequest("max-keys must be a positive number"))
+			return
+		}
+		if parsed < maxKeys {
+			maxKeys = parsed
+		}
+	}
+	after := query.Get("start-after")
+	token := query.Get("continuation-token")
+	if token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			abortWithS3Error(c, s3InvalidRequest("continuation token is invalid"))
+			return
+		}
+		after = string(decoded)
+	}
+	bucketId := c.Param("bucket")
+	prefix := query.Get("prefix")
+	objects, err := g.svc.ListObjects(CurrentPrincipal(c), bucketId, prefix)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].KeyId < objects[j].KeyId
+	})
+	ret := s3ListBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              bucketId,
+		Prefix:            prefix,
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: token,
+		MaxKeys:           maxKeys,
+		Contents:          make([]s3Object, 0),
+	}
+	for _, object := range objects {
+		if object.KeyId <= after {
+			continue
+		}
+		if len(ret.Contents) == maxKeys {
+			ret.IsTruncated = true
+			// Listing no keys leaves nothing to continue after.
+			if maxKeys > 0 {
+				last := ret.Contents[len(ret.Contents)-1].Key
+				ret.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			}
+			break
+		}
+		ret.Contents = append(ret.Contents, s3Object{
+			Key:          object.KeyId,
+			Size:         object.Length,
+			StorageClass: "STANDARD",
+		})
+	}
+	ret.KeyCount = len(ret.Contents)
+	c.XML(http.StatusOK, ret)
+}
+
+// uploadTarget is where an upload to keyId is written. S3 overwrites objects,
+// the new content of an existing one is staged next to it and swapped in once
+// it's complete, which takes the permission to delete the old one.
+func (g *s3Gateway) uploadTarget(p *Principal, bucketId, keyId string) (string, error) {
+	_, err := g.svc.store.ReadMetadata(bucketId, keyId)
+	if err != nil {
+		return keyId, nil
+	}
+	if !p.can((*users.Permissions).CanDelete, bucketId) {
+		return "", forbiddenError()
+	}
+	staged, err := replacementKey("object")
+	if err != nil {
+		return "", internalError(err)
+	}
+	return staged, nil
+}
+
+func (g *s3Gateway) putObject(c *gin.Context) {
+	query := c.Request.URL.Query()
+	if query.Get("uploadId") != "" {
+		g.uploadPart(c)
+		return
+	}
+	if c.GetHeader("X-Amz-Copy-Source") != "" {
+		abortWithS3Error(c, s3NotImplemented("copying objects isn't supported"))
+		return
+	}
+	if c.Request.ContentLength < 0 {
+		abortWithS3Error(c, s3MissingContentLength)
+		return
+	}
+	principal := CurrentPrincipal(c)
+	bucketId, keyId := c.Param("bucket"), objectKey(c)
+	target, err := g.uploadTarget(principal, bucketId, keyId)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	digest := md5.New()
+	body := io.TeeReader(c.Request.Body, digest)
+	_, err = g.svc.PutObject(principal, bucketId, target, keyId, c.Request.ContentLength, body)
+	if errors.Is(err, s3PayloadMismatch) {
+		// The object was written before the mismatch showed.
+		_ = g.svc.store.Delete(bucketId, target)
+	}
+	if err == nil && target != keyId {
+		err = g.svc.swapReplacement(principal, bucketId, keyId, target)
+	}
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	c.Header("ETag", `"`+hex.EncodeToString(digest.Sum(nil))+`"`)
+	c.Status(http.StatusOK)
+}
+
+func objectHeaders(c *gin.Context, filename string) {
+	c.Header("Accept-Ranges", "bytes")
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, filename))
+}
+
+func (g *s3Gateway) headObject(c *gin.Context) {
+	meta, reader, err := g.svc.GetObject(CurrentPrincipal(c), c.Param("bucket"), objectKey(c))
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	_ = reader.Close()
+	objectHeaders(c, meta.Filename)
+	c.Header("Content-Length", strconv.FormatInt(meta.Length, 10))
+	c.Status(http.StatusOK)
+}
+
+// parseRange supports the single byte ranges S3 supports, it returns the first
+// and the last byte.
+func parseRange(header string, length int64) (int64, int64, error) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, 0, s3InvalidRange
+	}
+	bounds := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(bounds) != 2 || (bounds[0] == "" && bounds[1] == "") {
+		return 0, 0, s3InvalidRange
+	}
+	if bounds[0] == "" {
+		suffix, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || suffix <= 0 || length == 0 {
+			return 0, 0, s3InvalidRange
+		}
+		if suffix > length {
+			suffix = length
+		}
+		return length - suffix, length - 1, nil
+	}
+	first, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || first < 0 || first >= length {
+		return 0, 0, s3InvalidRange
+	}
+	last := length - 1
+	if bounds[1] != "" {
+		last, err = strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || last < first {
+			return 0, 0, s3InvalidRange
+		}
+		if last >= length {
+			last = length - 1
+		}
+	}
+	return first, last, nil
+}
+
+func (g *s3Gateway) getObject(c *gin.Context) {
+	bucketId, keyId := c.Param("bucket"), objectKey(c)
+	meta, reader, err := g.svc.GetObject(CurrentPrincipal(c), bucketId, keyId)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	defer reader.Close()
+	rangeHeader := c.GetHeader("Range")
+	if rangeHeader == "" {
+		objectHeaders(c, meta.Filename)
+		c.DataFromReader(http.StatusOK, meta.Length, "application/octet-stream", reader, nil)
+		return
+	}
+	first, last, err := parseRange(rangeHeader, meta.Length)
+	if err != nil {
+		c.Header("Content-Range", fmt.Sprintf("bytes */%v", meta.Length))
+		abortWithS3Error(c, err)
+		return
+	}
+	// The cipher stream can't seek, the skipped bytes are decrypted and dropped.
+	_, err = io.CopyN(io.Discard, reader, first)
+	if err != nil {
+		abortWithS3Error(c, internalError(err))
+		return
+	}
+	objectHeaders(c, meta.Filename)
+	c.Header("Content-Range", fmt.Sprintf("bytes %v-%v/%v", first, last, meta.Length))
+	c.DataFromReader(http.StatusPartialContent, last-first+1, "application/octet-stream", io.LimitReader(reader, last-first+1), nil)
+}
+
+// deleteObject answers 204 for missing keys too, like S3 does.
+func (g *s3Gateway) deleteObject(c *gin.Context) {
+	if c.Request.URL.Query().Get("uploadId") != "" {
+		g.abortUpload(c)
+		return
+	}
+	err := g.svc.DeleteObject(CurrentPrincipal(c), c.Param("bucket"), objectKey(c))
+	if err != nil && !isApiError(err, CodeObjectNotFound) {
+		abortWithS3Error(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (g *s3Gateway) postObject(c *gin.Context) {
+	query := c.Request.URL.Query()
+	if _, ok := query["uploads"]; ok {
+		g.createUpload(c)
+		return
+	}
+	if query.Get("uploadId") != "" {
+		g.completeUpload(c)
+		return
+	}
+	g.notImplemented(c)
+}
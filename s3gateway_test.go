@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"secure-store/metadata"
+	"secure-store/security"
+	"secure-store/users"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newS3Client(t *testing.T, endpoint, accessKey, secret string) *s3.S3 {
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(endpoint),
+		Region:           aws.String("us-east-1"),
+		Credentials:      credentials.NewStaticCredentials(accessKey, secret, ""),
+		S3ForcePathStyle: aws.Bool(true),
+		DisableSSL:       aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3.New(sess)
+}
+
+// newS3TestClient starts the gateway of a fresh test server and returns a
+// client signed with the root credentials.
+func newS3TestClient(t *testing.T) (*testServer, *s3.S3) {
+	server := newTestServer(t)
+	server.rootApiKey(t)
+	gateway := httptest.NewServer(NewS3Router(NewService(server.store, server.access, server.users, nil, server.presign, nil), server.users))
+	t.Cleanup(gateway.Close)
+	root, err := server.users.ResolveByUuid(uuid.MustParse(RootUserId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessKey, secret := S3Credentials(root)
+	return server, newS3Client(t, gateway.URL, accessKey, secret)
+}
+
+func expectS3Error(t *testing.T, err error, code string) {
+	t.Helper()
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		t.Fatalf("Expected S3 error %v, got %v", code, err)
+	}
+	if awsErr.Code() != code {
+		t.Errorf("Expected S3 error %v, got %v", code, awsErr.Code())
+	}
+}
+
+func TestS3Objects(t *testing.T) {
+	server, client := newS3TestClient(t)
+
+	_, err := client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("reports")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := client.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets.Buckets) != 1 || *buckets.Buckets[0].Name != "reports" {
+		t.Errorf("Unexpected buckets %v", buckets.Buckets)
+	}
+
+	for _, key := range []string{"monday", "tuesday", "wednesday"} {
+		_, err = client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String("reports"),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader([]byte("report of " + key)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("reports"),
+		Key:    aws.String("tuesday"),
+		Body:   bytes.NewReader([]byte("overwritten")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	overwritten, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("reports"), Key: aws.String("tuesday")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(overwritten.Body)
+	if string(content) != "overwritten" {
+		t.Errorf("Overwritten object holds %q", content)
+	}
+	keys, err := server.store.ListKeys("reports", "")
+	if err != nil || len(keys) != 3 {
+		t.Errorf("Overwriting left %v behind: %v", keys, err)
+	}
+
+	head, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("reports"), Key: aws.String("monday")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *head.ContentLength != int64(len("report of monday")) {
+		t.Errorf("Head reported length %v", *head.ContentLength)
+	}
+
+	object, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String("reports"),
+		Key:    aws.String("monday"),
+		Range:  aws.String("bytes=3-8"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = io.ReadAll(object.Body)
+	if string(content) != "ort of" || *object.ContentRange != "bytes 3-8/16" {
+		t.Errorf("Range returned %q with %v", content, *object.ContentRange)
+	}
+
+	page, err := client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("reports"), MaxKeys: aws.Int64(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Contents) != 2 || !*page.IsTruncated || *page.Contents[0].Key != "monday" {
+		t.Fatalf("Unexpected first page %v", page)
+	}
+	page, err = client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("reports"), ContinuationToken: page.NextContinuationToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Contents) != 1 || *page.IsTruncated || *page.Contents[0].Key != "wednesday" {
+		t.Errorf("Unexpected second page %v", page)
+	}
+	page, err = client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("reports"), MaxKeys: aws.Int64(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Contents) != 0 || !*page.IsTruncated || page.NextContinuationToken != nil {
+		t.Errorf("Unexpected empty page %v", page)
+	}
+
+	_, err = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String("reports")})
+	expectS3Error(t, err, "BucketNotEmpty")
+	for _, key := range []string{"monday", "tuesday", "wednesday"} {
+		_, err = client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("reports"), Key: aws.String(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String("reports"), Key: aws.String("monday")})
+	expectS3Error(t, err, "NoSuchKey")
+	// The part of an unfinished upload isn't an object yet.
+	partKey := s3PartKey("abandoned", 1, "attempt")
+	err = server.store.Write("reports", partKey, metadata.NewMetadata(4, partKey), security.NewEncryptionKey(), strings.NewReader("part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String("reports")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String("reports")})
+	expectS3Error(t, err, "NoSuchBucket")
+	_, err = client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("reports")})
+	expectS3Error(t, err, "NoSuchBucket")
+}
+
+func TestS3Multipart(t *testing.T) {
+	server, client := newS3TestClient(t)
+	err := server.store.NewBucket("reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String("reports"), Key: aws.String("yearly")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := []string{"first part, ", "second part, ", "last part"}
+	completed := make([]*s3.CompletedPart, 0)
+	for i, part := range parts {
+		uploaded, err := client.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String("reports"),
+			Key:        aws.String("yearly"),
+			UploadId:   created.UploadId,
+			PartNumber: aws.Int64(int64(i + 1)),
+			Body:       bytes.NewReader([]byte(part)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		completed = append(completed, &s3.CompletedPart{ETag: uploaded.ETag, PartNumber: aws.Int64(int64(i + 1))})
+	}
+	// A retried part replaces the previous one.
+	retried, err := client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String("reports"),
+		Key:        aws.String("yearly"),
+		UploadId:   created.UploadId,
+		PartNumber: aws.Int64(2),
+		Body:       bytes.NewReader([]byte(parts[1])),
+	})
+	if err != nil {
+		t.Fatalf("Retrying a part failed: %v", err)
+	}
+	completed[1].ETag = retried.ETag
+
+	listing, err := client.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String("reports")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Contents) != 0 {
+		t.Errorf("Parts of unfinished uploads are listed: %v", listing.Contents)
+	}
+
+	_, err = client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("reports"),
+		Key:             aws.String("yearly"),
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: []*s3.CompletedPart{completed[1], completed[0]}},
+	})
+	expectS3Error(t, err, "InvalidPartOrder")
+	completedUpload, err := client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("reports"),
+		Key:             aws.String("yearly"),
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(*completedUpload.ETag, `-3"`) {
+		t.Errorf("Unexpected multipart ETag %v", *completedUpload.ETag)
+	}
+
+	object, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("reports"), Key: aws.String("yearly")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(object.Body)
+	if string(content) != strings.Join(parts, "") {
+		t.Errorf("Completed upload contains %q", content)
+	}
+	keyIds, err := server.store.ListKeys("reports", "")
+	if err != nil || len(keyIds) != 1 {
+		t.Errorf("Parts weren't removed, bucket holds %v", keyIds)
+	}
+
+	aborted, err := client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String("reports"), Key: aws.String("monthly")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String("reports"), Key: aws.String("monthly"), UploadId: aborted.UploadId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String("reports"),
+		Key:        aws.String("monthly"),
+		UploadId:   aborted.UploadId,
+		PartNumber: aws.Int64(1),
+		Body:       bytes.NewReader([]byte("too late")),
+	})
+	expectS3Error(t, err, "NoSuchUpload")
+}
+
+func TestS3Authentication(t *testing.T) {
+	server, _ := newS3TestClient(t)
+	gateway := httptest.NewServer(NewS3Router(NewService(server.store, server.access, server.users, nil, server.presign, nil), server.users))
+	defer gateway.Close()
+
+	_, err := newS3Client(t, gateway.URL, "root", "wrong-secret").ListBuckets(&s3.ListBucketsInput{})
+	expectS3Error(t, err, "SignatureDoesNotMatch")
+	_, err = newS3Client(t, gateway.URL, "nobody", "secret").ListBuckets(&s3.ListBucketsInput{})
+	expectS3Error(t, err, "InvalidAccessKeyId")
+
+	resp, err := http.Get(gateway.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Anonymous request answered %v", resp.StatusCode)
+	}
+
+	reader := users.User{Username: "reader", ApiKey: bytes.Repeat([]byte{1}, users.APIKeyLength), Id: uuid.New()}
+	err = server.users.Create(&reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessKey, secret := S3Credentials(&reader)
+	_, err = newS3Client(t, gateway.URL, accessKey, secret).CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("reports")})
+	expectS3Error(t, err, "AccessDenied")
+
+	// Overwriting takes the permission to delete the old object.
+	server.putObject(t, "reports", "monday", "report of monday")
+	writers := &users.Group{Id: uuid.New(), Name: "writers", Buckets: map[string]users.BucketPermission{"reports": {Write: true}}}
+	err = server.users.CreateGroup(writers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := users.User{Username: "writer", ApiKey: bytes.Repeat([]byte{2}, users.APIKeyLength), Id: uuid.New(), Groups: []uuid.UUID{writers.Id}}
+	err = server.users.Create(&writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessKey, secret = S3Credentials(&writer)
+	_, err = newS3Client(t, gateway.URL, accessKey, secret).PutObject(&s3.PutObjectInput{
+		Bucket: aws.String("reports"),
+		Key:    aws.String("monday"),
+		Body:   bytes.NewReader([]byte("overwritten")),
+	})
+	expectS3Error(t, err, "AccessDenied")
+}
+
+func TestS3PresignedUrl(t *testing.T) {
+	server, client := newS3TestClient(t)
+	server.putObject(t, "reports", "monday", "content")
+
+	req, _ := client.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String("reports"), Key: aws.String("monday")})
+	url, err := req.Presign(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(content) != "content" {
+		t.Errorf("Presigned url answered %v: %q", resp.StatusCode, content)
+	}
+
+	resp, err = http.Get(strings.Replace(url, "monday", "tuesday", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Tampered presigned url answered %v", resp.StatusCode)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"secure-store/users"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// s3PartPrefix marks the objects that hold parts of unfinished multipart
+// uploads, they are hidden from listings.
+const s3PartPrefix = "multipart-upload-"
+const s3MaxPartNumber = 10000
+
+type s3Part struct {
+	key  string
+	etag []byte
+	size int64
+}
+
+// s3Upload tracks a multipart upload. The parts are written encrypted like any
+// object, only this bookkeeping lives in memory, so unfinished uploads don't
+// survive a restart.
+type s3Upload struct {
+	bucketId  string
+	keyId     string
+	initiator string
+	parts     map[int]s3Part
+}
+
+type s3Uploads struct {
+	m       sync.Mutex
+	uploads map[string]*s3Upload
+}
+
+func newS3Uploads() *s3Uploads {
+	return &s3Uploads{uploads: make(map[string]*s3Upload)}
+}
+
+// s3PartKey names the object of one attempt at a part. Every attempt gets its
+// own object, so a retried part only replaces the previous one once it's
+// written completely.
+func s3PartKey(uploadId string, partNumber int, attempt string) string {
+	return fmt.Sprintf("%v%v-%v-%v-part", s3PartPrefix, uploadId, partNumber, attempt)
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// upload returns the upload of the request, it has to target the same object
+// and come from the user who started it.
+func (g *s3Gateway) upload(c *gin.Context) (string, *s3Upload, error) {
+	uploadId := c.Query("uploadId")
+	g.uploads.m.Lock()
+	upload, ok := g.uploads.uploads[uploadId]
+	g.uploads.m.Unlock()
+	if !ok || upload.bucketId != c.Param("bucket") || upload.keyId != objectKey(c) {
+		return "", nil, s3NoSuchUpload
+	}
+	if upload.initiator != CurrentUser(c).Id.String() {
+		return "", nil, s3AccessDenied
+	}
+	return uploadId, upload, nil
+}
+
+func (g *s3Gateway) createUpload(c *gin.Context) {
+	principal := CurrentPrincipal(c)
+	bucketId, keyId := c.Param("bucket"), objectKey(c)
+	err := g.svc.checkObjectId(bucketId, keyId)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	if !principal.can((*users.Permissions).CanUpload, bucketId) {
+		abortWithS3Error(c, s3AccessDenied)
+		return
+	}
+	err = g.svc.requireBucket(bucketId)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		abortWithS3Error(c, internalError(err))
+		return
+	}
+	uploadId := hex.EncodeToString(id)
+	g.uploads.m.Lock()
+	g.uploads.uploads[uploadId] = &s3Upload{
+		bucketId:  bucketId,
+		keyId:     keyId,
+		initiator: principal.userId(),
+		parts:     make(map[int]s3Part),
+	}
+	g.uploads.m.Unlock()
+	c.XML(http.StatusOK, s3InitiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucketId,
+		Key:      keyId,
+		UploadId: uploadId,
+	})
+}
+
+func (g *s3Gateway) uploadPart(c *gin.Context) {
+	uploadId, upload, err := g.upload(c)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	partNumber, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		abortWithS3Error(c, s3InvalidRequest("part number must be between 1 and 10000"))
+		return
+	}
+	if c.Request.ContentLength < 0 {
+		abortWithS3Error(c, s3MissingContentLength)
+		return
+	}
+	attempt := make([]byte, 8)
+	_, err = rand.Read(attempt)
+	if err != nil {
+		abortWithS3Error(c, internalError(err))
+		return
+	}
+	principal := CurrentPrincipal(c)
+	partKey := s3PartKey(uploadId, partNumber, hex.EncodeToString(attempt))
+	digest := md5.New()
+	_, err = g.svc.PutObject(principal, upload.bucketId, partKey, partKey, c.Request.ContentLength, io.TeeReader(c.Request.Body, digest))
+	if err != nil {
+		// The part key is new, anything under it was written by this attempt.
+		if asApiError(err).Code != CodeObjectExists {
+			_ = g.svc.store.Delete(upload.bucketId, partKey)
+		}
+		abortWithS3Error(c, err)
+		return
+	}
+	etag := digest.Sum(nil)
+	g.uploads.m.Lock()
+	previous, replaced := upload.parts[partNumber]
+	_, pending := g.uploads.uploads[uploadId]
+	if pending {
+		upload.parts[partNumber] = s3Part{key: partKey, etag: etag, size: c.Request.ContentLength}
+	}
+	g.uploads.m.Unlock()
+	if !pending {
+		// The upload was completed or aborted meanwhile.
+		_ = g.svc.store.Delete(upload.bucketId, partKey)
+		abortWithS3Error(c, s3NoSuchUpload)
+		return
+	}
+	if replaced {
+		_ = g.svc.store.Delete(upload.bucketId, previous.key)
+	}
+	c.Header("ETag", `"`+hex.EncodeToString(etag)+`"`)
+	c.Status(http.StatusOK)
+}
+
+// partsReader reads the parts of an upload one after another.
+type partsReader struct {
+	io.Reader
+	parts []io.ReadCloser
+}
+
+func (r *partsReader) Close() error {
+	var err error
+	for _, part := range r.parts {
+		closeErr := part.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openParts opens every part before the object is written, the storages
+// don't allow reads while they write.
+func (g *s3Gateway) openParts(bucketId string, keys []string) (io.ReadCloser, error) {
+	parts := make([]io.ReadCloser, 0, len(keys))
+	readers := make([]io.Reader, 0, len(keys))
+	for _, key := range keys {
+		_, reader, err := g.svc.store.Read(bucketId, key)
+		if err != nil {
+			_ = (&partsReader{parts: parts}).Close()
+			return nil, err
+		}
+		parts = append(parts, reader)
+		readers = append(readers, reader)
+	}
+	return &partsReader{Reader: io.MultiReader(readers...), parts: parts}, nil
+}
+
+func (g *s3Gateway) completeUpload(c *gin.Context) {
+	uploadId, upload, err := g.upload(c)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	request := s3CompleteMultipartUpload{}
+	err = xml.NewDecoder(c.Request.Body).Decode(&request)
+	if err != nil || len(request.Parts) == 0 {
+		abortWithS3Error(c, s3MalformedXML)
+		return
+	}
+	g.uploads.m.Lock()
+	parts := make(map[int]s3Part, len(upload.parts))
+	for number, part := range upload.parts {
+		parts[number] = part
+	}
+	g.uploads.m.Unlock()
+	keys := make([]string, 0, len(request.Parts))
+	etags := make([]byte, 0, md5.Size*len(request.Parts))
+	length := int64(0)
+	for i, completed := range request.Parts {
+		if i > 0 && completed.PartNumber <= request.Parts[i-1].PartNumber {
+			abortWithS3Error(c, s3InvalidPartOrder)
+			return
+		}
+		part, ok := parts[completed.PartNumber]
+		etag, err := hex.DecodeString(strings.Trim(completed.ETag, `"`))
+		if !ok || err != nil || !bytes.Equal(etag, part.etag) {
+			abortWithS3Error(c, s3InvalidPart)
+			return
+		}
+		keys = append(keys, part.key)
+		etags = append(etags, part.etag...)
+		length += part.size
+	}
+	principal := CurrentPrincipal(c)
+	target, err := g.uploadTarget(principal, upload.bucketId, upload.keyId)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	reader, err := g.openParts(upload.bucketId, keys)
+	if err != nil {
+		abortWithS3Error(c, internalError(err))
+		return
+	}
+	_, err = g.svc.PutObject(principal, upload.bucketId, target, upload.keyId, length, reader)
+	_ = reader.Close()
+	if err == nil && target != upload.keyId {
+		err = g.svc.swapReplacement(principal, upload.bucketId, upload.keyId, target)
+	}
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	g.dropUpload(uploadId, upload)
+	digest := md5.Sum(etags)
+	c.XML(http.StatusOK, s3CompleteMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + upload.bucketId + "/" + upload.keyId,
+		Bucket:   upload.bucketId,
+		Key:      upload.keyId,
+		ETag:     fmt.Sprintf(`"%v-%v"`, hex.EncodeToString(digest[:]), len(request.Parts)),
+	})
+}
+
+func (g *s3Gateway) abortUpload(c *gin.Context) {
+	uploadId, upload, err := g.upload(c)
+	if err != nil {
+		abortWithS3Error(c, err)
+		return
+	}
+	g.dropUpload(uploadId, upload)
+	c.Status(http.StatusNoContent)
+}
+
+func (g *s3Gateway) dropUpload(uploadId string, upload *s3Upload) {
+	g.uploads.m.Lock()
+	delete(g.uploads.uploads, uploadId)
+	keys := make([]string, 0, len(upload.parts))
+	for _, part := range upload.parts {
+		keys = append(keys, part.key)
+	}
+	g.uploads.m.Unlock()
+	for _, key := range keys {
+		_ = g.svc.store.Delete(upload.bucketId, key)
+	}
+}
+
+// Close drops the unfinished uploads, their parts would stay hidden forever
+// once the bookkeeping is gone.
+func (g *s3Gateway) Close() error {
+	g.uploads.m.Lock()
+	pending := make(map[string]*s3Upload, len(g.uploads.uploads))
+	for uploadId, upload := range g.uploads.uploads {
+		pending[uploadId] = upload
+	}
+	g.uploads.m.Unlock()
+	for uploadId, upload := range pending {
+		g.dropUpload(uploadId, upload)
+	}
+	return nil
+}
@@ -0,0 +1,797 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"secure-store/access"
+	"secure-store/metadata"
+	"secure-store/presign"
+	"secure-store/security"
+	"secure-store/users"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Principal is the caller of a service method. The legacy routes that never
+// authenticated keep working through legacyPrincipal, which skips the
+// permission checks.
+type Principal struct {
+	User        *users.User
+	Permissions *users.Permissions
+	legacy      bool
+}
+
+var legacyPrincipal = &Principal{legacy: true}
+
+func (p *Principal) can(check func(*users.Permissions, string) bool, bucketId string) bool {
+	if p.legacy {
+		return true
+	}
+	return p.Permissions != nil && check(p.Permissions, bucketId)
+}
+
+// canViewKey lets users see the links they created and every link of a bucket
+// they may share or revoke keys for.
+func (p *Principal) canViewKey(key *access.AKey) bool {
+	if p.legacy {
+		return true
+	}
+	return (p.User != nil && key.CreatedBy == p.User.Id.String()) ||
+		p.can((*users.Permissions).CanAddKeys, key.BucketId) ||
+		p.can((*users.Permissions).CanDeleteKeys, key.BucketId)
+}
+
+func (p *Principal) isAdmin() bool {
+	return p.legacy || (p.Permissions != nil && p.Permissions.Role.CanCreateUsers)
+}
+
+// canManage fails unless the caller may modify the target user, only root
+// users may touch other root users. Users that are root through a group count
+// as root.
+func (p *Principal) canManage(u users.UserStorage, target *users.User) error {
+	if p.isRoot() {
+		return nil
+	}
+	permissions, err := users.ResolvePermissions(u, target)
+	if err != nil {
+		return internalError(err)
+	}
+	if permissions.Role.RootUser {
+		return forbiddenError()
+	}
+	return nil
+}
+
+func (p *Principal) isRoot() bool {
+	return p.legacy || (p.Permissions != nil && p.Permissions.Role.RootUser)
+}
+
+func (p *Principal) userId() string {
+	if p.User == nil {
+		return ""
+	}
+	return p.User.Id.String()
+}
+
+type ObjectJson struct {
+	BucketId string `json:"BucketId"`
+	KeyId    string `json:"KeyId"`
+	Filename string `json:"Filename"`
+	Length   int64  `json:"Length"`
+	Owner    string `json:"Owner,omitempty"`
+}
+
+type BucketListJson struct {
+	Buckets []string `json:"Buckets"`
+}
+
+type ObjectListJson struct {
+	Objects []ObjectJson `json:"Objects"`
+}
+
+// Service holds the operations every API surface offers. It validates its
+// input and checks permissions, transports only translate requests and
+// ApiErrors.
+type Service struct {
+	store     *CompoundStore
+	access    access.AccessStore
+	users     users.UserStorage
+	presigner *presign.Keyring
+	lockout   *access.Lockout
+	matcher   *Matcher
+	// auth revokes the sessions of users whose password changed or who were
+	// deleted, it's nil where there are no sessions.
+	auth *Authenticator
+}
+
+func NewService(s *CompoundStore, a access.AccessStore, u users.UserStorage, auth *Authenticator, presigner *presign.Keyring, lockout *access.Lockout) *Service {
+	return &Service{
+		store:     s,
+		access:    a,
+		users:     u,
+		auth:      auth,
+		presigner: presigner,
+		lockout:   lockout,
+		matcher:   NewMatcher(),
+	}
+}
+
+func (s *Service) checkBucketId(bucketId string) error {
+	if !s.matcher.MatchString(bucketId) {
+		return newApiError(http.StatusBadRequest, CodeInvalidBucketId, BucketIdMatchingError().Error())
+	}
+	return nil
+}
+
+func (s *Service) checkObjectId(bucketId, keyId string) error {
+	err := s.checkBucketId(bucketId)
+	if err != nil {
+		return err
+	}
+	if !s.matcher.MatchString(keyId) {
+		return newApiError(http.StatusBadRequest, CodeInvalidKeyId, KeyIdMatchingError().Error())
+	}
+	return nil
+}
+
+func (s *Service) bucketExists(bucketId string) (bool, error) {
+	buckets, err := s.store.ListBuckets()
+	if err != nil {
+		return false, err
+	}
+	for _, bucket := range buckets {
+		if bucket == bucketId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Service) requireBucket(bucketId string) error {
+	exists, err := s.bucketExists(bucketId)
+	if err != nil {
+		return internalError(err)
+	}
+	if !exists {
+		return newApiError(http.StatusNotFound, CodeBucketNotFound, "bucket doesn't exist")
+	}
+	return nil
+}
+
+func (s *Service) readMetadata(bucketId, keyId string) (*metadata.Metadata, error) {
+	err := s.requireBucket(bucketId)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s.store.ReadMetadata(bucketId, keyId)
+	if err != nil {
+		return nil, wrapApiError(http.StatusNotFound, CodeObjectNotFound, "object doesn't exist", err)
+	}
+	return meta, nil
+}
+
+func (s *Service) CreateBucket(p *Principal, bucketId string) error {
+	err := s.checkBucketId(bucketId)
+	if err != nil {
+		return err
+	}
+	if !p.can((*users.Permissions).CanUpload, bucketId) {
+		return forbiddenError()
+	}
+	exists, err := s.bucketExists(bucketId)
+	if err != nil {
+		return internalError(err)
+	}
+	if exists {
+		return newApiError(http.StatusConflict, CodeBucketExists, "bucket already exists")
+	}
+	err = s.store.NewBucket(bucketId)
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+func (s *Service) DeleteBucket(p *Principal, bucketId string) error {
+	err := s.checkBucketId(bucketId)
+	if err != nil {
+		return err
+	}
+	if !p.can((*users.Permissions).CanDelete, bucketId) {
+		return forbiddenError()
+	}
+	err = s.requireBucket(bucketId)
+	if err != nil {
+		return err
+	}
+	err = s.store.DeleteBucket(bucketId)
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// ListBuckets only returns the buckets the caller can read.
+func (s *Service) ListBuckets(p *Principal) ([]string, error) {
+	buckets, err := s.store.ListBuckets()
+	if err != nil {
+		return nil, internalError(err)
+	}
+	ret := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		if p.can((*users.Permissions).CanRead, bucket) {
+			ret = append(ret, bucket)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (s *Service) PutObject(p *Principal, bucketId, keyId, filename string, length int64, body io.Reader) (*metadata.Metadata, error) {
+	err := s.checkObjectId(bucketId, keyId)
+	if err != nil {
+		return nil, err
+	}
+	if !p.can((*users.Permissions).CanUpload, bucketId) {
+		return nil, forbiddenError()
+	}
+	err = s.requireBucket(bucketId)
+	if err != nil {
+		return nil, err
+	}
+	meta := metadata.NewMetadata(length, filename)
+	meta.Owner = p.userId()
+	err = writeNewObject(s.store, bucketId, keyId, meta, body)
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// writeNewObject writes an object that doesn't exist yet. The stores don't
+// overwrite objects and would leave the new metadata behind when they refuse.
+func writeNewObject(store *CompoundStore, bucketId, keyId string, meta *metadata.Metadata, body io.Reader) error {
+	_, err := store.ReadMetadata(bucketId, keyId)
+	if err == nil {
+		return newApiError(http.StatusConflict, CodeObjectExists, "object already exists")
+	}
+	err = store.Write(bucketId, keyId, meta, security.NewEncryptionKey(), body)
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// replacementPrefix marks the objects that hold the new content of an object
+// while it's uploaded and the old content while the new one is swapped in.
+// They are hidden from listings.
+const replacementPrefix = "replacement-"
+
+// replacementKey names a new staging object of kind.
+func replacementKey(kind string) (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return replacementPrefix + hex.EncodeToString(id) + "-" + kind, nil
+}
+
+// copyObject writes the content of from to the new object to, keeping its
+// metadata.
+func copyObject(store *CompoundStore, bucketId, from, to string) error {
+	meta, reader, err := store.Read(bucketId, from)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return store.Write(bucketId, to, meta, security.NewEncryptionKey(), reader)
+}
+
+// swapReplacement moves the staged object in for keyId. Objects can't be
+// overwritten, so the old content is copied aside before it's deleted and put
+// back if the staged one can't be written. The staged object is only dropped
+// once it took the place of the old one or the old one is back.
+func (s *Service) swapReplacement(p *Principal, bucketId, keyId, staged string) error {
+	backup := ""
+	_, err := s.store.ReadMetadata(bucketId, keyId)
+	if err == nil {
+		backup, err = replacementKey("backup")
+		if err == nil {
+			err = copyObject(s.store, bucketId, keyId, backup)
+		}
+		if err != nil {
+			_ = s.store.Delete(bucketId, backup)
+			_ = s.store.Delete(bucketId, staged)
+			return internalError(err)
+		}
+	}
+	meta, reader, err := s.store.Read(bucketId, staged)
+	if err != nil {
+		return internalError(err)
+	}
+	defer reader.Close()
+	err = s.DeleteObject(p, bucketId, keyId)
+	if err != nil && asApiError(err).Code != CodeObjectNotFound {
+		_ = s.store.Delete(bucketId, backup)
+		_ = s.store.Delete(bucketId, staged)
+		return err
+	}
+	_, err = s.PutObject(p, bucketId, keyId, meta.Filename, meta.Length, reader)
+	if err == nil {
+		_ = s.store.Delete(bucketId, staged)
+		if backup != "" {
+			_ = s.store.Delete(bucketId, backup)
+		}
+		return nil
+	}
+	if backup == "" {
+		_ = s.store.Delete(bucketId, staged)
+		return err
+	}
+	restoreErr := copyObject(s.store, bucketId, backup, keyId)
+	if restoreErr != nil {
+		// Both versions are kept, neither is reachable under keyId now.
+		logrus.WithError(restoreErr).WithFields(logrus.Fields{
+			"Bucket Id": bucketId,
+			"Key Id":    keyId,
+			"Backup":    backup,
+			"Staged":    staged,
+		}).Errorf("Couldn't restore an object after a failed replacement.")
+		return err
+	}
+	_ = s.store.Delete(bucketId, backup)
+	_ = s.store.Delete(bucketId, staged)
+	return err
+}
+
+// GetObject opens an object for reading, the caller closes the reader.
+func (s *Service) GetObject(p *Principal, bucketId, keyId string) (*metadata.Metadata, io.ReadCloser, error) {
+	err := s.checkObjectId(bucketId, keyId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !p.can((*users.Permissions).CanRead, bucketId) {
+		return nil, nil, forbiddenError()
+	}
+	_, err = s.readMetadata(bucketId, keyId)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, reader, err := s.store.Read(bucketId, keyId)
+	if err != nil {
+		return nil, nil, internalError(err)
+	}
+	return meta, reader, nil
+}
+
+func (s *Service) DeleteObject(p *Principal, bucketId, keyId string) error {
+	err := s.checkObjectId(bucketId, keyId)
+	if err != nil {
+		return err
+	}
+	if !p.can((*users.Permissions).CanDelete, bucketId) {
+		return forbiddenError()
+	}
+	_, err = s.readMetadata(bucketId, keyId)
+	if err != nil {
+		return err
+	}
+	err = s.store.Delete(bucketId, keyId)
+	if err != nil {
+		return internalError(err)
+	}
+	return nil
+}
+
+// hiddenObject tells the parts of unfinished S3 multipart uploads and
+// replacements apart, they aren't objects yet and are left out of listings.
+func hiddenObject(keyId string) bool {
+	return strings.HasPrefix(keyId, s3PartPrefix) || strings.HasPrefix(keyId, replacementPrefix)
+}
+
+func (s *Service) ListObjects(p *Principal, bucketId, prefix string) ([]ObjectJson, error) {
+	err := s.checkBucketId(bucketId)
+	if err != nil {
+		return nil, err
+	}
+	if !p.can((*users.Permissions).CanRead, bucketId) {
+		return nil, forbiddenError()
+	}
+	err = s.requireBucket(bucketId)
+	if err != nil {
+		return nil, err
+	}
+	keyIds, err := s.store.ListKeys(bucketId, prefix)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	ret := make([]ObjectJson, 0, len(keyIds))
+	for _, keyId := range keyIds {
+		if hiddenObject(keyId) {
+			continue
+		}
+		meta, err := s.store.ReadMetadata(bucketId, keyId)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, ObjectJson{
+			BucketId: bucketId,
+			KeyId:    keyId,
+			Filename: meta.Filename,
+			Length:   meta.Length,
+			Owner:    meta.Owner,
+		})
+	}
+	return ret, nil
+}
+
+func (s *Service) AddKey(p *Principal, exKey access.ExAccessKey) (*access.AKey, error) {
+	if !p.can((*users.Permissions).CanAddKeys, exKey.BucketId) ||
+		(exKey.Upload && !p.can((*users.Permissions).CanUpload, exKey.BucketId)) {
+		return nil, forbiddenError()
+	}
+	if !s.matcher.MatchString(exKey.UrlKey) {
+		return nil, newApiError(http.StatusBadRequest, CodeInvalidUrlKey, UrlKeyMatchingError().Error())
+	}
+	key, err := access.FromExAccessKey(exKey)
+	if err != nil {
+		return nil, wrapApiError(http.StatusBadRequest, CodeInvalidAccessKey, err.Error(), err)
+	}
+	key.CreatedBy = p.userId()
+	_, err = s.access.GetKey(context.TODO(), key.UrlKey)
+	if err == nil {
+		return nil, newApiError(http.StatusConflict, CodeKeyExists, access.KeyAlreadyExists(key.UrlKey).Error())
+	}
+	err = s.access.AddKey(key)
+	if err != nil {
+		return nil, wrapApiError(http.StatusBadRequest, CodeInvalidAccessKey, err.Error(), err)
+	}
+	if p.User != nil {
+		keyLog(p.User, key).Infoln("Added access key.")
+	}
+	return key, nil
+}
+
+// ListKeys filters by bucket, key id and creator, createdBy takes an id or a
+// username. Keys the caller can't view are left out.
+func (s *Service) ListKeys(ctx context.Context, p *Principal, bucketId, keyId, createdBy string) ([]access.AccessKeyInfo, error) {
+	filter := access.KeyFilter{
+		BucketId: bucketId,
+		KeyId:    keyId,
+	}
+	if filter.KeyId != "" && filter.BucketId == "" {
+		return nil, newApiError(http.StatusBadRequest, CodeInvalidRequest, "filtering by key id requires a bucket id")
+	}
+	if createdBy != "" {
+		creator, err := resolveUser(s.users, createdBy)
+		if err != nil {
+			return nil, wrapApiError(http.StatusNotFound, CodeUserNotFound, "user doesn't exist", err)
+		}
+		filter.CreatedBy = creator.Id.String()
+	}
+	keys, err := s.access.ListKeys(ctx, filter)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	ret := make([]access.AccessKeyInfo, 0, len(keys))
+	for _, key := range keys {
+		if p.canViewKey(key) {
+			ret = append(ret, key.Info())
+		}
+	}
+	return ret, nil
+}
+
+func (s *Service) GetKey(ctx context.Context, p *Principal, urlKey string) (*access.AKey, error) {
+	if !s.matcher.MatchString(urlKey) {
+		return nil, newApiError(http.StatusBadRequest, CodeInvalidUrlKey, UrlKeyMatchingError().Error())
+	}
+	key, err := s.access.GetKey(ctx, urlKey)
+	if err != nil {
+		return nil, wrapApiError(http.StatusNotFound, CodeKeyNotFound, "key doesn't exist", err)
+	}
+	if !p.canViewKey(key) {
+		return nil, forbiddenError()
+	}
+	return key, nil
+}
+
+func (s *Service) UpdateKey(ctx context.Context, p *Principal, urlKey string, update access.KeyUpdate) (*access.AKey, error) {
+	key, err := s.GetKey(ctx, p, urlKey)
+	if err != nil {
+		return nil, err
+	}
+	if !p.can((*users.Permissions).CanAddKeys, key.BucketId) {
+		return nil, forbiddenError()
+	}
+	updated, err := s.access.UpdateKey(ctx, key.UrlKey, update)
+	if err != nil {
+		return nil, wrapApiError(http.StatusBadRequest, CodeInvalidUpdate, err.Error(), err)
+	}
+	if p.User != nil {
+		info := updated.Info()
+		keyLog(p.User, key).WithField("Ttl", info.Ttl).WithField("Limit", info.Limit).Infoln("Updated access key.")
+	}
+	return updated, nil
+}
+
+func (s *Service) RevokeKey(ctx context.Context, p *Principal, urlKey string) (*access.AKey, error) {
+	key, err := s.GetKey(ctx, p, urlKey)
+	if err != nil {
+		return nil, err
+	}
+	if !p.can((*users.Permissions).CanDeleteKeys, key.BucketId) {
+		return nil, forbiddenError()
+	}
+	err = s.access.DeleteKey(key)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if p.User != nil {
+		keyLog(p.User, key).Infoln("Revoked access key.")
+	}
+	return key, nil
+}
+
+// UnlockKey lifts a lock after repeated unlock failures before its window
+// passed.
+func (s *Service) UnlockKey(ctx context.Context, p *Principal, urlKey string) (*access.AKey, error) {
+	key, err := s.GetKey(ctx, p, urlKey)
+	if err != nil {
+		return nil, err
+	}
+	if !p.can((*users.Permissions).CanAddKeys, key.BucketId) {
+		return nil, forbiddenError()
+	}
+	if s.lockout == nil {
+		return nil, newApiError(http.StatusNotFound, CodeInvalidRequest, "lockout isn't enabled")
+	}
+	err = s.lockout.Unlock(ctx, key.UrlKey)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if p.User != nil {
+		keyLog(p.User, key).Infoln("Unlocked access key.")
+	}
+	return key, nil
+}
+
+func (s *Service) Presign(p *Principal, request PresignJson) (*PresignedUrlJson, error) {
+	err := s.checkObjectId(request.BucketId, request.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	if !p.can((*users.Permissions).CanAddKeys, request.BucketId) {
+		return nil, forbiddenError()
+	}
+	if request.Ip != "" && net.ParseIP(request.Ip) == nil {
+		return nil, newApiError(http.StatusBadRequest, CodeInvalidRequest, "ip couldn't be parsed")
+	}
+	expiresIn := time.Duration(request.ExpiresIn) * time.Second
+	query, expires, err := s.presigner.Presign(request.BucketId, request.KeyId, expiresIn, request.Ip)
+	if err != nil {
+		return nil, wrapApiError(http.StatusBadRequest, CodeInvalidRequest, err.Error(), err)
+	}
+	return &PresignedUrlJson{
+		Url:     "/api/download?" + query.Encode(),
+		Expires: expires,
+	}, nil
+}
+
+func (s *Service) revokeSessions(userId uuid.UUID) {
+	if s.auth == nil {
+		return
+	}
+	err := s.auth.RevokeSessions(userId)
+	if err != nil {
+		logrus.WithError(err).WithField("User Id", userId).Errorf("Couldn't revoke sessions.")
+	}
+}
+
+func (s *Service) resolveUser(idOrUsername string) (*users.User, error) {
+	user, err := resolveUser(s.users, idOrUsername)
+	if err != nil {
+		return nil, wrapApiError(http.StatusNotFound, CodeUserNotFound, "user doesn't exist", err)
+	}
+	return user, nil
+}
+
+// CreateUser is reserved to root users that may create users.
+func (s *Service) CreateUser(p *Principal, userJson *users.UserJson) (*users.User, error) {
+	if !p.isAdmin() || !p.isRoot() {
+		return nil, forbiddenError()
+	}
+	err := userJson.IsValid()
+	if err != nil {
+		return nil, wrapApiError(http.StatusBadRequest, CodeInvalidRequest, err.Error(), err)
+	}
+	user, err := users.UserFromUserJson(userJson)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	err = s.users.Create(user)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if p.User != nil {
+		adminLog(p.User, user).Infoln("Created user.")
+	}
+	return user, nil
+}
+
+// ListUsers pages through the users, a limit of zero or above
+// MaxUserListLimit returns MaxUserListLimit users.
+func (s *Service) ListUsers(p *Principal, offset, limit int) (*users.UserListJson, error) {
+	if !p.isAdmin() {
+		return nil, forbiddenError()
+	}
+	if offset < 0 || limit < 0 {
+		return nil, newApiError(http.StatusBadRequest, CodeInvalidRequest, "offset and limit must not be negative")
+	}
+	if limit == 0 || limit > MaxUserListLimit {
+		limit = MaxUserListLimit
+	}
+	list, total, err := s.users.List(offset, limit)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	ret := &users.UserListJson{
+		Users:  make([]users.UserSafeJson, 0, len(list)),
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+	}
+	for _, user := range list {
+		ret.Users = append(ret.Users, users.UserSafeJsonFromUser(user))
+	}
+	return ret, nil
+}
+
+func (s *Service) GetUser(p *Principal, idOrUsername string) (*users.User, error) {
+	if !p.isAdmin() {
+		return nil, forbiddenError()
+	}
+	return s.resolveUser(idOrUsername)
+}
+
+func (s *Service) SetUserRole(p *Principal, idOrUsername string, role users.Role) (*users.User, error) {
+	target, err := s.GetUser(p, idOrUsername)
+	if err != nil {
+		return nil, err
+	}
+	err = p.canManage(s.users, target)
+	if err != nil {
+		return nil, err
+	}
+	if role.RootUser && !p.isRoot() {
+		return nil, forbiddenError()
+	}
+	updated := *target
+	updated.Role = role
+	err = s.users.Update(&updated)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if p.User != nil {
+		adminLog(p.User, target).WithFields(logrus.Fields{
+			"Old Role": target.Role,
+			"New Role": updated.Role,
+		}).Infoln("Updated user role.")
+	}
+	return &updated, nil
+}
+
+func (s *Service) DeleteUser(p *Principal, idOrUsername string) (*users.User, error) {
+	target, err := s.GetUser(p, idOrUsername)
+	if err != nil {
+		return nil, err
+	}
+	if p.User != nil && p.User.Id == target.Id {
+		return nil, newApiError(http.StatusBadRequest, CodeInvalidRequest, "users can't delete themselves")
+	}
+	err = p.canManage(s.users, target)
+	if err != nil {
+		return nil, err
+	}
+	err = s.users.Delete(target.Id)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	s.revokeSessions(target.Id)
+	if p.User != nil {
+		adminLog(p.User, target).Infoln("Deleted user.")
+	}
+	return target, nil
+}
+
+// ResetPassword sets the password of another user and ends their sessions.
+func (s *Service) ResetPassword(p *Principal, idOrUsername, password string) (*users.User, error) {
+	target, err := s.GetUser(p, idOrUsername)
+	if err != nil {
+		return nil, err
+	}
+	err = p.canManage(s.users, target)
+	if err != nil {
+		return nil, err
+	}
+	if password == "" {
+		return nil, newApiError(http.StatusBadRequest, CodeInvalidRequest, users.PasswordIsEmpty.Error())
+	}
+	updated := *target
+	err = updated.SetPassword(users.DerivePasswordKey(password))
+	if err != nil {
+		return nil, internalError(err)
+	}
+	err = s.users.Update(&updated)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	s.revokeSessions(target.Id)
+	if p.User != nil {
+		adminLog(p.User, target).Infoln("Reset user password.")
+	}
+	return &updated, nil
+}
+
+// ChangePassword changes the password of the caller, who has to know the old
+// one. Wrong old passwords count against the user like failed logins, a wait
+// above zero means the caller is locked out for that long. The user is loaded
+// again, so changes to it since the caller authenticated aren't overwritten.
+func (s *Service) ChangePassword(ctx context.Context, p *Principal, ip, oldPassword, newPassword string) (time.Duration, error) {
+	if p.User == nil {
+		return 0, forbiddenError()
+	}
+	if newPassword == "" {
+		return 0, newApiError(http.StatusBadRequest, CodeInvalidRequest, users.PasswordIsEmpty.Error())
+	}
+	user, err := s.users.ResolveByUuid(p.User.Id)
+	if err != nil {
+		return 0, forbiddenError()
+	}
+	var attempt *access.Attempt
+	if s.lockout != nil {
+		var wait time.Duration
+		attempt, wait, err = s.lockout.Attempt(ctx, access.UserSubject(user.Username), ip)
+		if wait > 0 {
+			return wait, newApiError(http.StatusTooManyRequests, CodeForbidden, err.Error())
+		}
+		if err != nil {
+			return 0, internalError(err)
+		}
+	}
+	if !user.VerifyPassword(users.DerivePasswordKey(oldPassword)) {
+		if attempt != nil {
+			err = attempt.Fail(ctx)
+			if err != nil {
+				logrus.WithError(err).Errorf("Counting password failure failed.")
+			}
+		}
+		return 0, newApiError(http.StatusForbidden, CodeForbidden, InvalidCredentials.Error())
+	}
+	if attempt != nil {
+		err = attempt.Succeed(ctx)
+		if err != nil {
+			logrus.WithError(err).Errorf("Resetting password failures failed.")
+		}
+	}
+	updated := *user
+	err = updated.SetPassword(users.DerivePasswordKey(newPassword))
+	if err != nil {
+		return 0, internalError(err)
+	}
+	err = s.users.Update(&updated)
+	if err != nil {
+		return 0, internalError(err)
+	}
+	s.revokeSessions(user.Id)
+	logrus.WithField("Username", user.Username).Infoln("Changed own password.")
+	return 0, nil
+}
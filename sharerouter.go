@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"secure-store/access"
+	"time"
+)
+
+type SharedObjectJson struct {
+	KeyId       string `json:"KeyId"`
+	Filename    string `json:"Filename"`
+	Length      int64  `json:"Length"`
+	DownloadUrl string `json:"DownloadUrl"`
+}
+
+type ShareJson struct {
+	BucketId string             `json:"BucketId"`
+	Prefix   string             `json:"Prefix"`
+	Objects  []SharedObjectJson `json:"Objects"`
+}
+
+// registerShareRoutes lists the objects a bucket or prefix scoped download key
+// grants. Listing doesn't count as a use of the key, downloads go through
+// /api/download with the key id of the object.
+func registerShareRoutes(router *gin.Engine, s *CompoundStore, a access.AccessStore, lockout *access.Lockout, matcher *Matcher, isInDebugMode bool) {
+	resolveShare := func(c *gin.Context) (*ShareJson, bool) {
+		urlKey := c.Query("urlKey")
+		if !matcher.MatchString(urlKey) {
+			if isInDebugMode {
+				_ = c.AbortWithError(http.StatusBadRequest, UrlKeyMatchingError())
+			} else {
+				_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+			}
+			return nil, false
+		}
+		key, err := a.GetKey(context.TODO(), urlKey)
+		if err != nil || key.Kind != access.DownloadKey || !key.Prefix {
+			_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+			return nil, false
+		}
+		if !checkClientIp(c, key, isInDebugMode) {
+			return nil, false
+		}
+		if !checkUnlockKey(c, key, lockout, isInDebugMode) {
+			return nil, false
+		}
+		if !key.Active(time.Now()) {
+			abortInactive(c)
+			return nil, false
+		}
+		keyIds, err := s.ListKeys(key.BucketId, key.KeyId)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			logrus.WithError(err).Errorf("Listing shared objects failed.")
+			return nil, false
+		}
+		ret := &ShareJson{
+			BucketId: key.BucketId,
+			Prefix:   key.KeyId,
+			Objects:  make([]SharedObjectJson, 0, len(keyIds)),
+		}
+		for _, keyId := range keyIds {
+			if hiddenObject(keyId) {
+				continue
+			}
+			meta, err := s.ReadMetadata(key.BucketId, keyId)
+			if err != nil {
+				continue
+			}
+			query := url.Values{}
+			query.Set("urlKey", urlKey)
+			query.Set("keyId", keyId)
+			// Unlock keys in headers can't be carried by a link.
+			if key.NeedsKey && key.ResolveByUrlKey {
+				query.Set(UnlockKeyQuery, c.Query(UnlockKeyQuery))
+			}
+			ret.Objects = append(ret.Objects, SharedObjectJson{
+				KeyId:       keyId,
+				Filename:    meta.Filename,
+				Length:      meta.Length,
+				DownloadUrl: "/api/download?" + query.Encode(),
+			})
+		}
+		return ret, true
+	}
+
+	router.GET("/api/share", func(c *gin.Context) {
+		share, ok := resolveShare(c)
+		if !ok {
+			return
+		}
+		c.SecureJSON(http.StatusOK, share)
+	})
+
+	router.GET("/share", func(c *gin.Context) {
+		share, ok := resolveShare(c)
+		if !ok {
+			return
+		}
+		c.HTML(http.StatusOK, "share.tmpl", gin.H{
+			"Share": share,
+		})
+	})
+}
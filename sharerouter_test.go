@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"secure-store/access"
+	"secure-store/metadata"
+	"secure-store/security"
+	"strings"
+	"testing"
+)
+
+func TestShareHidesUnfinishedObjects(t *testing.T) {
+	server := newTestServer(t)
+	server.putObject(t, "reports", "monday", "content")
+	for _, keyId := range []string{s3PartKey("upload", 1, "attempt"), replacementPrefix + "0a-file"} {
+		meta := metadata.NewMetadata(int64(len("partial")), keyId)
+		err := server.store.Write("reports", keyId, meta, security.NewEncryptionKey(), bytes.NewReader([]byte("partial")))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	key, err := access.FromExAccessKey(access.ExAccessKey{BucketId: "reports", UrlKey: "whole-bucket", Prefix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.access.AddKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := server.do(httptest.NewRequest(http.MethodGet, "/api/share?urlKey=whole-bucket", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Share answered %v: %v", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `"KeyId":"monday"`) {
+		t.Errorf("Share is missing the object: %v", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), s3PartPrefix) || strings.Contains(w.Body.String(), replacementPrefix) {
+		t.Errorf("Share lists unfinished objects: %v", w.Body.String())
+	}
+
+	w = server.do(httptest.NewRequest(http.MethodGet, "/api/download?urlKey=whole-bucket&keyId="+s3PartKey("upload", 1, "attempt"), nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Downloading a part through the share answered %v", w.Code)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const ShutdownTimeoutEnv = "SHUTDOWN_TIMEOUT"
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Shutdown stops the servers once the process is asked to. Servers stop
+// accepting connections right away, in-flight transfers get until the timeout
+// to finish before their contexts are canceled and their connections closed.
+// The backends are closed last, once the canceled handlers returned.
+type Shutdown struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	timeout     time.Duration
+	servers     []*http.Server
+	handlers    sync.WaitGroup
+	grpcServers []*grpc.Server
+	closers     []io.Closer
+}
+
+func NewShutdown(timeout time.Duration) *Shutdown {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Shutdown{ctx: ctx, cancel: cancel, timeout: timeout}
+}
+
+// Server returns a server for handler whose requests are canceled when
+// draining times out. Closing a server doesn't wait for its handlers, so they
+// are counted to keep the backends open until the last one returned.
+func (s *Shutdown) Server(addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.handlers.Add(1)
+			defer s.handlers.Done()
+			handler.ServeHTTP(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return s.ctx
+		},
+	}
+	s.servers = append(s.servers, server)
+	return server
+}
+
+func (s *Shutdown) AddGrpcServer(server *grpc.Server) {
+	s.grpcServers = append(s.grpcServers, server)
+}
+
+// AddCloser closes the stores that hold connections or goroutines, looking
+// through decorators like the metrics.
+func (s *Shutdown) AddCloser(stores ...interface{}) {
+	for _, store := range stores {
+		closer, ok := unwrapStore(store).(io.Closer)
+		if ok {
+			s.closers = append(s.closers, closer)
+		}
+	}
+}
+
+// Serve runs serve in the background, it ends the process if serving fails
+// for any other reason than the shutdown.
+func (s *Shutdown) Serve(name string, serve func() error) {
+	go func() {
+		err := serve()
+		if err != nil && err != http.ErrServerClosed && err != grpc.ErrServerStopped {
+			logrus.WithError(err).Fatalf("%v stopped.", name)
+		}
+	}()
+}
+
+// Wait blocks until SIGTERM or an interrupt arrives and shuts down.
+func (s *Shutdown) Wait() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	received := <-signals
+	signal.Stop(signals)
+	logrus.WithFields(logrus.Fields{
+		"Signal":  received.String(),
+		"Timeout": s.timeout,
+	}).Infoln("Shutting down, waiting for in-flight requests.")
+	s.Drain()
+}
+
+// Drain stops the servers and closes the backends once they are stopped.
+func (s *Shutdown) Drain() {
+	deadline, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range s.servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			err := server.Shutdown(deadline)
+			if err != nil {
+				logrus.WithError(err).WithField("Address", server.Addr).Warnln("Canceling requests that didn't finish in time.")
+				s.cancel()
+				_ = server.Close()
+			}
+		}(server)
+	}
+	for _, server := range s.grpcServers {
+		wg.Add(1)
+		go func(server *grpc.Server) {
+			defer wg.Done()
+			stopped := make(chan struct{})
+			go func() {
+				server.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-deadline.Done():
+				logrus.Warnln("Canceling gRPC calls that didn't finish in time.")
+				// Stop cancels the contexts of the remaining calls.
+				server.Stop()
+			}
+		}(server)
+	}
+	wg.Wait()
+	s.cancel()
+	s.handlers.Wait()
+	for _, closer := range s.closers {
+		err := closer.Close()
+		if err != nil {
+			logrus.WithError(err).Errorf("Closing %v failed.", implementationName(closer))
+		}
+	}
+	logrus.Infoln("Shut down.")
+}
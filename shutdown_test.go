@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"secure-store/access"
+	"secure-store/metadata"
+	"secure-store/security"
+	"secure-store/storage"
+	"testing"
+	"time"
+)
+
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func serveForShutdown(t *testing.T, shutdown *Shutdown, handler http.HandlerFunc) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := shutdown.Server(listener.Addr().String(), handler)
+	shutdown.Serve("Test server", func() error {
+		return server.Serve(listener)
+	})
+	return "http://" + listener.Addr().String()
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	shutdown := NewShutdown(time.Second)
+	started := make(chan struct{})
+	url := serveForShutdown(t, shutdown, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("finished"))
+	})
+	store := &closeRecorder{}
+	shutdown.AddCloser(store)
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		responses <- string(body)
+	}()
+	<-started
+	shutdown.Drain()
+	if body := <-responses; body != "finished" {
+		t.Errorf("In-flight request ended with %q", body)
+	}
+	if !store.closed {
+		t.Error("Store wasn't closed")
+	}
+	_, err := http.Get(url)
+	if err == nil {
+		t.Error("Server still accepts connections")
+	}
+}
+
+func TestShutdownCancelsSlowRequests(t *testing.T) {
+	shutdown := NewShutdown(50 * time.Millisecond)
+	started := make(chan struct{})
+	canceled := make(chan bool, 1)
+	url := serveForShutdown(t, shutdown, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(5 * time.Second):
+			canceled <- false
+		}
+	})
+	go func() {
+		_, _ = http.Get(url)
+	}()
+	<-started
+	shutdown.Drain()
+	if !<-canceled {
+		t.Error("Request outliving the timeout wasn't canceled")
+	}
+}
+
+func TestShutdownWaitsForCanceledHandlers(t *testing.T) {
+	shutdown := NewShutdown(50 * time.Millisecond)
+	store := &closeRecorder{}
+	shutdown.AddCloser(store)
+	started := make(chan struct{})
+	closedEarly := make(chan bool, 1)
+	url := serveForShutdown(t, shutdown, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		// Cleanup after the cancel still needs the backends.
+		time.Sleep(100 * time.Millisecond)
+		closedEarly <- store.closed
+	})
+	go func() {
+		_, _ = http.Get(url)
+	}()
+	<-started
+	shutdown.Drain()
+	if <-closedEarly {
+		t.Error("Store was closed before the handler returned")
+	}
+	if !store.closed {
+		t.Error("Store wasn't closed")
+	}
+}
+
+func TestShutdownClosesThroughDecorators(t *testing.T) {
+	a := access.NewMemoryStore()
+	shutdown := NewShutdown(time.Second)
+	shutdown.AddCloser(NewMetrics().AccessStore(a), security.NewMemorySecurityStore())
+	if len(shutdown.closers) != 1 || shutdown.closers[0] != a {
+		t.Errorf("Unexpected closers %v", shutdown.closers)
+	}
+	shutdown.Drain()
+	// Expiring keys mustn't block once the store stopped removing them.
+	ttl := time.Now().Add(time.Hour)
+	key, err := access.FromExAccessKey(access.ExAccessKey{BucketId: "reports", KeyId: "monday", UrlKey: "monday-link", Ttl: &ttl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.AddKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type interruptedReader struct {
+	sent bool
+}
+
+func (r *interruptedReader) Read(b []byte) (int, error) {
+	if r.sent {
+		return 0, errors.New("connection closed")
+	}
+	r.sent = true
+	return copy(b, "half an upl"), nil
+}
+
+func TestInterruptedWriteLeavesNothingBehind(t *testing.T) {
+	fs, err := storage.NewFsStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	compound := &CompoundStore{
+		metadata: metadata.NewMemoryStore(),
+		security: security.NewMemorySecurityStore(),
+		storage:  fs,
+	}
+	err = compound.NewBucket("reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compound.Write("reports", "monday", metadata.NewMetadata(20, "monday.txt"), security.NewEncryptionKey(), &interruptedReader{})
+	if err == nil {
+		t.Fatal("Interrupted write succeeded")
+	}
+	_, err = compound.ReadMetadata("reports", "monday")
+	if err == nil {
+		t.Error("Metadata of the interrupted write is left")
+	}
+	err = compound.Write("reports", "monday", metadata.NewMetadata(7, "monday.txt"), security.NewEncryptionKey(), bytes.NewReader([]byte("content")))
+	if err != nil {
+		t.Errorf("Writing after the interrupted write failed: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
@@ -128,20 +129,34 @@ func (f *FsStorage) Write(bucket, key string, data io.Reader) error {
 	f.m.Unlock()
 	file, err := os.Create(f.GetRootKey(bucket, key))
 	if err != nil {
+		f.forget(bucket, key)
 		return err
 	}
 	proxyReader := bufio.NewReader(data)
 	_, err = file.ReadFrom(proxyReader)
-	if err != nil {
-		return err
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
 	}
 	if err != nil {
+		// Interrupted writes don't leave half an object behind.
+		_ = os.Remove(file.Name())
+		f.forget(bucket, key)
 		return err
 	}
 	return nil
 }
 
-func (f *FsStorage) Read(bucket, key string) (io.Reader, error) {
+func (f *FsStorage) forget(bucket, key string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	keySet, ok := f.memRep[bucket]
+	if ok {
+		keySet.Delete(key)
+	}
+}
+
+func (f *FsStorage) Read(bucket, key string) (io.ReadCloser, error) {
 	f.m.Lock()
 	keySet, ok := f.memRep[bucket]
 	if !ok {
@@ -157,8 +172,17 @@ func (f *FsStorage) Read(bucket, key string) (io.Reader, error) {
 	if err != nil {
 		return nil, err
 	}
-	proxyReader := bufio.NewReader(file)
-	return proxyReader, nil
+	return &fileReader{Reader: bufio.NewReader(file), file: file}, nil
+}
+
+// fileReader reads an object buffered and closes its file with the reader.
+type fileReader struct {
+	*bufio.Reader
+	file *os.File
+}
+
+func (r *fileReader) Close() error {
+	return r.file.Close()
 }
 
 func (f *FsStorage) Delete(bucket, key string) error {
@@ -205,3 +229,17 @@ func (f *FsStorage) ListBuckets() ([]string, error) {
 	}
 	return ret, nil
 }
+
+// CheckHealth makes sure the data directory is still writable by creating
+// and removing a file in it.
+func (f *FsStorage) CheckHealth(ctx context.Context) error {
+	file, err := os.CreateTemp(f.rootPath, ".health-*")
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(file.Name())
+}
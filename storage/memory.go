@@ -49,7 +49,7 @@ func (m *MemoryStorage) Write(bucket, key string, data io.Reader) error {
 	return nil
 }
 
-func (m *MemoryStorage) Read(bucket, key string) (io.Reader, error) {
+func (m *MemoryStorage) Read(bucket, key string) (io.ReadCloser, error) {
 	m.m.Lock()
 	defer m.m.Unlock()
 	if bucketMap, ok := m.i[bucket]; ok {
@@ -61,7 +61,7 @@ func (m *MemoryStorage) Read(bucket, key string) (io.Reader, error) {
 		copy(data, mapData)
 		reader := bytes.NewReader(data)
 		bufReader := bufio.NewReader(reader)
-		return bufReader, nil
+		return io.NopCloser(bufReader), nil
 	}
 	return nil, BucketDoesNotExist(bucket)
 }
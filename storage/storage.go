@@ -9,7 +9,7 @@ import (
 type Storage interface {
 	NewBucket(bucket string) error
 	Write(bucket, key string, data io.Reader) error
-	Read(bucket, key string) (io.Reader, error)
+	Read(bucket, key string) (io.ReadCloser, error)
 	Delete(bucket, key string) error
 	DeleteBucket(bucket string) error
 	ListBuckets() ([]string, error)
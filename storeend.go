@@ -60,12 +60,28 @@ func (c *CompoundStore) Write(bucketId, keyId string, metadata *metadata.Metadat
 
 	err = c.storage.Write(bucketId, keyId, reader)
 	if err != nil {
+		// The security store refuses existing objects, so this only drops
+		// what was just written for the interrupted one.
+		_ = c.metadata.Delete(bucketId, keyId)
+		_ = c.security.DeleteKey(bucketId, keyId)
 		return err
 	}
 	return nil
 }
 
-func (c *CompoundStore) Read(bucketId, keyId string) (*metadata.Metadata, io.Reader, error) {
+// objectReader decrypts an object and closes its data in the storage.
+type objectReader struct {
+	*cipher.StreamReader
+	data io.Closer
+}
+
+func (r *objectReader) Close() error {
+	return r.data.Close()
+}
+
+// Read opens an object for reading, the reader must be closed when the
+// request is done with it.
+func (c *CompoundStore) Read(bucketId, keyId string) (*metadata.Metadata, io.ReadCloser, error) {
 	meta, err := c.metadata.Read(bucketId, keyId)
 	if err != nil {
 		return nil, nil, err
@@ -78,8 +94,7 @@ func (c *CompoundStore) Read(bucketId, keyId string) (*metadata.Metadata, io.Rea
 	if err != nil {
 		return nil, nil, err
 	}
-	reader := CreateStreamReader(key.Key, data)
-	return meta, reader, nil
+	return meta, &objectReader{StreamReader: CreateStreamReader(key.Key, data), data: data}, nil
 }
 
 func (c *CompoundStore) Delete(bucketId, keyId string) error {
@@ -117,3 +132,11 @@ func (c *CompoundStore) DeleteBucket(bucket string) error {
 func (c *CompoundStore) ListBuckets() ([]string, error) {
 	return c.metadata.ListBuckets()
 }
+
+func (c *CompoundStore) ReadMetadata(bucketId, keyId string) (*metadata.Metadata, error) {
+	return c.metadata.Read(bucketId, keyId)
+}
+
+func (c *CompoundStore) ListKeys(bucketId, prefix string) ([]string, error) {
+	return c.metadata.ListKeys(bucketId, prefix)
+}
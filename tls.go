@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TlsCertFileEnv = "TLS_CERT_FILE"
+const TlsKeyFileEnv = "TLS_KEY_FILE"
+const TlsMinVersionEnv = "TLS_MIN_VERSION"
+const TlsClientCaFileEnv = "TLS_CLIENT_CA_FILE"
+const TlsClientUsersEnv = "TLS_CLIENT_USERS"
+
+const DefaultTlsMinVersion = "1.2"
+
+// CertificateCheckInterval limits how often handshakes look for changed
+// certificate files.
+const CertificateCheckInterval = time.Second
+
+var TlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var NoClientCaCertificates = errors.New("client ca file holds no pem certificates")
+
+// CertificateFiles serves the certificate and the client cas from files and
+// loads them again once the files change, so renewed certificates are picked
+// up without a restart. Broken files keep the previous certificate in use.
+type CertificateFiles struct {
+	certFile     string
+	keyFile      string
+	clientCaFile string
+	interval     time.Duration
+
+	m           sync.Mutex
+	checked     time.Time
+	modified    []time.Time
+	certificate *tls.Certificate
+	clientCas   *x509.CertPool
+}
+
+// NewCertificateFiles loads the files, clientCaFile is optional.
+func NewCertificateFiles(certFile, keyFile, clientCaFile string) (*CertificateFiles, error) {
+	ret := &CertificateFiles{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCaFile: clientCaFile,
+		interval:     CertificateCheckInterval,
+	}
+	modified, err := ret.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	err = ret.load(modified)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (f *CertificateFiles) files() []string {
+	if f.clientCaFile == "" {
+		return []string{f.certFile, f.keyFile}
+	}
+	return []string{f.certFile, f.keyFile, f.clientCaFile}
+}
+
+func (f *CertificateFiles) modTimes() ([]time.Time, error) {
+	ret := make([]time.Time, 0, 3)
+	for _, file := range f.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, info.ModTime())
+	}
+	return ret, nil
+}
+
+func loadClientCas(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, NoClientCaCertificates
+	}
+	return pool, nil
+}
+
+func (f *CertificateFiles) load(modified []time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return err
+	}
+	var clientCas *x509.CertPool
+	if f.clientCaFile != "" {
+		clientCas, err = loadClientCas(f.clientCaFile)
+		if err != nil {
+			return fmt.Errorf("%v: %w", f.clientCaFile, err)
+		}
+	}
+	f.certificate = &certificate
+	f.clientCas = clientCas
+	f.modified = modified
+	return nil
+}
+
+func sameTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// current returns the certificate and client cas, loading them again if the
+// files changed since the last check.
+func (f *CertificateFiles) current(now time.Time) (*tls.Certificate, *x509.CertPool) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if now.Sub(f.checked) < f.interval {
+		return f.certificate, f.clientCas
+	}
+	f.checked = now
+	modified, err := f.modTimes()
+	if err != nil {
+		logrus.WithError(err).Errorln("Couldn't check the certificate files, keeping the loaded certificate.")
+		return f.certificate, f.clientCas
+	}
+	if sameTimes(modified, f.modified) {
+		return f.certificate, f.clientCas
+	}
+	err = f.load(modified)
+	if err != nil {
+		// A certificate and key written one after the other don't match in
+		// between, the next check tries again.
+		logrus.WithError(err).Errorln("Couldn't reload the certificate files, keeping the loaded certificate.")
+		return f.certificate, f.clientCas
+	}
+	logrus.WithField("Certificate File", f.certFile).Infoln("Reloaded the tls certificate.")
+	return f.certificate, f.clientCas
+}
+
+// ServerConfig returns the tls config of a server speaking nextProtos. When
+// there are client cas, clients may present a certificate signed by them.
+func (f *CertificateFiles) ServerConfig(minVersion uint16, nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: minVersion,
+		NextProtos: nextProtos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			certificate, _ := f.current(time.Now())
+			return certificate, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			certificate, clientCas := f.current(time.Now())
+			config := &tls.Config{
+				MinVersion:   minVersion,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*certificate},
+			}
+			if clientCas != nil {
+				config.ClientCAs = clientCas
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return config, nil
+		},
+	}
+}
+
+// The kinds of client certificate identities. Every identity is prefixed by
+// its kind, so a common name doesn't match a san with the same text.
+const IdentitySubject = "subject:"
+const IdentityCommonName = "cn:"
+const IdentityDns = "dns:"
+const IdentityEmail = "email:"
+const IdentityUri = "uri:"
+
+var identityKinds = []string{IdentitySubject, IdentityCommonName, IdentityDns, IdentityEmail, IdentityUri}
+
+func hasIdentityKind(identity string) bool {
+	for _, kind := range identityKinds {
+		if strings.HasPrefix(identity, kind) && len(identity) > len(kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateIdentities lists the names a client certificate can be mapped
+// to a user by: the subject, its common name, and the dns, email and uri
+// subject alternative names.
+func certificateIdentities(certificate *x509.Certificate) []string {
+	ret := []string{IdentitySubject + certificate.Subject.String()}
+	if certificate.Subject.CommonName != "" {
+		ret = append(ret, IdentityCommonName+certificate.Subject.CommonName)
+	}
+	for _, name := range certificate.DNSNames {
+		ret = append(ret, IdentityDns+name)
+	}
+	for _, email := range certificate.EmailAddresses {
+		ret = append(ret, IdentityEmail+email)
+	}
+	for _, uri := range certificate.URIs {
+		ret = append(ret, IdentityUri+uri.String())
+	}
+	return ret
+}
+
+// listenAndServe serves server over https with the certificate files, or
+// over plain http without them.
+func listenAndServe(server *http.Server, certificates *CertificateFiles, minVersion uint16) func() error {
+	if certificates == nil {
+		return server.ListenAndServe
+	}
+	server.TLSConfig = certificates.ServerConfig(minVersion, "h2", "http/1.1")
+	return func() error {
+		return server.ListenAndServeTLS("", "")
+	}
+}
+
+// autocertCacheDir is where certificates from Let's Encrypt are kept between
+// restarts.
+func autocertCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "golang-autocert")
+}
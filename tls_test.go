@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// newTestCertificate signs template with parent, or itself without one.
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{certificate: certificate, key: key}
+}
+
+func newTestCa(t *testing.T, name string) *testCertificate {
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestServerCertificate(t *testing.T, ca *testCertificate) *testCertificate {
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "secure-store"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+func newTestClientCertificate(t *testing.T, ca *testCertificate, name string, uris ...*url.URL) *testCertificate {
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name, Organization: []string{"Example"}},
+		URIs:        uris,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.certificate.Raw}, PrivateKey: c.key}
+}
+
+// write stores the certificate and its key as pem and moves their
+// modification time to modified.
+func (c *testCertificate) write(t *testing.T, certFile, keyFile string, modified time.Time) {
+	key, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: c.certificate.Raw},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: key},
+	}
+	for file, block := range files {
+		err = os.WriteFile(file, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(file, modified, modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertificateFilesReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ca := newTestCa(t, "Test CA")
+	first := newTestServerCertificate(t, ca)
+	first.write(t, certFile, keyFile, time.Now().Add(-time.Minute))
+	files, err := NewCertificateFiles(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func(now time.Time) *big.Int {
+		certificate, _ := files.current(now)
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber
+	}
+	now := time.Now()
+	if serial(now).Cmp(first.certificate.SerialNumber) != 0 {
+		t.Error("Serving another certificate than the loaded one")
+	}
+
+	second := newTestServerCertificate(t, ca)
+	second.write(t, certFile, keyFile, time.Now())
+	if serial(now.Add(files.interval/2)).Cmp(first.certificate.SerialNumber) != 0 {
+		t.Error("Files were checked again before the interval passed")
+	}
+	now = now.Add(files.interval)
+	if serial(now).Cmp(second.certificate.SerialNumber) != 0 {
+		t.Error("Changed certificate wasn't reloaded")
+	}
+
+	err = os.WriteFile(certFile, []byte("half a certificate"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(certFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(files.interval)
+	if serial(now).Cmp(second.certificate.SerialNumber) != 0 {
+		t.Error("Broken certificate replaced the loaded one")
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	serverCa, clientCa, otherCa := newTestCa(t, "Server CA"), newTestCa(t, "Client CA"), newTestCa(t, "Other CA")
+	newTestServerCertificate(t, serverCa).write(t, certFile, keyFile, time.Now())
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCa.certificate.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := NewCertificateFiles(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newTestServer(t)
+	server.rootCredentials(t)
+	server.auth.MapClientCertificates(map[string]string{
+		"subject:CN=nightly-backup,O=Example":       RootUsername,
+		"uri:spiffe://example.com/reports-exporter": RootUsername,
+		"cn:backup-job":  RootUsername,
+		"cn:unknown-job": "nobody",
+	})
+	httpServer := httptest.NewUnstartedServer(server.router)
+	httpServer.TLS = files.ServerConfig(tls.VersionTLS12, "http/1.1")
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCa.certificate)
+	get := func(certificate *testCertificate, maxVersion uint16) (int, error) {
+		config := &tls.Config{RootCAs: roots, MaxVersion: maxVersion}
+		if certificate != nil {
+			// Sent even if the server doesn't name its ca as acceptable.
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				ret := certificate.tlsCertificate()
+				return &ret, nil
+			}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(httpServer.URL + "/v1/buckets")
+		if err != nil {
+			return 0, err
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	exporter, err := url.Parse("spiffe://example.com/reports-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backupJob, err := url.Parse("backup-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name        string
+		certificate *testCertificate
+		status      int
+	}{
+		{"mapped subject", newTestClientCertificate(t, clientCa, "nightly-backup"), http.StatusOK},
+		{"mapped uri", newTestClientCertificate(t, clientCa, "exporter", exporter), http.StatusOK},
+		{"mapped common name", newTestClientCertificate(t, clientCa, "backup-job"), http.StatusOK},
+		{"uri named like a common name", newTestClientCertificate(t, clientCa, "someone", backupJob), http.StatusUnauthorized},
+		{"unmapped", newTestClientCertificate(t, clientCa, "someone"), http.StatusUnauthorized},
+		{"unknown user", newTestClientCertificate(t, clientCa, "unknown-job"), http.StatusUnauthorized},
+		{"no certificate", nil, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		status, err := get(c.certificate, 0)
+		if err != nil || status != c.status {
+			t.Errorf("%v: expected %v, got %v, %v", c.name, c.status, status, err)
+		}
+	}
+
+	_, err = get(newTestClientCertificate(t, otherCa, "nightly-backup"), 0)
+	if err == nil {
+		t.Error("Certificate of an untrusted ca was accepted")
+	}
+	_, err = get(nil, tls.VersionTLS11)
+	if err == nil {
+		t.Error("Handshake below the min version succeeded")
+	}
+}
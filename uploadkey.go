@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"secure-store/access"
+	"secure-store/metadata"
+	"time"
+)
+
+// registerUploadKeyRoutes lets holders of an upload key write objects without
+// an account. The objects are attributed to the user who created the key.
+func registerUploadKeyRoutes(router *gin.Engine, s *CompoundStore, a access.AccessStore, lockout *access.Lockout, matcher *Matcher, isInDebugMode bool) {
+	router.PUT("/api/upload", func(c *gin.Context) {
+		ctx, cancel := context.WithDeadline(context.TODO(), time.Now().Add(100*time.Second))
+		defer cancel()
+		urlKey := c.Query("urlKey")
+		if !matcher.MatchString(urlKey) {
+			if isInDebugMode {
+				_ = c.AbortWithError(http.StatusBadRequest, UrlKeyMatchingError())
+			} else {
+				_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+			}
+			return
+		}
+		res, ok := reserveKey(ctx, c, a, lockout, access.UploadKey, urlKey, c.Query("keyId"), isInDebugMode)
+		if !ok {
+			return
+		}
+		defer res.finish()
+		key := res.key
+		keyId := key.Object()
+		if !matcher.MatchString(keyId) {
+			_ = c.AbortWithError(http.StatusBadRequest, KeyIdMatchingError())
+			return
+		}
+		contentLength := c.Request.ContentLength
+		if contentLength < 0 {
+			_ = c.AbortWithError(http.StatusLengthRequired, errors.New("uploads through keys need a content length"))
+			return
+		}
+		if !key.AllowsUpload(contentLength, c.ContentType()) {
+			if key.MaxSize > 0 && contentLength > key.MaxSize {
+				_ = c.AbortWithError(http.StatusRequestEntityTooLarge, errors.New("upload exceeds the size allowed by the key"))
+			} else {
+				_ = c.AbortWithError(http.StatusUnsupportedMediaType, errors.New("content type isn't allowed by the key"))
+			}
+			return
+		}
+		filename := c.Request.Header.Get("filename")
+		meta := metadata.NewMetadata(contentLength, filename)
+		meta.Owner = key.CreatedBy
+		err := writeNewObject(s, key.BucketId, keyId, meta, bufio.NewReader(c.Request.Body))
+		if err != nil {
+			apiErr := asApiError(err)
+			_ = c.AbortWithError(apiErr.Status, err)
+			if apiErr.Status == http.StatusInternalServerError {
+				logrus.WithError(err).Errorf("Error while writing data into storage.")
+			}
+			return
+		}
+		res.commit()
+		c.String(http.StatusOK, "Successfully uploaded to bucket-id: %v with key-id: %v", key.BucketId, keyId)
+		logrus.WithFields(logrus.Fields{
+			"Url Key":        urlKey,
+			"Bucket Id":      key.BucketId,
+			"Key Id":         keyId,
+			"Filename":       filename,
+			"Content Length": contentLength,
+			"Owner":          key.CreatedBy,
+		}).Infoln("Successfully uploaded through upload key.")
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"secure-store/users"
+	"strconv"
+)
+
+const DefaultUserListLimit = 50
+const MaxUserListLimit = 500
+
+func resolveUser(u users.UserStorage, idOrUsername string) (*users.User, error) {
+	id, err := uuid.Parse(idOrUsername)
+	if err == nil {
+		return u.ResolveByUuid(id)
+	}
+	return u.ResolveByUsername(idOrUsername)
+}
+
+func queryInt(c *gin.Context, name string, fallback int) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if parsed < 0 {
+		return 0, errors.New("query parameter must not be negative")
+	}
+	return parsed, nil
+}
+
+func requireAdmin(c *gin.Context) {
+	if !CurrentPermissions(c).Role.CanCreateUsers {
+		_ = c.AbortWithError(http.StatusForbidden, AccessForbiddenError())
+	}
+}
+
+func adminLog(actor, target *users.User) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"Acting User":    actor.Username,
+		"Acting User Id": actor.Id,
+		"User":           target.Username,
+		"User Id":        target.Id,
+	})
+}
+
+func registerUserRoutes(router *gin.Engine, svc *Service, auth *Authenticator) {
+	router.GET("/api/users", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		offset, err := queryInt(c, "offset", 0)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		limit, err := queryInt(c, "limit", DefaultUserListLimit)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		list, err := svc.ListUsers(CurrentPrincipal(c), offset, limit)
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, list)
+	})
+
+	router.GET("/api/users/:user", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		user, err := svc.GetUser(CurrentPrincipal(c), c.Param("user"))
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, users.UserSafeJsonFromUser(user))
+	})
+
+	router.PUT("/api/users/:user/role", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		role := &users.Role{}
+		err := c.ShouldBindJSON(role)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		updated, err := svc.SetUserRole(CurrentPrincipal(c), c.Param("user"), *role)
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, users.UserSafeJsonFromUser(updated))
+	})
+
+	router.DELETE("/api/users/:user", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		target, err := svc.DeleteUser(CurrentPrincipal(c), c.Param("user"))
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.String(http.StatusOK, "Deleted user with id: %v", target.Id)
+	})
+
+	router.POST("/api/users/:user/password", auth.Middleware(), requireAdmin, func(c *gin.Context) {
+		resetJson := &users.PasswordResetJson{}
+		err := c.ShouldBindJSON(resetJson)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		target, err := svc.ResetPassword(CurrentPrincipal(c), c.Param("user"), resetJson.Password)
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.String(http.StatusOK, "Reset password of user with id: %v", target.Id)
+	})
+
+	router.POST("/api/user/password", auth.Middleware(), func(c *gin.Context) {
+		changeJson := &users.PasswordChangeJson{}
+		err := c.ShouldBindJSON(changeJson)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		wait, err := svc.ChangePassword(c, CurrentPrincipal(c), c.ClientIP(), changeJson.OldPassword, changeJson.NewPassword)
+		if wait > 0 {
+			c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+		}
+		if err != nil {
+			abortLegacy(c, err)
+			return
+		}
+		c.String(http.StatusOK, "Changed password")
+	})
+}
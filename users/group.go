@@ -0,0 +1,146 @@
+package users
+
+import (
+	"errors"
+	"github.com/google/uuid"
+)
+
+var GroupAlreadyExists = errors.New("group already exists")
+var GroupDoesntExist = errors.New("group doesn't exist")
+var GroupWithNameAlreadyExists = errors.New("group with this name already exists")
+var GroupNameIsAnIssue = errors.New("group name doesn't match the requirement")
+
+type BucketPermission struct {
+	Read   bool `json:"Read"`
+	Write  bool `json:"Write"`
+	Delete bool `json:"Delete"`
+	Share  bool `json:"Share"`
+}
+
+func (b BucketPermission) Union(other BucketPermission) BucketPermission {
+	return BucketPermission{
+		Read:   b.Read || other.Read,
+		Write:  b.Write || other.Write,
+		Delete: b.Delete || other.Delete,
+		Share:  b.Share || other.Share,
+	}
+}
+
+func (r Role) Union(other Role) Role {
+	return Role{
+		RootUser:       r.RootUser || other.RootUser,
+		CanCreateUsers: r.CanCreateUsers || other.CanCreateUsers,
+		CanAddKeys:     r.CanAddKeys || other.CanAddKeys,
+		CanUploadData:  r.CanUploadData || other.CanUploadData,
+		CanDeleteKeys:  r.CanDeleteKeys || other.CanDeleteKeys,
+	}
+}
+
+type Group struct {
+	Id      uuid.UUID
+	Name    string
+	Role    Role
+	Buckets map[string]BucketPermission
+}
+
+type GroupJson struct {
+	Id      string                      `json:"Id,omitempty"`
+	Name    string                      `json:"Name"`
+	Role    Role                        `json:"Role"`
+	Buckets map[string]BucketPermission `json:"Buckets,omitempty"`
+}
+
+func (g *GroupJson) IsValid() error {
+	matchRes := usernameMatcher.MatchString(g.Name)
+	if !matchRes {
+		return GroupNameIsAnIssue
+	}
+	return nil
+}
+
+func GroupFromGroupJson(groupJson *GroupJson) (*Group, error) {
+	id := uuid.New()
+	if groupJson.Id != "" {
+		parsed, err := uuid.Parse(groupJson.Id)
+		if err != nil {
+			return nil, err
+		}
+		id = parsed
+	}
+	buckets := groupJson.Buckets
+	if buckets == nil {
+		buckets = make(map[string]BucketPermission)
+	}
+	return &Group{
+		Id:      id,
+		Name:    groupJson.Name,
+		Role:    groupJson.Role,
+		Buckets: buckets,
+	}, nil
+}
+
+func GroupJsonFromGroup(group *Group) GroupJson {
+	return GroupJson{
+		Id:      group.Id.String(),
+		Name:    group.Name,
+		Role:    group.Role,
+		Buckets: group.Buckets,
+	}
+}
+
+type GroupStorage interface {
+	CreateGroup(group *Group) error
+	ResolveGroup(id uuid.UUID) (*Group, error)
+	ResolveGroupByName(name string) (*Group, error)
+	ListGroups() ([]*Group, error)
+	UpdateGroup(group *Group) error
+	DeleteGroup(id uuid.UUID) error
+}
+
+// Permissions are the effective grants of a user, the union of the own role
+// and the grants of every group the user belongs to.
+type Permissions struct {
+	Role    Role
+	Buckets map[string]BucketPermission
+}
+
+func ResolvePermissions(store UserStorage, user *User) (*Permissions, error) {
+	ret := &Permissions{
+		Role:    user.Role,
+		Buckets: make(map[string]BucketPermission),
+	}
+	for _, groupId := range user.Groups {
+		group, err := store.ResolveGroup(groupId)
+		if errors.Is(err, GroupDoesntExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret.Role = ret.Role.Union(group.Role)
+		for bucket, permission := range group.Buckets {
+			ret.Buckets[bucket] = ret.Buckets[bucket].Union(permission)
+		}
+	}
+	return ret, nil
+}
+
+func (p *Permissions) CanRead(bucket string) bool {
+	return p.Role.RootUser || p.Role.CanUploadData || p.Buckets[bucket].Read
+}
+
+func (p *Permissions) CanUpload(bucket string) bool {
+	return p.Role.CanUploadData || p.Buckets[bucket].Write
+}
+
+func (p *Permissions) CanDelete(bucket string) bool {
+	return p.Role.CanUploadData || p.Buckets[bucket].Delete
+}
+
+func (p *Permissions) CanAddKeys(bucket string) bool {
+	return p.Role.CanAddKeys || p.Buckets[bucket].Share
+}
+
+func (p *Permissions) CanDeleteKeys(bucket string) bool {
+	return p.Role.CanDeleteKeys || p.Buckets[bucket].Share
+}
@@ -0,0 +1,71 @@
+package users
+
+import (
+	"github.com/google/uuid"
+	"testing"
+)
+
+func TestResolvePermissions(t *testing.T) {
+	db := NewMemoryStore()
+	uploaders := &Group{Id: uuid.New(), Name: "uploaders", Role: Role{CanUploadData: true}}
+	sharers := &Group{Id: uuid.New(), Name: "sharers", Buckets: map[string]BucketPermission{
+		"photos": {Read: true, Share: true},
+	}}
+	for _, group := range []*Group{uploaders, sharers} {
+		err := db.CreateGroup(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	user := newTestUser(0)
+	user.Role = Role{CanAddKeys: true}
+	user.Groups = []uuid.UUID{uploaders.Id, sharers.Id, uuid.New()}
+	err := db.Create(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissions, err := ResolvePermissions(db, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !permissions.Role.CanAddKeys || !permissions.Role.CanUploadData || permissions.Role.RootUser {
+		t.Errorf("Unexpected effective role %+v", permissions.Role)
+	}
+	if !permissions.CanDeleteKeys("photos") || permissions.CanDeleteKeys("videos") {
+		t.Errorf("Unexpected bucket grants %+v", permissions.Buckets)
+	}
+}
+
+func TestDeleteGroupMemory(t *testing.T) {
+	db := NewMemoryStore()
+	group := &Group{Id: uuid.New(), Name: "admins", Role: Role{CanCreateUsers: true}}
+	err := db.CreateGroup(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateGroup(&Group{Id: uuid.New(), Name: "admins"})
+	if err != GroupWithNameAlreadyExists {
+		t.Errorf("Duplicate group name was accepted: %v", err)
+	}
+	user := newTestUser(0)
+	user.Groups = []uuid.UUID{group.Id}
+	err = db.Create(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteGroup(group.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := db.ResolveByUuid(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.InGroup(group.Id) {
+		t.Error("Membership of deleted group wasn't removed")
+	}
+	_, err = db.ResolveGroupByName("admins")
+	if err != GroupDoesntExist {
+		t.Errorf("Deleted group still resolves by name: %v", err)
+	}
+}
@@ -3,13 +3,17 @@ package users
 import (
 	"encoding/base64"
 	"github.com/google/uuid"
+	"sort"
 	"sync"
 )
 
 type MemoryStore struct {
+	m              sync.Mutex
 	userById       sync.Map
 	uuidByApiKey   sync.Map
 	uuidByUsername sync.Map
+	groupById      sync.Map
+	uuidByGroup    sync.Map
 }
 
 func NewMemoryStore() *MemoryStore {
@@ -17,10 +21,14 @@ func NewMemoryStore() *MemoryStore {
 		userById:       sync.Map{},
 		uuidByApiKey:   sync.Map{},
 		uuidByUsername: sync.Map{},
+		groupById:      sync.Map{},
+		uuidByGroup:    sync.Map{},
 	}
 }
 
 func (m *MemoryStore) Create(user *User) error {
+	m.m.Lock()
+	defer m.m.Unlock()
 	id := user.Id
 	_, ok := m.userById.Load(id)
 	if ok {
@@ -68,11 +76,162 @@ func (m *MemoryStore) ResolveByUuid(id uuid.UUID) (*User, error) {
 	return user, nil
 }
 
+func (m *MemoryStore) Update(user *User) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	existingInterface, ok := m.userById.Load(user.Id)
+	if !ok {
+		return UserDoesntExist
+	}
+	existing := existingInterface.(*User)
+	oldApiKey := base64.StdEncoding.EncodeToString(existing.ApiKey)
+	newApiKey := base64.StdEncoding.EncodeToString(user.ApiKey)
+	if oldApiKey != newApiKey {
+		_, ok = m.uuidByApiKey.Load(newApiKey)
+		if ok {
+			return UserWithApiKeyAlreadyExists
+		}
+	}
+	if existing.Username != user.Username {
+		_, ok = m.uuidByUsername.Load(user.Username)
+		if ok {
+			return UserWithUsernameAlreadyExists
+		}
+	}
+	if oldApiKey != newApiKey {
+		m.uuidByApiKey.Delete(oldApiKey)
+		m.uuidByApiKey.Store(newApiKey, user.Id)
+	}
+	if existing.Username != user.Username {
+		m.uuidByUsername.Delete(existing.Username)
+		m.uuidByUsername.Store(user.Username, user.Id)
+	}
+	m.userById.Store(user.Id, user)
+	return nil
+}
+
+func (m *MemoryStore) List(offset, limit int) ([]*User, int, error) {
+	all := make([]*User, 0)
+	m.userById.Range(func(_, value interface{}) bool {
+		all = append(all, value.(*User))
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Username < all[j].Username
+	})
+	total := len(all)
+	if offset >= total {
+		return make([]*User, 0), total, nil
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return all[offset:end], total, nil
+}
+
 func (m *MemoryStore) Delete(id uuid.UUID) error {
-	_, ok := m.userById.Load(id)
+	m.m.Lock()
+	defer m.m.Unlock()
+	userInterface, ok := m.userById.Load(id)
 	if !ok {
 		return UserDoesntExist
 	}
+	user := userInterface.(*User)
+	m.uuidByApiKey.Delete(base64.StdEncoding.EncodeToString(user.ApiKey))
+	m.uuidByUsername.Delete(user.Username)
 	m.userById.Delete(id)
 	return nil
 }
+
+func (m *MemoryStore) CreateGroup(group *Group) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	_, ok := m.groupById.Load(group.Id)
+	if ok {
+		return GroupAlreadyExists
+	}
+	_, ok = m.uuidByGroup.Load(group.Name)
+	if ok {
+		return GroupWithNameAlreadyExists
+	}
+	m.groupById.Store(group.Id, group)
+	m.uuidByGroup.Store(group.Name, group.Id)
+	return nil
+}
+
+func (m *MemoryStore) ResolveGroup(id uuid.UUID) (*Group, error) {
+	groupInterface, ok := m.groupById.Load(id)
+	if !ok {
+		return nil, GroupDoesntExist
+	}
+	return groupInterface.(*Group), nil
+}
+
+func (m *MemoryStore) ResolveGroupByName(name string) (*Group, error) {
+	idInterface, ok := m.uuidByGroup.Load(name)
+	if !ok {
+		return nil, GroupDoesntExist
+	}
+	return m.ResolveGroup(idInterface.(uuid.UUID))
+}
+
+func (m *MemoryStore) ListGroups() ([]*Group, error) {
+	ret := make([]*Group, 0)
+	m.groupById.Range(func(_, value interface{}) bool {
+		ret = append(ret, value.(*Group))
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+func (m *MemoryStore) UpdateGroup(group *Group) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	existingInterface, ok := m.groupById.Load(group.Id)
+	if !ok {
+		return GroupDoesntExist
+	}
+	existing := existingInterface.(*Group)
+	if existing.Name != group.Name {
+		_, ok = m.uuidByGroup.Load(group.Name)
+		if ok {
+			return GroupWithNameAlreadyExists
+		}
+		m.uuidByGroup.Delete(existing.Name)
+		m.uuidByGroup.Store(group.Name, group.Id)
+	}
+	m.groupById.Store(group.Id, group)
+	return nil
+}
+
+func (m *MemoryStore) DeleteGroup(id uuid.UUID) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	groupInterface, ok := m.groupById.Load(id)
+	if !ok {
+		return GroupDoesntExist
+	}
+	group := groupInterface.(*Group)
+	m.userById.Range(func(key, value interface{}) bool {
+		user := value.(*User)
+		if !user.InGroup(id) {
+			return true
+		}
+		updated := *user
+		updated.Groups = make([]uuid.UUID, 0, len(user.Groups)-1)
+		for _, groupId := range user.Groups {
+			if groupId != id {
+				updated.Groups = append(updated.Groups, groupId)
+			}
+		}
+		m.userById.Store(key, &updated)
+		return true
+	})
+	m.uuidByGroup.Delete(group.Name)
+	m.groupById.Delete(id)
+	return nil
+}
@@ -0,0 +1,99 @@
+package users
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"testing"
+)
+
+func newTestUser(idx int) *User {
+	return &User{
+		Id:       uuid.New(),
+		Name:     "Test",
+		Username: fmt.Sprintf("user_%c", 'a'+idx),
+		ApiKey:   []byte(fmt.Sprintf("api-key-%v", idx)),
+	}
+}
+
+func TestListMemory(t *testing.T) {
+	db := NewMemoryStore()
+	for i := 0; i < 5; i++ {
+		err := db.Create(newTestUser(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, total, err := db.List(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 5 {
+		t.Errorf("Expected 5 users in total, got %v", total)
+	}
+	if len(page) != 2 || page[0].Username != "user_b" || page[1].Username != "user_c" {
+		t.Errorf("Unexpected page %v", page)
+	}
+	page, _, err = db.List(10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 0 {
+		t.Errorf("Expected empty page, got %v", page)
+	}
+}
+
+func TestDeleteCleansIndexesMemory(t *testing.T) {
+	db := NewMemoryStore()
+	user := newTestUser(0)
+	err := db.Create(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Delete(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ResolveByApiKey(user.ApiKey)
+	if err != UserWithApiKeyDoesntExist {
+		t.Errorf("Api key index wasn't cleaned up: %v", err)
+	}
+	_, err = db.ResolveByUsername(user.Username)
+	if err != UserWithUsernameDoesntExist {
+		t.Errorf("Username index wasn't cleaned up: %v", err)
+	}
+	err = db.Create(newTestUser(0))
+	if err != nil {
+		t.Errorf("Couldn't recreate user with the same username: %v", err)
+	}
+}
+
+func TestUpdateMemory(t *testing.T) {
+	db := NewMemoryStore()
+	user := newTestUser(0)
+	other := newTestUser(1)
+	for _, u := range []*User{user, other} {
+		err := db.Create(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	updated := *user
+	updated.Username = other.Username
+	err := db.Update(&updated)
+	if err != UserWithUsernameAlreadyExists {
+		t.Errorf("Update to an existing username was accepted: %v", err)
+	}
+	updated.Username = "renamed"
+	err = db.Update(&updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ResolveByUsername(user.Username)
+	if err != UserWithUsernameDoesntExist {
+		t.Errorf("Old username still resolves: %v", err)
+	}
+	resolved, err := db.ResolveByUsername("renamed")
+	if err != nil || resolved.Id != user.Id {
+		t.Errorf("New username doesn't resolve: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package users
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+const SecretBoxKeyLength = 32
+
+var SecretBoxCiphertextTooShort = errors.New("ciphertext is too short")
+
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	if len(key) != SecretBoxKeyLength {
+		return nil, errors.New("secret box key has the wrong length")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	ret := new(SecretBox)
+	ret.aead = aead
+	return ret, nil
+}
+
+func (s *SecretBox) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (s *SecretBox) Open(ciphertext []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, SecretBoxCiphertextTooShort
+	}
+	return s.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+}
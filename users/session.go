@@ -0,0 +1,129 @@
+package users
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+type Session struct {
+	Id        uuid.UUID
+	UserId    uuid.UUID
+	RefreshId uuid.UUID
+	Created   time.Time
+	Expires   time.Time
+	Revoked   bool
+}
+
+func NewSession(userId uuid.UUID) *Session {
+	now := time.Now()
+	return &Session{
+		Id:        uuid.New(),
+		UserId:    userId,
+		RefreshId: uuid.New(),
+		Created:   now,
+		Expires:   now.Add(RefreshTokenLifetime),
+		Revoked:   false,
+	}
+}
+
+func (s *Session) Valid() bool {
+	return !s.Revoked && time.Now().Before(s.Expires)
+}
+
+type SessionStore interface {
+	CreateSession(session *Session) error
+	ResolveSession(id uuid.UUID) (*Session, error)
+	RotateRefresh(id, refreshId uuid.UUID) (*Session, error)
+	RevokeSession(id uuid.UUID) error
+	RevokeUserSessions(userId uuid.UUID) error
+}
+
+var SessionAlreadyExists = errors.New("session already exists")
+var SessionDoesntExist = errors.New("session doesn't exist")
+var SessionIsRevoked = errors.New("session is revoked")
+var RefreshTokenWasReused = errors.New("refresh token was already used")
+
+type MemorySessionStore struct {
+	m        sync.Mutex
+	sessions map[uuid.UUID]*Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	ret := new(MemorySessionStore)
+	ret.m = sync.Mutex{}
+	ret.sessions = make(map[uuid.UUID]*Session)
+	return ret
+}
+
+func (m *MemorySessionStore) CreateSession(session *Session) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	_, ok := m.sessions[session.Id]
+	if ok {
+		return SessionAlreadyExists
+	}
+	now := time.Now()
+	for id, existing := range m.sessions {
+		if now.After(existing.Expires) {
+			delete(m.sessions, id)
+		}
+	}
+	stored := *session
+	m.sessions[session.Id] = &stored
+	return nil
+}
+
+func (m *MemorySessionStore) ResolveSession(id uuid.UUID) (*Session, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, SessionDoesntExist
+	}
+	ret := *session
+	return &ret, nil
+}
+
+func (m *MemorySessionStore) RotateRefresh(id, refreshId uuid.UUID) (*Session, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, SessionDoesntExist
+	}
+	if !session.Valid() {
+		return nil, SessionIsRevoked
+	}
+	if session.RefreshId != refreshId {
+		// A refresh token can only be used once, a second use means it leaked.
+		session.Revoked = true
+		return nil, RefreshTokenWasReused
+	}
+	session.RefreshId = uuid.New()
+	ret := *session
+	return &ret, nil
+}
+
+func (m *MemorySessionStore) RevokeSession(id uuid.UUID) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return SessionDoesntExist
+	}
+	session.Revoked = true
+	return nil
+}
+
+func (m *MemorySessionStore) RevokeUserSessions(userId uuid.UUID) error {
+	m.m.Lock()
+	defer m.m.Unlock()
+	for _, session := range m.sessions {
+		if session.UserId == userId {
+			session.Revoked = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+const TokenSecretLength = 32
+
+const AccessTokenLifetime = 15 * time.Minute
+const RefreshTokenLifetime = 7 * 24 * time.Hour
+
+type TokenKind string
+
+const (
+	AccessTokenKind  TokenKind = "access"
+	RefreshTokenKind TokenKind = "refresh"
+)
+
+var TokenIsMalformed = errors.New("token is malformed")
+var TokenSignatureIsInvalid = errors.New("token signature is invalid")
+var TokenHasExpired = errors.New("token has expired")
+var TokenHasWrongKind = errors.New("token has the wrong kind")
+
+type TokenClaims struct {
+	SessionId uuid.UUID `json:"sid"`
+	UserId    uuid.UUID `json:"uid"`
+	RefreshId uuid.UUID `json:"rid,omitempty"`
+	Kind      TokenKind `json:"typ"`
+	Expires   int64     `json:"exp"`
+}
+
+func (t *TokenClaims) ExpiresAt() time.Time {
+	return time.Unix(t.Expires, 0)
+}
+
+type TokenSigner struct {
+	secret []byte
+	now    func() time.Time
+}
+
+func NewTokenSigner(secret []byte) (*TokenSigner, error) {
+	if len(secret) < TokenSecretLength {
+		return nil, errors.New("token secret is too short")
+	}
+	ret := new(TokenSigner)
+	ret.secret = secret
+	ret.now = time.Now
+	return ret, nil
+}
+
+func NewTokenSecret() ([]byte, error) {
+	secret := make([]byte, TokenSecretLength)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func (t *TokenSigner) mac(payload string) []byte {
+	h := hmac.New(sha256.New, t.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+func (t *TokenSigner) Sign(claims *TokenClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	signature := base64.RawURLEncoding.EncodeToString(t.mac(payload))
+	return payload + "." + signature, nil
+}
+
+func (t *TokenSigner) Verify(token string, kind TokenKind) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, TokenIsMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, TokenIsMalformed
+	}
+	if !hmac.Equal(signature, t.mac(parts[0])) {
+		return nil, TokenSignatureIsInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, TokenIsMalformed
+	}
+	claims := &TokenClaims{}
+	err = json.Unmarshal(data, claims)
+	if err != nil {
+		return nil, TokenIsMalformed
+	}
+	if claims.Kind != kind {
+		return nil, TokenHasWrongKind
+	}
+	if !t.now().Before(claims.ExpiresAt()) {
+		return nil, TokenHasExpired
+	}
+	return claims, nil
+}
+
+func (t *TokenSigner) NewAccessToken(session *Session) (string, time.Time, error) {
+	expires := t.now().Add(AccessTokenLifetime)
+	token, err := t.Sign(&TokenClaims{
+		SessionId: session.Id,
+		UserId:    session.UserId,
+		Kind:      AccessTokenKind,
+		Expires:   expires.Unix(),
+	})
+	return token, expires, err
+}
+
+func (t *TokenSigner) NewRefreshToken(session *Session) (string, error) {
+	return t.Sign(&TokenClaims{
+		SessionId: session.Id,
+		UserId:    session.UserId,
+		RefreshId: session.RefreshId,
+		Kind:      RefreshTokenKind,
+		Expires:   session.Expires.Unix(),
+	})
+}
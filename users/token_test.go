@@ -0,0 +1,98 @@
+package users
+
+import (
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) *TokenSigner {
+	secret, err := NewTokenSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewTokenSigner(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	signer := newTestSigner(t)
+	session := NewSession(uuid.New())
+	token, _, err := signer.NewAccessToken(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := signer.Verify(token, AccessTokenKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.SessionId != session.Id || claims.UserId != session.UserId {
+		t.Errorf("Claims %v don't match session %v", claims, session)
+	}
+	_, err = signer.Verify(token, RefreshTokenKind)
+	if err != TokenHasWrongKind {
+		t.Errorf("Access token was accepted as refresh token: %v", err)
+	}
+}
+
+func TestTokenTampered(t *testing.T) {
+	signer := newTestSigner(t)
+	other := newTestSigner(t)
+	token, _, err := signer.NewAccessToken(NewSession(uuid.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.Verify(token, AccessTokenKind)
+	if err != TokenSignatureIsInvalid {
+		t.Errorf("Token signed with another secret was accepted: %v", err)
+	}
+	_, err = signer.Verify("garbage", AccessTokenKind)
+	if err != TokenIsMalformed {
+		t.Errorf("Malformed token was accepted: %v", err)
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	signer := newTestSigner(t)
+	token, _, err := signer.NewAccessToken(NewSession(uuid.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.now = func() time.Time {
+		return time.Now().Add(AccessTokenLifetime + time.Second)
+	}
+	_, err = signer.Verify(token, AccessTokenKind)
+	if err != TokenHasExpired {
+		t.Errorf("Expired token was accepted: %v", err)
+	}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	store := NewMemorySessionStore()
+	session := NewSession(uuid.New())
+	err := store.CreateSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := store.RotateRefresh(session.Id, session.RefreshId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.RefreshId == session.RefreshId {
+		t.Error("Refresh id wasn't rotated")
+	}
+	_, err = store.RotateRefresh(session.Id, session.RefreshId)
+	if err != RefreshTokenWasReused {
+		t.Errorf("Reused refresh token was accepted: %v", err)
+	}
+	resolved, err := store.ResolveSession(session.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Valid() {
+		t.Error("Session is still valid after refresh token reuse")
+	}
+}
@@ -0,0 +1,304 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TotpIssuer = "SecureStore"
+const TotpDigits = 6
+const TotpPeriod = 30
+const TotpSecretLength = 20
+const TotpSkew = 1
+
+const RecoveryCodeCount = 10
+const RecoveryCodeLength = 10
+
+var TotpIsNotEnrolled = errors.New("totp is not enrolled")
+var TotpIsAlreadyEnabled = errors.New("totp is already enabled")
+var TotpIsNotEnabled = errors.New("totp is not enabled")
+var TotpCodeIsInvalid = errors.New("totp code is invalid")
+var TotpCodeRequired = errors.New("totp code required")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TotpState struct {
+	EncryptedSecret []byte
+	Enabled         bool
+	LastStep        int64
+	RecoveryCodes   [][]byte
+}
+
+type TotpEnrollmentJson struct {
+	Secret          string `json:"Secret"`
+	ProvisioningUri string `json:"ProvisioningUri"`
+}
+
+type TotpCodeJson struct {
+	Code string `json:"Code"`
+}
+
+type RecoveryCodesJson struct {
+	RecoveryCodes []string `json:"RecoveryCodes"`
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / TotpPeriod
+}
+
+func hotp(secret []byte, counter int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	h := hmac.New(sha1.New, secret)
+	h.Write(msg)
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+func TotpCode(secret []byte, t time.Time) string {
+	return hotp(secret, totpStep(t), TotpDigits)
+}
+
+// validateTotp returns the time step the code belongs to, so callers can
+// refuse to accept the same code twice.
+func validateTotp(secret []byte, code string, t time.Time) (int64, bool) {
+	step := totpStep(t)
+	for i := -TotpSkew; i <= TotpSkew; i++ {
+		candidate := hotp(secret, step+int64(i), TotpDigits)
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(code)) == 1 {
+			return step + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+func TotpProvisioningUri(username string, secret []byte) string {
+	label := url.PathEscape(fmt.Sprintf("%v:%v", TotpIssuer, username))
+	values := url.Values{}
+	values.Set("secret", totpEncoding.EncodeToString(secret))
+	values.Set("issuer", TotpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(TotpDigits))
+	values.Set("period", fmt.Sprint(TotpPeriod))
+	return fmt.Sprintf("otpauth://totp/%v?%v", label, values.Encode())
+}
+
+func hashRecoveryCode(code string) []byte {
+	sum := sha256.Sum256([]byte(strings.ToLower(code)))
+	return sum[:]
+}
+
+func newRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([][]byte, RecoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, RecoveryCodeLength)
+		_, err := rand.Read(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))[:RecoveryCodeLength]
+		codes[i] = code
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+type TotpManager struct {
+	m     sync.Mutex
+	users UserStorage
+	box   *SecretBox
+	now   func() time.Time
+}
+
+func NewTotpManager(u UserStorage, box *SecretBox) *TotpManager {
+	ret := new(TotpManager)
+	ret.users = u
+	ret.box = box
+	ret.now = time.Now
+	return ret
+}
+
+func (t *TotpManager) current(user *User) (*User, error) {
+	return t.users.ResolveByUuid(user.Id)
+}
+
+func (t *TotpManager) secret(user *User) ([]byte, error) {
+	if user.Totp.EncryptedSecret == nil {
+		return nil, TotpIsNotEnrolled
+	}
+	return t.box.Open(user.Totp.EncryptedSecret)
+}
+
+func (t *TotpManager) Enroll(user *User) (*TotpEnrollmentJson, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	user, err := t.current(user)
+	if err != nil {
+		return nil, err
+	}
+	if user.Totp.Enabled {
+		return nil, TotpIsAlreadyEnabled
+	}
+	secret := make([]byte, TotpSecretLength)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := t.box.Seal(secret)
+	if err != nil {
+		return nil, err
+	}
+	updated := *user
+	updated.Totp = TotpState{EncryptedSecret: encrypted}
+	err = t.users.Update(&updated)
+	if err != nil {
+		return nil, err
+	}
+	return &TotpEnrollmentJson{
+		Secret:          totpEncoding.EncodeToString(secret),
+		ProvisioningUri: TotpProvisioningUri(user.Username, secret),
+	}, nil
+}
+
+func (t *TotpManager) Confirm(user *User, code string) (*RecoveryCodesJson, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	user, err := t.current(user)
+	if err != nil {
+		return nil, err
+	}
+	if user.Totp.Enabled {
+		return nil, TotpIsAlreadyEnabled
+	}
+	secret, err := t.secret(user)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := validateTotp(secret, code, t.now())
+	if !ok {
+		return nil, TotpCodeIsInvalid
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	updated := *user
+	updated.Totp = TotpState{
+		EncryptedSecret: user.Totp.EncryptedSecret,
+		Enabled:         true,
+		LastStep:        step,
+		RecoveryCodes:   hashes,
+	}
+	err = t.users.Update(&updated)
+	if err != nil {
+		return nil, err
+	}
+	return &RecoveryCodesJson{RecoveryCodes: codes}, nil
+}
+
+// verify accepts either a current totp code or an unused recovery code and
+// returns the state that has to be persisted afterwards.
+func (t *TotpManager) verify(user *User, code string) (*TotpState, error) {
+	if !user.Totp.Enabled {
+		return nil, TotpIsNotEnabled
+	}
+	secret, err := t.secret(user)
+	if err != nil {
+		return nil, err
+	}
+	state := user.Totp
+	step, ok := validateTotp(secret, code, t.now())
+	if ok {
+		if step <= state.LastStep {
+			return nil, TotpCodeIsInvalid
+		}
+		state.LastStep = step
+		return &state, nil
+	}
+	hash := hashRecoveryCode(code)
+	for idx, recoveryCode := range state.RecoveryCodes {
+		if subtle.ConstantTimeCompare(hash, recoveryCode) == 1 {
+			remaining := make([][]byte, 0, len(state.RecoveryCodes)-1)
+			remaining = append(remaining, state.RecoveryCodes[:idx]...)
+			remaining = append(remaining, state.RecoveryCodes[idx+1:]...)
+			state.RecoveryCodes = remaining
+			return &state, nil
+		}
+	}
+	return nil, TotpCodeIsInvalid
+}
+
+func (t *TotpManager) Verify(user *User, code string) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	user, err := t.current(user)
+	if err != nil {
+		return err
+	}
+	state, err := t.verify(user, code)
+	if err != nil {
+		return err
+	}
+	updated := *user
+	updated.Totp = *state
+	return t.users.Update(&updated)
+}
+
+func (t *TotpManager) RegenerateRecoveryCodes(user *User, code string) (*RecoveryCodesJson, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	user, err := t.current(user)
+	if err != nil {
+		return nil, err
+	}
+	state, err := t.verify(user, code)
+	if err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	state.RecoveryCodes = hashes
+	updated := *user
+	updated.Totp = *state
+	err = t.users.Update(&updated)
+	if err != nil {
+		return nil, err
+	}
+	return &RecoveryCodesJson{RecoveryCodes: codes}, nil
+}
+
+func (t *TotpManager) Disable(user *User, code string) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	user, err := t.current(user)
+	if err != nil {
+		return err
+	}
+	_, err = t.verify(user, code)
+	if err != nil {
+		return err
+	}
+	updated := *user
+	updated.Totp = TotpState{}
+	return t.users.Update(&updated)
+}
@@ -0,0 +1,149 @@
+package users
+
+import (
+	"encoding/base32"
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+var rfcSecret = []byte("12345678901234567890")
+
+// Test vectors from RFC 6238 Appendix B for SHA1.
+var rfcVectors = map[int64]string{
+	59:          "94287082",
+	1111111109:  "07081804",
+	1111111111:  "14050471",
+	1234567890:  "89005924",
+	2000000000:  "69279037",
+	20000000000: "65353130",
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.t
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.t = f.t.Add(d)
+}
+
+func TestHotpVectors(t *testing.T) {
+	for unix, expected := range rfcVectors {
+		code := hotp(rfcSecret, totpStep(time.Unix(unix, 0)), 8)
+		if code != expected {
+			t.Errorf("At %v expected %v got %v", unix, expected, code)
+		}
+		short := TotpCode(rfcSecret, time.Unix(unix, 0))
+		if short != expected[2:] {
+			t.Errorf("At %v expected %v got %v", unix, expected[2:], short)
+		}
+	}
+}
+
+func newTotpFixture(t *testing.T) (*TotpManager, *User, *fakeClock) {
+	store := NewMemoryStore()
+	user := &User{Id: uuid.New(), Username: "admin", ApiKey: []byte("admin-api-key")}
+	err := store.Create(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	box, err := NewSecretBox(make([]byte, SecretBoxKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Unix(1111111111, 0)}
+	manager := NewTotpManager(store, box)
+	manager.now = clock.Now
+	return manager, user, clock
+}
+
+func enrollAndConfirm(t *testing.T, manager *TotpManager, user *User, clock *fakeClock) ([]byte, []string) {
+	enrollment, err := manager.Enroll(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := manager.Confirm(user, TotpCode(secret, clock.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery.RecoveryCodes) != RecoveryCodeCount {
+		t.Fatalf("Expected %v recovery codes, got %v", RecoveryCodeCount, len(recovery.RecoveryCodes))
+	}
+	return secret, recovery.RecoveryCodes
+}
+
+func TestTotpEnrollment(t *testing.T) {
+	manager, user, clock := newTotpFixture(t)
+	secret, _ := enrollAndConfirm(t, manager, user, clock)
+
+	stored, err := manager.users.ResolveByUuid(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Totp.Enabled {
+		t.Fatal("Totp isn't enabled after confirmation")
+	}
+	if string(stored.Totp.EncryptedSecret) == string(secret) {
+		t.Error("Totp secret is stored in plain text")
+	}
+
+	err = manager.Verify(user, TotpCode(secret, clock.Now()))
+	if err != TotpCodeIsInvalid {
+		t.Errorf("Code used for confirmation was accepted again: %v", err)
+	}
+	clock.Advance(TotpPeriod * time.Second)
+	err = manager.Verify(user, TotpCode(secret, clock.Now()))
+	if err != nil {
+		t.Errorf("Code of the next period was rejected: %v", err)
+	}
+	clock.Advance(10 * TotpPeriod * time.Second)
+	err = manager.Verify(user, TotpCode(secret, clock.Now().Add(-5*TotpPeriod*time.Second)))
+	if err != TotpCodeIsInvalid {
+		t.Errorf("Outdated code was accepted: %v", err)
+	}
+}
+
+func TestTotpRecoveryCodes(t *testing.T) {
+	manager, user, clock := newTotpFixture(t)
+	_, codes := enrollAndConfirm(t, manager, user, clock)
+
+	err := manager.Verify(user, codes[0])
+	if err != nil {
+		t.Fatalf("Recovery code was rejected: %v", err)
+	}
+	err = manager.Verify(user, codes[0])
+	if err != TotpCodeIsInvalid {
+		t.Errorf("Recovery code was accepted twice: %v", err)
+	}
+	err = manager.Disable(user, codes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := manager.users.ResolveByUuid(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Totp.Enabled || stored.Totp.EncryptedSecret != nil {
+		t.Error("Totp state wasn't cleared when disabling")
+	}
+}
+
+func TestTotpConfirmRejectsWrongCode(t *testing.T) {
+	manager, user, _ := newTotpFixture(t)
+	_, err := manager.Enroll(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manager.Confirm(user, "000000")
+	if err != TotpCodeIsInvalid {
+		t.Errorf("Wrong code was accepted during confirmation: %v", err)
+	}
+}
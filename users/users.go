@@ -10,6 +10,7 @@ import (
 	"golang.org/x/crypto/argon2"
 	"regexp"
 	"secure-store/access"
+	"time"
 )
 
 const PasswordHashLength = 64
@@ -21,6 +22,8 @@ const ArgonTime = 1
 const ArgonMemory = 64 * 1024
 const ArgonThreads = 4
 
+const ClientSaltLength = 128
+
 const nameExp = `^[a-zA-Z]+([ ]?[a-zA-Z]+)*$`
 const usernameExp = `^[a-zA-Z]+([_]?[a-zA-Z]+)*$`
 
@@ -40,6 +43,17 @@ type User struct {
 	PasswordSalt  []byte
 	ApiKey        []byte
 	BelongingKeys []*access.AKey
+	Totp          TotpState
+	Groups        []uuid.UUID
+}
+
+func (u *User) InGroup(id uuid.UUID) bool {
+	for _, groupId := range u.Groups {
+		if groupId == id {
+			return true
+		}
+	}
+	return false
 }
 
 func (u *User) VerifyPassword(password []byte) bool {
@@ -47,6 +61,24 @@ func (u *User) VerifyPassword(password []byte) bool {
 	return bytes.Compare(hash, u.PasswordHash) == 0
 }
 
+// DerivePasswordKey turns a typed password into the key clients send as
+// PasswordHash when creating a user.
+func DerivePasswordKey(password string) []byte {
+	salt := make([]byte, ClientSaltLength)
+	return argon2.IDKey([]byte(password), salt, ArgonTime, ArgonMemory, ArgonThreads, PasswordHashLength)
+}
+
+func (u *User) SetPassword(passwordKey []byte) error {
+	salt := make([]byte, PasswordSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = argon2.IDKey(passwordKey, salt, ArgonTime, ArgonMemory, ArgonThreads, PasswordHashLength)
+	u.PasswordSalt = salt
+	return nil
+}
+
 func (u *User) VerifyApiKey(apiKey []byte) bool {
 	return bytes.Compare(apiKey, u.ApiKey) == 0
 }
@@ -105,22 +137,61 @@ func UserFromUserJson(userJson *UserJson) (*User, error) {
 	}, nil
 }
 
-type UserSafeJson struct {
-	Id       string `json:"Id"`
-	Name     string `json:"Name"`
-	Role     Role   `json:"Role"`
+type LoginJson struct {
 	Username string `json:"Username"`
+	Password string `json:"Password"`
+	Code     string `json:"Code,omitempty"`
+}
+
+type TokenJson struct {
+	AccessToken  string    `json:"AccessToken"`
+	RefreshToken string    `json:"RefreshToken"`
+	TokenType    string    `json:"TokenType"`
+	ExpiresAt    time.Time `json:"ExpiresAt"`
+}
+
+type RefreshJson struct {
+	RefreshToken string `json:"RefreshToken"`
+}
+
+type UserSafeJson struct {
+	Id       string   `json:"Id"`
+	Name     string   `json:"Name"`
+	Role     Role     `json:"Role"`
+	Username string   `json:"Username"`
+	Groups   []string `json:"Groups"`
 }
 
 func UserSafeJsonFromUser(user *User) UserSafeJson {
+	groups := make([]string, 0, len(user.Groups))
+	for _, id := range user.Groups {
+		groups = append(groups, id.String())
+	}
 	return UserSafeJson{
 		Id:       user.Id.String(),
 		Name:     user.Name,
 		Role:     user.Role,
 		Username: user.Username,
+		Groups:   groups,
 	}
 }
 
+type UserListJson struct {
+	Users  []UserSafeJson `json:"Users"`
+	Total  int            `json:"Total"`
+	Offset int            `json:"Offset"`
+	Limit  int            `json:"Limit"`
+}
+
+type PasswordChangeJson struct {
+	OldPassword string `json:"OldPassword"`
+	NewPassword string `json:"NewPassword"`
+}
+
+type PasswordResetJson struct {
+	Password string `json:"Password"`
+}
+
 type Role struct {
 	RootUser       bool `json:"RootUser"`
 	CanCreateUsers bool `json:"CanCreateUsers"`
@@ -130,10 +201,13 @@ type Role struct {
 }
 
 type UserStorage interface {
+	GroupStorage
 	Create(user *User) error
 	ResolveByApiKey(apiKey []byte) (*User, error)
 	ResolveByUsername(username string) (*User, error)
 	ResolveByUuid(id uuid.UUID) (*User, error)
+	List(offset, limit int) ([]*User, int, error)
+	Update(user *User) error
 	Delete(id uuid.UUID) error
 }
 
@@ -143,3 +217,4 @@ var UserWithApiKeyAlreadyExists = errors.New("user with this api key already exi
 var UserWithApiKeyDoesntExist = errors.New("user with this api key doesn't exist")
 var UserWithUsernameAlreadyExists = errors.New("user with this username already exists")
 var UserWithUsernameDoesntExist = errors.New("user with this username doesn't exist")
+var PasswordIsEmpty = errors.New("password is empty")
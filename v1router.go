@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"secure-store/access"
+)
+
+type BucketJson struct {
+	BucketId string `json:"BucketId"`
+}
+
+func bindApiJson(c *gin.Context, obj interface{}) bool {
+	err := c.ShouldBindJSON(obj)
+	if err != nil {
+		abortWithApiError(c, wrapApiError(http.StatusBadRequest, CodeInvalidRequest, "request body isn't valid json", err))
+		return false
+	}
+	return true
+}
+
+// registerV1Routes adds the versioned api. Every route needs authentication,
+// answers with json and reports errors with the ErrorEnvelope.
+func registerV1Routes(router *gin.Engine, svc *Service, auth *Authenticator) {
+	v1 := router.Group("/v1", auth.ApiMiddleware())
+
+	v1.GET("/buckets", func(c *gin.Context) {
+		buckets, err := svc.ListBuckets(CurrentPrincipal(c))
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, BucketListJson{Buckets: buckets})
+	})
+
+	v1.PUT("/buckets/:bucket", func(c *gin.Context) {
+		bucketId := c.Param("bucket")
+		err := svc.CreateBucket(CurrentPrincipal(c), bucketId)
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusCreated, BucketJson{BucketId: bucketId})
+	})
+
+	v1.DELETE("/buckets/:bucket", func(c *gin.Context) {
+		err := svc.DeleteBucket(CurrentPrincipal(c), c.Param("bucket"))
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	v1.GET("/buckets/:bucket/objects", func(c *gin.Context) {
+		objects, err := svc.ListObjects(CurrentPrincipal(c), c.Param("bucket"), c.Query("prefix"))
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, ObjectListJson{Objects: objects})
+	})
+
+	v1.PUT("/buckets/:bucket/objects/:key", func(c *gin.Context) {
+		if c.Request.ContentLength < 0 {
+			abortWithApiError(c, newApiError(http.StatusLengthRequired, CodeLengthRequired, "Content-Length is required"))
+			return
+		}
+		bucketId, keyId := c.Param("bucket"), c.Param("key")
+		filename := c.GetHeader("filename")
+		if filename == "" {
+			filename = keyId
+		}
+		meta, err := svc.PutObject(CurrentPrincipal(c), bucketId, keyId, filename, c.Request.ContentLength, c.Request.Body)
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusCreated, ObjectJson{
+			BucketId: bucketId,
+			KeyId:    keyId,
+			Filename: meta.Filename,
+			Length:   meta.Length,
+			Owner:    meta.Owner,
+		})
+	})
+
+	v1.GET("/buckets/:bucket/objects/:key", func(c *gin.Context) {
+		bucketId, keyId := c.Param("bucket"), c.Param("key")
+		meta, reader, err := svc.GetObject(CurrentPrincipal(c), bucketId, keyId)
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		defer reader.Close()
+		renderObject(c, bucketId, keyId, meta, reader)
+	})
+
+	v1.DELETE("/buckets/:bucket/objects/:key", func(c *gin.Context) {
+		err := svc.DeleteObject(CurrentPrincipal(c), c.Param("bucket"), c.Param("key"))
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	v1.POST("/keys", func(c *gin.Context) {
+		exKey := access.ExAccessKey{}
+		if !bindApiJson(c, &exKey) {
+			return
+		}
+		key, err := svc.AddKey(CurrentPrincipal(c), exKey)
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusCreated, key.Info())
+	})
+
+	v1.GET("/keys", func(c *gin.Context) {
+		keys, err := svc.ListKeys(context.TODO(), CurrentPrincipal(c), c.Query("bucketId"), c.Query("keyId"), c.Query("createdBy"))
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, KeyListJson{Keys: keys})
+	})
+
+	v1.GET("/keys/:urlKey", func(c *gin.Context) {
+		key, err := svc.GetKey(context.TODO(), CurrentPrincipal(c), c.Param("urlKey"))
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, key.Info())
+	})
+
+	v1.PATCH("/keys/:urlKey", func(c *gin.Context) {
+		update := access.KeyUpdate{}
+		if !bindApiJson(c, &update) {
+			return
+		}
+		key, err := svc.UpdateKey(context.TODO(), CurrentPrincipal(c), c.Param("urlKey"), update)
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, key.Info())
+	})
+
+	v1.DELETE("/keys/:urlKey", func(c *gin.Context) {
+		_, err := svc.RevokeKey(context.TODO(), CurrentPrincipal(c), c.Param("urlKey"))
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	v1.DELETE("/keys/:urlKey/lockout", func(c *gin.Context) {
+		_, err := svc.UnlockKey(context.TODO(), CurrentPrincipal(c), c.Param("urlKey"))
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	v1.POST("/presign", func(c *gin.Context) {
+		request := PresignJson{}
+		if !bindApiJson(c, &request) {
+			return
+		}
+		presigned, err := svc.Presign(CurrentPrincipal(c), request)
+		if err != nil {
+			abortWithApiError(c, err)
+			return
+		}
+		c.SecureJSON(http.StatusOK, presigned)
+		logPresign(CurrentUser(c), &request, presigned)
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func v1Request(method, path, apiKey string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, path+"?apiKey="+apiKey, bytes.NewReader(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req
+}
+
+func expectApiError(t *testing.T, w *httptest.ResponseRecorder, status int, code ErrorCode) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("Expected status %v, got %v: %v", status, w.Code, w.Body.String())
+	}
+	envelope := ErrorEnvelope{}
+	err := json.Unmarshal(w.Body.Bytes(), &envelope)
+	if err != nil {
+		t.Fatalf("Error body isn't an envelope: %v", w.Body.String())
+	}
+	if envelope.Error.Code != code {
+		t.Errorf("Expected code %v, got %v", code, envelope.Error.Code)
+	}
+	if envelope.Error.Message == "" {
+		t.Error("Error envelope has no message")
+	}
+}
+
+func TestV1Objects(t *testing.T) {
+	server := newTestServer(t)
+	apiKey := server.rootApiKey(t)
+
+	w := server.do(v1Request(http.MethodPut, "/v1/buckets/reports", apiKey, nil))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Creating bucket answered %v", w.Code)
+	}
+	w = server.do(v1Request(http.MethodPut, "/v1/buckets/reports", apiKey, nil))
+	expectApiError(t, w, http.StatusConflict, CodeBucketExists)
+
+	w = server.do(v1Request(http.MethodPut, "/v1/buckets/reports/objects/monday", apiKey, []byte("content")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Uploading answered %v: %v", w.Code, w.Body.String())
+	}
+	object := ObjectJson{}
+	err := json.Unmarshal(w.Body.Bytes(), &object)
+	if err != nil || object.Length != 7 || object.Owner != RootUserId {
+		t.Errorf("Unexpected object %+v", object)
+	}
+	w = server.do(v1Request(http.MethodPut, "/v1/buckets/reports/objects/monday", apiKey, []byte("other")))
+	expectApiError(t, w, http.StatusConflict, CodeObjectExists)
+
+	w = server.do(v1Request(http.MethodGet, "/v1/buckets/reports/objects", apiKey, nil))
+	list := ObjectListJson{}
+	err = json.Unmarshal(w.Body.Bytes(), &list)
+	if err != nil || len(list.Objects) != 1 || list.Objects[0].KeyId != "monday" {
+		t.Errorf("Unexpected listing %v", w.Body.String())
+	}
+
+	w = server.do(v1Request(http.MethodGet, "/v1/buckets/reports/objects/monday", apiKey, nil))
+	if w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Errorf("Downloading answered %v: %v", w.Code, w.Body.String())
+	}
+
+	w = server.do(v1Request(http.MethodDelete, "/v1/buckets/reports/objects/monday", apiKey, nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Deleting answered %v", w.Code)
+	}
+	w = server.do(v1Request(http.MethodGet, "/v1/buckets/reports/objects/monday", apiKey, nil))
+	expectApiError(t, w, http.StatusNotFound, CodeObjectNotFound)
+
+	w = server.do(v1Request(http.MethodDelete, "/v1/buckets/reports", apiKey, nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Deleting bucket answered %v", w.Code)
+	}
+	w = server.do(v1Request(http.MethodGet, "/v1/buckets/reports/objects", apiKey, nil))
+	expectApiError(t, w, http.StatusNotFound, CodeBucketNotFound)
+}
+
+func TestV1Errors(t *testing.T) {
+	server := newTestServer(t)
+	apiKey := server.rootApiKey(t)
+
+	w := server.do(v1Request(http.MethodGet, "/v1/buckets", "", nil))
+	expectApiError(t, w, http.StatusUnauthorized, CodeUnauthenticated)
+
+	w = server.do(v1Request(http.MethodPut, "/v1/buckets/Not_Valid", apiKey, nil))
+	expectApiError(t, w, http.StatusBadRequest, CodeInvalidBucketId)
+
+	w = server.do(v1Request(http.MethodGet, "/v1/keys/missing", apiKey, nil))
+	expectApiError(t, w, http.StatusNotFound, CodeKeyNotFound)
+
+	w = server.do(v1Request(http.MethodPost, "/v1/keys", apiKey, []byte("{")))
+	expectApiError(t, w, http.StatusBadRequest, CodeInvalidRequest)
+}
+
+func TestV1Keys(t *testing.T) {
+	server := newTestServer(t)
+	apiKey := server.rootApiKey(t)
+	server.putObject(t, "reports", "monday", "content")
+
+	body := []byte(`{"UrlKey":"monday-link","BucketId":"reports","KeyId":"monday","Ttl":"2099-01-01T00:00:00Z"}`)
+	w := server.do(v1Request(http.MethodPost, "/v1/keys", apiKey, body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Adding key answered %v: %v", w.Code, w.Body.String())
+	}
+	w = server.do(v1Request(http.MethodPost, "/v1/keys", apiKey, body))
+	expectApiError(t, w, http.StatusConflict, CodeKeyExists)
+
+	w = server.do(v1Request(http.MethodGet, "/v1/keys", apiKey, nil))
+	keys := KeyListJson{}
+	err := json.Unmarshal(w.Body.Bytes(), &keys)
+	if err != nil || len(keys.Keys) != 1 || keys.Keys[0].UrlKey != "monday-link" {
+		t.Errorf("Unexpected key listing %v", w.Body.String())
+	}
+
+	w = server.do(v1Request(http.MethodDelete, "/v1/keys/monday-link", apiKey, nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Revoking answered %v", w.Code)
+	}
+	w = server.do(v1Request(http.MethodGet, "/v1/keys/monday-link", apiKey, nil))
+	expectApiError(t, w, http.StatusNotFound, CodeKeyNotFound)
+}
+
+func TestLegacyRoutesKeepPlainResponses(t *testing.T) {
+	server := newTestServer(t)
+
+	w := server.do(httptest.NewRequest(http.MethodGet, "/new-bucket?bucketId=reports", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "Created bucket with id: reports" {
+		t.Errorf("Legacy bucket creation answered %v: %v", w.Code, w.Body.String())
+	}
+	w = server.do(httptest.NewRequest(http.MethodGet, "/download?bucketId=reports&keyId=missing", nil))
+	if w.Code != http.StatusNotFound || w.Body.Len() != 0 {
+		t.Errorf("Legacy download answered %v: %v", w.Code, w.Body.String())
+	}
+}
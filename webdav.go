@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"secure-store/access"
+	"secure-store/users"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const WebDavPortEnv = "WEBDAV_PORT"
+
+// WebDavCredentialTtl is how long verified basic auth credentials are
+// remembered. Clients send them with every request, without the cache every
+// request would pay for the password hashing.
+const WebDavCredentialTtl = time.Minute
+
+// webdavMaxBufferedLength caps uploads without a Content-Length, they are held
+// in memory until the file is closed. Larger files have to send their length.
+var webdavMaxBufferedLength = 64 << 20
+
+const webdavRealm = `Basic realm="secure-store", charset="UTF-8"`
+
+var WebDavTotpUnsupported = errors.New("users with totp can't authenticate over webdav")
+var webdavIsDirectory = errors.New("is a directory")
+var webdavNotDirectory = errors.New("not a directory")
+var webdavNegativeOffset = errors.New("negative offset")
+
+type webdavContextKey struct{}
+
+// webdavRequest is shared between the handler and the file system for one
+// request. The file system keeps the ApiError of a failure, so the status the
+// webdav package picks can be replaced by the one the service chose.
+type webdavRequest struct {
+	principal *Principal
+	length    int64
+	failure   *ApiError
+}
+
+func currentWebDavRequest(ctx context.Context) *webdavRequest {
+	return ctx.Value(webdavContextKey{}).(*webdavRequest)
+}
+
+// fail translates errors of the service to the errors of the os package the
+// webdav package understands.
+func (r *webdavRequest) fail(err error) error {
+	apiErr := asApiError(err)
+	switch apiErr.Code {
+	case CodeBucketNotFound, CodeObjectNotFound:
+		return os.ErrNotExist
+	case CodeBucketExists:
+		return os.ErrExist
+	}
+	r.failure = apiErr
+	return apiErr
+}
+
+type webdavResponse struct {
+	http.ResponseWriter
+	request  *webdavRequest
+	replaced bool
+}
+
+func (w *webdavResponse) WriteHeader(status int) {
+	if status >= http.StatusBadRequest && w.request.failure != nil {
+		w.replaced = true
+		w.ResponseWriter.WriteHeader(w.request.failure.Status)
+		_, _ = w.ResponseWriter.Write([]byte(w.request.failure.Message))
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *webdavResponse) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+type webdavServer struct {
+	users   users.UserStorage
+	lockout *access.Lockout
+	handler *webdav.Handler
+
+	m           sync.Mutex
+	secret      []byte
+	credentials map[[sha256.Size]byte]*webdavCredential
+	swept       time.Time
+}
+
+// webdavCredential is a verified password, it's only valid as long as the
+// password of the user stays the same.
+type webdavCredential struct {
+	userId       uuid.UUID
+	passwordHash []byte
+	expires      time.Time
+}
+
+// NewWebDavHandler serves buckets as folders and objects as the files in
+// them. Users authenticate with their password over basic auth, which can't
+// carry a totp code, so users with totp are turned away. Wrong passwords
+// count against the username like other failed secrets.
+func NewWebDavHandler(svc *Service, u users.UserStorage) (http.Handler, error) {
+	secret := make([]byte, sha256.Size)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &webdavServer{
+		users:       u,
+		lockout:     svc.lockout,
+		secret:      secret,
+		credentials: make(map[[sha256.Size]byte]*webdavCredential),
+		handler: &webdav.Handler{
+			FileSystem: &webdavFs{svc: svc},
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					logrus.WithError(err).WithFields(logrus.Fields{
+						"Method": r.Method,
+						"Path":   r.URL.Path,
+					}).Infoln("WebDAV request failed.")
+				}
+			},
+		},
+	}, nil
+}
+
+// credentialKey identifies credentials in the cache without keeping the
+// password around.
+func (s *webdavServer) credentialKey(username, password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, s.secret)
+	_, _ = mac.Write([]byte(username))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write([]byte(password))
+	var ret [sha256.Size]byte
+	copy(ret[:], mac.Sum(nil))
+	return ret
+}
+
+func (s *webdavServer) cached(key [sha256.Size]byte, user *users.User, now time.Time) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	credential, ok := s.credentials[key]
+	if !ok {
+		return false
+	}
+	if !now.Before(credential.expires) || credential.userId != user.Id || !bytes.Equal(credential.passwordHash, user.PasswordHash) {
+		delete(s.credentials, key)
+		return false
+	}
+	return true
+}
+
+func (s *webdavServer) remember(key [sha256.Size]byte, user *users.User, now time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if now.Sub(s.swept) >= WebDavCredentialTtl {
+		s.swept = now
+		for cachedKey, credential := range s.credentials {
+			if !now.Before(credential.expires) {
+				delete(s.credentials, cachedKey)
+			}
+		}
+	}
+	s.credentials[key] = &webdavCredential{
+		userId:       user.Id,
+		passwordHash: user.PasswordHash,
+		expires:      now.Add(WebDavCredentialTtl),
+	}
+}
+
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// authenticate returns the user of the basic auth credentials. Blocked
+// attempts get how long to wait until the next one.
+func (s *webdavServer) authenticate(r *http.Request) (*users.User, time.Duration, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, 0, InvalidCredentials
+	}
+	now := time.Now()
+	key := s.credentialKey(username, password)
+	user, err := s.users.ResolveByUsername(username)
+	if err == nil && s.cached(key, user, now) && !user.Totp.Enabled {
+		return user, 0, nil
+	}
+	var attempt *access.Attempt
+	if s.lockout != nil {
+		var wait time.Duration
+		attempt, wait, err = s.lockout.Attempt(r.Context(), access.UserSubject(username), clientIp(r))
+		if err != nil {
+			return nil, wait, err
+		}
+	}
+	user, err = s.users.ResolveByUsername(username)
+	if err != nil || !user.VerifyPassword(users.DerivePasswordKey(password)) {
+		if attempt != nil {
+			err = attempt.Fail(r.Context())
+			if err != nil {
+				logrus.WithError(err).Errorf("Counting WebDAV password failure failed.")
+			}
+		}
+		return nil, 0, InvalidCredentials
+	}
+	if attempt != nil {
+		err = attempt.Succeed(r.Context())
+		if err != nil {
+			logrus.WithError(err).Errorf("Resetting WebDAV password failures failed.")
+		}
+	}
+	if user.Totp.Enabled {
+		return nil, 0, WebDavTotpUnsupported
+	}
+	s.remember(key, user, now)
+	return user, 0, nil
+}
+
+func (s *webdavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, wait, err := s.authenticate(r)
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil && err != InvalidCredentials && err != WebDavTotpUnsupported {
+		logrus.WithError(err).Errorf("Checking WebDAV password failures failed.")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", webdavRealm)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	permissions, err := users.ResolvePermissions(s.users, user)
+	if err != nil {
+		logrus.WithError(err).Errorf("Couldn't resolve permissions of WebDAV user.")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	request := &webdavRequest{
+		principal: &Principal{User: user, Permissions: permissions},
+		length:    -1,
+	}
+	// Only PUT bodies become objects, a LOCK creating an empty file mustn't
+	// take the length of its XML body.
+	if r.Method == http.MethodPut {
+		request.length = r.ContentLength
+	}
+	ctx := context.WithValue(r.Context(), webdavContextKey{}, request)
+	s.handler.ServeHTTP(&webdavResponse{ResponseWriter: w, request: request}, r.WithContext(ctx))
+}
+
+// webdavFs maps the root to the buckets and every bucket to its objects,
+// there are no deeper folders since keys can't contain slashes.
+type webdavFs struct {
+	svc *Service
+}
+
+func splitWebDavPath(name string) []string {
+	trimmed := strings.Trim(name, "/")
+	if trimmed == "" {
+		return nil
+	}
+	return strings.Split(trimmed, "/")
+}
+
+func (f *webdavFs) Mkdir(ctx context.Context, name string, _ os.FileMode) error {
+	request := currentWebDavRequest(ctx)
+	parts := splitWebDavPath(name)
+	if len(parts) != 1 {
+		return request.fail(newApiError(http.StatusForbidden, CodeInvalidRequest, "folders can only be created at the top level"))
+	}
+	err := f.svc.CreateBucket(request.principal, parts[0])
+	if err != nil {
+		return request.fail(err)
+	}
+	return nil
+}
+
+func (f *webdavFs) OpenFile(ctx context.Context, name string, flag int, _ os.FileMode) (webdav.File, error) {
+	request := currentWebDavRequest(ctx)
+	parts := splitWebDavPath(name)
+	switch len(parts) {
+	case 0:
+		return f.openRoot(request)
+	case 1:
+		return f.openBucket(request, parts[0])
+	case 2:
+		if flag&os.O_CREATE != 0 {
+			return f.createObject(request, parts[0], parts[1], flag&os.O_TRUNC != 0)
+		}
+		return f.openObject(request, parts[0], parts[1])
+	}
+	return nil, os.ErrNotExist
+}
+
+func (f *webdavFs) openRoot(request *webdavRequest) (webdav.File, error) {
+	buckets, err := f.svc.ListBuckets(request.principal)
+	if err != nil {
+		return nil, request.fail(err)
+	}
+	entries := make([]os.FileInfo, 0, len(buckets))
+	for _, bucket := range buckets {
+		entries = append(entries, &webdavFileInfo{name: bucket, dir: true})
+	}
+	return &webdavDir{info: &webdavFileInfo{name: "/", dir: true}, entries: entries}, nil
+}
+
+func (f *webdavFs) openBucket(request *webdavRequest, bucketId string) (webdav.File, error) {
+	objects, err := f.svc.ListObjects(request.principal, bucketId, "")
+	if err != nil {
+		return nil, request.fail(err)
+	}
+	entries := make([]os.FileInfo, 0, len(objects))
+	for _, object := range objects {
+		entries = append(entries, &webdavFileInfo{name: object.KeyId, filename: object.Filename, size: object.Length})
+	}
+	return &webdavDir{info: &webdavFileInfo{name: bucketId, dir: true}, entries: entries}, nil
+}
+
+func (f *webdavFs) openObject(request *webdavRequest, bucketId, keyId string) (webdav.File, error) {
+	meta, reader, err := f.svc.GetObject(request.principal, bucketId, keyId)
+	if err != nil {
+		return nil, request.fail(err)
+	}
+	return &webdavObject{
+		fs:       f,
+		request:  request,
+		bucketId: bucketId,
+		keyId:    keyId,
+		info:     &webdavFileInfo{name: keyId, filename: meta.Filename, size: meta.Length},
+		reader:   reader,
+	}, nil
+}
+
+// createObject checks everything PutObject would before the body is read, so
+// refused uploads answer with the status of the service. Objects can't be
+// overwritten, truncating one uploads the new content next to it and only
+// swaps it in once the upload succeeded.
+func (f *webdavFs) createObject(request *webdavRequest, bucketId, keyId string, truncate bool) (webdav.File, error) {
+	err := f.svc.checkObjectId(bucketId, keyId)
+	if err != nil {
+		return nil, request.fail(err)
+	}
+	if !request.principal.can((*users.Permissions).CanUpload, bucketId) {
+		return nil, request.fail(forbiddenError())
+	}
+	err = f.svc.requireBucket(bucketId)
+	if err != nil {
+		return nil, request.fail(err)
+	}
+	upload := &webdavUpload{
+		fs:       f,
+		request:  request,
+		bucketId: bucketId,
+		keyId:    keyId,
+		target:   keyId,
+		info:     &webdavFileInfo{name: keyId, filename: keyId},
+	}
+	_, err = f.svc.store.ReadMetadata(bucketId, keyId)
+	if err == nil {
+		if !truncate {
+			return nil, os.ErrExist
+		}
+		if !request.principal.can((*users.Permissions).CanDelete, bucketId) {
+			return nil, request.fail(forbiddenError())
+		}
+		upload.target, err = replacementKey("file")
+		if err != nil {
+			return nil, request.fail(internalError(err))
+		}
+	}
+	if request.length >= 0 {
+		upload.stream()
+	}
+	return upload, nil
+}
+
+func (f *webdavFs) RemoveAll(ctx context.Context, name string) error {
+	request := currentWebDavRequest(ctx)
+	parts := splitWebDavPath(name)
+	var err error
+	switch len(parts) {
+	case 1:
+		err = f.svc.DeleteBucket(request.principal, parts[0])
+	case 2:
+		err = f.svc.DeleteObject(request.principal, parts[0], parts[1])
+	default:
+		err = forbiddenError()
+	}
+	if err != nil {
+		return request.fail(err)
+	}
+	return nil
+}
+
+// Rename moves objects by copying them, buckets can't be renamed.
+func (f *webdavFs) Rename(ctx context.Context, oldName, newName string) error {
+	request := currentWebDavRequest(ctx)
+	from, to := splitWebDavPath(oldName), splitWebDavPath(newName)
+	if len(from) != 2 || len(to) != 2 {
+		return request.fail(newApiError(http.StatusForbidden, CodeInvalidRequest, "only objects can be moved"))
+	}
+	meta, reader, err := f.svc.GetObject(request.principal, from[0], from[1])
+	if err != nil {
+		return request.fail(err)
+	}
+	defer reader.Close()
+	_, err = f.svc.PutObject(request.principal, to[0], to[1], meta.Filename, meta.Length, reader)
+	if err != nil {
+		return request.fail(err)
+	}
+	err = f.svc.DeleteObject(request.principal, from[0], from[1])
+	if err != nil {
+		return request.fail(err)
+	}
+	return nil
+}
+
+func (f *webdavFs) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	request := currentWebDavRequest(ctx)
+	parts := splitWebDavPath(name)
+	switch len(parts) {
+	case 0:
+		return &webdavFileInfo{name: "/", dir: true}, nil
+	case 1:
+		_, err := f.svc.ListObjects(request.principal, parts[0], "")
+		if err != nil {
+			return nil, request.fail(err)
+		}
+		return &webdavFileInfo{name: parts[0], dir: true}, nil
+	case 2:
+		err := f.svc.checkObjectId(parts[0], parts[1])
+		if err != nil {
+			return nil, request.fail(err)
+		}
+		if !request.principal.can((*users.Permissions).CanRead, parts[0]) {
+			return nil, request.fail(forbiddenError())
+		}
+		meta, err := f.svc.readMetadata(parts[0], parts[1])
+		if err != nil {
+			return nil, request.fail(err)
+		}
+		return &webdavFileInfo{name: parts[1], filename: meta.Filename, size: meta.Length}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// webdavFileInfo has no modification time, the metadata doesn't keep one.
+type webdavFileInfo struct {
+	name     string
+	filename string
+	size     int64
+	dir      bool
+}
+
+func (i *webdavFileInfo) Name() string {
+	return i.name
+}
+
+func (i *webdavFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *webdavFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *webdavFileInfo) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (i *webdavFileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i *webdavFileInfo) Sys() interface{} {
+	return nil
+}
+
+// ContentType keeps PROPFIND from decrypting every object to sniff it.
+func (i *webdavFileInfo) ContentType(_ context.Context) (string, error) {
+	contentType := mime.TypeByExtension(filepath.Ext(i.filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return contentType, nil
+}
+
+type webdavDir struct {
+	info    *webdavFileInfo
+	entries []os.FileInfo
+}
+
+func (d *webdavDir) Close() error {
+	return nil
+}
+
+func (d *webdavDir) Read(_ []byte) (int, error) {
+	return 0, webdavIsDirectory
+}
+
+func (d *webdavDir) Seek(_ int64, _ int) (int64, error) {
+	return 0, webdavIsDirectory
+}
+
+func (d *webdavDir) Write(_ []byte) (int, error) {
+	return 0, webdavIsDirectory
+}
+
+func (d *webdavDir) Readdir(count int) ([]os.FileInfo, error) {
+	if count <= 0 {
+		ret := d.entries
+		d.entries = nil
+		return ret, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	ret := d.entries[:count]
+	d.entries = d.entries[count:]
+	return ret, nil
+}
+
+func (d *webdavDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+// webdavObject reads an object. The stored data can only be decrypted front
+// to back, so seeking backwards opens the object again.
+type webdavObject struct {
+	fs       *webdavFs
+	request  *webdavRequest
+	bucketId string
+	keyId    string
+	info     *webdavFileInfo
+	reader   io.ReadCloser
+	readPos  int64
+	pos      int64
+}
+
+func (o *webdavObject) Close() error {
+	return o.reader.Close()
+}
+
+func (o *webdavObject) Read(b []byte) (int, error) {
+	if o.pos >= o.info.size {
+		return 0, io.EOF
+	}
+	if o.readPos > o.pos {
+		_, reader, err := o.fs.svc.GetObject(o.request.principal, o.bucketId, o.keyId)
+		if err != nil {
+			return 0, err
+		}
+		_ = o.reader.Close()
+		o.reader, o.readPos = reader, 0
+	}
+	if o.readPos < o.pos {
+		skipped, err := io.CopyN(io.Discard, o.reader, o.pos-o.readPos)
+		o.readPos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := o.reader.Read(b)
+	o.readPos += int64(n)
+	o.pos += int64(n)
+	return n, err
+}
+
+func (o *webdavObject) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.info.size
+	}
+	if offset < 0 {
+		return 0, webdavNegativeOffset
+	}
+	o.pos = offset
+	return o.pos, nil
+}
+
+func (o *webdavObject) Write(_ []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (o *webdavObject) Readdir(_ int) ([]os.FileInfo, error) {
+	return nil, webdavNotDirectory
+}
+
+func (o *webdavObject) Stat() (os.FileInfo, error) {
+	return o.info, nil
+}
+
+// webdavUpload writes a new object. With a known length the body is streamed
+// into the store, otherwise it's buffered in memory until the file is closed,
+// the length has to be known before the object is written. The buffer is
+// capped by webdavMaxBufferedLength. Replacements are
+// written to target and moved to keyId when the file is closed.
+type webdavUpload struct {
+	fs       *webdavFs
+	request  *webdavRequest
+	bucketId string
+	keyId    string
+	target   string
+	info     *webdavFileInfo
+	buffer   bytes.Buffer
+	tooLarge bool
+	pipe     *io.PipeWriter
+	done     chan error
+}
+
+func (u *webdavUpload) stream() {
+	reader, writer := io.Pipe()
+	u.pipe = writer
+	u.done = make(chan error, 1)
+	go func() {
+		_, err := u.fs.svc.PutObject(u.request.principal, u.bucketId, u.target, u.keyId, u.request.length, reader)
+		_ = reader.CloseWithError(err)
+		u.done <- err
+	}()
+}
+
+func (u *webdavUpload) Write(b []byte) (int, error) {
+	var n int
+	var err error
+	if u.pipe != nil {
+		n, err = u.pipe.Write(b)
+	} else if u.buffer.Len()+len(b) > webdavMaxBufferedLength {
+		u.tooLarge = true
+		return 0, u.request.fail(newApiError(http.StatusRequestEntityTooLarge, CodeInvalidRequest,
+			fmt.Sprintf("uploads without a Content-Length can't exceed %v bytes", webdavMaxBufferedLength)))
+	} else {
+		n, err = u.buffer.Write(b)
+	}
+	u.info.size += int64(n)
+	return n, err
+}
+
+func (u *webdavUpload) Close() error {
+	var err error
+	if u.pipe != nil && u.info.size != u.request.length {
+		// The client went away, the partial object mustn't stay behind.
+		_ = u.pipe.CloseWithError(io.ErrUnexpectedEOF)
+		<-u.done
+		_ = u.fs.svc.store.Delete(u.bucketId, u.target)
+		return u.request.fail(newApiError(http.StatusBadRequest, CodeInvalidRequest, "body is shorter than its Content-Length"))
+	} else if u.pipe != nil {
+		_ = u.pipe.Close()
+		err = <-u.done
+	} else if u.tooLarge {
+		return u.request.failure
+	} else {
+		_, err = u.fs.svc.PutObject(u.request.principal, u.bucketId, u.target, u.keyId, int64(u.buffer.Len()), &u.buffer)
+	}
+	if err != nil {
+		return u.request.fail(err)
+	}
+	if u.target != u.keyId {
+		err = u.fs.svc.swapReplacement(u.request.principal, u.bucketId, u.keyId, u.target)
+		if err != nil {
+			return u.request.fail(err)
+		}
+	}
+	return nil
+}
+
+func (u *webdavUpload) Read(_ []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (u *webdavUpload) Seek(_ int64, _ int) (int64, error) {
+	return 0, os.ErrPermission
+}
+
+func (u *webdavUpload) Readdir(_ int) ([]os.FileInfo, error) {
+	return nil, webdavNotDirectory
+}
+
+func (u *webdavUpload) Stat() (os.FileInfo, error) {
+	return u.info, nil
+}
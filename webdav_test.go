@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/uuid"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"secure-store/access"
+	"secure-store/storage"
+	"secure-store/users"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webdavClient struct {
+	handler  http.Handler
+	username string
+	password string
+}
+
+func newWebDavClient(t *testing.T) (*testServer, *webdavClient) {
+	server := newTestServer(t)
+	credentials := server.rootCredentials(t)
+	handler, err := NewWebDavHandler(NewService(server.store, server.access, server.users, nil, server.presign, nil), server.users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, &webdavClient{handler: handler, username: RootUsername, password: credentials.Password}
+}
+
+func (c *webdavClient) do(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.SetBasicAuth(c.username, c.password)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestWebDavFiles(t *testing.T) {
+	_, client := newWebDavClient(t)
+
+	w := client.do("MKCOL", "/reports", "", nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL answered %v: %v", w.Code, w.Body.String())
+	}
+	w = client.do("MKCOL", "/reports", "", nil)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("MKCOL of an existing bucket answered %v", w.Code)
+	}
+	w = client.do("MKCOL", "/reports/nested", "", nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("MKCOL inside a bucket answered %v", w.Code)
+	}
+
+	w = client.do(http.MethodPut, "/reports/monday", "report of monday", nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT answered %v: %v", w.Code, w.Body.String())
+	}
+	w = client.do(http.MethodPut, "/reports/monday", "new report of monday", nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Overwriting answered %v: %v", w.Code, w.Body.String())
+	}
+	w = client.do(http.MethodPut, "/reports/Not_Valid", "content", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT of an invalid key answered %v", w.Code)
+	}
+
+	w = client.do("PROPFIND", "/reports", "", map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "/reports/monday") {
+		t.Errorf("PROPFIND answered %v: %v", w.Code, w.Body.String())
+	}
+	w = client.do("PROPFIND", "/", "", map[string]string{"Depth": "1"})
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "/reports/") {
+		t.Errorf("PROPFIND of the root answered %v: %v", w.Code, w.Body.String())
+	}
+
+	w = client.do(http.MethodGet, "/reports/monday", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "new report of monday" {
+		t.Errorf("GET answered %v: %q", w.Code, w.Body.String())
+	}
+	w = client.do(http.MethodGet, "/reports/monday", "", map[string]string{"Range": "bytes=4-9"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "report" {
+		t.Errorf("Range answered %v: %q", w.Code, w.Body.String())
+	}
+
+	w = client.do("MOVE", "/reports/monday", "", map[string]string{"Destination": "/reports/tuesday"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("MOVE answered %v: %v", w.Code, w.Body.String())
+	}
+	w = client.do(http.MethodDelete, "/reports/tuesday", "", nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("DELETE answered %v", w.Code)
+	}
+	w = client.do(http.MethodGet, "/reports/tuesday", "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET of a deleted object answered %v", w.Code)
+	}
+	w = client.do(http.MethodDelete, "/reports", "", nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("DELETE of the bucket answered %v", w.Code)
+	}
+}
+
+func TestWebDavUnknownLength(t *testing.T) {
+	server, client := newWebDavClient(t)
+	err := server.store.NewBucket("reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/reports/monday", bytes.NewReader([]byte("chunked report")))
+	req.ContentLength = -1
+	req.SetBasicAuth(client.username, client.password)
+	w := httptest.NewRecorder()
+	client.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Chunked PUT answered %v: %v", w.Code, w.Body.String())
+	}
+	meta, err := server.store.ReadMetadata("reports", "monday")
+	if err != nil || meta.Length != int64(len("chunked report")) {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+
+	limit := webdavMaxBufferedLength
+	webdavMaxBufferedLength = 8
+	defer func() {
+		webdavMaxBufferedLength = limit
+	}()
+	req = httptest.NewRequest(http.MethodPut, "/reports/tuesday", bytes.NewReader([]byte("chunked report")))
+	req.ContentLength = -1
+	req.SetBasicAuth(client.username, client.password)
+	w = httptest.NewRecorder()
+	client.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Oversized chunked PUT answered %v: %v", w.Code, w.Body.String())
+	}
+	_, err = server.store.ReadMetadata("reports", "tuesday")
+	if err == nil {
+		t.Error("Oversized chunked PUT was stored")
+	}
+}
+
+func TestWebDavAuthentication(t *testing.T) {
+	server, client := newWebDavClient(t)
+	server.putObject(t, "reports", "monday", "content")
+
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	w := httptest.NewRecorder()
+	client.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Anonymous request answered %v", w.Code)
+	}
+	wrong := &webdavClient{handler: client.handler, username: RootUsername, password: "wrong"}
+	w = wrong.do("PROPFIND", "/", "", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong password answered %v", w.Code)
+	}
+
+	reader := users.User{Username: "reader", Id: uuid.New()}
+	err := reader.SetPassword(users.DerivePasswordKey("reader-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.users.Create(&reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unprivileged := &webdavClient{handler: client.handler, username: "reader", password: "reader-password"}
+	w = unprivileged.do("MKCOL", "/notes", "", nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("MKCOL without permission answered %v", w.Code)
+	}
+	w = unprivileged.do(http.MethodPut, "/reports/tuesday", "content", nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("PUT without permission answered %v", w.Code)
+	}
+	w = unprivileged.do(http.MethodGet, "/reports/monday", "", nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("GET without permission answered %v", w.Code)
+	}
+}
+
+func TestWebDavPasswords(t *testing.T) {
+	server := newTestServer(t)
+	lockout, err := access.NewLockout(access.NewMemoryStore(), access.LockoutPolicy{MaxFailures: 3, Window: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewWebDavHandler(NewService(server.store, server.access, server.users, nil, server.presign, lockout), server.users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := users.User{Username: "reader", Id: uuid.New()}
+	err = reader.SetPassword(users.DerivePasswordKey("reader-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.users.Create(&reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &webdavClient{handler: handler, username: "reader", password: "reader-password"}
+	for i := 0; i < 2; i++ {
+		w := client.do("PROPFIND", "/", "", nil)
+		if w.Code != http.StatusMultiStatus {
+			t.Errorf("Request %v answered %v", i+1, w.Code)
+		}
+	}
+
+	// The cached password goes with the password it was verified against.
+	err = reader.SetPassword(users.DerivePasswordKey("new-password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.users.Update(&reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := client.do("PROPFIND", "/", "", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Old password answered %v after the change", w.Code)
+	}
+
+	client.password = "wrong"
+	for i := 0; i < 2; i++ {
+		w = client.do("PROPFIND", "/", "", nil)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Wrong password answered %v", w.Code)
+		}
+	}
+	client.password = "new-password"
+	w = client.do("PROPFIND", "/", "", nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Password of a locked user answered %v", w.Code)
+	}
+}
+
+func TestWebDavFailedReplacementKeepsFile(t *testing.T) {
+	server, client := newWebDavClient(t)
+	server.putObject(t, "reports", "monday", "report of monday")
+
+	req := httptest.NewRequest(http.MethodPut, "/reports/monday", strings.NewReader("half a new rep"))
+	req.ContentLength = 100
+	req.SetBasicAuth(client.username, client.password)
+	w := httptest.NewRecorder()
+	client.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Aborted PUT answered %v: %v", w.Code, w.Body.String())
+	}
+	w = client.do(http.MethodGet, "/reports/monday", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "report of monday" {
+		t.Errorf("Aborted PUT changed the file to %v: %q", w.Code, w.Body.String())
+	}
+
+	w = client.do(http.MethodPut, "/reports/monday", "new report of monday", nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Replacing answered %v: %v", w.Code, w.Body.String())
+	}
+	w = client.do(http.MethodGet, "/reports/monday", "", nil)
+	if w.Body.String() != "new report of monday" {
+		t.Errorf("Replaced file holds %q", w.Body.String())
+	}
+	keys, err := server.store.ListKeys("reports", "")
+	if err != nil || len(keys) != 1 {
+		t.Errorf("Replacing left %v behind: %v", keys, err)
+	}
+}
+
+// failingStorage fails the next write of failKey.
+type failingStorage struct {
+	storage.Storage
+	m       sync.Mutex
+	failKey string
+}
+
+func (s *failingStorage) Write(bucket, key string, data io.Reader) error {
+	s.m.Lock()
+	fail := key == s.failKey
+	if fail {
+		s.failKey = ""
+	}
+	s.m.Unlock()
+	if fail {
+		return errors.New("disk full")
+	}
+	return s.Storage.Write(bucket, key, data)
+}
+
+func TestWebDavFailedSwapKeepsFile(t *testing.T) {
+	server, client := newWebDavClient(t)
+	server.putObject(t, "reports", "monday", "report of monday")
+	server.store.storage = &failingStorage{Storage: server.store.storage, failKey: "monday"}
+
+	w := client.do(http.MethodPut, "/reports/monday", "new report of monday", nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Failed swap answered %v: %v", w.Code, w.Body.String())
+	}
+	w = client.do(http.MethodGet, "/reports/monday", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "report of monday" {
+		t.Errorf("Failed swap changed the file to %v: %q", w.Code, w.Body.String())
+	}
+	keys, err := server.store.ListKeys("reports", "")
+	if err != nil || len(keys) != 1 {
+		t.Errorf("Failed swap left %v behind: %v", keys, err)
+	}
+}